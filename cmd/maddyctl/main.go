@@ -30,6 +30,7 @@ import (
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/queue"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/bcrypt"
@@ -655,6 +656,122 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "queue",
+			Usage: "Outbound queue management",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List queued messages",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						adm, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueList(adm, ctx)
+					},
+				},
+				{
+					Name:      "inspect",
+					Usage:     "Show meta-data and header of the queued message",
+					ArgsUsage: "ID",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						adm, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueInspect(adm, ctx)
+					},
+				},
+				{
+					Name:        "flush",
+					Usage:       "Attempt delivery of queued messages now",
+					Description: "If no IDs are specified - all queued messages are tried except ones held for future release.",
+					ArgsUsage:   "[ID...]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						adm, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueFlush(adm, ctx)
+					},
+				},
+				{
+					Name:        "delete",
+					Usage:       "Remove messages from the queue",
+					Description: "No delivery status notifications are generated for removed messages.",
+					ArgsUsage:   "ID...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						adm, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueDelete(adm, ctx)
+					},
+				},
+				{
+					Name:        "bounce",
+					Usage:       "Fail delivery of messages permanently",
+					Description: "Remaining recipients are considered failed and bounce message is sent to the sender.",
+					ArgsUsage:   "ID...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						adm, err := openQueue(ctx)
+						if err != nil {
+							return err
+						}
+						return queueBounce(adm, ctx)
+					},
+				},
+			},
+		},
 		{
 			Name:   "hash",
 			Usage:  "Generate password hashes for use with pass_table",
@@ -772,6 +889,25 @@ func openStorage(ctx *cli.Context) (module.Storage, error) {
 	return storage, nil
 }
 
+func openQueue(ctx *cli.Context) (*queue.Admin, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q, ok := mod.Instance.(*queue.Queue)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s is not a queue", ctx.String("cfg-block"))
+	}
+
+	adm, err := q.Admin(config.NewMap(globals, mod.Cfg))
+	if err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return adm, nil
+}
+
 func openUserDB(ctx *cli.Context) (module.PlainUserDB, error) {
 	globals, mod, err := getCfgBlockModule(ctx)
 	if err != nil {
@@ -0,0 +1,160 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/urfave/cli"
+)
+
+func printQueueMeta(meta *queue.QueueMetadata) {
+	fmt.Println("From:", meta.From)
+	fmt.Println("First attempt:", meta.FirstAttempt.Format(time.RFC1123Z))
+	fmt.Println("Last attempt:", meta.LastAttempt.Format(time.RFC1123Z))
+	if !meta.HoldUntil.IsZero() {
+		fmt.Println("Held until:", meta.HoldUntil.Format(time.RFC1123Z))
+	}
+	if meta.MsgMeta.Priority != 0 {
+		fmt.Println("Priority:", meta.MsgMeta.Priority)
+	}
+	fmt.Println("Pending recipients:")
+	for _, rcpt := range meta.To {
+		if meta.FallbackRcpts[rcpt] {
+			fmt.Printf("  %s (tries: %d, using fallback target)\n", rcpt, meta.TriesCount[rcpt])
+		} else {
+			fmt.Printf("  %s (tries: %d)\n", rcpt, meta.TriesCount[rcpt])
+		}
+		if rcptErr := meta.RcptErrs[rcpt]; rcptErr != nil {
+			fmt.Printf("    last error: %d %v %s\n", rcptErr.Code, rcptErr.EnhancedCode, rcptErr.Message)
+		}
+	}
+}
+
+func queueList(adm *queue.Admin, ctx *cli.Context) error {
+	msgs, err := adm.List()
+	if err != nil {
+		return err
+	}
+
+	if len(msgs) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Queue is empty.")
+	}
+
+	for _, meta := range msgs {
+		fmt.Println("- ID:", meta.MsgMeta.ID)
+		printQueueMeta(meta)
+		fmt.Println()
+	}
+	return nil
+}
+
+func queueInspect(adm *queue.Admin, ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return errors.New("Error: ID is required")
+	}
+
+	meta, hdr, err := adm.Read(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("- Queue meta-data:")
+	fmt.Println("ID:", meta.MsgMeta.ID)
+	if meta.MsgMeta.OriginalFrom != "" && meta.MsgMeta.OriginalFrom != meta.From {
+		fmt.Println("Original sender:", meta.MsgMeta.OriginalFrom)
+	}
+	printQueueMeta(meta)
+	if len(meta.FailedRcpts) != 0 {
+		fmt.Println("Failed recipients:", meta.FailedRcpts)
+	}
+	fmt.Println("- Header:")
+	return textproto.WriteHeader(os.Stdout, hdr)
+}
+
+func queueFlush(adm *queue.Admin, ctx *cli.Context) error {
+	ids := []string(ctx.Args())
+	if len(ids) == 0 {
+		msgs, err := adm.List()
+		if err != nil {
+			return err
+		}
+		for _, meta := range msgs {
+			// Held messages are released only if explicitly requested.
+			if !meta.HoldUntil.IsZero() {
+				continue
+			}
+			ids = append(ids, meta.MsgMeta.ID)
+		}
+	}
+
+	for _, id := range ids {
+		if err := adm.Flush(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queueDelete(adm *queue.Admin, ctx *cli.Context) error {
+	ids := []string(ctx.Args())
+	if len(ids) == 0 {
+		return errors.New("Error: ID is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("Are you sure you want to delete these messages?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	for _, id := range ids {
+		if err := adm.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queueBounce(adm *queue.Admin, ctx *cli.Context) error {
+	ids := []string(ctx.Args())
+	if len(ids) == 0 {
+		return errors.New("Error: ID is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("Are you sure you want to fail delivery of these messages?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	for _, id := range ids {
+		if err := adm.Bounce(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"net"
+	"strings"
+)
+
+// Networks is a list of IP networks, such as trusted sources of the client
+// address passed by a proxy.
+type Networks []net.IPNet
+
+// ParseNetworks parses the list of IP addresses or networks in CIDR
+// notation. Addresses are converted to single-address networks.
+//
+// node is used for error reporting.
+func ParseNetworks(node Node, args []string) (Networks, error) {
+	var nets Networks
+	for _, arg := range args {
+		if !strings.Contains(arg, "/") {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, NodeErr(node, "malformed IP address: %s", arg)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, NodeErr(node, "%v", err)
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
+}
+
+// Contains reports whether the connection from addr belongs to one of the
+// networks.
+//
+// Connections over Unix sockets are always considered to belong to the list.
+func (nets Networks) Contains(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UnixAddr:
+		return true
+	default:
+		return false
+	}
+
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	for _, args := range [][]string{
+		{"not-an-ip"},
+		{"10.0.0.0/33"},
+		{"10.0.0.1", "2001:db8::/129"},
+	} {
+		if _, err := ParseNetworks(Node{}, args); err == nil {
+			t.Errorf("Expected an error for %v", args)
+		}
+	}
+
+	nets, err := ParseNetworks(Node{}, []string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, contains := range map[string]bool{
+		"10.1.2.3:1":          true,
+		"11.0.0.1:1":          false,
+		"[2001:db8::1]:1":     true,
+		"[2001:db8::2]:1":     false,
+		"[::ffff:10.0.0.1]:1": true,
+	} {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nets.Contains(tcpAddr) != contains {
+			t.Errorf("Wrong result for %s, want %v", addr, contains)
+		}
+	}
+	if !nets.Contains(&net.UnixAddr{Name: "/run/maddy.sock", Net: "unix"}) {
+		t.Error("Unix socket connections should be always matched")
+	}
+}
@@ -23,7 +23,6 @@ import (
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
-	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/buffer"
 )
 
@@ -53,7 +52,7 @@ type Check interface {
 // advanced handling is available (such as 'quarantine' action and headers
 // prepending).
 type EarlyCheck interface {
-	CheckConnection(ctx context.Context, state *smtp.ConnectionState) error
+	CheckConnection(ctx context.Context, state *ConnectionState) error
 }
 
 type CheckState interface {
@@ -0,0 +1,51 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+// DSNHandover describes who is responsible for the success delivery status
+// notification for the recipient once the message is accepted by the target
+// (RFC 3461 Section 5.2).
+type DSNHandover int
+
+const (
+	// DSNDelivered means the message reached its final destination. A
+	// "delivered" DSN should be generated if requested.
+	DSNDelivered DSNHandover = iota
+	// DSNRelayed means the message was relayed to a system that does not
+	// support the DSN extension. A "relayed" DSN should be generated if
+	// requested.
+	DSNRelayed
+	// DSNPassedOn means the message was relayed to a system that supports
+	// the DSN extension. The DSN parameters were passed to it and it is
+	// responsible for the notification, no DSN should be generated.
+	DSNPassedOn
+)
+
+// DSNDelivery is an optional interface that may be implemented by the object
+// returned by DeliveryTarget.Start to report the DSNHandover value for
+// successfully delivered recipients.
+//
+// If it is not implemented, DSNDelivered is assumed.
+type DSNDelivery interface {
+	// DSNHandover returns the value for the recipient. rcptTo should match
+	// the value passed to AddRcpt.
+	//
+	// It is called after Commit.
+	DSNHandover(rcptTo string) DSNHandover
+}
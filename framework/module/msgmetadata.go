@@ -20,13 +20,28 @@ package module
 
 import (
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"io"
+	"net"
+	"strconv"
+	"time"
 
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/future"
 )
 
+// ConnectionState contains the information about the SMTP connection.
+type ConnectionState struct {
+	// HELO/EHLO hostname.
+	Hostname   string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// TLS connection state. Zero value if TLS is not used.
+	TLS tls.ConnectionState
+}
+
 // ConnState structure holds the state information of the protocol used to
 // accept this message.
 type ConnState struct {
@@ -37,7 +52,7 @@ type ConnState struct {
 	// Information about the SMTP connection, including HELO hostname and
 	// source IP. Valid only if Proto refers the SMTP protocol or its variant
 	// (e.g. LMTP).
-	smtp.ConnectionState
+	ConnectionState
 
 	// The RDNSName field contains the result of Reverse DNS lookup on the
 	// client IP.
@@ -63,6 +78,28 @@ type ConnState struct {
 	AuthPassword string
 }
 
+// Range of MsgMetadata.Priority values, see RFC 6710.
+const (
+	MinPriority = -9
+	MaxPriority = 9
+)
+
+// PriorityDirective parses the priority value from the configuration
+// directive. It can be used with config.Map.Custom, the value is *int.
+func PriorityDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "exactly one argument required")
+	}
+	priority, err := strconv.Atoi(node.Args[0])
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid priority: %v", err)
+	}
+	if priority < MinPriority || priority > MaxPriority {
+		return nil, config.NodeErr(node, "priority should be in range from %d to %d", MinPriority, MaxPriority)
+	}
+	return &priority, nil
+}
+
 // MsgMetadata structure contains all information about the origin of
 // the message and all associated flags indicating how it should be handled
 // by components.
@@ -118,6 +155,31 @@ type MsgMetadata struct {
 	// Buffer.Len does not.
 	SMTPOpts smtp.MailOptions
 
+	// RcptOpts contains the SMTP RCPT TO command arguments (such as DSN
+	// parameters) for each recipient that has them. Keys are recipient
+	// addresses as they were presented by the client (see OriginalRcpts).
+	RcptOpts map[string]smtp.RcptOptions
+
+	// HoldUntil is the time before which the message should not be
+	// delivered (see RFC 4865). Zero value means the message should be
+	// delivered immediately.
+	//
+	// It is honored only by modules that store the message for later
+	// delivery (target.queue).
+	HoldUntil time.Time
+
+	// Priority is the message transfer priority (see RFC 6710), from
+	// MinPriority (-9) to MaxPriority (9). Zero value is the normal priority.
+	//
+	// It can be assigned by the message pipeline and is used by target.queue
+	// to decide which messages should be delivered first.
+	Priority int
+
+	// AuthUser is the username the client authenticated as, if any. Unlike
+	// Conn.AuthUser, it is preserved when the message is stored by
+	// target.queue.
+	AuthUser string
+
 	// Conn contains the information about the underlying protocol connection
 	// that was used to accept this message. The referenced instance may be shared
 	// between multiple messages.
@@ -138,11 +200,29 @@ type MsgMetadata struct {
 // - SrcAddr is not copied and copy field references original value.
 func (msgMeta *MsgMetadata) DeepCopy() *MsgMetadata {
 	cpy := *msgMeta
+	if msgMeta.RcptOpts != nil {
+		cpy.RcptOpts = make(map[string]smtp.RcptOptions, len(msgMeta.RcptOpts))
+		for rcpt, opts := range msgMeta.RcptOpts {
+			if opts.Notify != nil {
+				opts.Notify = append([]smtp.DSNNotify(nil), opts.Notify...)
+			}
+			cpy.RcptOpts[rcpt] = opts
+		}
+	}
 	// There is no good way to copy net.Addr, but it should not be
 	// modified by anything anyway so we are safe.
 	return &cpy
 }
 
+// RcptOptsFor returns the SMTP RCPT TO command arguments for the recipient,
+// taking recipient rewriting into account (see OriginalRcpts).
+func (msgMeta *MsgMetadata) RcptOptsFor(rcpt string) smtp.RcptOptions {
+	if original, ok := msgMeta.OriginalRcpts[rcpt]; ok {
+		rcpt = original
+	}
+	return msgMeta.RcptOpts[rcpt]
+}
+
 // GenerateMsgID generates a string usable as MsgID field in module.MsgMeta.
 func GenerateMsgID() (string, error) {
 	rawID := make([]byte, 4)
@@ -0,0 +1,52 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package module
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestMsgMetadata_DeepCopy(t *testing.T) {
+	orig := &MsgMetadata{
+		ID: "test",
+		RcptOpts: map[string]smtp.RcptOptions{
+			"rcpt@example.org": {
+				Notify:            []smtp.DSNNotify{smtp.DSNNotifyFailure, smtp.DSNNotifyDelayed},
+				OriginalRecipient: "rcpt@example.org",
+			},
+		},
+	}
+	cpy := orig.DeepCopy()
+	if !reflect.DeepEqual(cpy, orig) {
+		t.Fatalf("Copy is not equal to the original: %+v", cpy)
+	}
+
+	cpy.RcptOpts["rcpt@example.org"].Notify[0] = smtp.DSNNotifySuccess
+	cpy.RcptOpts["rcpt2@example.org"] = smtp.RcptOptions{}
+
+	opts := orig.RcptOpts["rcpt@example.org"]
+	if opts.Notify[0] != smtp.DSNNotifyFailure {
+		t.Error("NOTIFY list is shared with the copy:", opts.Notify)
+	}
+	if _, ok := orig.RcptOpts["rcpt2@example.org"]; ok {
+		t.Error("RcptOpts map is shared with the copy")
+	}
+}
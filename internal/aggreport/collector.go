@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package aggreport
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Results is the set of results collected for the reporting period.
+//
+// It is serialized using encoding/json when the Collector state is saved.
+type Results interface {
+	// Merge adds results from the saved set (loaded from the state) to the
+	// set.
+	Merge(saved Results)
+}
+
+// Collector aggregates results for the reporting period.
+//
+// It is safe for concurrent use.
+type Collector struct {
+	lock       sync.Mutex
+	start      time.Time
+	results    Results
+	newResults func() Results
+}
+
+// NewCollector creates the Collector for the reporting period starting at
+// start. newResults is called to create an empty result set.
+func NewCollector(start time.Time, newResults func() Results) *Collector {
+	return &Collector{
+		start:      start,
+		results:    newResults(),
+		newResults: newResults,
+	}
+}
+
+// Update calls f with the current result set. Calls are serialized.
+func (c *Collector) Update(f func(Results)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f(c.results)
+}
+
+// Flush returns results collected since the previous Flush call (or the
+// Collector creation) and starts a new reporting period.
+func (c *Collector) Flush(now time.Time) (start time.Time, results Results) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	start, results = c.start, c.results
+	c.start = now
+	c.results = c.newResults()
+	return start, results
+}
+
+type collectorState struct {
+	Start   time.Time
+	Results json.RawMessage
+}
+
+// Save writes collected results to w so they can be restored using Load
+// (e.g. after the server restart).
+func (c *Collector) Save(w io.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	results, err := json.Marshal(c.results)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(collectorState{
+		Start:   c.start,
+		Results: results,
+	})
+}
+
+// Load merges results saved using Save into the Collector. Reporting period
+// is extended to start at the saved start time if it is earlier.
+func (c *Collector) Load(r io.Reader) error {
+	var state collectorState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	saved := c.newResults()
+	if len(state.Results) != 0 {
+		if err := json.Unmarshal(state.Results, saved); err != nil {
+			return err
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if state.Start.Before(c.start) {
+		c.start = state.Start
+	}
+	c.results.Merge(saved)
+	return nil
+}
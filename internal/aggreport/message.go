@@ -0,0 +1,161 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package aggreport contains the code shared by implementations of aggregate
+// reports sent by email, such as DMARC aggregate reports (RFC 7489) and SMTP
+// TLS reports (RFC 8460).
+package aggreport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Envelope contains the addressing information of the report message.
+type Envelope struct {
+	MsgID string
+	From  string
+	To    string
+
+	// Domain name of the reporting MTA, included in the subject.
+	Submitter string
+
+	// Domain the report is about, included in the subject.
+	PolicyDomain string
+}
+
+// Report describes the report attached to the message.
+type Report struct {
+	// Report type used in the human-readable part, e.g. "DMARC".
+	Kind string
+
+	ID    string
+	Begin time.Time
+	End   time.Time
+
+	// Content-Type of the message, the boundary parameter is appended to it.
+	ContentType string
+
+	// Content-Type of the attachment and the extension of its name (without
+	// .gz).
+	AttachmentType string
+	Extension      string
+
+	// Serialized report, it is compressed using gzip before attaching.
+	Data []byte
+}
+
+// Filename returns the name of the report attachment in the format used by
+// both RFC 7489 Section 7.2.1.1 and RFC 8460 Section 5.1.
+func Filename(envelope Envelope, report Report) string {
+	return fmt.Sprintf("%s!%s!%d!%d.%s.gz", envelope.Submitter, envelope.PolicyDomain,
+		report.Begin.Unix(), report.End.Unix(), report.Extension)
+}
+
+// GenerateMessage creates the message containing the human-readable
+// description and the compressed report as an attachment.
+//
+// Message header will be returned, body itself will be written to outWriter.
+func GenerateMessage(envelope Envelope, report Report, outWriter io.Writer) (textproto.Header, error) {
+	partWriter := textproto.NewMultipartWriter(outWriter)
+
+	reportHeader := textproto.Header{}
+	reportHeader.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	reportHeader.Add("Message-Id", envelope.MsgID)
+	reportHeader.Add("Content-Type", report.ContentType+"; boundary="+partWriter.Boundary())
+	reportHeader.Add("MIME-Version", "1.0")
+	reportHeader.Add("Auto-Submitted", "auto-generated")
+	reportHeader.Add("To", envelope.To)
+	reportHeader.Add("From", envelope.From)
+	reportHeader.Add("Subject", fmt.Sprintf("Report Domain: %s Submitter: %s Report-ID: <%s>",
+		envelope.PolicyDomain, envelope.Submitter, report.ID))
+
+	defer partWriter.Close()
+
+	if err := writeHumanReadablePart(partWriter, envelope, report); err != nil {
+		return textproto.Header{}, err
+	}
+	if err := writeReportPart(partWriter, envelope, report); err != nil {
+		return textproto.Header{}, err
+	}
+	return reportHeader, nil
+}
+
+func writeHumanReadablePart(w *textproto.MultipartWriter, envelope Envelope, report Report) error {
+	humanHeader := textproto.Header{}
+	humanHeader.Add("Content-Transfer-Encoding", "8bit")
+	humanHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
+	humanWriter, err := w.CreatePart(humanHeader)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(humanWriter, "This is the aggregate %s report for %s from %s\n"+
+		"covering the period from %s to %s.\n\n"+
+		"See the attached file for details.\n",
+		report.Kind, envelope.PolicyDomain, envelope.Submitter,
+		report.Begin.UTC().Format(time.RFC3339),
+		report.End.UTC().Format(time.RFC3339))
+	return err
+}
+
+func writeReportPart(w *textproto.MultipartWriter, envelope Envelope, report Report) error {
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	if _, err := gzw.Write(report.Data); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	filename := Filename(envelope, report)
+	reportHeader := textproto.Header{}
+	reportHeader.Add("Content-Type", report.AttachmentType+"; name=\""+filename+"\"")
+	reportHeader.Add("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	reportHeader.Add("Content-Transfer-Encoding", "base64")
+	reportWriter, err := w.CreatePart(reportHeader)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(reportWriter, wrapBase64(compressed.Bytes()))
+	return err
+}
+
+// wrapBase64 encodes data using base64 and splits it into lines of 76
+// characters, as required by RFC 2045 Section 6.8.
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var wrapped strings.Builder
+	for len(encoded) > 76 {
+		wrapped.WriteString(encoded[:76])
+		wrapped.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	wrapped.WriteString(encoded)
+	wrapped.WriteString("\r\n")
+	return wrapped.String()
+}
@@ -0,0 +1,55 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package aggreport
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+var ErrUnsupportedURI = errors.New("aggreport: unsupported report URI scheme")
+
+// ParseMailtoURI returns the recipient address of the mailto: report URI.
+// ErrUnsupportedURI is returned for other schemes.
+func ParseMailtoURI(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "mailto" {
+		return "", ErrUnsupportedURI
+	}
+
+	// The query part (e.g. ?subject=...) is not used.
+	rcpt := u.Opaque
+	if idx := strings.IndexByte(rcpt, '?'); idx != -1 {
+		rcpt = rcpt[:idx]
+	}
+	rcpt, err = url.PathUnescape(rcpt)
+	if err != nil {
+		return "", err
+	}
+	if _, _, err := address.Split(rcpt); err != nil {
+		return "", err
+	}
+	return rcpt, nil
+}
@@ -0,0 +1,347 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package aggreport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+var (
+	// How often the collected results are written to the state file.
+	SaveInterval = time.Minute
+
+	// How often delivery of reports that failed to send is retried and
+	// for how long.
+	RetryInterval = time.Hour
+	MaxRetryAge   = 24 * time.Hour
+)
+
+// Message is the generated report message.
+type Message struct {
+	// Message ID, without angle brackets.
+	ID string
+
+	Rcpt string
+
+	// Policy domain, report URI and report ID used for logging.
+	Domain   string
+	URI      string
+	ReportID string
+
+	Header textproto.Header
+	Body   []byte
+
+	Created time.Time
+}
+
+type serializedMessage struct {
+	ID       string
+	Rcpt     string
+	Domain   string
+	URI      string
+	ReportID string
+	Header   []byte
+	Body     []byte
+	Created  time.Time
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	var hdr bytes.Buffer
+	if err := textproto.WriteHeader(&hdr, m.Header); err != nil {
+		return nil, err
+	}
+	return json.Marshal(serializedMessage{
+		ID:       m.ID,
+		Rcpt:     m.Rcpt,
+		Domain:   m.Domain,
+		URI:      m.URI,
+		ReportID: m.ReportID,
+		Header:   hdr.Bytes(),
+		Body:     m.Body,
+		Created:  m.Created,
+	})
+}
+
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var s serializedMessage
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(s.Header)))
+	if err != nil {
+		return err
+	}
+	*m = Message{
+		ID:       s.ID,
+		Rcpt:     s.Rcpt,
+		Domain:   s.Domain,
+		URI:      s.URI,
+		ReportID: s.ReportID,
+		Header:   hdr,
+		Body:     s.Body,
+		Created:  s.Created,
+	}
+	return nil
+}
+
+// Sender runs in background, saves collected results to the state file every
+// SaveInterval and sends reports once a day for the UTC day.
+//
+// Reports that failed to send with a temporary error are kept in the state
+// file and retried every RetryInterval until they are older than MaxRetryAge.
+type Sender struct {
+	// Report type used in log messages, e.g. "DMARC".
+	Kind string
+
+	Log       log.Logger
+	From      string
+	DeliverTo module.DeliveryTarget
+	StateFile string
+	Collector *Collector
+
+	// Prepare is called to flush the Collector and generate the reports for
+	// the period ending at now.
+	Prepare func(ctx context.Context, now time.Time) []Message
+
+	// Check is called before each delivery attempt, if set. If it returns
+	// a permanent error, the report is discarded.
+	Check func(ctx context.Context, msg Message) error
+
+	// Protects pending and the state file.
+	lock    sync.Mutex
+	pending []Message
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type senderState struct {
+	Collector json.RawMessage
+	Pending   []Message
+}
+
+// Start loads the state file, if it exists, and starts the background
+// goroutine.
+func (s *Sender) Start() error {
+	f, err := os.Open(s.StateFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		defer f.Close()
+
+		var state senderState
+		if err := json.NewDecoder(f).Decode(&state); err != nil {
+			return err
+		}
+		if len(state.Collector) != 0 {
+			if err := s.Collector.Load(bytes.NewReader(state.Collector)); err != nil {
+				return err
+			}
+		}
+		s.pending = append(s.pending, state.Pending...)
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run()
+	return nil
+}
+
+func (s *Sender) run() {
+	defer close(s.done)
+
+	saveTicker := time.NewTicker(SaveInterval)
+	defer saveTicker.Stop()
+	retryTicker := time.NewTicker(RetryInterval)
+	defer retryTicker.Stop()
+
+	for {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		t := time.NewTimer(midnight.Sub(now))
+
+		select {
+		case <-t.C:
+			s.SendReports(midnight)
+		case <-saveTicker.C:
+			if err := s.Save(); err != nil {
+				s.Log.Error("failed to save state", err)
+			}
+		case <-retryTicker.C:
+			s.retry()
+		case <-s.stop:
+			t.Stop()
+			return
+		}
+		t.Stop()
+	}
+}
+
+// Close stops the background goroutine and saves the state.
+func (s *Sender) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	return s.Save()
+}
+
+// Save writes collected results and reports waiting for retry to the state
+// file.
+func (s *Sender) Save() error {
+	var collector bytes.Buffer
+	if err := s.Collector.Save(&collector); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := os.Create(s.StateFile + ".new")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = json.NewEncoder(f).Encode(senderState{
+		Collector: collector.Bytes(),
+		Pending:   s.pending,
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(s.StateFile+".new", s.StateFile)
+}
+
+// SendReports generates and sends reports for the period ending at now.
+func (s *Sender) SendReports(now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	msgs := s.Prepare(ctx, now)
+	for i := range msgs {
+		msgs[i].Created = now
+	}
+
+	s.lock.Lock()
+	s.pending = append(s.pending, msgs...)
+	s.lock.Unlock()
+
+	// Make sure generated reports are not lost if the server is stopped
+	// during the delivery.
+	if err := s.Save(); err != nil {
+		s.Log.Error("failed to save state", err)
+	}
+
+	s.sendPending(ctx)
+}
+
+func (s *Sender) retry() {
+	s.lock.Lock()
+	empty := len(s.pending) == 0
+	s.lock.Unlock()
+	if empty {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	s.sendPending(ctx)
+}
+
+func (s *Sender) sendPending(ctx context.Context) {
+	s.lock.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.lock.Unlock()
+
+	var failed []Message
+	for _, msg := range pending {
+		err := s.send(ctx, msg)
+		if err == nil {
+			s.Log.Msg(fmt.Sprintf("sent %s report", s.Kind), "domain", msg.Domain, "uri", msg.URI, "report_id", msg.ReportID)
+			continue
+		}
+
+		retry := exterrors.IsTemporaryOrUnspec(err) && time.Since(msg.Created) < MaxRetryAge
+		s.Log.Error(fmt.Sprintf("failed to send %s report", s.Kind), err,
+			"domain", msg.Domain, "uri", msg.URI, "report_id", msg.ReportID, "will_retry", retry)
+		if retry {
+			failed = append(failed, msg)
+		}
+	}
+
+	s.lock.Lock()
+	s.pending = append(s.pending, failed...)
+	s.lock.Unlock()
+
+	if err := s.Save(); err != nil {
+		s.Log.Error("failed to save state", err)
+	}
+}
+
+func (s *Sender) send(ctx context.Context, msg Message) error {
+	if s.Check != nil {
+		if err := s.Check(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return s.Deliver(ctx, msg)
+}
+
+// Deliver submits msg to DeliverTo.
+func (s *Sender) Deliver(ctx context.Context, msg Message) (err error) {
+	delivery, err := s.DeliverTo.Start(ctx, &module.MsgMetadata{ID: msg.ID}, s.From)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := delivery.Abort(ctx); err != nil {
+				s.Log.Error(fmt.Sprintf("failed to abort %s report delivery", s.Kind), err, "msg_id", msg.ID)
+			}
+		}
+	}()
+
+	if err = delivery.AddRcpt(ctx, msg.Rcpt); err != nil {
+		return err
+	}
+	if err = delivery.Body(ctx, msg.Header, buffer.MemoryBuffer{Slice: msg.Body}); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
@@ -0,0 +1,248 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package aggreport
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type counter struct {
+	Count int
+}
+
+func (c *counter) Merge(saved Results) {
+	c.Count += saved.(*counter).Count
+}
+
+func testSender(t *testing.T, stateFile string, tgt *testutils.Target) *Sender {
+	s := &Sender{
+		Kind:      "test",
+		Log:       testutils.Logger(t, "aggreport"),
+		From:      "reports@example.org",
+		DeliverTo: tgt,
+		StateFile: stateFile,
+		Collector: NewCollector(time.Now(), func() Results { return &counter{} }),
+	}
+	s.Prepare = func(_ context.Context, now time.Time) []Message {
+		_, res := s.Collector.Flush(now)
+		if res.(*counter).Count == 0 {
+			return nil
+		}
+
+		hdr := textproto.Header{}
+		hdr.Add("Subject", "Report")
+		return []Message{{
+			ID:     "test",
+			Rcpt:   "rua@example.com",
+			Domain: "example.com",
+			Header: hdr,
+			Body:   []byte("report\r\n"),
+		}}
+	}
+	return s
+}
+
+func add(s *Sender) {
+	s.Collector.Update(func(r Results) {
+		r.(*counter).Count++
+	})
+}
+
+func TestSender_State(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	tgt := testutils.Target{}
+	s := testSender(t, stateFile, &tgt)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	add(s)
+	add(s)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Results saved periodically are restored even if Close is not called.
+	s2 := testSender(t, stateFile, &tgt)
+	if err := s2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	_, res := s2.Collector.Flush(time.Now())
+	if res.(*counter).Count != 2 {
+		t.Fatal("Wrong restored count:", res.(*counter).Count)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSender_Retry(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	tgt := testutils.Target{
+		StartErr: exterrors.WithTemporary(errors.New("try again"), true),
+	}
+	s := testSender(t, stateFile, &tgt)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	add(s)
+	s.SendReports(time.Now())
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Report delivered despite the error")
+	}
+
+	// Failed report is kept in the state and delivered on retry.
+	tgt.StartErr = nil
+	s = testSender(t, stateFile, &tgt)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s.retry()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Wrong amount of messages delivered:", len(tgt.Messages))
+	}
+	if tgt.Messages[0].Header.Get("Subject") != "Report" {
+		t.Error("Wrong header:", tgt.Messages[0].Header)
+	}
+	if len(s.pending) != 0 {
+		t.Error("Delivered report is not removed")
+	}
+}
+
+func TestSender_Retry_Permanent(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	tgt := testutils.Target{
+		StartErr: exterrors.WithTemporary(errors.New("no"), false),
+	}
+	s := testSender(t, filepath.Join(dir, "state.json"), &tgt)
+	add(s)
+	s.SendReports(time.Now())
+	if len(s.pending) != 0 {
+		t.Error("Report is kept after a permanent error")
+	}
+}
+
+func TestSender_Retry_Expired(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	tgt := testutils.Target{
+		StartErr: exterrors.WithTemporary(errors.New("try again"), true),
+	}
+	s := testSender(t, filepath.Join(dir, "state.json"), &tgt)
+	add(s)
+	s.SendReports(time.Now().Add(-MaxRetryAge))
+	if len(s.pending) != 0 {
+		t.Error("Report is kept after MaxRetryAge")
+	}
+}
+
+func TestSender_PendingState(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	tgt := testutils.Target{
+		StartErr: exterrors.WithTemporary(errors.New("try again"), true),
+	}
+	s := testSender(t, stateFile, &tgt)
+	add(s)
+	created := time.Now().Add(-time.Hour).UTC()
+	s.SendReports(created)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = testSender(t, stateFile, &tgt)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if len(s.pending) != 1 {
+		t.Fatal("Wrong amount of pending reports:", len(s.pending))
+	}
+	msg := s.pending[0]
+	if msg.ID != "test" || msg.Rcpt != "rua@example.com" || msg.Domain != "example.com" {
+		t.Errorf("Wrong message: %+v", msg)
+	}
+	if msg.Header.Get("Subject") != "Report" || string(msg.Body) != "report\r\n" {
+		t.Errorf("Wrong message content: %v %q", msg.Header, msg.Body)
+	}
+	if !msg.Created.Equal(created) {
+		t.Error("Wrong creation time:", msg.Created)
+	}
+}
+
+func TestSender_Retry_ExpiredPending(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	tgt := testutils.Target{
+		StartErr: exterrors.WithTemporary(errors.New("try again"), true),
+	}
+	s := testSender(t, stateFile, &tgt)
+	add(s)
+	s.SendReports(time.Now().Add(-MaxRetryAge / 2))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The report is retried while it is younger than MaxRetryAge.
+	s = testSender(t, stateFile, &tgt)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.retry()
+	if len(s.pending) != 1 {
+		t.Fatal("Report is not kept for retry")
+	}
+
+	// ... and is discarded once it gets older.
+	s.pending[0].Created = time.Now().Add(-MaxRetryAge)
+	s.retry()
+	if len(s.pending) != 0 {
+		t.Error("Report is kept after MaxRetryAge")
+	}
+}
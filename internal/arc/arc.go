@@ -0,0 +1,227 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package arc implements verification and creation of Authenticated Received
+// Chain (RFC 8617) header fields.
+//
+// go-msgauth does not support ARC, so the signature format and
+// canonicalization algorithms shared with DKIM (RFC 6376) are reimplemented
+// here.
+package arc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+const (
+	sealField = "ARC-Seal"
+	amsField  = "ARC-Message-Signature"
+	aarField  = "ARC-Authentication-Results"
+
+	// MaxInstance is the maximum amount of ARC sets allowed in a single
+	// message.
+	MaxInstance = 50
+)
+
+type Resolver interface {
+	LookupTXT(context.Context, string) ([]string, error)
+}
+
+// Result is the outcome of the ARC chain validation.
+type Result struct {
+	// Chain validation status: none, pass, fail or temperror (if public key
+	// lookup failed).
+	Value authres.ResultValue
+
+	// Human-readable explanation for fail and temperror results.
+	Reason string
+
+	// Instance number of the latest ARC set, 0 if there is none.
+	Instance int
+
+	// Signing domain (d=) of the latest ARC-Seal, it is the domain of the
+	// last intermediary that handled the message.
+	Domain string
+}
+
+// AuthResult returns the Authentication-Results entry describing r.
+func (r Result) AuthResult() authres.Result {
+	params := map[string]string{}
+	if r.Domain != "" {
+		params["header.d"] = r.Domain
+	}
+	if r.Instance != 0 {
+		params["header.i"] = strconv.Itoa(r.Instance)
+	}
+	return &authres.GenericResult{
+		Method: "arc",
+		Value:  r.Value,
+		Params: params,
+	}
+}
+
+// field is a single ARC header field.
+type field struct {
+	raw  string
+	tags map[string]string
+}
+
+type set struct {
+	aar  *field
+	ams  *field
+	seal *field
+}
+
+// parseTags parses the DKIM-style tag-value list (RFC 6376, Section 3.2).
+//
+// Whitespace is removed from values since none of the tags used by ARC
+// allows it to be significant.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed tag-list: %s", strings.TrimSpace(part))
+		}
+		key := strings.TrimSpace(kv[0])
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("duplicate tag: %s", key)
+		}
+		tags[key] = strings.Join(strings.Fields(kv[1]), "")
+	}
+	return tags, nil
+}
+
+func parseInstance(tags map[string]string) (int, error) {
+	i, err := strconv.Atoi(tags["i"])
+	if err != nil || i < 1 || i > MaxInstance {
+		return 0, fmt.Errorf("invalid instance: %s", tags["i"])
+	}
+	return i, nil
+}
+
+// collectSets extracts ARC sets from the header.
+//
+// It returns the sets indexed by instance number minus one. An error is
+// returned if the structure of the chain is invalid (RFC 8617, Section
+// 5.2, step 3).
+func collectSets(h textproto.Header) ([]set, error) {
+	byInstance := make(map[int]*set)
+	maxInstance := 0
+
+	for fields := h.Fields(); fields.Next(); {
+		key := fields.Key()
+		if !strings.EqualFold(key, sealField) && !strings.EqualFold(key, amsField) && !strings.EqualFold(key, aarField) {
+			continue
+		}
+
+		raw, err := fields.Raw()
+		if err != nil {
+			return nil, err
+		}
+
+		var tags map[string]string
+		if strings.EqualFold(key, aarField) {
+			// Only the instance tag has the tag-value format, the rest is the
+			// Authentication-Results value.
+			tags, err = parseTags(strings.SplitN(fields.Value(), ";", 2)[0])
+		} else {
+			tags, err = parseTags(fields.Value())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		i, err := parseInstance(tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		s := byInstance[i]
+		if s == nil {
+			s = &set{}
+			byInstance[i] = s
+		}
+		f := &field{raw: string(raw), tags: tags}
+		var slot **field
+		switch {
+		case strings.EqualFold(key, sealField):
+			slot = &s.seal
+		case strings.EqualFold(key, amsField):
+			slot = &s.ams
+		default:
+			slot = &s.aar
+		}
+		if *slot != nil {
+			return nil, fmt.Errorf("duplicate %s for instance %d", key, i)
+		}
+		*slot = f
+
+		if i > maxInstance {
+			maxInstance = i
+		}
+	}
+
+	sets := make([]set, maxInstance)
+	for i := 1; i <= maxInstance; i++ {
+		s := byInstance[i]
+		if s == nil || s.aar == nil || s.ams == nil || s.seal == nil {
+			return nil, fmt.Errorf("incomplete ARC set for instance %d", i)
+		}
+		sets[i-1] = *s
+	}
+	return sets, nil
+}
+
+// AuthResults returns the results recorded in the ARC-Authentication-Results
+// field of the specified ARC set.
+//
+// The chain should be verified using Verify before relying on them.
+func AuthResults(h textproto.Header, instance int) ([]authres.Result, error) {
+	for fields := h.FieldsByKey(aarField); fields.Next(); {
+		parts := strings.SplitN(fields.Value(), ";", 2)
+		tags, err := parseTags(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", aarField, err)
+		}
+		i, err := parseInstance(tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", aarField, err)
+		}
+		if i != instance {
+			continue
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: missing results", aarField)
+		}
+		_, results, err := authres.Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", aarField, err)
+		}
+		return results, nil
+	}
+	return nil, fmt.Errorf("no %s for instance %d", aarField, instance)
+}
@@ -0,0 +1,495 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+)
+
+const testMsg = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner   ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.  \r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n" +
+	"\r\n" +
+	"\r\n"
+
+var testKeys = map[string]*rsa.PrivateKey{}
+
+func testKey(t *testing.T, domain string) *rsa.PrivateKey {
+	t.Helper()
+	if key, ok := testKeys[domain]; ok {
+		return key
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKeys[domain] = key
+	return key
+}
+
+func testResolver(t *testing.T, domains ...string) *mockdns.Resolver {
+	zones := map[string]mockdns.Zone{}
+	for _, domain := range domains {
+		pub, err := x509.MarshalPKIXPublicKey(testKey(t, domain).Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		zones["sel._domainkey."+domain+"."] = mockdns.Zone{
+			TXT: []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)},
+		}
+	}
+	return &mockdns.Resolver{Zones: zones}
+}
+
+func readMsg(t *testing.T, msg string) (textproto.Header, string) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+	return hdr, body.String()
+}
+
+// seal adds the ARC set and serializes the message so further checks operate
+// on the message as seen by the next hop.
+func seal(t *testing.T, msg, domain string, cv authres.ResultValue) string {
+	t.Helper()
+	hdr, body := readMsg(t, msg)
+	err := Seal(&hdr, strings.NewReader(body), &SealOptions{
+		Domain:          domain,
+		Selector:        "sel",
+		Signer:          testKey(t, domain),
+		AuthResults:     domain + "; spf=pass smtp.mailfrom=football.example.com",
+		ChainValidation: cv,
+		HeaderKeys:      []string{"From", "To", "Subject", "Date", "Message-ID", "DKIM-Signature", "ARC-Seal"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, hdr); err != nil {
+		t.Fatal(err)
+	}
+	return b.String() + body
+}
+
+func verify(t *testing.T, r Resolver, msg string) Result {
+	t.Helper()
+	hdr, body := readMsg(t, msg)
+	return Verify(context.Background(), r, hdr, strings.NewReader(body))
+}
+
+func TestVerify_NoChain(t *testing.T) {
+	res := verify(t, testResolver(t), testMsg)
+	if res.Value != authres.ResultNone {
+		t.Fatal("Wrong result:", res.Value, res.Reason)
+	}
+}
+
+func TestSealVerify(t *testing.T) {
+	r := testResolver(t, "list.example.org", "forwarder.example.com")
+
+	msg := seal(t, testMsg, "list.example.org", authres.ResultNone)
+	res := verify(t, r, msg)
+	if res.Value != authres.ResultPass {
+		t.Fatal("Wrong result:", res.Value, res.Reason)
+	}
+	if res.Instance != 1 || res.Domain != "list.example.org" {
+		t.Fatal("Wrong chain info:", res.Instance, res.Domain)
+	}
+
+	msg = seal(t, msg, "forwarder.example.com", res.Value)
+	res = verify(t, r, msg)
+	if res.Value != authres.ResultPass {
+		t.Fatal("Wrong result:", res.Value, res.Reason)
+	}
+	if res.Instance != 2 || res.Domain != "forwarder.example.com" {
+		t.Fatal("Wrong chain info:", res.Instance, res.Domain)
+	}
+
+	hdr, _ := readMsg(t, msg)
+	if val := hdr.Get("ARC-Authentication-Results"); !strings.HasPrefix(val, "i=2; forwarder.example.com; spf=pass") {
+		t.Error("Wrong ARC-Authentication-Results:", val)
+	}
+}
+
+func TestVerify_Broken(t *testing.T) {
+	r := testResolver(t, "list.example.org", "forwarder.example.com")
+	msg := seal(t, testMsg, "list.example.org", authres.ResultNone)
+	msg = seal(t, msg, "forwarder.example.com", authres.ResultPass)
+
+	test := func(name, msg string, expected authres.ResultValue) {
+		t.Helper()
+		res := verify(t, r, msg)
+		if res.Value != expected {
+			t.Errorf("%s: wrong result: %s (%s)", name, res.Value, res.Reason)
+		}
+	}
+
+	test("body", strings.Replace(msg, "hungry", "thirsty", 1), authres.ResultFail)
+	test("signed field", strings.Replace(msg, "dinner", "lunch", 1), authres.ResultFail)
+	test("whitespace", strings.Replace(msg, "Hi.  ", "Hi. ", 1), authres.ResultPass)
+	test("AAR", strings.Replace(msg, "i=1; list.example.org; spf=pass", "i=1; list.example.org; spf=fail", 1), authres.ResultFail)
+	test("missing set", strings.Replace(msg, "ARC-Seal: i=1", "X-ARC-Seal: i=1", 1), authres.ResultFail)
+	test("duplicate instance", strings.Replace(msg, "ARC-Seal: i=1", "ARC-Seal: i=2", 1), authres.ResultFail)
+
+	res := verify(t, testResolver(t, "forwarder.example.com"), msg)
+	if res.Value != authres.ResultFail {
+		t.Error("missing key: wrong result:", res.Value, res.Reason)
+	}
+
+	r.Zones["sel._domainkey.list.example.org."] = mockdns.Zone{
+		Err: &net.DNSError{Err: "the dns server is going insane", IsTemporary: true},
+	}
+	res = verify(t, r, msg)
+	if res.Value != authres.ResultTempError {
+		t.Error("DNS error: wrong result:", res.Value, res.Reason)
+	}
+}
+
+func TestVerify_FailedChain(t *testing.T) {
+	r := testResolver(t, "list.example.org", "forwarder.example.com")
+	msg := seal(t, testMsg, "list.example.org", authres.ResultNone)
+	msg = strings.Replace(msg, "hungry", "thirsty", 1)
+
+	res := verify(t, r, msg)
+	if res.Value != authres.ResultFail {
+		t.Fatal("Wrong result:", res.Value, res.Reason)
+	}
+
+	msg = seal(t, msg, "forwarder.example.com", res.Value)
+	hdr, _ := readMsg(t, msg)
+	if val := hdr.Get("ARC-Seal"); !strings.Contains(val, "i=2;") || !strings.Contains(val, "cv=fail;") {
+		t.Fatal("Wrong ARC-Seal:", val)
+	}
+
+	res = verify(t, r, msg)
+	if res.Value != authres.ResultFail || res.Instance != 2 {
+		t.Fatal("Wrong result:", res.Value, res.Instance, res.Reason)
+	}
+
+	hdr, body := readMsg(t, msg)
+	err := Seal(&hdr, strings.NewReader(body), &SealOptions{
+		Domain:          "list.example.org",
+		Selector:        "sel",
+		Signer:          testKey(t, "list.example.org"),
+		AuthResults:     "list.example.org; none",
+		ChainValidation: authres.ResultFail,
+	})
+	if err != ErrChainFailed {
+		t.Fatal("Unexpected error:", err)
+	}
+}
+
+// TestCanonicalization checks the implementation against go-msgauth by
+// verifying DKIM signatures using the ARC-Message-Signature code.
+func TestCanonicalization(t *testing.T) {
+	r := testResolver(t, "football.example.com")
+	for _, canon := range []dkim.Canonicalization{dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed} {
+		var b bytes.Buffer
+		err := dkim.Sign(&b, strings.NewReader(testMsg), &dkim.SignOptions{
+			Domain:                 "football.example.com",
+			Selector:               "sel",
+			Signer:                 testKey(t, "football.example.com"),
+			HeaderCanonicalization: canon,
+			BodyCanonicalization:   canon,
+			HeaderKeys:             []string{"From", "To", "Subject", "Subject"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, body := readMsg(t, b.String())
+		fields := hdr.FieldsByKey("DKIM-Signature")
+		fields.Next()
+		raw, err := fields.Raw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags, err := parseTags(fields.Value())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v := verifier{ctx: context.Background(), resolver: r, keys: map[string]*rsa.PublicKey{}}
+		if err := v.verifyAMS(&field{raw: string(raw), tags: tags}, hdr, strings.NewReader(body)); err != nil {
+			t.Errorf("%s: %v", canon, err)
+		}
+	}
+}
+
+// Fixed test vectors. They were produced by an independent implementation
+// (relaxed canonicalization written from RFC 6376 and RSA signatures made
+// using OpenSSL) so the verification is not checked only against Seal.
+
+const vectorOneHop = "ARC-Seal: i=1; a=rsa-sha256; t=1700000000; cv=none; d=lists.example.org; s=sel;\r\n" +
+	"\tb=J5O8STINbKAArKa5kveRge81QUu7hrTS8oyt3dP0v6GZTQLKab3krLbTdh9hZ/g6\r\n" +
+	"\tzTQKBWGFmUYbhgletuEdi6uoc6vtPLZST1TRClyxa+aSNhS2dyB/L6P6G/izKUVs\r\n" +
+	"\t01m+Ogatp7nLngp5l4fsWzj8i8ODrAqJwX18xikbVrfHrMtFms+1flsbsv9y8MfH\r\n" +
+	"\tzB9zqpI3GH23pSngs3vjo59GwEoWhvJFtU3xBdSQLworuM/FBJydn3EfZCcnqjlO\r\n" +
+	"\tZ0sxDmZM4uCwlGFuPeAXel8XDQQIX5rMUWE3pGV+8dDKtmHpYS0U4dWhs6/haQ+1\r\n" +
+	"\tNbguxaTybFyLVDX0KbaRrQ==\r\n" +
+	"ARC-Message-Signature: i=1; a=rsa-sha256; c=relaxed/relaxed; d=lists.example.org; s=sel; t=1700000000;\r\n" +
+	"\th=From:To:Subject:Date:Message-ID;\r\n" +
+	"\tbh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	"\tb=GyZyUyjvy2dZr0fj1qYAGVGx8Xw/Ko67xPIXOydzb81LDRgo+0KWj3F3SaDoIrmb\r\n" +
+	"\txDZtcIJlddzsy4Av8m173oJ6tpTxOdOUNQ9IkTJd9xTDwW9g24YMm9BM0mD/K3jt\r\n" +
+	"\tbUCO/piboo9sG05puSXpaHNbUvg/QIYfpPw7SN3MnIki7Z6MENGAzrdLwgeDNxkt\r\n" +
+	"\teSd8ypVc/Ta7LDLhb0xnWSu4ett3rC+IJ861js2jfGIH0tmgxfVjtaeotQLueSAh\r\n" +
+	"\taIX5GCpwmlJPeUFT08Z504RuVF/0RBu0a7aepN4zvWx87Tf8T1ZFMh37tlexPPHZ\r\n" +
+	"\t6FIWDiCvVw8GhdGgc8CLsQ==\r\n" +
+	"ARC-Authentication-Results: i=1; lists.example.org; dkim=pass header.d=football.example.com; spf=pass smtp.mailfrom=joe@football.example.com\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const vectorTwoHops = "ARC-Seal: i=2; a=rsa-sha256; t=1700000100; cv=pass; d=forwarder.example.net; s=sel;\r\n" +
+	"\tb=CMlBvM0dbi+JTp7lWbGyaLIEych+hO36nEhNIqiG4R3CoquEKAN03oJS3v1dCWeW\r\n" +
+	"\tVmJekIROEXWkPhkbAbxrzbzqL1aVgdT14eW/D+HcpPk2l7zrXDFVqa/LUySc6KnT\r\n" +
+	"\tluyg6x8sV2mAitFUaA3f2Qpd9j8kyVR4lcssYqtHQXxqfcHTYtNHENeKPr6xWshf\r\n" +
+	"\tGIzWYsdqDFeQ8xGOOI5IWJ9b1eAOrnncq9oRfLgSjIbCYStQ6i+Tc7toY7U4ntFd\r\n" +
+	"\tQMeExMgECRhViXir0ohn3zHfRDcN3844PGLL7B5OLKkZztFcYgqn2BGFP7/6ZxDV\r\n" +
+	"\tfqa7prILqz30dwySxgdSHw==\r\n" +
+	"ARC-Message-Signature: i=2; a=rsa-sha256; c=relaxed/relaxed; d=forwarder.example.net; s=sel; t=1700000100;\r\n" +
+	"\th=From:To:Subject:Date:Message-ID;\r\n" +
+	"\tbh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	"\tb=SP5ykHJy7tUzLYVdixezKGYgTCDINC9PeVbMJs8leQ5ezAbtUa4Zd+5C/Rw3Jrtr\r\n" +
+	"\tK/mgPNQm4820wl512rJ1tkfMhXW+9wcq8N7WcExP0xkjWMMf4izESQcmVRXtpT3F\r\n" +
+	"\tO4VItnnliUEbGHf9LJ61HNk1rxtiq0a6A4Yn2BC1j4p0gK404DdwGgbwiX0YMwEM\r\n" +
+	"\t0NB7gq/hMhjQHKUy6xz9wF948SA8X7tm+R0xwJys1OwahGF1+SltslNKWIhr2oW2\r\n" +
+	"\ttw38b29x+CBHz3PhIN0XZzKcV0NGYM/5+qNbihrI1PKH0H6mF1TyWkfL7qzJkNUh\r\n" +
+	"\tYpVIKJyOzdb8NGrgmowbog==\r\n" +
+	"ARC-Authentication-Results: i=2; forwarder.example.net; arc=pass header.d=lists.example.org; spf=fail smtp.mailfrom=lists.example.org\r\n" +
+	"ARC-Seal: i=1; a=rsa-sha256; t=1700000000; cv=none; d=lists.example.org; s=sel;\r\n" +
+	"\tb=J5O8STINbKAArKa5kveRge81QUu7hrTS8oyt3dP0v6GZTQLKab3krLbTdh9hZ/g6\r\n" +
+	"\tzTQKBWGFmUYbhgletuEdi6uoc6vtPLZST1TRClyxa+aSNhS2dyB/L6P6G/izKUVs\r\n" +
+	"\t01m+Ogatp7nLngp5l4fsWzj8i8ODrAqJwX18xikbVrfHrMtFms+1flsbsv9y8MfH\r\n" +
+	"\tzB9zqpI3GH23pSngs3vjo59GwEoWhvJFtU3xBdSQLworuM/FBJydn3EfZCcnqjlO\r\n" +
+	"\tZ0sxDmZM4uCwlGFuPeAXel8XDQQIX5rMUWE3pGV+8dDKtmHpYS0U4dWhs6/haQ+1\r\n" +
+	"\tNbguxaTybFyLVDX0KbaRrQ==\r\n" +
+	"ARC-Message-Signature: i=1; a=rsa-sha256; c=relaxed/relaxed; d=lists.example.org; s=sel; t=1700000000;\r\n" +
+	"\th=From:To:Subject:Date:Message-ID;\r\n" +
+	"\tbh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	"\tb=GyZyUyjvy2dZr0fj1qYAGVGx8Xw/Ko67xPIXOydzb81LDRgo+0KWj3F3SaDoIrmb\r\n" +
+	"\txDZtcIJlddzsy4Av8m173oJ6tpTxOdOUNQ9IkTJd9xTDwW9g24YMm9BM0mD/K3jt\r\n" +
+	"\tbUCO/piboo9sG05puSXpaHNbUvg/QIYfpPw7SN3MnIki7Z6MENGAzrdLwgeDNxkt\r\n" +
+	"\teSd8ypVc/Ta7LDLhb0xnWSu4ett3rC+IJ861js2jfGIH0tmgxfVjtaeotQLueSAh\r\n" +
+	"\taIX5GCpwmlJPeUFT08Z504RuVF/0RBu0a7aepN4zvWx87Tf8T1ZFMh37tlexPPHZ\r\n" +
+	"\t6FIWDiCvVw8GhdGgc8CLsQ==\r\n" +
+	"ARC-Authentication-Results: i=1; lists.example.org; dkim=pass header.d=football.example.com; spf=pass smtp.mailfrom=joe@football.example.com\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const vectorExpired = "ARC-Seal: i=1; a=rsa-sha256; t=1700000000; cv=none; d=lists.example.org; s=sel;\r\n" +
+	"\tb=HvUBrjtR9qU39gKbXaykUTuYaSKop6anh4HVCwlK+0P4pUM5BBb4qBZaWKVGXBS5\r\n" +
+	"\t+/Ah2vZgYt6mUbYRsYknlY4y2Gy4hYCHyegZb7S6hqbCmU54/eIPS5HiFT7U6eiU\r\n" +
+	"\tCC+w1XmqHr8S1lFC+QAdPt3zZFztPo5fss//7gIF2Oo+cOEi1XBrYNJ7R4a0B682\r\n" +
+	"\tboJ/+rs0at849c7meyY/iNCFUGghJAH2Dp4+/d1r9XnTaYGjeiiQAvBwHLdOTNHo\r\n" +
+	"\tPEXSgVtGJaHYC6hPRbxfHGlaJbPO6vdfTbBnrfXc4jx8MkhWIyxthy/5nNAV6dAp\r\n" +
+	"\tSPUAPlzYpTCqVJ7kAWjI/A==\r\n" +
+	"ARC-Message-Signature: i=1; a=rsa-sha256; c=relaxed/relaxed; d=lists.example.org; s=sel; t=1700000000; x=1700086400;\r\n" +
+	"\th=From:To:Subject:Date:Message-ID;\r\n" +
+	"\tbh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	"\tb=k1qCBusTyD28Vgosc8GSZpgCiQf/mTo1+z1SDVGjbUK8kI5EoqyPUemZCXdq1pbq\r\n" +
+	"\tx5LWPYx2Hy9aJSRwKyO6Kw2csw8u1c54/E09lKMARE2zjxNloG5wf/LGbyXIExd9\r\n" +
+	"\toF7QMDQCV/LNz0sv1xkQb5iTyaqcfRV6M0ZBd5A3TyGI/yJuyYXnvYqbQb5tfYwX\r\n" +
+	"\t5qMhwrKwXytFYX9tJbLfoFjBZ8/aBaRJ6WAMLIHuoIPUfWY+/ZRb0Llq9+tZqm8P\r\n" +
+	"\t8FHvVzBuGekVbRtXG0u0QZkrIEHIuAxHyuC2SZVGyLaKc/Bpcy481Ma53/4C2CA0\r\n" +
+	"\tUAkdOxoaA+LMItqlZQ5O8A==\r\n" +
+	"ARC-Authentication-Results: i=1; lists.example.org; spf=pass smtp.mailfrom=football.example.com\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const vectorShortKey = "ARC-Seal: i=1; a=rsa-sha256; t=1700000000; cv=none; d=lists.example.org; s=sel;\r\n" +
+	"\tb=RPy684SDujAuNWAu6cxoZW+XwjJfVyz/MUWbAP9LpOxz2pD15pU+kkFkLFoPofNk\r\n" +
+	"\tiWLDzg0qZ0PGqz6rqs6XGg==\r\n" +
+	"ARC-Message-Signature: i=1; a=rsa-sha256; c=relaxed/relaxed; d=lists.example.org; s=sel; t=1700000000;\r\n" +
+	"\th=From:To:Subject:Date:Message-ID;\r\n" +
+	"\tbh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	"\tb=TRw02vshE6jHhiAhG4yieoB8/Hn2LPMeOMQNVmLtoK9ShyAmN+ulWp+M5xnC9PXR\r\n" +
+	"\tlkoA7HYjqYGPAoPrCJIFiQ==\r\n" +
+	"ARC-Authentication-Results: i=1; lists.example.org; spf=pass smtp.mailfrom=football.example.com\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const vectorKeyLists = "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAuqsk93iUqxV2gdGVsgIICX587utYFL4Nxy8LZfRM4HYvCZDfdjhjdtYVG3A8SDxgVp6I1/5X8O+D5lhm1zCFRujVeiFn7OfrZakcQsl5ua31tVh/WAxk5B9CF+C2R4BjEBacGynrbLQhmsjS24b+K8gVrhbl02U7m0yCqVyG/HmwpkOS6t5kjyvzGQTNotbwMrwQ9+ak0fz4cxLravNBmpQxK78aCPzsTME6itGP9A3gM8HB3ZmlhpjadgaLR/Z7poNp6FWlCiSMZkKlKkh/E4jdb72ZzX2pHI9ktn9OzHY49FL3lDPOD8lLqZIDUj7lrzZ19Z0eN8IXBXaAAN3KjwIDAQAB"
+
+const vectorKeyForwarder = "MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA1Pr/GGCcHtg3QVHhr7bMlfjffNrqfTAKbjE7c3tNO81kjnIswAsUOK/CCh9AyEBWrJoBySSCk5dIG/wrRudjJ6SYDjBaPAMQjBfpdL/cgDOqnxNGkkdAyNtJ4ckf1QGGmgZxeDNnib2neisd3VN2xu3mgn98ZvMiRhM4yZVh9+IhsvCqjCuX5XRum81T553W0WKFnR8N4SC4KtJ8pb7Pwy05ARdLJvpwvDcCvYyiFMeOa6ZLPnNp194WpAlDqevRMNTgR2+qCpzVwi+ASIyXxIvQ8K1D4sp+ItIIKnUu/TyRFd0g76tF/hDeQ+6KYuzyP1h4f0AcOdtHJFkdZgdBZwIDAQAB"
+
+const vectorKeyShort = "MFwwDQYJKoZIhvcNAQEBBQADSwAwSAJBAMinAwaUVY3oAnDqollKSX+UaAyH4giUL51B9ii5ByaA7qioSbOr94Z2Up3AJoyq29bdTe1i7JM5LKDjsW3Mp1MCAwEAAQ=="
+
+func vectorResolver(keys map[string]string) *mockdns.Resolver {
+	zones := map[string]mockdns.Zone{}
+	for domain, record := range keys {
+		zones["sel._domainkey."+domain+"."] = mockdns.Zone{TXT: []string{record}}
+	}
+	return &mockdns.Resolver{Zones: zones}
+}
+
+func TestVerify_Vectors(t *testing.T) {
+	r := vectorResolver(map[string]string{
+		"lists.example.org":     "v=DKIM1; k=rsa; p=" + vectorKeyLists,
+		"forwarder.example.net": "v=DKIM1; k=rsa; p=" + vectorKeyForwarder,
+	})
+
+	res := verify(t, r, vectorOneHop)
+	if res.Value != authres.ResultPass || res.Instance != 1 || res.Domain != "lists.example.org" {
+		t.Fatal("One hop: wrong result:", res.Value, res.Instance, res.Domain, res.Reason)
+	}
+
+	res = verify(t, r, vectorTwoHops)
+	if res.Value != authres.ResultPass || res.Instance != 2 || res.Domain != "forwarder.example.net" {
+		t.Fatal("Two hops: wrong result:", res.Value, res.Instance, res.Domain, res.Reason)
+	}
+
+	hdr, _ := readMsg(t, vectorTwoHops)
+	results, err := AuthResults(hdr, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatal("Wrong results:", results)
+	}
+	dkimRes, ok := results[0].(*authres.DKIMResult)
+	if !ok || dkimRes.Value != authres.ResultPass || dkimRes.Domain != "football.example.com" {
+		t.Error("Wrong DKIM result:", results[0])
+	}
+	if _, err := AuthResults(hdr, 3); err == nil {
+		t.Error("Expected an error for missing instance")
+	}
+
+	res = verify(t, r, strings.Replace(vectorTwoHops, "spf=fail", "spf=pass", 1))
+	if res.Value != authres.ResultFail {
+		t.Error("Modified AAR: wrong result:", res.Value, res.Reason)
+	}
+}
+
+func TestVerify_KeyRecord(t *testing.T) {
+	test := func(record string, expected authres.ResultValue) {
+		t.Helper()
+		r := vectorResolver(map[string]string{"lists.example.org": record})
+		res := verify(t, r, vectorOneHop)
+		if res.Value != expected {
+			t.Errorf("%s: wrong result: %s (%s)", record, res.Value, res.Reason)
+		}
+	}
+
+	test("p="+vectorKeyLists, authres.ResultPass)
+	test("v=DKIM1; h=sha1:sha256; p="+vectorKeyLists, authres.ResultPass)
+	test("v=DKIM1; h=sha1; p="+vectorKeyLists, authres.ResultFail)
+	test("v=DKIM1; s=email; p="+vectorKeyLists, authres.ResultPass)
+	test("v=DKIM1; s=*; p="+vectorKeyLists, authres.ResultPass)
+	test("v=DKIM1; s=other; p="+vectorKeyLists, authres.ResultFail)
+	test("v=DKIM1; p=", authres.ResultFail)
+}
+
+func TestVerify_ShortKey(t *testing.T) {
+	r := vectorResolver(map[string]string{"lists.example.org": "v=DKIM1; k=rsa; p=" + vectorKeyShort})
+	res := verify(t, r, vectorShortKey)
+	if res.Value != authres.ResultFail || !strings.Contains(res.Reason, "too short") {
+		t.Fatal("Wrong result:", res.Value, res.Reason)
+	}
+}
+
+func TestVerify_Expired(t *testing.T) {
+	r := vectorResolver(map[string]string{"lists.example.org": "v=DKIM1; k=rsa; p=" + vectorKeyLists})
+	res := verify(t, r, vectorExpired)
+	if res.Value != authres.ResultFail || !strings.Contains(res.Reason, "expired") {
+		t.Fatal("Wrong result:", res.Value, res.Reason)
+	}
+
+	// Signature is valid before x=.
+	hdr, body := readMsg(t, vectorExpired)
+	sets, err := collectSets(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := verifier{
+		ctx:      context.Background(),
+		resolver: r,
+		keys:     map[string]*rsa.PublicKey{},
+		now:      time.Unix(1700000100, 0),
+	}
+	if err := v.verifyAMS(sets[0].ams, hdr, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const (
+	canonSimple  = "simple"
+	canonRelaxed = "relaxed"
+)
+
+func isWSP(ch byte) bool {
+	return ch == ' ' || ch == '\t'
+}
+
+// collapseWSP replaces all sequences of whitespace characters with a single
+// space and removes the trailing whitespace.
+func collapseWSP(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if isWSP(s[i]) {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			b.WriteByte(' ')
+		}
+		inWSP = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// canonHeader converts the raw header field (including the trailing CRLF)
+// into the canonical form (RFC 6376, Section 3.4.1 and 3.4.2).
+func canonHeader(canon, raw string) string {
+	if canon == canonSimple {
+		return raw
+	}
+
+	kv := strings.SplitN(raw, ":", 2)
+	if len(kv) != 2 {
+		return raw
+	}
+	key := strings.ToLower(strings.TrimRight(kv[0], " \t"))
+
+	// Unfold the value.
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(kv[1])
+	value = strings.TrimLeft(collapseWSP(value), " ")
+
+	return key + ":" + value + "\r\n"
+}
+
+// canonBody writes the body converted into the canonical form (RFC 6376,
+// Section 3.4.3 and 3.4.4) to w.
+func canonBody(canon string, w io.Writer, body io.Reader) error {
+	r := bufio.NewReader(body)
+	bw := bufio.NewWriter(w)
+
+	// Empty lines are written only when followed by a non-empty line since
+	// trailing empty lines are ignored.
+	emptyLines := 0
+	nonEmpty := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if canon == canonRelaxed {
+			line = collapseWSP(line)
+		}
+
+		if line == "" {
+			emptyLines++
+		} else {
+			for ; emptyLines > 0; emptyLines-- {
+				bw.WriteString("\r\n")
+			}
+			bw.WriteString(line)
+			bw.WriteString("\r\n")
+			nonEmpty = true
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if !nonEmpty && canon == canonSimple {
+		bw.WriteString("\r\n")
+	}
+	return bw.Flush()
+}
+
+// stripSignature removes the b= tag value from the raw signature header
+// field and the trailing CRLF as required for hashing of the field itself
+// (RFC 6376, Section 3.7).
+func stripSignature(raw string) string {
+	raw = strings.TrimSuffix(raw, "\r\n")
+	parts := strings.Split(raw, ";")
+	for i, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "b" {
+			parts[i] = kv[0] + "="
+		}
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,206 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+type SealOptions struct {
+	// Signing domain and selector of the key.
+	Domain   string
+	Selector string
+
+	// RSA private key.
+	Signer crypto.Signer
+
+	// Value of the Authentication-Results field (authserv-id followed by
+	// results) to record in the ARC-Authentication-Results field.
+	AuthResults string
+
+	// Validation status of the existing chain (none, pass or fail) as
+	// determined by Verify.
+	ChainValidation authres.ResultValue
+
+	// Header fields to include in the ARC-Message-Signature. ARC fields are
+	// ignored.
+	HeaderKeys []string
+
+	// Signature timestamp, current time is used if it is zero.
+	Time time.Time
+}
+
+// ErrChainFailed is returned by Seal if the existing chain is already marked
+// as failed by a previous intermediary, there is no point in adding more
+// sets in this case.
+var ErrChainFailed = errors.New("arc: chain is already marked as failed")
+
+// highestInstance returns the largest instance number used by ARC fields in
+// the header, ignoring malformed fields.
+func highestInstance(h textproto.Header) int {
+	highest := 0
+	for fields := h.Fields(); fields.Next(); {
+		key := fields.Key()
+		if !strings.EqualFold(key, sealField) && !strings.EqualFold(key, amsField) && !strings.EqualFold(key, aarField) {
+			continue
+		}
+		tags, err := parseTags(strings.SplitN(fields.Value(), ";", 2)[0])
+		if err != nil {
+			continue
+		}
+		if i, err := parseInstance(tags); err == nil && i > highest {
+			highest = i
+		}
+	}
+	return highest
+}
+
+// foldList joins the values using sep, inserting line breaks to keep lines
+// reasonably short.
+func foldList(values []string, sep string) string {
+	var b strings.Builder
+	lineLen := 0
+	for i, val := range values {
+		if i != 0 {
+			b.WriteString(sep)
+			lineLen += len(sep)
+		}
+		if lineLen != 0 && lineLen+len(val) > 70 {
+			b.WriteString("\r\n ")
+			lineLen = 1
+		}
+		b.WriteString(val)
+		lineLen += len(val)
+	}
+	return b.String()
+}
+
+func sign(signer crypto.Signer, hashed []byte) (string, error) {
+	sig, err := signer.Sign(rand.Reader, hashed, crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.StdEncoding.EncodeToString(sig)
+
+	chunks := make([]string, 0, len(b64)/70+1)
+	for len(b64) > 70 {
+		chunks = append(chunks, b64[:70])
+		b64 = b64[70:]
+	}
+	chunks = append(chunks, b64)
+	return strings.Join(chunks, "\r\n "), nil
+}
+
+// Seal adds a new ARC set to the message header (RFC 8617, Section 5.1).
+//
+// If opts.ChainValidation is fail, the ARC-Seal covers only the new set.
+func Seal(h *textproto.Header, body io.Reader, opts *SealOptions) error {
+	if _, ok := opts.Signer.Public().(*rsa.PublicKey); !ok {
+		return errors.New("arc: only RSA keys are supported")
+	}
+
+	var (
+		sets     []set
+		instance int
+	)
+	switch opts.ChainValidation {
+	case authres.ResultNone, authres.ResultPass:
+		var err error
+		sets, err = collectSets(*h)
+		if err != nil {
+			return fmt.Errorf("arc: %w", err)
+		}
+		if (opts.ChainValidation == authres.ResultNone) != (len(sets) == 0) {
+			return fmt.Errorf("arc: cv=%s is not valid for the chain with %d sets", opts.ChainValidation, len(sets))
+		}
+		instance = len(sets) + 1
+	case authres.ResultFail:
+		if sets, err := collectSets(*h); err == nil && len(sets) != 0 &&
+			sets[len(sets)-1].seal.tags["cv"] == string(authres.ResultFail) {
+			return ErrChainFailed
+		}
+		instance = highestInstance(*h) + 1
+	default:
+		return fmt.Errorf("arc: invalid chain validation status: %s", opts.ChainValidation)
+	}
+	if instance > MaxInstance {
+		return fmt.Errorf("arc: too many ARC sets")
+	}
+
+	now := opts.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	aar := &field{raw: fmt.Sprintf("%s: i=%d; %s\r\n", aarField, instance, opts.AuthResults)}
+
+	keys := make([]string, 0, len(opts.HeaderKeys))
+	for _, key := range opts.HeaderKeys {
+		if strings.HasPrefix(strings.ToLower(key), "arc-") {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	bh, err := bodyHash(canonRelaxed, body)
+	if err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+	amsRaw := fmt.Sprintf("%s: i=%d; a=rsa-sha256; c=relaxed/relaxed; d=%s;\r\n"+
+		" s=%s; t=%s;\r\n h=%s;\r\n bh=%s;\r\n b=",
+		amsField, instance, opts.Domain, opts.Selector, timestamp, foldList(keys, ":"),
+		base64.StdEncoding.EncodeToString(bh))
+	hashed, err := messageHash(canonRelaxed, *h, keys, amsRaw)
+	if err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+	sig, err := sign(opts.Signer, hashed)
+	if err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+	ams := &field{raw: amsRaw + sig + "\r\n"}
+
+	sealRaw := fmt.Sprintf("%s: i=%d; a=rsa-sha256; t=%s; cv=%s;\r\n d=%s; s=%s;\r\n b=",
+		sealField, instance, timestamp, opts.ChainValidation, opts.Domain, opts.Selector)
+	newSet := set{aar: aar, ams: ams, seal: &field{raw: sealRaw}}
+	if opts.ChainValidation == authres.ResultFail {
+		sets = nil
+	}
+	sig, err = sign(opts.Signer, sealHash(append(sets, newSet)))
+	if err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+
+	h.AddRaw([]byte(aar.raw))
+	h.AddRaw([]byte(ams.raw))
+	h.AddRaw([]byte(sealRaw + sig + "\r\n"))
+	return nil
+}
@@ -0,0 +1,365 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// tempError is returned if the public key can't be fetched due to
+// a temporary DNS error.
+type tempError struct {
+	err error
+}
+
+func (err tempError) Error() string {
+	return err.err.Error()
+}
+
+func (err tempError) Unwrap() error {
+	return err.err
+}
+
+// minKeyBits is the minimal accepted RSA key size (RFC 8301, Section 3.2).
+const minKeyBits = 1024
+
+type verifier struct {
+	ctx      context.Context
+	resolver Resolver
+	keys     map[string]*rsa.PublicKey
+	now      time.Time
+}
+
+func (v *verifier) publicKey(domain, selector string) (*rsa.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	if key, ok := v.keys[name]; ok {
+		return key, nil
+	}
+
+	txts, err := v.resolver.LookupTXT(v.ctx, dns.FQDN(name))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("no key for %s", name)
+		}
+		return nil, tempError{err: fmt.Errorf("key lookup failed for %s: %w", name, err)}
+	}
+	if len(txts) == 0 {
+		return nil, fmt.Errorf("no key for %s", name)
+	}
+
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, fmt.Errorf("malformed key record for %s: %w", name, err)
+	}
+	if ver, ok := tags["v"]; ok && ver != "DKIM1" {
+		return nil, fmt.Errorf("malformed key record for %s: unsupported version", name)
+	}
+	if keyType, ok := tags["k"]; ok && keyType != "rsa" {
+		return nil, fmt.Errorf("unsupported key type for %s: %s", name, keyType)
+	}
+	if hashes, ok := tags["h"]; ok && !hasListValue(hashes, "sha256") {
+		return nil, fmt.Errorf("key for %s is not usable with SHA-256", name)
+	}
+	if services, ok := tags["s"]; ok && !hasListValue(services, "*") && !hasListValue(services, "email") {
+		return nil, fmt.Errorf("key for %s is not usable for email", name)
+	}
+	if tags["p"] == "" {
+		return nil, fmt.Errorf("key for %s is revoked", name)
+	}
+	keyBlob, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed key record for %s: %w", name, err)
+	}
+
+	var key *rsa.PublicKey
+	pub, err := x509.ParsePKIXPublicKey(keyBlob)
+	if err != nil {
+		// Some records contain the PKCS #1 form.
+		key, err = x509.ParsePKCS1PublicKey(keyBlob)
+		if err != nil {
+			return nil, fmt.Errorf("malformed key record for %s: %w", name, err)
+		}
+	} else {
+		var ok bool
+		key, ok = pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type for %s: %T", name, pub)
+		}
+	}
+	if key.N.BitLen() < minKeyBits {
+		return nil, fmt.Errorf("key for %s is too short: %d bits", name, key.N.BitLen())
+	}
+
+	v.keys[name] = key
+	return key, nil
+}
+
+// hasListValue reports whether the colon-separated list contains value.
+func hasListValue(list, value string) bool {
+	for _, v := range strings.Split(list, ":") {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimestamp(f *field, tag string) (time.Time, bool, error) {
+	val, ok := f.tags[tag]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	secs, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, false, fmt.Errorf("malformed %s= tag: %s", tag, val)
+	}
+	return time.Unix(secs, 0), true, nil
+}
+
+// checkTimestamps checks the signature timestamp (t=) and expiration (x=)
+// tags (RFC 6376, Section 3.5).
+func (v *verifier) checkTimestamps(f *field) error {
+	signed, hasSigned, err := parseTimestamp(f, "t")
+	if err != nil {
+		return err
+	}
+	expires, hasExpires, err := parseTimestamp(f, "x")
+	if err != nil {
+		return err
+	}
+	if !hasExpires {
+		return nil
+	}
+	if hasSigned && expires.Before(signed) {
+		return errors.New("x= is before t=")
+	}
+	if v.now.After(expires) {
+		return errors.New("signature expired")
+	}
+	return nil
+}
+
+func (v *verifier) verifySig(f *field, hashed []byte) error {
+	if f.tags["a"] != "rsa-sha256" {
+		return fmt.Errorf("unsupported algorithm: %s", f.tags["a"])
+	}
+	if f.tags["d"] == "" || f.tags["s"] == "" {
+		return errors.New("missing d= or s= tag")
+	}
+	if err := v.checkTimestamps(f); err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(f.tags["b"])
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+
+	key, err := v.publicKey(f.tags["d"], f.tags["s"])
+	if err != nil {
+		return err
+	}
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed, sig); err != nil {
+		return errors.New("signature did not verify")
+	}
+	return nil
+}
+
+// sealHash computes the hash signed by the ARC-Seal of the last set in sets
+// (RFC 8617, Section 5.1.1).
+func sealHash(sets []set) []byte {
+	h := sha256.New()
+	for i, s := range sets {
+		io.WriteString(h, canonHeader(canonRelaxed, s.aar.raw))
+		io.WriteString(h, canonHeader(canonRelaxed, s.ams.raw))
+		if i == len(sets)-1 {
+			io.WriteString(h, strings.TrimSuffix(canonHeader(canonRelaxed, stripSignature(s.seal.raw)+"\r\n"), "\r\n"))
+		} else {
+			io.WriteString(h, canonHeader(canonRelaxed, s.seal.raw))
+		}
+	}
+	return h.Sum(nil)
+}
+
+func parseCanon(c string) (headerCanon, bodyCanon string, err error) {
+	if c == "" {
+		return canonSimple, canonSimple, nil
+	}
+	parts := strings.SplitN(c, "/", 2)
+	headerCanon = parts[0]
+	bodyCanon = canonSimple
+	if len(parts) == 2 {
+		bodyCanon = parts[1]
+	}
+	for _, canon := range []string{headerCanon, bodyCanon} {
+		if canon != canonSimple && canon != canonRelaxed {
+			return "", "", fmt.Errorf("unsupported canonicalization: %s", c)
+		}
+	}
+	return headerCanon, bodyCanon, nil
+}
+
+func bodyHash(canon string, body io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if err := canonBody(canon, h, body); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// messageHash computes the hash of header fields listed in keys and the
+// signature field itself (RFC 6376, Section 3.7).
+func messageHash(canon string, h textproto.Header, keys []string, sigRaw string) ([]byte, error) {
+	// Fields are picked from the bottom of the header, so build the lists of
+	// raw values for each key first.
+	byKey := make(map[string][]string)
+	for fields := h.Fields(); fields.Next(); {
+		raw, err := fields.Raw()
+		if err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(fields.Key())
+		byKey[key] = append(byKey[key], string(raw))
+	}
+
+	hash := sha256.New()
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		values := byKey[key]
+		if len(values) == 0 {
+			// Non-existent fields are treated as a null string.
+			continue
+		}
+		io.WriteString(hash, canonHeader(canon, values[len(values)-1]))
+		byKey[key] = values[:len(values)-1]
+	}
+
+	sigCanon := canonHeader(canon, stripSignature(sigRaw)+"\r\n")
+	io.WriteString(hash, strings.TrimSuffix(sigCanon, "\r\n"))
+	return hash.Sum(nil), nil
+}
+
+func (v *verifier) verifyAMS(f *field, h textproto.Header, body io.Reader) error {
+	headerCanon, bodyCanon, err := parseCanon(f.tags["c"])
+	if err != nil {
+		return err
+	}
+	if f.tags["h"] == "" {
+		return errors.New("missing h= tag")
+	}
+	keys := strings.Split(f.tags["h"], ":")
+	for _, key := range keys {
+		if strings.EqualFold(key, sealField) {
+			return errors.New("ARC-Seal is included in the signed fields")
+		}
+	}
+
+	expectedBH, err := base64.StdEncoding.DecodeString(f.tags["bh"])
+	if err != nil {
+		return fmt.Errorf("malformed body hash: %w", err)
+	}
+	bh, err := bodyHash(bodyCanon, body)
+	if err != nil {
+		return err
+	}
+	if string(bh) != string(expectedBH) {
+		return errors.New("body hash did not verify")
+	}
+
+	hashed, err := messageHash(headerCanon, h, keys, f.raw)
+	if err != nil {
+		return err
+	}
+	return v.verifySig(f, hashed)
+}
+
+// Verify validates the ARC chain of the message (RFC 8617, Section 5.2).
+//
+// The body is read only if there are ARC sets present in the header.
+func Verify(ctx context.Context, r Resolver, h textproto.Header, body io.Reader) Result {
+	if !h.Has(sealField) && !h.Has(amsField) && !h.Has(aarField) {
+		return Result{Value: authres.ResultNone}
+	}
+
+	fail := func(instance int, domain string, err error) Result {
+		res := Result{
+			Value:    authres.ResultFail,
+			Reason:   err.Error(),
+			Instance: instance,
+			Domain:   domain,
+		}
+		var tempErr tempError
+		if errors.As(err, &tempErr) {
+			res.Value = authres.ResultTempError
+		}
+		return res
+	}
+
+	sets, err := collectSets(h)
+	if err != nil {
+		return fail(0, "", err)
+	}
+	latest := sets[len(sets)-1]
+	instance, domain := len(sets), latest.seal.tags["d"]
+
+	if latest.seal.tags["cv"] == string(authres.ResultFail) {
+		return fail(instance, domain, errors.New("chain is marked as failed"))
+	}
+
+	v := verifier{ctx: ctx, resolver: r, keys: map[string]*rsa.PublicKey{}, now: time.Now()}
+	if err := v.verifyAMS(latest.ams, h, body); err != nil {
+		return fail(instance, domain, fmt.Errorf("%s (i=%d): %w", amsField, instance, err))
+	}
+
+	for i := len(sets); i > 0; i-- {
+		seal := sets[i-1].seal
+		expectedCV := string(authres.ResultPass)
+		if i == 1 {
+			expectedCV = string(authres.ResultNone)
+		}
+		if seal.tags["cv"] != expectedCV {
+			return fail(instance, domain, fmt.Errorf("%s (i=%d): unexpected cv=%s", sealField, i, seal.tags["cv"]))
+		}
+		if err := v.verifySig(seal, sealHash(sets[:i])); err != nil {
+			return fail(instance, domain, fmt.Errorf("%s (i=%d): %w", sealField, i, err))
+		}
+	}
+
+	return Result{
+		Value:    authres.ResultPass,
+		Instance: instance,
+		Domain:   domain,
+	}
+}
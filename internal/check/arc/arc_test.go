@@ -0,0 +1,145 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	maddyarc "github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, zones map[string]mockdns.Zone, cfg []config.Node) *Check {
+	t.Helper()
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := mod.(*Check)
+	check.resolver = &mockdns.Resolver{Zones: zones}
+	check.log = testutils.Logger(t, mod.Name())
+
+	if err := check.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	return check
+}
+
+func sealedMsg(t *testing.T) (map[string]mockdns.Zone, textproto.Header) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones := map[string]mockdns.Zone{
+		"arc._domainkey.lists.example.org.": {
+			TXT: []string{"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(pub)},
+		},
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "heya")
+	hdr.Add("From", "<hello@example.com>")
+	err = maddyarc.Seal(&hdr, bytes.NewReader([]byte("hello there\r\n")), &maddyarc.SealOptions{
+		Domain:          "lists.example.org",
+		Selector:        "arc",
+		Signer:          key,
+		AuthResults:     "lists.example.org; dkim=pass header.d=example.com",
+		ChainValidation: authres.ResultNone,
+		HeaderKeys:      []string{"From", "Subject"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zones, hdr
+}
+
+func checkBody(t *testing.T, c *Check, hdr textproto.Header, body string) module.CheckResult {
+	t.Helper()
+
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	return s.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(body)})
+}
+
+func TestARC(t *testing.T) {
+	zones, hdr := sealedMsg(t)
+	c := testCheck(t, zones, nil)
+
+	res := checkBody(t, c, hdr, "hello there\r\n")
+	if res.Reject || res.Quarantine || res.Reason != nil {
+		t.Fatal("Unexpected check result:", res.Reason)
+	}
+	if len(res.AuthResult) != 1 {
+		t.Fatal("Wrong amount of auth. results:", len(res.AuthResult))
+	}
+	arcRes := res.AuthResult[0].(*authres.GenericResult)
+	if arcRes.Method != "arc" || arcRes.Value != authres.ResultPass || arcRes.Params["header.d"] != "lists.example.org" {
+		t.Fatal("Wrong auth. result:", authres.Format("", res.AuthResult))
+	}
+
+	res = checkBody(t, c, textproto.Header{}, "hello there\r\n")
+	if res.Reason != nil || res.AuthResult[0].(*authres.GenericResult).Value != authres.ResultNone {
+		t.Fatal("Wrong result for unsealed message:", authres.Format("", res.AuthResult), res.Reason)
+	}
+}
+
+func TestARC_Fail(t *testing.T) {
+	zones, hdr := sealedMsg(t)
+
+	c := testCheck(t, zones, nil)
+	res := checkBody(t, c, hdr, "hello where\r\n")
+	if res.Reject || res.Quarantine {
+		t.Fatal("Message is rejected with fail_action ignore")
+	}
+	if res.AuthResult[0].(*authres.GenericResult).Value != authres.ResultFail {
+		t.Fatal("Wrong auth. result:", authres.Format("", res.AuthResult))
+	}
+
+	c = testCheck(t, zones, []config.Node{
+		{
+			Name: "fail_action",
+			Args: []string{"reject"},
+		},
+	})
+	res = checkBody(t, c, hdr, "hello where\r\n")
+	if !res.Reject {
+		t.Fatal("Message is not rejected with fail_action reject")
+	}
+}
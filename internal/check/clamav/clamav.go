@@ -0,0 +1,347 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package clamav implements the virus scanning check using the clamd daemon.
+//
+// The message is sent to clamd using the INSTREAM command, see clamd(8) for
+// the protocol description.
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName = "check.clamav"
+
+	// Size of INSTREAM chunks. clamd does not accept chunks bigger than
+	// StreamMaxLength, which is 25M by default.
+	chunkSize = 64 * 1024
+
+	// Header field that contains the scan result.
+	scanHeader = "X-Virus-Scan"
+)
+
+var errSizeLimit = errors.New("clamav: stream size limit exceeded")
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	endpoint string
+	network  string
+	address  string
+	hostname string
+	maxSize  int
+	timeout  time.Duration
+	addHdr   bool
+
+	infectedAction  modconfig.FailAction
+	errAction       modconfig.FailAction
+	sizeLimitAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		c.endpoint = inlineArgs[0]
+	case 0:
+		c.endpoint = "tcp://127.0.0.1:3310"
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpoint, &c.endpoint)
+	cfg.String("hostname", true, false, "", &c.hostname)
+	cfg.DataSize("max_size", false, false, 25*1024*1024, &c.maxSize)
+	cfg.Duration("timeout", false, false, 1*time.Minute, &c.timeout)
+	cfg.Bool("add_header", false, true, &c.addHdr)
+	cfg.Custom("infected_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.infectedAction)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	cfg.Custom("size_limit_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.sizeLimitAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	endp, err := config.ParseEndpoint(c.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	switch endp.Scheme {
+	case "tcp", "unix":
+	default:
+		return fmt.Errorf("%s: scheme unsupported: %v", modName, endp.Scheme)
+	}
+	c.network = endp.Network()
+	c.address = endp.Address()
+
+	return nil
+}
+
+// readResponse reads the null-terminated clamd response and interprets it.
+// Signature name is returned if the malware is found.
+func readResponse(conn net.Conn) (string, error) {
+	resp, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	resp = strings.TrimSpace(strings.TrimSuffix(resp, "\x00"))
+
+	switch {
+	case strings.HasSuffix(resp, " FOUND"):
+		resp = strings.TrimSuffix(resp, " FOUND")
+		resp = strings.TrimPrefix(resp, "stream:")
+		return strings.TrimSpace(resp), nil
+	case strings.HasSuffix(resp, "OK"):
+		return "", nil
+	case strings.Contains(resp, "size limit exceeded"):
+		return "", errSizeLimit
+	default:
+		return "", fmt.Errorf("clamav: %s", resp)
+	}
+}
+
+func (c *Check) writeStream(conn net.Conn, r io.Reader) error {
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n != 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// scan sends the message to clamd. Signature name is returned if the malware
+// is found.
+func (c *Check) scan(ctx context.Context, r io.Reader) (string, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return "", err
+	}
+
+	if err := c.writeStream(conn, r); err != nil {
+		// clamd closes the connection after sending the error, e.g. if the
+		// size limit is exceeded. Report it instead of the write error if
+		// possible.
+		if sig, respErr := readResponse(conn); respErr == nil || respErr == errSizeLimit {
+			return sig, respErr
+		}
+		return "", err
+	}
+
+	return readResponse(conn)
+}
+
+func (c *Check) header(value authres.ResultValue, params map[string]string) textproto.Header {
+	hdr := textproto.Header{}
+	if !c.addHdr {
+		return hdr
+	}
+	hdr.Add(scanHeader, strings.TrimSpace(authres.Format(c.hostname, []authres.Result{
+		&authres.GenericResult{
+			Method: "clamav",
+			Value:  value,
+			Params: params,
+		},
+	})))
+	return hdr
+}
+
+func (c *Check) sizeLimitResult(size int) module.CheckResult {
+	results.WithLabelValues(c.instName, "size_limit").Inc()
+	return c.sizeLimitAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message:      "Message is too big to be scanned for viruses",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"size": size,
+			},
+		},
+		Header: c.header(authres.ResultNone, nil),
+	})
+}
+
+func (c *Check) errResult(err error) module.CheckResult {
+	results.WithLabelValues(c.instName, "error").Inc()
+	return c.errAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Internal error during virus scan",
+			CheckName:    modName,
+			Err:          err,
+		},
+		Header: c.header(authres.ResultTempError, nil),
+	})
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return s.c.errResult(err)
+	}
+
+	size := hdrBuf.Len() + body.Len()
+	if s.c.maxSize != 0 && size > s.c.maxSize {
+		s.log.Msg("message is too big to be scanned", "size", size)
+		return s.c.sizeLimitResult(size)
+	}
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return s.c.errResult(err)
+	}
+	defer bodyR.Close()
+
+	sig, err := s.c.scan(ctx, io.MultiReader(&hdrBuf, bodyR))
+	if err == errSizeLimit {
+		s.log.Msg("message is too big to be scanned", "size", size)
+		return s.c.sizeLimitResult(size)
+	}
+	if err != nil {
+		s.log.Error("scan failed", err, "endpoint", s.c.endpoint)
+		return s.c.errResult(err)
+	}
+
+	if sig == "" {
+		results.WithLabelValues(s.c.instName, "clean").Inc()
+		return module.CheckResult{
+			Header: s.c.header(authres.ResultPass, nil),
+		}
+	}
+
+	s.log.Msg("malware found", "signature", sig)
+	results.WithLabelValues(s.c.instName, "infected").Inc()
+	return s.c.infectedAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Message contains malware (%s)", sig),
+			Reason:       "infected",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"signature": sig,
+			},
+		},
+		Header: s.c.header(authres.ResultFail, map[string]string{"signature": sig}),
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,234 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// fakeClamd implements the INSTREAM command and reports messages containing
+// "EICAR" as infected.
+type fakeClamd struct {
+	t        *testing.T
+	l        net.Listener
+	maxSize  int
+	response string // if set, sent instead of the scan result
+}
+
+func newFakeClamd(t *testing.T) *fakeClamd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeClamd{t: t, l: l}
+	go d.serve()
+	return d
+}
+
+func (d *fakeClamd) serve() {
+	for {
+		conn, err := d.l.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		d.t.Log("fake clamd:", err)
+		return
+	}
+	if cmd != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+
+	var data bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			d.t.Log("fake clamd:", err)
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if d.maxSize != 0 && data.Len()+int(size) > d.maxSize {
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+			return
+		}
+		if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+			d.t.Log("fake clamd:", err)
+			return
+		}
+	}
+
+	switch {
+	case d.response != "":
+		io.WriteString(conn, d.response+"\x00")
+	case bytes.Contains(data.Bytes(), []byte("EICAR")):
+		io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+	default:
+		io.WriteString(conn, "stream: OK\x00")
+	}
+}
+
+func (d *fakeClamd) Close() {
+	d.l.Close()
+}
+
+func testCheck(t *testing.T, addr string) *Check {
+	return &Check{
+		instName:       "test",
+		log:            testutils.Logger(t, modName),
+		endpoint:       "tcp://" + addr,
+		network:        "tcp",
+		address:        addr,
+		hostname:       "mx.example.org",
+		timeout:        5 * time.Second,
+		addHdr:         true,
+		infectedAction: modconfig.FailAction{Reject: true},
+		errAction:      modconfig.FailAction{Reject: true},
+	}
+}
+
+func checkBody(t *testing.T, c *Check, body string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<sender@example.org>")
+	return st.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(body)})
+}
+
+func TestClamAV(t *testing.T) {
+	d := newFakeClamd(t)
+	defer d.Close()
+	c := testCheck(t, d.l.Addr().String())
+
+	res := checkBody(t, c, "Hello!\r\n")
+	if res.Reject || res.Quarantine {
+		t.Fatal("Clean message is rejected:", res.Reason)
+	}
+	if val := res.Header.Get(scanHeader); val != "mx.example.org; clamav=pass" {
+		t.Errorf("Wrong %s value: %q", scanHeader, val)
+	}
+
+	// Make sure the message is sent in multiple chunks.
+	res = checkBody(t, c, strings.Repeat("A", 2*chunkSize)+"EICAR\r\n")
+	if !res.Reject {
+		t.Fatal("Infected message is not rejected")
+	}
+	if smtpErr, ok := res.Reason.(*exterrors.SMTPError); !ok || !strings.Contains(smtpErr.Message, "Eicar-Test-Signature") {
+		t.Error("Signature is not included in the reason:", res.Reason)
+	}
+	if exterrors.IsTemporary(res.Reason) {
+		t.Error("Rejection should be permanent")
+	}
+	if val := res.Header.Get(scanHeader); val != "mx.example.org; clamav=fail signature=Eicar-Test-Signature" {
+		t.Errorf("Wrong %s value: %q", scanHeader, val)
+	}
+
+	c.infectedAction = modconfig.FailAction{Quarantine: true}
+	res = checkBody(t, c, "EICAR\r\n")
+	if res.Reject || !res.Quarantine {
+		t.Error("Infected message is not quarantined")
+	}
+}
+
+func TestClamAV_SizeLimit(t *testing.T) {
+	d := newFakeClamd(t)
+	defer d.Close()
+	c := testCheck(t, d.l.Addr().String())
+
+	// Local limit.
+	c.maxSize = 1024
+	res := checkBody(t, c, strings.Repeat("A", 2048))
+	if res.Reject {
+		t.Fatal("Message is rejected with size_limit_action ignore:", res.Reason)
+	}
+	if val := res.Header.Get(scanHeader); val != "mx.example.org; clamav=none" {
+		t.Errorf("Wrong %s value: %q", scanHeader, val)
+	}
+
+	// clamd limit.
+	c.maxSize = 0
+	d.maxSize = 1024
+	c.sizeLimitAction = modconfig.FailAction{Reject: true}
+	res = checkBody(t, c, strings.Repeat("A", 4*chunkSize))
+	if !res.Reject {
+		t.Fatal("Message is not rejected with size_limit_action reject")
+	}
+	if !strings.Contains(res.Reason.Error(), "too big") {
+		t.Error("Wrong reason:", res.Reason)
+	}
+}
+
+func TestClamAV_Error(t *testing.T) {
+	d := newFakeClamd(t)
+	defer d.Close()
+	c := testCheck(t, d.l.Addr().String())
+
+	d.response = "Can't allocate memory ERROR"
+	res := checkBody(t, c, "Hello!\r\n")
+	if !res.Reject || !exterrors.IsTemporary(res.Reason) {
+		t.Fatal("Expected temporary rejection, got", res.Reject, res.Reason)
+	}
+
+	c.errAction = modconfig.FailAction{}
+	res = checkBody(t, c, "Hello!\r\n")
+	if res.Reject {
+		t.Fatal("Message is rejected with error_action ignore")
+	}
+	if val := res.Header.Get(scanHeader); val != "mx.example.org; clamav=temperror" {
+		t.Errorf("Wrong %s value: %q", scanHeader, val)
+	}
+
+	d.Close()
+	res = checkBody(t, testCheck(t, d.l.Addr().String()), "Hello!\r\n")
+	if !res.Reject {
+		t.Fatal("Message is accepted while clamd is down")
+	}
+}
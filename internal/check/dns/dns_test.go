@@ -22,7 +22,6 @@ import (
 	"net"
 	"testing"
 
-	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/go-mockdns"
 	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/module"
@@ -51,7 +50,7 @@ func TestRequireMatchingRDNS(t *testing.T) {
 			},
 			MsgMeta: &module.MsgMetadata{
 				Conn: &module.ConnState{
-					ConnectionState: smtp.ConnectionState{
+					ConnectionState: module.ConnectionState{
 						RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
 						Hostname:   srcHost,
 					},
@@ -92,7 +91,7 @@ func TestRequireMXRecord(t *testing.T) {
 			},
 			MsgMeta: &module.MsgMetadata{
 				Conn: &module.ConnState{
-					ConnectionState: smtp.ConnectionState{
+					ConnectionState: module.ConnectionState{
 						RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
 					},
 				},
@@ -136,7 +135,7 @@ func TestMatchingEHLO(t *testing.T) {
 			},
 			MsgMeta: &module.MsgMetadata{
 				Conn: &module.ConnState{
-					ConnectionState: smtp.ConnectionState{
+					ConnectionState: module.ConnectionState{
 						RemoteAddr: &net.TCPAddr{IP: srcIP, Port: 55555},
 						Hostname:   srcHost,
 					},
@@ -27,7 +27,6 @@ import (
 	"sync"
 
 	"github.com/emersion/go-message/textproto"
-	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
@@ -365,7 +364,7 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 }
 
 // CheckConnection implements module.EarlyCheck.
-func (bl *DNSBL) CheckConnection(ctx context.Context, state *smtp.ConnectionState) error {
+func (bl *DNSBL) CheckConnection(ctx context.Context, state *module.ConnectionState) error {
 	if !bl.checkEarly {
 		return nil
 	}
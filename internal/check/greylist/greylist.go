@@ -0,0 +1,381 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package greylist implements the greylisting check.
+//
+// Messages from unknown (client network, sender, recipient) triplets are
+// deferred with a temporary error. Legitimate MTAs retry the delivery later,
+// and retries made after the configured delay are accepted.
+package greylist
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.greylist"
+
+// How often expired entries are removed from the storage.
+const cleanupInterval = time.Hour
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	store         Store
+	delay         time.Duration
+	retryWindow   time.Duration
+	expiry        time.Duration
+	autoAllowlist int
+	ipv4Prefix    int
+	ipv6Prefix    int
+	allowIPs      config.Networks
+	allowDomains  map[string]struct{}
+	errAction     modconfig.FailAction
+
+	now func() time.Time
+
+	stopCleanup chan struct{}
+	cleanupWg   sync.WaitGroup
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func allowIPsDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	return config.ParseNetworks(node, node.Args)
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var allowDomains []string
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Duration("delay", false, false, 5*time.Minute, &c.delay)
+	cfg.Duration("retry_window", false, false, 48*time.Hour, &c.retryWindow)
+	cfg.Duration("expiry", false, false, 35*24*time.Hour, &c.expiry)
+	cfg.Int("auto_allowlist", false, false, 5, &c.autoAllowlist)
+	cfg.Int("ipv4_prefix", false, false, 24, &c.ipv4Prefix)
+	cfg.Int("ipv6_prefix", false, false, 64, &c.ipv6Prefix)
+	cfg.Custom("allow_ips", false, false, nil, allowIPsDirective, &c.allowIPs)
+	cfg.StringList("allow_domains", false, false, nil, &allowDomains)
+	cfg.Custom("error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errAction)
+	cfg.Custom("storage", false, false, func() (interface{}, error) {
+		return defaultStore(c.instName)
+	}, storageDirective, &c.store)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.ipv4Prefix < 0 || c.ipv4Prefix > 32 {
+		return fmt.Errorf("%s: ipv4_prefix should be in range 0-32", modName)
+	}
+	if c.ipv6Prefix < 0 || c.ipv6Prefix > 128 {
+		return fmt.Errorf("%s: ipv6_prefix should be in range 0-128", modName)
+	}
+	if c.retryWindow <= c.delay {
+		return fmt.Errorf("%s: retry_window should be bigger than delay", modName)
+	}
+
+	c.allowDomains = make(map[string]struct{}, len(allowDomains))
+	for _, domain := range allowDomains {
+		c.allowDomains[strings.ToLower(strings.TrimSuffix(domain, "."))] = struct{}{}
+	}
+
+	c.stopCleanup = make(chan struct{})
+	c.cleanupWg.Add(1)
+	go c.cleanupLoop()
+
+	return nil
+}
+
+func (c *Check) cleanupLoop() {
+	defer c.cleanupWg.Done()
+
+	t := time.NewTicker(cleanupInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.cleanup()
+		case <-c.stopCleanup:
+			return
+		}
+	}
+}
+
+func (c *Check) cleanup() {
+	now := c.now()
+	if err := c.store.Cleanup(now, now.Add(-c.expiry), now.Add(-c.retryWindow)); err != nil {
+		c.log.Error("cleanup failed", err)
+	}
+}
+
+func (c *Check) Close() error {
+	if c.stopCleanup != nil {
+		close(c.stopCleanup)
+		c.cleanupWg.Wait()
+	}
+	return c.store.Close()
+}
+
+// clientNet returns the network of the client used as a part of the
+// triplet. Empty string is returned if greylisting is not applicable.
+func (c *Check) clientNet(msgMeta *module.MsgMetadata) (net.IP, string) {
+	if msgMeta.Conn == nil || msgMeta.Conn.AuthUser != "" {
+		return nil, ""
+	}
+	tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, ""
+	}
+
+	ip := tcpAddr.IP
+	mask := net.CIDRMask(c.ipv6Prefix, 8*net.IPv6len)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(c.ipv4Prefix, 8*net.IPv4len)
+	}
+	ipNet := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	return ip, ipNet.String()
+}
+
+func normalizeAddr(addr string) string {
+	norm, err := address.ForLookup(addr)
+	if err != nil {
+		return strings.ToLower(addr)
+	}
+	return norm
+}
+
+// allowlisted checks whether the client or sender domain is allowlisted.
+func (c *Check) allowlisted(ip net.IP, client, sender string) (bool, error) {
+	for _, ipNet := range c.allowIPs {
+		if ipNet.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	now := c.now()
+	ok, err := c.store.AllowedIP(client, now)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	if sender == "" {
+		return false, nil
+	}
+	_, domain, err := address.Split(sender)
+	if err != nil || domain == "" {
+		return false, nil
+	}
+	domain = strings.TrimSuffix(domain, ".")
+	if _, ok := c.allowDomains[domain]; ok {
+		return true, nil
+	}
+	return c.store.AllowedDomain(domain, now)
+}
+
+// checkTriplet records the delivery attempt and returns the greylisting
+// decision for it. The returned string is the metric label and the log
+// description of the decision.
+func (c *Check) checkTriplet(t Triplet) (bool, string, error) {
+	now := c.now()
+	state, ok, err := c.store.Triplet(t)
+	if err != nil {
+		return false, "", err
+	}
+
+	switch {
+	case !ok,
+		state.Passed && now.Sub(state.LastSeen) > c.expiry,
+		!state.Passed && now.Sub(state.FirstSeen) > c.retryWindow:
+		return false, "deferred", c.store.PutTriplet(t, tripletState{FirstSeen: now, LastSeen: now})
+	case state.Passed:
+		state.LastSeen = now
+		return true, "passed", c.store.PutTriplet(t, state)
+	case now.Sub(state.FirstSeen) < c.delay:
+		return false, "deferred", nil
+	}
+
+	state.Passed = true
+	state.LastSeen = now
+	if err := c.store.PutTriplet(t, state); err != nil {
+		return false, "", err
+	}
+
+	if c.autoAllowlist > 0 {
+		count, err := c.store.PassedCount(t.Client)
+		if err != nil {
+			return true, "retried", err
+		}
+		if count >= c.autoAllowlist {
+			c.log.DebugMsg("client is allowlisted", "client", t.Client, "passed_triplets", count)
+			if err := c.store.AllowIP(t.Client, now.Add(c.expiry)); err != nil {
+				return true, "retried", err
+			}
+		}
+	}
+
+	return true, "retried", nil
+}
+
+func (c *Check) errResult(err error) module.CheckResult {
+	return c.errAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Internal error during policy check",
+			CheckName:    modName,
+			Err:          err,
+		},
+	})
+}
+
+// greylist checks triplets for all recipients. The message is deferred if
+// at least one of them is unknown.
+func (c *Check) greylist(msgMeta *module.MsgMetadata, dlog log.Logger, sender string, rcpts []string) module.CheckResult {
+	ip, client := c.clientNet(msgMeta)
+	if client == "" {
+		return module.CheckResult{}
+	}
+
+	sender = normalizeAddr(sender)
+	ok, err := c.allowlisted(ip, client, sender)
+	if err != nil {
+		dlog.Error("allowlist lookup failed", err)
+		results.WithLabelValues(c.instName, "error").Inc()
+		return c.errResult(err)
+	}
+	if ok {
+		results.WithLabelValues(c.instName, "allowlisted").Inc()
+		return module.CheckResult{}
+	}
+
+	deferred := false
+	for _, rcpt := range rcpts {
+		t := Triplet{Client: client, Sender: sender, Rcpt: normalizeAddr(rcpt)}
+		passed, result, err := c.checkTriplet(t)
+		if err != nil {
+			dlog.Error("triplet lookup failed", err, "client", client, "rcpt", t.Rcpt)
+			results.WithLabelValues(c.instName, "error").Inc()
+			return c.errResult(err)
+		}
+		results.WithLabelValues(c.instName, result).Inc()
+		dlog.DebugMsg("greylisting", "client", client, "rcpt", t.Rcpt, "result", result)
+		if !passed {
+			deferred = true
+		}
+	}
+	if !deferred {
+		return module.CheckResult{}
+	}
+
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Greylisted, please try again later",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"client": client,
+			},
+		},
+	}
+}
+
+// GreylistMsg applies greylisting to the message with all its recipients.
+// It is used by other checks (e.g. check.rspamd) to defer suspicious
+// messages.
+func (c *Check) GreylistMsg(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string, rcpts []string) module.CheckResult {
+	return c.greylist(msgMeta, target.DeliveryLogger(c.log, msgMeta), mailFrom, rcpts)
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	s.mailFrom = addr
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return s.c.greylist(s.msgMeta, s.log, s.mailFrom, []string{addr})
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
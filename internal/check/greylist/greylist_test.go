@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func testCheck(t *testing.T, store Store) (*Check, *clock) {
+	t.Helper()
+
+	if store == nil {
+		store = newMemoryStore()
+	}
+	clk := &clock{t: time.Unix(1600000000, 0)}
+	c := &Check{
+		instName:      "test",
+		log:           testutils.Logger(t, modName),
+		store:         store,
+		delay:         5 * time.Minute,
+		retryWindow:   48 * time.Hour,
+		expiry:        35 * 24 * time.Hour,
+		autoAllowlist: 3,
+		ipv4Prefix:    24,
+		ipv6Prefix:    64,
+		allowDomains:  map[string]struct{}{},
+		now:           clk.now,
+	}
+	return c, clk
+}
+
+func testMeta(ip string) *module.MsgMetadata {
+	return &module.MsgMetadata{
+		ID: "test",
+		Conn: &module.ConnState{
+			ConnectionState: module.ConnectionState{
+				RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+			},
+		},
+	}
+}
+
+func checkRcpt(t *testing.T, c *Check, ip, from, rcpt string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), testMeta(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if res := st.CheckSender(context.Background(), from); res.Reject {
+		t.Fatal("Unexpected sender rejection:", res.Reason)
+	}
+	return st.CheckRcpt(context.Background(), rcpt)
+}
+
+func expectDeferred(t *testing.T, res module.CheckResult) {
+	t.Helper()
+	if !res.Reject {
+		t.Fatal("Expected message to be deferred")
+	}
+	if !exterrors.IsTemporary(res.Reason) {
+		t.Fatal("Expected temporary error, got", res.Reason)
+	}
+}
+
+func expectAccepted(t *testing.T, res module.CheckResult) {
+	t.Helper()
+	if res.Reject {
+		t.Fatal("Unexpected rejection:", res.Reason)
+	}
+}
+
+func testGreylisting(t *testing.T, store Store) {
+	c, clk := testCheck(t, store)
+
+	expectDeferred(t, checkRcpt(t, c, "192.0.2.1", "sender@example.org", "rcpt@example.com"))
+
+	// Retry is too early.
+	clk.t = clk.t.Add(time.Minute)
+	expectDeferred(t, checkRcpt(t, c, "192.0.2.1", "sender@example.org", "rcpt@example.com"))
+
+	// Retry from the same network after the delay.
+	clk.t = clk.t.Add(5 * time.Minute)
+	expectAccepted(t, checkRcpt(t, c, "192.0.2.2", "Sender@example.org", "rcpt@example.com"))
+	expectAccepted(t, checkRcpt(t, c, "192.0.2.1", "sender@example.org", "rcpt@example.com"))
+
+	// Other triplets are still unknown.
+	expectDeferred(t, checkRcpt(t, c, "192.0.2.1", "sender@example.org", "rcpt2@example.com"))
+	expectDeferred(t, checkRcpt(t, c, "198.51.100.1", "sender@example.org", "rcpt@example.com"))
+
+	// The triplet first seen too long ago is considered new.
+	clk.t = clk.t.Add(49 * time.Hour)
+	expectDeferred(t, checkRcpt(t, c, "192.0.2.1", "sender@example.org", "rcpt2@example.com"))
+
+	// Passed triplets expire too.
+	clk.t = clk.t.Add(36 * 24 * time.Hour)
+	expectDeferred(t, checkRcpt(t, c, "192.0.2.1", "sender@example.org", "rcpt@example.com"))
+
+	// Authenticated and local messages are not greylisted.
+	meta := testMeta("203.0.113.1")
+	meta.Conn.AuthUser = "user"
+	expectAccepted(t, c.GreylistMsg(context.Background(), meta, "sender@example.org", []string{"rcpt@example.com"}))
+	expectAccepted(t, c.GreylistMsg(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org", []string{"rcpt@example.com"}))
+}
+
+func testAutoAllowlist(t *testing.T, store Store) {
+	c, clk := testCheck(t, store)
+
+	for _, rcpt := range []string{"rcpt1@example.com", "rcpt2@example.com", "rcpt3@example.com"} {
+		expectDeferred(t, checkRcpt(t, c, "2001:db8::1", "sender@example.org", rcpt))
+	}
+	clk.t = clk.t.Add(10 * time.Minute)
+	for _, rcpt := range []string{"rcpt1@example.com", "rcpt2@example.com", "rcpt3@example.com"} {
+		expectAccepted(t, checkRcpt(t, c, "2001:db8::2", "sender@example.org", rcpt))
+	}
+
+	// The client network passed enough triplets.
+	expectAccepted(t, checkRcpt(t, c, "2001:db8::3", "sender2@example.org", "rcpt4@example.com"))
+	expectDeferred(t, checkRcpt(t, c, "2001:db8:1::1", "sender2@example.org", "rcpt4@example.com"))
+
+	// Expired entries are removed.
+	clk.t = clk.t.Add(40 * 24 * time.Hour)
+	c.cleanup()
+	expectDeferred(t, checkRcpt(t, c, "2001:db8::3", "sender3@example.org", "rcpt4@example.com"))
+}
+
+func TestGreylist(t *testing.T) {
+	testGreylisting(t, nil)
+}
+
+func TestGreylist_AutoAllowlist(t *testing.T) {
+	testAutoAllowlist(t, nil)
+}
+
+func TestGreylist_StaticAllowlist(t *testing.T) {
+	c, _ := testCheck(t, nil)
+	c.allowIPs = []net.IPNet{{IP: net.IPv4(198, 51, 100, 0).To4(), Mask: net.CIDRMask(24, 32)}}
+	c.allowDomains["example.net"] = struct{}{}
+
+	expectAccepted(t, checkRcpt(t, c, "198.51.100.7", "sender@example.org", "rcpt@example.com"))
+	expectAccepted(t, checkRcpt(t, c, "192.0.2.1", "sender@EXAMPLE.net", "rcpt@example.com"))
+	expectDeferred(t, checkRcpt(t, c, "192.0.2.1", "sender@example.org", "rcpt@example.com"))
+}
+
+func TestGreylist_Msg(t *testing.T) {
+	c, clk := testCheck(t, nil)
+	rcpts := []string{"rcpt1@example.com", "rcpt2@example.com"}
+
+	expectDeferred(t, checkRcpt(t, c, "192.0.2.1", "sender@example.org", "rcpt1@example.com"))
+	clk.t = clk.t.Add(10 * time.Minute)
+
+	// One of recipients is unknown.
+	expectDeferred(t, c.GreylistMsg(context.Background(), testMeta("192.0.2.1"), "sender@example.org", rcpts))
+	clk.t = clk.t.Add(10 * time.Minute)
+	expectAccepted(t, c.GreylistMsg(context.Background(), testMeta("192.0.2.1"), "sender@example.org", rcpts))
+}
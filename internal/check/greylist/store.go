@@ -0,0 +1,198 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// Triplet identifies the message flow subject to greylisting.
+type Triplet struct {
+	// Client network (e.g. 192.0.2.0/24).
+	Client string
+	Sender string
+	Rcpt   string
+}
+
+type tripletState struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	// Passed is set once the client retries after the greylisting delay.
+	Passed bool
+}
+
+// Store is the persistent storage for greylisting state.
+//
+// Allowlist entries with zero expiry time never expire and are not touched by
+// Cleanup. These are expected to be added by the administrator directly.
+type Store interface {
+	// Triplet returns the saved state of the triplet. ok is false if there
+	// is none.
+	Triplet(t Triplet) (state tripletState, ok bool, err error)
+	PutTriplet(t Triplet, state tripletState) error
+
+	// PassedCount returns the amount of passed triplets for the client
+	// network.
+	PassedCount(client string) (int, error)
+
+	AllowedIP(client string, now time.Time) (bool, error)
+	// AllowIP adds the client network to the allowlist or extends the
+	// expiry time of the existing entry. Permanent entries are not changed.
+	AllowIP(client string, expires time.Time) error
+
+	AllowedDomain(domain string, now time.Time) (bool, error)
+
+	// Cleanup removes expired allowlist entries, passed triplets last seen
+	// before passedBefore and pending triplets first seen before
+	// pendingBefore.
+	Cleanup(now, passedBefore, pendingBefore time.Time) error
+
+	Close() error
+}
+
+func storageDirective(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+
+	switch node.Args[0] {
+	case "memory":
+		if len(node.Children) != 0 {
+			return nil, config.NodeErr(node, "memory storage has no options")
+		}
+		return newMemoryStore(), nil
+	case "sql":
+		return newSQLStore(config.NewMap(m.Globals, node))
+	default:
+		return nil, config.NodeErr(node, "unknown storage type: %s", node.Args[0])
+	}
+}
+
+// defaultStore opens the SQLite database in the state directory.
+func defaultStore(instName string) (Store, error) {
+	name := "greylist.db"
+	if instName != "" {
+		name = "greylist_" + instName + ".db"
+	}
+	store, err := openSQLStore("sqlite3", filepath.Join(config.StateDirectory, name), "maddy_greylist_")
+	if err != nil {
+		return nil, fmt.Errorf("%s: default storage is not available, use storage memory or storage sql: %w", modName, err)
+	}
+	return store, nil
+}
+
+// memoryStore keeps the state in memory, it is lost on restart.
+type memoryStore struct {
+	lock         sync.Mutex
+	triplets     map[Triplet]tripletState
+	allowIPs     map[string]time.Time
+	allowDomains map[string]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		triplets:     map[Triplet]tripletState{},
+		allowIPs:     map[string]time.Time{},
+		allowDomains: map[string]time.Time{},
+	}
+}
+
+func allowed(expires time.Time, ok bool, now time.Time) bool {
+	return ok && (expires.IsZero() || expires.After(now))
+}
+
+func (s *memoryStore) Triplet(t Triplet) (tripletState, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state, ok := s.triplets[t]
+	return state, ok, nil
+}
+
+func (s *memoryStore) PutTriplet(t Triplet, state tripletState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.triplets[t] = state
+	return nil
+}
+
+func (s *memoryStore) PassedCount(client string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count := 0
+	for t, state := range s.triplets {
+		if t.Client == client && state.Passed {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) AllowedIP(client string, now time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expires, ok := s.allowIPs[client]
+	return allowed(expires, ok, now), nil
+}
+
+func (s *memoryStore) AllowIP(client string, expires time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cur, ok := s.allowIPs[client]; ok && cur.IsZero() {
+		return nil
+	}
+	s.allowIPs[client] = expires
+	return nil
+}
+
+func (s *memoryStore) AllowedDomain(domain string, now time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expires, ok := s.allowDomains[domain]
+	return allowed(expires, ok, now), nil
+}
+
+func (s *memoryStore) Cleanup(now, passedBefore, pendingBefore time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for t, state := range s.triplets {
+		if (state.Passed && state.LastSeen.Before(passedBefore)) ||
+			(!state.Passed && state.FirstSeen.Before(pendingBefore)) {
+			delete(s.triplets, t)
+		}
+	}
+	for _, m := range []map[string]time.Time{s.allowIPs, s.allowDomains} {
+		for key, expires := range m {
+			if !allowed(expires, true, now) {
+				delete(m, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
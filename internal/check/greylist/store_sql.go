@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	_ "github.com/lib/pq"
+)
+
+// sqlStore keeps the state in SQL database tables, allowing multiple
+// instances to share it.
+//
+// Timestamps are stored as Unix time, zero expiry time means the allowlist
+// entry is permanent.
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+
+	tripletsTbl     string
+	allowIPsTbl     string
+	allowDomainsTbl string
+}
+
+func newSQLStore(cfg *config.Map) (*sqlStore, error) {
+	var (
+		driver   string
+		dsnParts []string
+		prefix   string
+	)
+	cfg.String("driver", false, true, "", &driver)
+	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	cfg.String("table_prefix", false, false, "maddy_greylist_", &prefix)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	store, err := openSQLStore(driver, strings.Join(dsnParts, " "), prefix)
+	if err != nil {
+		return nil, config.NodeErr(cfg.Block, "%v", err)
+	}
+	return store, nil
+}
+
+func openSQLStore(driver, dsn, prefix string) (*sqlStore, error) {
+	s := sqlStore{
+		driver:          driver,
+		tripletsTbl:     prefix + "triplets",
+		allowIPsTbl:     prefix + "allow_ips",
+		allowDomainsTbl: prefix + "allow_domains",
+	}
+
+	db, err := sql.Open(s.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %v", err)
+	}
+	s.db = db
+	if s.driver == "sqlite3" {
+		// SQLite does not allow concurrent writes anyway.
+		db.SetMaxOpenConns(1)
+	}
+
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.tripletsTbl + ` (
+			client TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			rcpt TEXT NOT NULL,
+			first_seen BIGINT NOT NULL,
+			last_seen BIGINT NOT NULL,
+			passed INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (client, sender, rcpt)
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + s.allowIPsTbl + ` (
+			client TEXT NOT NULL PRIMARY KEY,
+			expires BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + s.allowDomainsTbl + ` (
+			domain TEXT NOT NULL PRIMARY KEY,
+			expires BIGINT NOT NULL DEFAULT 0
+		)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create table: %v", err)
+		}
+	}
+
+	return &s, nil
+}
+
+// query rewrites ?-placeholders into the form expected by the driver.
+func (s *sqlStore) query(q string) string {
+	if s.driver != "postgres" {
+		return q
+	}
+
+	var (
+		res strings.Builder
+		idx int
+	)
+	for _, chr := range q {
+		if chr == '?' {
+			idx++
+			res.WriteString("$" + strconv.Itoa(idx))
+			continue
+		}
+		res.WriteRune(chr)
+	}
+	return res.String()
+}
+
+func (s *sqlStore) Triplet(t Triplet) (tripletState, bool, error) {
+	var (
+		firstSeen, lastSeen int64
+		passed              int
+	)
+	err := s.db.QueryRow(s.query(`SELECT first_seen, last_seen, passed FROM `+s.tripletsTbl+`
+		WHERE client = ? AND sender = ? AND rcpt = ?`), t.Client, t.Sender, t.Rcpt).Scan(&firstSeen, &lastSeen, &passed)
+	if err == sql.ErrNoRows {
+		return tripletState{}, false, nil
+	}
+	if err != nil {
+		return tripletState{}, false, err
+	}
+	return tripletState{
+		FirstSeen: time.Unix(firstSeen, 0),
+		LastSeen:  time.Unix(lastSeen, 0),
+		Passed:    passed != 0,
+	}, true, nil
+}
+
+func (s *sqlStore) PutTriplet(t Triplet, state tripletState) error {
+	passed := 0
+	if state.Passed {
+		passed = 1
+	}
+	_, err := s.db.Exec(s.query(`INSERT INTO `+s.tripletsTbl+` (client, sender, rcpt, first_seen, last_seen, passed)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (client, sender, rcpt) DO UPDATE SET
+			first_seen = excluded.first_seen, last_seen = excluded.last_seen, passed = excluded.passed`),
+		t.Client, t.Sender, t.Rcpt, state.FirstSeen.Unix(), state.LastSeen.Unix(), passed)
+	return err
+}
+
+func (s *sqlStore) PassedCount(client string) (int, error) {
+	var count int
+	err := s.db.QueryRow(s.query(`SELECT COUNT(*) FROM `+s.tripletsTbl+`
+		WHERE client = ? AND passed <> 0`), client).Scan(&count)
+	return count, err
+}
+
+func (s *sqlStore) allowed(tbl, column, key string, now time.Time) (bool, error) {
+	var expires int64
+	err := s.db.QueryRow(s.query(`SELECT expires FROM `+tbl+` WHERE `+column+` = ?`), key).Scan(&expires)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return expires == 0 || expires > now.Unix(), nil
+}
+
+func (s *sqlStore) AllowedIP(client string, now time.Time) (bool, error) {
+	return s.allowed(s.allowIPsTbl, "client", client, now)
+}
+
+func (s *sqlStore) AllowIP(client string, expires time.Time) error {
+	_, err := s.db.Exec(s.query(`INSERT INTO `+s.allowIPsTbl+` (client, expires) VALUES (?, ?)
+		ON CONFLICT (client) DO UPDATE SET expires = excluded.expires
+		WHERE `+s.allowIPsTbl+`.expires <> 0`), client, expires.Unix())
+	return err
+}
+
+func (s *sqlStore) AllowedDomain(domain string, now time.Time) (bool, error) {
+	return s.allowed(s.allowDomainsTbl, "domain", domain, now)
+}
+
+func (s *sqlStore) Cleanup(now, passedBefore, pendingBefore time.Time) error {
+	if _, err := s.db.Exec(s.query(`DELETE FROM `+s.tripletsTbl+`
+		WHERE (passed <> 0 AND last_seen < ?) OR (passed = 0 AND first_seen < ?)`),
+		passedBefore.Unix(), pendingBefore.Unix()); err != nil {
+		return err
+	}
+	for _, tbl := range []string{s.allowIPsTbl, s.allowDomainsTbl} {
+		if _, err := s.db.Exec(s.query(`DELETE FROM `+tbl+` WHERE expires <> 0 AND expires <= ?`), now.Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,116 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestSQLStore(t *testing.T) *sqlStore {
+	t.Helper()
+	store, err := newSQLStore(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "driver",
+				Args: []string{"sqlite3"},
+			},
+			{
+				Name: "dsn",
+				Args: []string{filepath.Join(testutils.Dir(t), "greylist.db")},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestGreylist_SQL(t *testing.T) {
+	store := newTestSQLStore(t)
+	defer store.Close()
+	testGreylisting(t, store)
+}
+
+func TestGreylist_SQL_AutoAllowlist(t *testing.T) {
+	store := newTestSQLStore(t)
+	defer store.Close()
+	testAutoAllowlist(t, store)
+}
+
+func TestSQLStore_PermanentAllowlist(t *testing.T) {
+	store := newTestSQLStore(t)
+	defer store.Close()
+
+	if _, err := store.db.Exec(`INSERT INTO ` + store.allowIPsTbl + ` VALUES ('192.0.2.0/24', 0)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec(`INSERT INTO ` + store.allowDomainsTbl + ` VALUES ('example.org', 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1600000000, 0)
+	// Permanent entries are not changed by auto-allowlisting or removed by
+	// cleanup.
+	if err := store.AllowIP("192.0.2.0/24", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Cleanup(now.Add(time.Hour), now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	later := now.Add(365 * 24 * time.Hour)
+	if ok, err := store.AllowedIP("192.0.2.0/24", later); err != nil || !ok {
+		t.Error("IP allowlist entry is lost:", ok, err)
+	}
+	if ok, err := store.AllowedDomain("example.org", later); err != nil || !ok {
+		t.Error("Domain allowlist entry is lost:", ok, err)
+	}
+	if ok, err := store.AllowedDomain("example.com", later); err != nil || ok {
+		t.Error("Unexpected domain allowlist entry:", ok, err)
+	}
+}
+
+func TestDefaultStore(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	oldState := config.StateDirectory
+	config.StateDirectory = dir
+	defer func() { config.StateDirectory = oldState }()
+
+	store, err := defaultStore("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*sqlStore).Close()
+
+	if _, err := os.Stat(filepath.Join(dir, "greylist_test.db")); err != nil {
+		t.Fatal("Database is not created in the state directory:", err)
+	}
+	testGreylisting(t, store)
+}
@@ -43,6 +43,12 @@ import (
 
 const modName = "check.rspamd"
 
+// greylister is implemented by check.greylist.
+type greylister interface {
+	module.Module
+	GreylistMsg(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string, rcpts []string) module.CheckResult
+}
+
 type Check struct {
 	instName string
 	log      log.Logger
@@ -58,6 +64,8 @@ type Check struct {
 	addHdrAction      modconfig.FailAction
 	rewriteSubjAction modconfig.FailAction
 
+	greylist greylister
+
 	client *http.Client
 }
 
@@ -118,6 +126,11 @@ func (c *Check) Init(cfg *config.Map) error {
 			return modconfig.FailAction{Quarantine: true}, nil
 		}, modconfig.FailActionDirective, &c.rewriteSubjAction)
 	cfg.StringList("flags", false, false, []string{"pass_all"}, &flags)
+	cfg.Custom("greylist", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var g greylister
+		err := modconfig.ModuleFromNode("check", node.Args, node, m.Globals, &g)
+		return g, err
+	}, &c.greylist)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -285,12 +298,16 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 	case "no action":
 		return module.CheckResult{}
 	case "greylist":
-		// uuh... TODO: Implement greylisting?
 		hdrAdd := textproto.Header{}
 		hdrAdd.Add("X-Spam-Score", strconv.FormatFloat(respData.Score, 'f', 2, 64))
-		return module.CheckResult{
-			Header: hdrAdd,
+		if s.c.greylist == nil {
+			return module.CheckResult{
+				Header: hdrAdd,
+			}
 		}
+		res := s.c.greylist.GreylistMsg(ctx, s.msgMeta, s.mailFrom, s.rcpt)
+		res.Header = hdrAdd
+		return res
 	case "add header":
 		hdrAdd := textproto.Header{}
 		hdrAdd.Add("X-Spam-Flag", "Yes")
@@ -320,6 +337,9 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 			Header: hdrAdd,
 		})
 	case "soft reject":
+		if s.c.greylist != nil {
+			return s.c.greylist.GreylistMsg(ctx, s.msgMeta, s.mailFrom, s.rcpt)
+		}
 		return module.CheckResult{
 			Reject: true,
 			Reason: &exterrors.SMTPError{
@@ -0,0 +1,478 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package spamassassin implements the message filtering using the SpamAssassin
+// daemon (spamd).
+//
+// See https://svn.apache.org/repos/asf/spamassassin/trunk/spamd/PROTOCOL for
+// the protocol description.
+package spamassassin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const (
+	modName = "check.spamassassin"
+
+	protoVersion = "SPAMC/1.5"
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	endpoint string
+	network  string
+	address  string
+	command  string
+	user     string
+	maxSize  int
+	timeout  time.Duration
+	addHdr   bool
+
+	// nil if not set.
+	quarantineThreshold *float64
+	rejectThreshold     *float64
+
+	ioErrAction     modconfig.FailAction
+	errorRespAction modconfig.FailAction
+	spamAction      modconfig.FailAction
+	rejectAction    modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		c.endpoint = inlineArgs[0]
+	case 0:
+		c.endpoint = "tcp://127.0.0.1:783"
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func thresholdDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+	val, err := strconv.ParseFloat(node.Args[0], 64)
+	if err != nil {
+		return nil, config.NodeErr(node, "invalid score: %v", err)
+	}
+	return &val, nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpoint, &c.endpoint)
+	cfg.Enum("command", false, false, []string{"check", "symbols", "process"}, "symbols", &c.command)
+	cfg.String("user", false, false, "", &c.user)
+	cfg.DataSize("max_size", false, false, 512*1024, &c.maxSize)
+	cfg.Duration("timeout", false, false, 1*time.Minute, &c.timeout)
+	cfg.Bool("add_header", false, true, &c.addHdr)
+	cfg.Custom("quarantine_threshold", false, false, nil, thresholdDirective, &c.quarantineThreshold)
+	cfg.Custom("reject_threshold", false, false, nil, thresholdDirective, &c.rejectThreshold)
+	cfg.Custom("io_error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.ioErrAction)
+	cfg.Custom("error_resp_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.errorRespAction)
+	cfg.Custom("spam_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.spamAction)
+	cfg.Custom("reject_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.rejectAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	endp, err := config.ParseEndpoint(c.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	switch endp.Scheme {
+	case "tcp", "unix":
+	default:
+		return fmt.Errorf("%s: scheme unsupported: %v", modName, endp.Scheme)
+	}
+	c.network = endp.Network()
+	c.address = endp.Address()
+
+	return nil
+}
+
+// errMalformed is wrapped by all errors caused by unexpected spamd responses.
+var errMalformed = errors.New("spamd: malformed response")
+
+// errResponse is returned if spamd reports an error.
+type errResponse struct {
+	code int
+	msg  string
+}
+
+func (err errResponse) Error() string {
+	return fmt.Sprintf("spamd: %d %s", err.code, err.msg)
+}
+
+type response struct {
+	isSpam    bool
+	score     float64
+	threshold float64
+
+	// Rule names, only for SYMBOLS.
+	symbols []string
+	// X-Spam-* fields from the processed message, only for PROCESS.
+	processed bool
+	header    textproto.Header
+}
+
+func parseSpamHeader(val string, resp *response) error {
+	// Spam: True ; 15.0 / 5.0
+	parts := strings.SplitN(val, ";", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%w: Spam header: %s", errMalformed, val)
+	}
+	switch strings.ToLower(strings.TrimSpace(parts[0])) {
+	case "true", "yes":
+		resp.isSpam = true
+	case "false", "no":
+	default:
+		return fmt.Errorf("%w: Spam header: %s", errMalformed, val)
+	}
+
+	scores := strings.SplitN(parts[1], "/", 2)
+	if len(scores) != 2 {
+		return fmt.Errorf("%w: Spam header: %s", errMalformed, val)
+	}
+	var err error
+	resp.score, err = strconv.ParseFloat(strings.TrimSpace(scores[0]), 64)
+	if err != nil {
+		return fmt.Errorf("%w: Spam header: %s", errMalformed, val)
+	}
+	resp.threshold, err = strconv.ParseFloat(strings.TrimSpace(scores[1]), 64)
+	if err != nil {
+		return fmt.Errorf("%w: Spam header: %s", errMalformed, val)
+	}
+	return nil
+}
+
+func (c *Check) readResponse(r *bufio.Reader) (*response, error) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	fields := strings.SplitN(strings.TrimSpace(status), " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return nil, fmt.Errorf("%w: status line: %s", errMalformed, strings.TrimSpace(status))
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: status line: %s", errMalformed, strings.TrimSpace(status))
+	}
+	if code != 0 {
+		msg := ""
+		if len(fields) == 3 {
+			msg = fields[2]
+		}
+		return nil, errResponse{code: code, msg: msg}
+	}
+
+	resp := &response{}
+	hasSpam := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%w: header: %s", errMalformed, line)
+		}
+		if strings.EqualFold(parts[0], "Spam") {
+			if err := parseSpamHeader(parts[1], resp); err != nil {
+				return nil, err
+			}
+			hasSpam = true
+		}
+	}
+	if !hasSpam {
+		return nil, fmt.Errorf("%w: Spam header is missing", errMalformed)
+	}
+
+	switch c.command {
+	case "symbols":
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, sym := range strings.Split(strings.TrimSpace(string(body)), ",") {
+			if sym = strings.TrimSpace(sym); sym != "" {
+				resp.symbols = append(resp.symbols, sym)
+			}
+		}
+	case "process":
+		hdr, err := textproto.ReadHeader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: processed message: %v", errMalformed, err)
+		}
+		resp.processed = true
+		fields := hdr.Fields()
+		for fields.Next() {
+			if strings.HasPrefix(strings.ToLower(fields.Key()), "x-spam-") {
+				resp.header.Add(fields.Key(), fields.Value())
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+func (c *Check) request(ctx context.Context, hdr *bytes.Buffer, body io.Reader, size int) (*response, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s\r\n", strings.ToUpper(c.command), protoVersion)
+	fmt.Fprintf(w, "Content-length: %d\r\n", size)
+	if c.user != "" {
+		fmt.Fprintf(w, "User: %s\r\n", c.user)
+	}
+	w.WriteString("\r\n")
+	if _, err := io.Copy(w, io.MultiReader(hdr, body)); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.readResponse(bufio.NewReader(conn))
+}
+
+func (c *Check) spamHeader(resp *response) textproto.Header {
+	if resp.processed {
+		return resp.header
+	}
+
+	flag := "No"
+	if resp.isSpam {
+		flag = "Yes"
+	}
+	status := fmt.Sprintf("%s, score=%.1f required=%.1f", flag, resp.score, resp.threshold)
+	if len(resp.symbols) != 0 {
+		status += " tests=" + strings.Join(resp.symbols, ",")
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("X-Spam-Status", status)
+	hdr.Add("X-Spam-Score", strconv.FormatFloat(resp.score, 'f', 1, 64))
+	if resp.isSpam {
+		hdr.Add("X-Spam-Flag", "YES")
+	}
+	return hdr
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+
+	size := hdrBuf.Len() + body.Len()
+	if s.c.maxSize != 0 && size > s.c.maxSize {
+		s.log.DebugMsg("message is too big, skipping", "size", size)
+		return module.CheckResult{}
+	}
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+	defer bodyR.Close()
+
+	resp, err := s.c.request(ctx, &hdrBuf, bodyR, size)
+	if err != nil {
+		var respErr errResponse
+		if errors.As(err, &respErr) || errors.Is(err, errMalformed) {
+			code := exterrors.EnhancedCode{4, 7, 0}
+			if errors.Is(err, errMalformed) {
+				code = exterrors.EnhancedCode{4, 9, 0}
+			}
+			return s.c.errorRespAction.Apply(module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         451,
+					EnhancedCode: code,
+					Message:      "Internal error during policy check",
+					CheckName:    modName,
+					Err:          err,
+				},
+			})
+		}
+		return s.c.ioErrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+
+	s.log.DebugMsg("spamd result", "score", resp.score, "threshold", resp.threshold, "spam", resp.isSpam)
+
+	var hdrAdd textproto.Header
+	if s.c.addHdr {
+		hdrAdd = s.c.spamHeader(resp)
+	}
+
+	if s.c.rejectThreshold != nil && resp.score >= *s.c.rejectThreshold {
+		return s.c.rejectAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Message rejected due to local policy",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"score":     resp.score,
+					"threshold": *s.c.rejectThreshold,
+				},
+			},
+			Header: hdrAdd,
+		})
+	}
+
+	isSpam := resp.isSpam
+	threshold := resp.threshold
+	if s.c.quarantineThreshold != nil {
+		threshold = *s.c.quarantineThreshold
+		isSpam = resp.score >= threshold
+	}
+	if isSpam {
+		return s.c.spamAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Message rejected due to local policy",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"score":     resp.score,
+					"threshold": threshold,
+				},
+			},
+			Header: hdrAdd,
+		})
+	}
+
+	return module.CheckResult{
+		Header: hdrAdd,
+	}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
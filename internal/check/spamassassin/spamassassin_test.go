@@ -0,0 +1,315 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spamassassin
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// fakeSpamd scores messages containing "GTUBE" with 1000 points and all other
+// messages with 1.5 points, the threshold is 5.
+type fakeSpamd struct {
+	t        *testing.T
+	l        net.Listener
+	response string // if set, sent instead of the scan result
+
+	lastCmd  string
+	lastUser string
+}
+
+func newFakeSpamd(t *testing.T) *fakeSpamd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeSpamd{t: t, l: l}
+	go d.serve()
+	return d
+}
+
+func (d *fakeSpamd) serve() {
+	for {
+		conn, err := d.l.Accept()
+		if err != nil {
+			return
+		}
+		d.handle(conn)
+	}
+}
+
+func (d *fakeSpamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	reqLine, err := r.ReadString('\n')
+	if err != nil {
+		d.t.Log("fake spamd:", err)
+		return
+	}
+	d.lastCmd = strings.TrimSpace(reqLine)
+	d.lastUser = ""
+
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			d.t.Log("fake spamd:", err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		switch parts[0] {
+		case "Content-length":
+			length, _ = strconv.Atoi(parts[1])
+		case "User":
+			d.lastUser = parts[1]
+		}
+	}
+	if length < 0 {
+		io.WriteString(conn, "SPAMD/1.5 79 EX_PROTOCOL Bad header line\r\n")
+		return
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil || len(msg) != length {
+		io.WriteString(conn, "SPAMD/1.5 79 EX_PROTOCOL Content-length mismatch\r\n")
+		return
+	}
+
+	if d.response != "" {
+		io.WriteString(conn, d.response)
+		return
+	}
+
+	spam, score, symbols := "False", 1.5, "NO_RECEIVED"
+	if strings.Contains(string(msg), "GTUBE") {
+		spam, score, symbols = "True", 1000, "GTUBE,NO_RECEIVED"
+	}
+
+	fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nSpam: %s ; %.1f / 5.0\r\n", spam, score)
+	switch strings.Fields(d.lastCmd)[0] {
+	case "SYMBOLS":
+		fmt.Fprintf(conn, "Content-length: %d\r\n\r\n%s", len(symbols), symbols)
+	case "PROCESS":
+		out := fmt.Sprintf("X-Spam-Checker-Version: fake\r\nX-Spam-Level: ***\r\n%s", msg)
+		fmt.Fprintf(conn, "Content-length: %d\r\n\r\n%s", len(out), out)
+	default:
+		io.WriteString(conn, "\r\n")
+	}
+}
+
+func (d *fakeSpamd) Close() {
+	d.l.Close()
+}
+
+func testCheck(t *testing.T, addr string) *Check {
+	return &Check{
+		instName:     "test",
+		log:          testutils.Logger(t, modName),
+		endpoint:     "tcp://" + addr,
+		network:      "tcp",
+		address:      addr,
+		command:      "symbols",
+		timeout:      5 * time.Second,
+		addHdr:       true,
+		spamAction:   modconfig.FailAction{Quarantine: true},
+		rejectAction: modconfig.FailAction{Reject: true},
+	}
+}
+
+func checkBody(t *testing.T, c *Check, body string) module.CheckResult {
+	t.Helper()
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<sender@example.org>")
+	return st.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(body)})
+}
+
+func TestSpamAssassin(t *testing.T) {
+	d := newFakeSpamd(t)
+	defer d.Close()
+	c := testCheck(t, d.l.Addr().String())
+	c.user = "maddy"
+
+	res := checkBody(t, c, "Hello!\r\n")
+	if res.Reject || res.Quarantine {
+		t.Fatal("Ham message is rejected:", res.Reason)
+	}
+	if d.lastCmd != "SYMBOLS SPAMC/1.5" {
+		t.Errorf("Wrong request line: %q", d.lastCmd)
+	}
+	if d.lastUser != "maddy" {
+		t.Errorf("Wrong User header: %q", d.lastUser)
+	}
+	if val := res.Header.Get("X-Spam-Status"); val != "No, score=1.5 required=5.0 tests=NO_RECEIVED" {
+		t.Errorf("Wrong X-Spam-Status value: %q", val)
+	}
+	if val := res.Header.Get("X-Spam-Score"); val != "1.5" {
+		t.Errorf("Wrong X-Spam-Score value: %q", val)
+	}
+	if res.Header.Has("X-Spam-Flag") {
+		t.Error("X-Spam-Flag is set for ham message")
+	}
+
+	res = checkBody(t, c, "GTUBE\r\n")
+	if res.Reject || !res.Quarantine {
+		t.Fatal("Spam message is not quarantined:", res.Reject, res.Reason)
+	}
+	if val := res.Header.Get("X-Spam-Status"); val != "Yes, score=1000.0 required=5.0 tests=GTUBE,NO_RECEIVED" {
+		t.Errorf("Wrong X-Spam-Status value: %q", val)
+	}
+	if val := res.Header.Get("X-Spam-Flag"); val != "YES" {
+		t.Errorf("Wrong X-Spam-Flag value: %q", val)
+	}
+
+	c.addHdr = false
+	res = checkBody(t, c, "GTUBE\r\n")
+	if res.Header.Len() != 0 {
+		t.Error("Header is added with add_header no")
+	}
+}
+
+func TestSpamAssassin_Thresholds(t *testing.T) {
+	d := newFakeSpamd(t)
+	defer d.Close()
+	c := testCheck(t, d.l.Addr().String())
+
+	quarantine, reject := 1.0, 100.0
+	c.quarantineThreshold = &quarantine
+	c.rejectThreshold = &reject
+
+	res := checkBody(t, c, "Hello!\r\n")
+	if res.Reject || !res.Quarantine {
+		t.Fatal("Message over quarantine_threshold is not quarantined:", res.Reject, res.Reason)
+	}
+
+	res = checkBody(t, c, "GTUBE\r\n")
+	if !res.Reject {
+		t.Fatal("Message over reject_threshold is not rejected")
+	}
+	if exterrors.IsTemporary(res.Reason) {
+		t.Error("Rejection should be permanent")
+	}
+
+	quarantine = 2.0
+	res = checkBody(t, c, "Hello!\r\n")
+	if res.Reject || res.Quarantine {
+		t.Fatal("Message below quarantine_threshold is rejected:", res.Reason)
+	}
+}
+
+func TestSpamAssassin_Commands(t *testing.T) {
+	d := newFakeSpamd(t)
+	defer d.Close()
+	c := testCheck(t, d.l.Addr().String())
+
+	c.command = "check"
+	res := checkBody(t, c, "GTUBE\r\n")
+	if !res.Quarantine {
+		t.Fatal("Spam message is not quarantined")
+	}
+	if d.lastCmd != "CHECK SPAMC/1.5" {
+		t.Errorf("Wrong request line: %q", d.lastCmd)
+	}
+	if val := res.Header.Get("X-Spam-Status"); val != "Yes, score=1000.0 required=5.0" {
+		t.Errorf("Wrong X-Spam-Status value: %q", val)
+	}
+
+	c.command = "process"
+	res = checkBody(t, c, "GTUBE\r\n")
+	if !res.Quarantine {
+		t.Fatal("Spam message is not quarantined")
+	}
+	if val := res.Header.Get("X-Spam-Level"); val != "***" {
+		t.Errorf("Wrong X-Spam-Level value: %q", val)
+	}
+	if res.Header.Has("From") {
+		t.Error("Non-spam fields are copied from the processed message")
+	}
+}
+
+func TestSpamAssassin_Errors(t *testing.T) {
+	d := newFakeSpamd(t)
+	defer d.Close()
+	c := testCheck(t, d.l.Addr().String())
+
+	d.response = "SPAMD/1.5 76 EX_PROTOCOL Bad header line\r\n"
+	res := checkBody(t, c, "Hello!\r\n")
+	if res.Reject || res.Quarantine {
+		t.Fatal("Message is rejected with error_resp_action ignore")
+	}
+	c.errorRespAction = modconfig.FailAction{Reject: true}
+	res = checkBody(t, c, "Hello!\r\n")
+	if !res.Reject || !exterrors.IsTemporary(res.Reason) {
+		t.Fatal("Expected temporary rejection, got", res.Reject, res.Reason)
+	}
+
+	d.response = "garbage\r\n"
+	res = checkBody(t, c, "Hello!\r\n")
+	if !res.Reject {
+		t.Fatal("Malformed response is not handled using error_resp_action")
+	}
+
+	d.Close()
+	res = checkBody(t, c, "Hello!\r\n")
+	if res.Reject || res.Quarantine {
+		t.Fatal("Message is rejected with io_error_action ignore")
+	}
+	c.ioErrAction = modconfig.FailAction{Reject: true}
+	res = checkBody(t, c, "Hello!\r\n")
+	if !res.Reject || !exterrors.IsTemporary(res.Reason) {
+		t.Fatal("Expected temporary rejection, got", res.Reject, res.Reason)
+	}
+}
+
+func TestSpamAssassin_MaxSize(t *testing.T) {
+	d := newFakeSpamd(t)
+	defer d.Close()
+	c := testCheck(t, d.l.Addr().String())
+
+	c.maxSize = 16
+	res := checkBody(t, c, "GTUBE"+strings.Repeat("A", 32))
+	if res.Reject || res.Quarantine || res.Header.Len() != 0 {
+		t.Fatal("Message over max_size is checked")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dmarc
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/aggreport"
+)
+
+// DomainResults contains the evaluation results collected for a single
+// policy domain.
+type DomainResults struct {
+	Policy PolicyPublished
+
+	// Aggregate report URIs from the most recently seen policy record.
+	RUA []string
+
+	Records []ReportRecord
+}
+
+type domainState struct {
+	DomainResults
+
+	// Maps recordKey to the index in Records.
+	index map[string]int
+}
+
+// Results contains DMARC evaluation results collected by
+// aggreport.Collector.
+type Results struct {
+	Domains map[string]*domainState
+}
+
+// NewResults creates the empty result set, it is passed to
+// aggreport.NewCollector.
+func NewResults() aggreport.Results {
+	return &Results{Domains: make(map[string]*domainState)}
+}
+
+func recordKey(rec ReportRecord) string {
+	rec.Row.Count = 0
+	key, _ := json.Marshal(rec)
+	return string(key)
+}
+
+func (r *Results) domain(domain string) *domainState {
+	res, ok := r.Domains[domain]
+	if !ok {
+		res = &domainState{index: make(map[string]int)}
+		r.Domains[domain] = res
+	}
+	return res
+}
+
+func (ds *domainState) add(rec ReportRecord) {
+	key := recordKey(rec)
+	if i, ok := ds.index[key]; ok {
+		ds.Records[i].Row.Count += rec.Row.Count
+		return
+	}
+	ds.index[key] = len(ds.Records)
+	ds.Records = append(ds.Records, rec)
+}
+
+func (r *Results) Merge(saved aggreport.Results) {
+	for domain, saved := range saved.(*Results).Domains {
+		res := r.domain(domain)
+		if res.RUA == nil {
+			res.Policy = saved.Policy
+			res.RUA = saved.RUA
+		}
+		for _, rec := range saved.Records {
+			res.add(rec)
+		}
+	}
+}
+
+// Add records the evaluation result. Evaluations for domains that do not
+// request aggregate reports are ignored.
+func (r *Results) Add(ev Evaluation) {
+	rec := ev.Result.Record
+	if rec == nil || len(rec.ReportURIAggregate) == 0 {
+		return
+	}
+	domain := strings.ToLower(ev.Result.PolicyDomain)
+
+	res := r.domain(domain)
+	res.Policy = PublishedPolicy(domain, rec)
+	res.RUA = rec.ReportURIAggregate
+	res.add(ev.ReportRecord())
+}
+
+// ByDomain returns the collected results grouped by the policy domain.
+func (r *Results) ByDomain() map[string]DomainResults {
+	byDomain := make(map[string]DomainResults, len(r.Domains))
+	for domain, res := range r.Domains {
+		sort.Slice(res.Records, func(i, j int) bool {
+			return recordKey(res.Records[i]) < recordKey(res.Records[j])
+		})
+		byDomain[domain] = res.DomainResults
+	}
+	return byDomain
+}
@@ -107,6 +107,19 @@ type EvalResult struct {
 	// Whether there is a DKIM signature with the d= field matching the
 	// RFC5322.From domain.
 	DKIMAligned bool
+
+	// Domain of the trusted ARC sealer that caused the policy to be not
+	// applied despite the alignment failure. Set by Verifier.Apply.
+	ARCOverride string
+
+	// Whether the policy was not applied due to the pct tag value. Set by
+	// Verifier.Apply.
+	SampledOut bool
+
+	// The policy record and the domain it was found at. Set by
+	// Verifier.Apply, nil if there is no record.
+	PolicyDomain string
+	Record       *Record
 }
 
 // EvaluateAlignment checks whether identifiers authenticated by SPF and DKIM are in alignment
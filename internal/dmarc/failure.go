@@ -0,0 +1,334 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dmarc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// FailureReport contains the information about the message that failed
+// authentication checks, used to generate the failure report as described
+// in RFC 7489 Section 7.3.
+type FailureReport struct {
+	Evaluation
+
+	MailFrom string
+
+	// Authserv-id for the Authentication-Results field included in the
+	// report.
+	AuthservID string
+
+	// Header and body of the original message.
+	Header textproto.Header
+	Body   buffer.Buffer
+}
+
+// FailureReporter is implemented by objects that send failure reports.
+type FailureReporter interface {
+	SendFailureReport(report FailureReport)
+}
+
+// FailureReportRequested reports whether the policy record requests the
+// failure report for the evaluation result, see the fo tag description in
+// RFC 7489 Section 6.3.
+func FailureReportRequested(ev Evaluation) bool {
+	rec := ev.Result.Record
+	if rec == nil || len(rec.ReportURIFailure) == 0 {
+		return false
+	}
+
+	fo := rec.FailureOptions
+	if fo == 0 {
+		fo = dmarc.FailureAll
+	}
+
+	if fo&dmarc.FailureAll != 0 && !ev.Result.SPFAligned && !ev.Result.DKIMAligned {
+		return true
+	}
+	if fo&dmarc.FailureAny != 0 && (!ev.Result.SPFAligned || !ev.Result.DKIMAligned) {
+		return true
+	}
+	if fo&dmarc.FailureDKIM != 0 && dkimFailed(ev.AuthResults) {
+		return true
+	}
+	if fo&dmarc.FailureSPF != 0 && spfFailed(ev.AuthResults) {
+		return true
+	}
+	return false
+}
+
+func dkimFailed(results []authres.Result) bool {
+	for _, res := range results {
+		if res, ok := res.(*authres.DKIMResult); ok {
+			if res.Value == authres.ResultFail || res.Value == authres.ResultPermError {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func spfFailed(results []authres.Result) bool {
+	for _, res := range results {
+		if res, ok := res.(*authres.SPFResult); ok {
+			if res.Value == authres.ResultFail || res.Value == authres.ResultHardFail {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authFailure returns the Auth-Failure field value, see RFC 6591 Section 3.2
+// and RFC 7489 Section 7.3.1.
+func authFailure(ev Evaluation) string {
+	switch {
+	case ev.Result.Authres.Value == authres.ResultFail:
+		return "dmarc"
+	case dkimFailed(ev.AuthResults):
+		return "signature"
+	case spfFailed(ev.AuthResults):
+		return "spf"
+	}
+	return "dmarc"
+}
+
+func identityAlignment(res EvalResult) string {
+	var aligned []string
+	if res.DKIMAligned {
+		aligned = append(aligned, "dkim")
+	}
+	if res.SPFAligned {
+		aligned = append(aligned, "spf")
+	}
+	if len(aligned) == 0 {
+		return "none"
+	}
+	return strings.Join(aligned, ", ")
+}
+
+// FailureReportOptions controls how much of the original message is
+// included in the failure report.
+type FailureReportOptions struct {
+	// Include the message body, otherwise only the header is included.
+	IncludeBody bool
+
+	// Replace local parts of email addresses in the envelope and address
+	// fields of the message header, see RFC 6590.
+	RedactAddresses bool
+}
+
+var addressFields = map[string]bool{
+	"from":          true,
+	"sender":        true,
+	"reply-to":      true,
+	"to":            true,
+	"cc":            true,
+	"bcc":           true,
+	"return-path":   true,
+	"delivered-to":  true,
+	"resent-from":   true,
+	"resent-sender": true,
+	"resent-to":     true,
+	"resent-cc":     true,
+	"resent-bcc":    true,
+}
+
+var localPartRe = regexp.MustCompile(`[^\s<>()\[\],;:"@]+@`)
+
+func redactAddress(s string) string {
+	return localPartRe.ReplaceAllString(s, "redacted@")
+}
+
+func redactHeader(h textproto.Header) textproto.Header {
+	var fields [][]byte
+	for f := h.Fields(); f.Next(); {
+		if addressFields[strings.ToLower(f.Key())] {
+			redacted := textproto.Header{}
+			redacted.Add(f.Key(), redactAddress(f.Value()))
+			raw, err := redacted.Raw(f.Key())
+			if err != nil {
+				continue
+			}
+			fields = append(fields, raw)
+			continue
+		}
+		raw, err := f.Raw()
+		if err != nil {
+			continue
+		}
+		fields = append(fields, raw)
+	}
+
+	// AddRaw prepends the field, so add them in the reverse order.
+	res := textproto.Header{}
+	for i := len(fields) - 1; i >= 0; i-- {
+		res.AddRaw(fields[i])
+	}
+	return res
+}
+
+// GenerateFailureMessage creates the message containing the failure report
+// in the Abuse Reporting Format, as described in RFC 6591 and RFC 7489
+// Section 7.3. The multipart/report body is written to outWriter.
+func GenerateFailureMessage(envelope Envelope, report FailureReport, opts FailureReportOptions, outWriter io.Writer) (textproto.Header, error) {
+	partWriter := textproto.NewMultipartWriter(outWriter)
+
+	reportHeader := textproto.Header{}
+	reportHeader.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	reportHeader.Add("Message-Id", envelope.MsgID)
+	reportHeader.Add("Content-Type", "multipart/report; report-type=feedback-report; boundary="+partWriter.Boundary())
+	reportHeader.Add("MIME-Version", "1.0")
+	reportHeader.Add("Auto-Submitted", "auto-generated")
+	reportHeader.Add("To", envelope.To)
+	reportHeader.Add("From", envelope.From)
+	reportHeader.Add("Subject", fmt.Sprintf("DMARC failure report for %s from %s",
+		envelope.PolicyDomain, envelope.Submitter))
+
+	defer partWriter.Close()
+
+	if err := writeFailureHumanReadablePart(partWriter, envelope, report); err != nil {
+		return textproto.Header{}, err
+	}
+	if err := writeFeedbackReportPart(partWriter, report, opts); err != nil {
+		return textproto.Header{}, err
+	}
+	if err := writeOriginalMessagePart(partWriter, report, opts); err != nil {
+		return textproto.Header{}, err
+	}
+	return reportHeader, nil
+}
+
+func writeFailureHumanReadablePart(w *textproto.MultipartWriter, envelope Envelope, report FailureReport) error {
+	humanHeader := textproto.Header{}
+	humanHeader.Add("Content-Transfer-Encoding", "8bit")
+	humanHeader.Add("Content-Type", `text/plain; charset="utf-8"`)
+	humanWriter, err := w.CreatePart(humanHeader)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(humanWriter, "This is the authentication failure report for the message\n"+
+		"received by %s from %s that claims to be from %s.\n\n"+
+		"Result: %s\n",
+		envelope.Submitter, report.SourceIP, report.Result.Authres.From, report.Result.Authres.Reason)
+	return err
+}
+
+func writeFeedbackReportPart(w *textproto.MultipartWriter, report FailureReport, opts FailureReportOptions) error {
+	partHeader := textproto.Header{}
+	partHeader.Add("Content-Type", "message/feedback-report")
+	partWriter, err := w.CreatePart(partHeader)
+	if err != nil {
+		return err
+	}
+
+	mailFrom := report.MailFrom
+	if opts.RedactAddresses {
+		mailFrom = redactAddress(mailFrom)
+	}
+
+	// Fields are listed in the order they are written, Header.Add would
+	// reverse it.
+	fields := [][2]string{
+		{"Feedback-Type", "auth-failure"},
+		{"User-Agent", "maddy"},
+		{"Version", "1"},
+		{"Original-Mail-From", "<" + mailFrom + ">"},
+		{"Arrival-Date", report.Time.Format("Mon, 2 Jan 2006 15:04:05 -0700")},
+	}
+	if report.SourceIP != nil {
+		fields = append(fields, [2]string{"Source-IP", report.SourceIP.String()})
+	}
+	fields = append(fields,
+		[2]string{"Reported-Domain", report.Result.Authres.From},
+		[2]string{"Authentication-Results", authres.Format(report.AuthservID, report.AuthResults)},
+		[2]string{"Auth-Failure", authFailure(report.Evaluation)},
+		[2]string{"Identity-Alignment", identityAlignment(report.Result)},
+		[2]string{"Delivery-Result", deliveryResult(report.Policy)},
+	)
+
+	bw := bufio.NewWriter(partWriter)
+	for _, f := range fields {
+		fieldHdr := textproto.Header{}
+		fieldHdr.Add(f[0], f[1])
+		raw, err := fieldHdr.Raw(f[0])
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(raw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func deliveryResult(policy Policy) string {
+	switch policy {
+	case PolicyReject:
+		return "reject"
+	case PolicyQuarantine:
+		return "spam"
+	default:
+		return "delivered"
+	}
+}
+
+func writeOriginalMessagePart(w *textproto.MultipartWriter, report FailureReport, opts FailureReportOptions) error {
+	hdr := report.Header
+	if opts.RedactAddresses {
+		hdr = redactHeader(hdr)
+	}
+
+	partHeader := textproto.Header{}
+	if opts.IncludeBody {
+		partHeader.Add("Content-Type", "message/rfc822")
+	} else {
+		partHeader.Add("Content-Type", "text/rfc822-headers")
+	}
+	partWriter, err := w.CreatePart(partHeader)
+	if err != nil {
+		return err
+	}
+
+	if err := textproto.WriteHeader(partWriter, hdr); err != nil {
+		return err
+	}
+	if !opts.IncludeBody || report.Body == nil {
+		return nil
+	}
+
+	body, err := report.Body.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(partWriter, body)
+	return err
+}
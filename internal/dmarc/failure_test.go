@@ -0,0 +1,229 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dmarc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+func TestFailureReportRequested(t *testing.T) {
+	test := func(fo FailureOptions, spfAligned, dkimAligned bool, authRes []authres.Result, want bool) {
+		t.Helper()
+		ev := Evaluation{
+			Result: EvalResult{
+				SPFAligned:  spfAligned,
+				DKIMAligned: dkimAligned,
+				Record: &Record{
+					FailureOptions:   fo,
+					ReportURIFailure: []string{"mailto:ruf@example.org"},
+				},
+			},
+			AuthResults: authRes,
+		}
+		if got := FailureReportRequested(ev); got != want {
+			t.Errorf("fo=%v, spf=%v, dkim=%v: expected %v, got %v", fo, spfAligned, dkimAligned, want, got)
+		}
+	}
+	dkimFail := []authres.Result{&authres.DKIMResult{Value: authres.ResultFail, Domain: "example.com"}}
+	spfFail := []authres.Result{&authres.SPFResult{Value: authres.ResultFail, From: "example.com"}}
+
+	test(0, false, false, nil, true)
+	test(0, true, false, nil, false)
+	test(dmarc.FailureAll, false, false, nil, true)
+	test(dmarc.FailureAny, true, false, nil, true)
+	test(dmarc.FailureAny, true, true, nil, false)
+	test(dmarc.FailureDKIM, true, true, dkimFail, true)
+	test(dmarc.FailureDKIM, true, true, spfFail, false)
+	test(dmarc.FailureSPF, true, true, spfFail, true)
+	test(dmarc.FailureSPF, true, false, dkimFail, false)
+
+	// No ruf => no reports.
+	ev := Evaluation{Result: EvalResult{Record: &Record{}}}
+	if FailureReportRequested(ev) {
+		t.Error("report requested without ruf")
+	}
+}
+
+func failureReport(t *testing.T) FailureReport {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(
+		"From: Sender <sender@example.org>\r\n" +
+			"To: rcpt@example.com, other@example.com\r\n" +
+			"Subject: Hello\r\n" +
+			"\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FailureReport{
+		Evaluation: Evaluation{
+			Time:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			SourceIP: net.IPv4(192, 0, 2, 1),
+			Result: EvalResult{
+				Authres:      authres.DMARCResult{Value: authres.ResultFail, Reason: "No aligned identifiers", From: "example.org"},
+				PolicyDomain: "example.org",
+				Record:       &Record{ReportURIFailure: []string{"mailto:ruf@example.org"}},
+			},
+			Policy: PolicyReject,
+			AuthResults: []authres.Result{
+				&authres.SPFResult{Value: authres.ResultFail, From: "example.org"},
+			},
+		},
+		MailFrom:   "bounce@example.org",
+		AuthservID: "mx.example.com",
+		Header:     hdr,
+		Body:       buffer.MemoryBuffer{Slice: []byte("Secret text\r\n")},
+	}
+}
+
+func readFailureMessage(t *testing.T, opts FailureReportOptions) (textproto.Header, []textproto.Header, []string) {
+	envelope := Envelope{
+		MsgID:        "<report1@mx.example.com>",
+		From:         "dmarc@mx.example.com",
+		To:           "ruf@example.org",
+		Submitter:    "mx.example.com",
+		PolicyDomain: "example.org",
+	}
+
+	var body bytes.Buffer
+	hdr, err := GenerateFailureMessage(envelope, failureReport(t), opts, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct := hdr.Get("Content-Type")
+	boundary := ct[strings.Index(ct, "boundary=")+len("boundary="):]
+	mr := textproto.NewMultipartReader(&body, boundary)
+
+	var (
+		headers []textproto.Header
+		parts   []string
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, part.Header)
+		parts = append(parts, string(b))
+	}
+	if len(parts) != 3 {
+		t.Fatalf("wrong amount of parts: %d", len(parts))
+	}
+	return hdr, headers, parts
+}
+
+func TestGenerateFailureMessage(t *testing.T) {
+	hdr, headers, parts := readFailureMessage(t, FailureReportOptions{IncludeBody: true})
+
+	if !strings.HasPrefix(hdr.Get("Content-Type"), "multipart/report; report-type=feedback-report;") {
+		t.Errorf("wrong content type: %v", hdr.Get("Content-Type"))
+	}
+	if headers[1].Get("Content-Type") != "message/feedback-report" {
+		t.Errorf("wrong report part type: %v", headers[1].Get("Content-Type"))
+	}
+
+	report, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(parts[1] + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{
+		"Feedback-Type":          "auth-failure",
+		"Version":                "1",
+		"Original-Mail-From":     "<bounce@example.org>",
+		"Source-IP":              "192.0.2.1",
+		"Reported-Domain":        "example.org",
+		"Authentication-Results": "mx.example.com; spf=fail smtp.mailfrom=example.org",
+		"Auth-Failure":           "dmarc",
+		"Identity-Alignment":     "none",
+		"Delivery-Result":        "reject",
+	} {
+		if got := report.Get(field); got != want {
+			t.Errorf("wrong %s: want %q, got %q", field, want, got)
+		}
+	}
+
+	if headers[2].Get("Content-Type") != "message/rfc822" {
+		t.Errorf("wrong original message part type: %v", headers[2].Get("Content-Type"))
+	}
+	if !strings.Contains(parts[2], "To: rcpt@example.com, other@example.com\r\n") || !strings.HasSuffix(parts[2], "\r\n\r\nSecret text\r\n") {
+		t.Errorf("wrong original message:\n%s", parts[2])
+	}
+}
+
+func TestGenerateFailureMessage_Redacted(t *testing.T) {
+	_, headers, parts := readFailureMessage(t, FailureReportOptions{RedactAddresses: true})
+
+	report, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(parts[1] + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report.Get("Original-Mail-From"); got != "<redacted@example.org>" {
+		t.Errorf("wrong Original-Mail-From: %v", got)
+	}
+
+	if headers[2].Get("Content-Type") != "text/rfc822-headers" {
+		t.Errorf("wrong original message part type: %v", headers[2].Get("Content-Type"))
+	}
+	want := "From: Sender <redacted@example.org>\r\n" +
+		"To: redacted@example.com, redacted@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n"
+	if parts[2] != want {
+		t.Errorf("wrong original message:\n%s", parts[2])
+	}
+}
+
+func TestVerifier_ReportFailure(t *testing.T) {
+	v := NewVerifier(nil)
+
+	// No callback, should not panic.
+	v.ReportFailure(failureReport(t))
+
+	var reports []FailureReport
+	v.FailureReportFunc = func(r FailureReport) {
+		reports = append(reports, r)
+	}
+	v.ReportFailure(failureReport(t))
+
+	passed := failureReport(t)
+	passed.Result.SPFAligned = true
+	v.ReportFailure(passed)
+
+	if len(reports) != 1 {
+		t.Errorf("wrong amount of reports: %d", len(reports))
+	}
+}
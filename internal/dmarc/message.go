@@ -0,0 +1,59 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dmarc
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/aggreport"
+)
+
+type Envelope = aggreport.Envelope
+
+func attachment(report Feedback) (aggreport.Report, error) {
+	var data bytes.Buffer
+	data.WriteString(xml.Header)
+	if err := xml.NewEncoder(&data).Encode(report); err != nil {
+		return aggreport.Report{}, err
+	}
+	return aggreport.Report{
+		Kind:           "DMARC",
+		ID:             report.ReportMetadata.ReportID,
+		Begin:          time.Unix(report.ReportMetadata.DateRange.Begin, 0),
+		End:            time.Unix(report.ReportMetadata.DateRange.End, 0),
+		ContentType:    "multipart/mixed",
+		AttachmentType: "application/gzip",
+		Extension:      "xml",
+		Data:           data.Bytes(),
+	}, nil
+}
+
+// GenerateMessage is aggreport.GenerateMessage for the aggregate report (RFC
+// 7489 Section 7.2.1.1).
+func GenerateMessage(envelope Envelope, report Feedback, outWriter io.Writer) (textproto.Header, error) {
+	att, err := attachment(report)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	return aggreport.GenerateMessage(envelope, att, outWriter)
+}
@@ -0,0 +1,273 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dmarc
+
+import (
+	"encoding/xml"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+)
+
+// Feedback is the aggregate report, as defined in RFC 7489 Appendix C.
+type Feedback struct {
+	XMLName         xml.Name        `xml:"feedback"`
+	Version         string          `xml:"version"`
+	ReportMetadata  ReportMetadata  `xml:"report_metadata"`
+	PolicyPublished PolicyPublished `xml:"policy_published"`
+	Records         []ReportRecord  `xml:"record"`
+}
+
+type ReportMetadata struct {
+	OrgName          string    `xml:"org_name"`
+	Email            string    `xml:"email"`
+	ExtraContactInfo string    `xml:"extra_contact_info,omitempty"`
+	ReportID         string    `xml:"report_id"`
+	DateRange        DateRange `xml:"date_range"`
+}
+
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+// PolicyPublished is the DMARC policy record that was used during the
+// evaluation.
+type PolicyPublished struct {
+	Domain string        `xml:"domain"`
+	ADKIM  AlignmentMode `xml:"adkim"`
+	ASPF   AlignmentMode `xml:"aspf"`
+	P      Policy        `xml:"p"`
+	SP     Policy        `xml:"sp"`
+	Pct    int           `xml:"pct"`
+	Fo     string        `xml:"fo"`
+}
+
+type ReportRecord struct {
+	Row         Row         `xml:"row"`
+	Identifiers Identifiers `xml:"identifiers"`
+	AuthResults AuthResults `xml:"auth_results"`
+}
+
+type Row struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type PolicyEvaluated struct {
+	Disposition Policy                 `xml:"disposition"`
+	DKIM        string                 `xml:"dkim"`
+	SPF         string                 `xml:"spf"`
+	Reasons     []PolicyOverrideReason `xml:"reason,omitempty"`
+}
+
+// PolicyOverrideReason explains why the applied policy differs from the
+// published one, see RFC 7489 Section 7.2.1.1.
+type PolicyOverrideReason struct {
+	Type    string `xml:"type"`
+	Comment string `xml:"comment,omitempty"`
+}
+
+const (
+	OverrideTrustedForwarder = "trusted_forwarder"
+	OverrideSampledOut       = "sampled_out"
+)
+
+type Identifiers struct {
+	EnvelopeTo   string `xml:"envelope_to,omitempty"`
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+type AuthResults struct {
+	DKIM []DKIMAuthResult `xml:"dkim,omitempty"`
+	SPF  []SPFAuthResult  `xml:"spf"`
+}
+
+type DKIMAuthResult struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+type SPFAuthResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope,omitempty"`
+	Result string `xml:"result"`
+}
+
+// Evaluation contains the information about a single DMARC check that is
+// included in aggregate reports.
+type Evaluation struct {
+	Time     time.Time
+	SourceIP net.IP
+
+	// Result and the Policy returned by Verifier.Apply.
+	Result EvalResult
+	Policy Policy
+
+	// Authentication results used for the DMARC check.
+	AuthResults []authres.Result
+}
+
+// Reporter is implemented by objects that collect DMARC evaluation results
+// for the report generation.
+type Reporter interface {
+	RecordEvaluation(ev Evaluation)
+}
+
+// PublishedPolicy returns the policy_published element for the record with
+// defaults applied.
+func PublishedPolicy(policyDomain string, rec *Record) PolicyPublished {
+	pp := PolicyPublished{
+		Domain: policyDomain,
+		ADKIM:  rec.DKIMAlignment,
+		ASPF:   rec.SPFAlignment,
+		P:      rec.Policy,
+		SP:     rec.SubdomainPolicy,
+		Pct:    100,
+		Fo:     formatFailureOptions(rec.FailureOptions),
+	}
+	if pp.ADKIM == "" {
+		pp.ADKIM = dmarc.AlignmentRelaxed
+	}
+	if pp.ASPF == "" {
+		pp.ASPF = dmarc.AlignmentRelaxed
+	}
+	if pp.SP == "" {
+		pp.SP = pp.P
+	}
+	if rec.Percent != nil {
+		pp.Pct = *rec.Percent
+	}
+	return pp
+}
+
+func formatFailureOptions(fo FailureOptions) string {
+	var opts []string
+	if fo&dmarc.FailureAll != 0 || fo == 0 {
+		opts = append(opts, "0")
+	}
+	if fo&dmarc.FailureAny != 0 {
+		opts = append(opts, "1")
+	}
+	if fo&dmarc.FailureDKIM != 0 {
+		opts = append(opts, "d")
+	}
+	if fo&dmarc.FailureSPF != 0 {
+		opts = append(opts, "s")
+	}
+	return strings.Join(opts, ":")
+}
+
+func alignmentResult(aligned bool) string {
+	if aligned {
+		return "pass"
+	}
+	return "fail"
+}
+
+// reportResult converts the authentication result value into the one
+// permitted by the report schema.
+func reportResult(val authres.ResultValue, spf bool) string {
+	switch val {
+	case authres.ResultNone, authres.ResultPass, authres.ResultFail, authres.ResultNeutral,
+		authres.ResultTempError, authres.ResultPermError:
+		return string(val)
+	case authres.ResultSoftFail:
+		if spf {
+			return "softfail"
+		}
+		return "fail"
+	case authres.ResultPolicy:
+		if spf {
+			return "fail"
+		}
+		return "policy"
+	case authres.ResultHardFail:
+		return "fail"
+	default:
+		return "temperror"
+	}
+}
+
+// ReportRecord converts the evaluation into the report record with the
+// count of 1.
+func (ev Evaluation) ReportRecord() ReportRecord {
+	rec := ReportRecord{
+		Row: Row{
+			Count: 1,
+			PolicyEvaluated: PolicyEvaluated{
+				Disposition: ev.Policy,
+				DKIM:        alignmentResult(ev.Result.DKIMAligned),
+				SPF:         alignmentResult(ev.Result.SPFAligned),
+			},
+		},
+		Identifiers: Identifiers{
+			HeaderFrom: ev.Result.Authres.From,
+		},
+	}
+	if ev.SourceIP != nil {
+		rec.Row.SourceIP = ev.SourceIP.String()
+	}
+	if ev.Result.ARCOverride != "" {
+		rec.Row.PolicyEvaluated.Reasons = append(rec.Row.PolicyEvaluated.Reasons, PolicyOverrideReason{
+			Type:    OverrideTrustedForwarder,
+			Comment: "arc=pass as sealed by " + ev.Result.ARCOverride,
+		})
+	}
+	if ev.Result.SampledOut {
+		rec.Row.PolicyEvaluated.Reasons = append(rec.Row.PolicyEvaluated.Reasons, PolicyOverrideReason{
+			Type: OverrideSampledOut,
+		})
+	}
+
+	for _, res := range ev.AuthResults {
+		switch res := res.(type) {
+		case *authres.DKIMResult:
+			rec.AuthResults.DKIM = append(rec.AuthResults.DKIM, DKIMAuthResult{
+				Domain: res.Domain,
+				Result: reportResult(res.Value, false),
+			})
+		case *authres.SPFResult:
+			spfRes := SPFAuthResult{
+				Domain: res.From,
+				Scope:  "mfrom",
+				Result: reportResult(res.Value, true),
+			}
+			if spfRes.Domain == "" {
+				spfRes.Domain = res.Helo
+				spfRes.Scope = "helo"
+			}
+			if idx := strings.LastIndexByte(spfRes.Domain, '@'); idx != -1 {
+				spfRes.Domain = spfRes.Domain[idx+1:]
+			}
+			rec.AuthResults.SPF = append(rec.AuthResults.SPF, spfRes)
+		}
+	}
+	if len(rec.AuthResults.SPF) == 0 {
+		// The element is mandatory.
+		rec.AuthResults.SPF = []SPFAuthResult{{Result: "none"}}
+	}
+	return rec
+}
@@ -0,0 +1,284 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dmarc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/aggreport"
+)
+
+func TestParseReportURI(t *testing.T) {
+	for _, c := range []struct {
+		uri  string
+		res  ReportURI
+		fail bool
+	}{
+		{uri: "mailto:dmarc@example.org", res: ReportURI{Address: "dmarc@example.org"}},
+		{uri: "mailto:dmarc@example.org!10m", res: ReportURI{Address: "dmarc@example.org", MaxSize: 10 << 20}},
+		{uri: "mailto:dmarc@example.org!500", res: ReportURI{Address: "dmarc@example.org", MaxSize: 500}},
+		{uri: "mailto:dmarc%2Breports@example.org?subject=hi", res: ReportURI{Address: "dmarc+reports@example.org"}},
+		{uri: "mailto:dmarc@example.org!m", fail: true},
+		{uri: "mailto:dmarc", fail: true},
+		{uri: "https://example.org/dmarc", fail: true},
+	} {
+		res, err := ParseReportURI(c.uri)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s: expected failure, got %+v", c.uri, res)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.uri, err)
+			continue
+		}
+		if res != c.res {
+			t.Errorf("%s: wrong result: %+v", c.uri, res)
+		}
+	}
+}
+
+func TestVerifyExternalDestination(t *testing.T) {
+	r := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"example.org._report._dmarc.reports.example.net.": {
+			TXT: []string{"v=DMARC1"},
+		},
+		"example.org._report._dmarc.example.com.": {
+			TXT: []string{"v=spf1 -all"},
+		},
+	}}
+
+	for _, c := range []struct {
+		policyDomain, destDomain string
+		ok                       bool
+	}{
+		{"example.org", "example.org", true},
+		{"sub.example.org", "reports.example.org", true},
+		{"example.org", "reports.example.net", true},
+		{"example.org", "example.com", false},
+		{"example.org", "example.invalid", false},
+	} {
+		ok, err := VerifyExternalDestination(context.Background(), r, c.policyDomain, c.destDomain)
+		if err != nil {
+			t.Errorf("%s -> %s: unexpected error: %v", c.policyDomain, c.destDomain, err)
+			continue
+		}
+		if ok != c.ok {
+			t.Errorf("%s -> %s: expected %v, got %v", c.policyDomain, c.destDomain, c.ok, ok)
+		}
+	}
+}
+
+func testEvaluation(ip string, dkimAligned bool) Evaluation {
+	pct := 50
+	res := EvalResult{
+		Authres:      authres.DMARCResult{Value: authres.ResultPass, From: "example.org"},
+		DKIMAligned:  dkimAligned,
+		PolicyDomain: "example.org",
+		Record: &Record{
+			Policy:             PolicyReject,
+			Percent:            &pct,
+			ReportURIAggregate: []string{"mailto:dmarc@example.org"},
+		},
+	}
+	return Evaluation{
+		Time:     time.Now(),
+		SourceIP: net.ParseIP(ip),
+		Result:   res,
+		Policy:   PolicyNone,
+		AuthResults: []authres.Result{
+			&authres.SPFResult{Value: authres.ResultPass, From: "example.org", Helo: "mx.example.org"},
+			&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.org"},
+		},
+	}
+}
+
+func TestEvaluation_ReportRecord(t *testing.T) {
+	ev := testEvaluation("192.0.2.1", true)
+	ev.Result.SampledOut = true
+	ev.Result.ARCOverride = "forwarder.example"
+	ev.AuthResults = append(ev.AuthResults, &authres.SPFResult{Value: authres.ResultHardFail, Helo: "mx.example.org"})
+
+	want := ReportRecord{
+		Row: Row{
+			SourceIP: "192.0.2.1",
+			Count:    1,
+			PolicyEvaluated: PolicyEvaluated{
+				Disposition: PolicyNone,
+				DKIM:        "pass",
+				SPF:         "fail",
+				Reasons: []PolicyOverrideReason{
+					{Type: OverrideTrustedForwarder, Comment: "arc=pass as sealed by forwarder.example"},
+					{Type: OverrideSampledOut},
+				},
+			},
+		},
+		Identifiers: Identifiers{HeaderFrom: "example.org"},
+		AuthResults: AuthResults{
+			DKIM: []DKIMAuthResult{{Domain: "example.org", Result: "pass"}},
+			SPF: []SPFAuthResult{
+				{Domain: "example.org", Scope: "mfrom", Result: "pass"},
+				{Domain: "mx.example.org", Scope: "helo", Result: "fail"},
+			},
+		},
+	}
+	if rec := ev.ReportRecord(); !reflect.DeepEqual(rec, want) {
+		t.Errorf("wrong record:\n%+v\n%+v", rec, want)
+	}
+
+	pp := PublishedPolicy("example.org", ev.Result.Record)
+	wantPP := PolicyPublished{Domain: "example.org", ADKIM: "r", ASPF: "r", P: PolicyReject, SP: PolicyReject, Pct: 50, Fo: "0"}
+	if pp != wantPP {
+		t.Errorf("wrong published policy: %+v", pp)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := aggreport.NewCollector(start, NewResults)
+	add := func(c *aggreport.Collector, ev Evaluation) {
+		c.Update(func(r aggreport.Results) {
+			r.(*Results).Add(ev)
+		})
+	}
+	add(c, testEvaluation("192.0.2.1", true))
+	add(c, testEvaluation("192.0.2.1", true))
+	add(c, testEvaluation("192.0.2.2", false))
+
+	noRUA := testEvaluation("192.0.2.1", true)
+	noRUA.Result.PolicyDomain = "example.com"
+	noRUA.Result.Record = &Record{Policy: PolicyNone}
+	add(c, noRUA)
+
+	noRecord := testEvaluation("192.0.2.1", true)
+	noRecord.Result.Record = nil
+	add(c, noRecord)
+
+	var saved bytes.Buffer
+	if err := c.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	restored := aggreport.NewCollector(start.Add(time.Hour), NewResults)
+	if err := restored.Load(&saved); err != nil {
+		t.Fatal(err)
+	}
+	add(restored, testEvaluation("192.0.2.2", false))
+
+	end := start.Add(24 * time.Hour)
+	begin, collected := restored.Flush(end)
+	if !begin.Equal(start) {
+		t.Errorf("wrong period start: %v", begin)
+	}
+	results := collected.(*Results).ByDomain()
+	if len(results) != 1 {
+		t.Fatalf("wrong amount of domains: %v", len(results))
+	}
+	res := results["example.org"]
+	if !reflect.DeepEqual(res.RUA, []string{"mailto:dmarc@example.org"}) {
+		t.Errorf("wrong rua: %v", res.RUA)
+	}
+	if len(res.Records) != 2 {
+		t.Fatalf("wrong amount of records: %v", len(res.Records))
+	}
+	counts := map[string]int{}
+	for _, rec := range res.Records {
+		counts[rec.Row.SourceIP] = rec.Row.Count
+	}
+	if counts["192.0.2.1"] != 2 || counts["192.0.2.2"] != 2 {
+		t.Errorf("wrong counts: %v", counts)
+	}
+
+	if _, collected := restored.Flush(end.Add(time.Hour)); len(collected.(*Results).Domains) != 0 {
+		t.Errorf("results are not reset after flush: %v", collected)
+	}
+}
+
+func TestGenerateMessage(t *testing.T) {
+	report := Feedback{
+		Version: "1.0",
+		ReportMetadata: ReportMetadata{
+			OrgName:  "Example",
+			Email:    "dmarc@mx.example.com",
+			ReportID: "report1@mx.example.com",
+			DateRange: DateRange{
+				Begin: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Unix(),
+				End:   time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC).Unix(),
+			},
+		},
+		PolicyPublished: PolicyPublished{Domain: "example.org", ADKIM: "r", ASPF: "r", P: PolicyNone, SP: PolicyNone, Pct: 100, Fo: "0"},
+		Records:         []ReportRecord{testEvaluation("192.0.2.1", true).ReportRecord()},
+	}
+	envelope := Envelope{
+		MsgID:        "<report1@mx.example.com>",
+		From:         "dmarc@mx.example.com",
+		To:           "dmarc@example.org",
+		Submitter:    "mx.example.com",
+		PolicyDomain: "example.org",
+	}
+
+	var body bytes.Buffer
+	hdr, err := GenerateMessage(envelope, report, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "Report Domain: example.org Submitter: mx.example.com Report-ID: <report1@mx.example.com>"; hdr.Get("Subject") != want {
+		t.Errorf("wrong subject: %v", hdr.Get("Subject"))
+	}
+
+	ct := hdr.Get("Content-Type")
+	boundary := ct[strings.Index(ct, "boundary=")+len("boundary="):]
+	mr := textproto.NewMultipartReader(&body, boundary)
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "attachment; filename=\"mx.example.com!example.org!1577836800!1577923200.xml.gz\""; part.Header.Get("Content-Disposition") != want {
+		t.Errorf("wrong attachment disposition: %v", part.Header.Get("Content-Disposition"))
+	}
+
+	gzr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, part))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Feedback
+	if err := xml.NewDecoder(gzr).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	decoded.XMLName = xml.Name{}
+	if !reflect.DeepEqual(decoded, report) {
+		t.Errorf("report mismatch:\n%+v\n%+v", decoded, report)
+	}
+}
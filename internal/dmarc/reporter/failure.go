@@ -0,0 +1,185 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package reporter
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/aggreport"
+	"github.com/foxcpp/maddy/internal/dmarc"
+)
+
+// failureLimiter limits the amount of failure reports sent to each
+// destination address within the period.
+type failureLimiter struct {
+	count  int
+	period time.Duration
+
+	lock    sync.Mutex
+	windows map[string]*limiterWindow
+}
+
+type limiterWindow struct {
+	start time.Time
+	sent  int
+}
+
+// Upper bound on the amount of tracked destinations before expired entries
+// are removed.
+const maxLimiterWindows = 1000
+
+func rateLimitDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 2 {
+		return nil, config.NodeErr(node, "expected two arguments: count and period")
+	}
+	count, err := strconv.Atoi(node.Args[0])
+	if err != nil || count < 0 {
+		return nil, config.NodeErr(node, "invalid count: %v", node.Args[0])
+	}
+	period, err := time.ParseDuration(node.Args[1])
+	if err != nil || period <= 0 {
+		return nil, config.NodeErr(node, "invalid period: %v", node.Args[1])
+	}
+	return &failureLimiter{count: count, period: period}, nil
+}
+
+func (l *failureLimiter) take(dest string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.windows == nil {
+		l.windows = make(map[string]*limiterWindow)
+	}
+
+	w, ok := l.windows[dest]
+	if !ok || now.Sub(w.start) >= l.period {
+		if !ok && len(l.windows) >= maxLimiterWindows {
+			for key, w := range l.windows {
+				if now.Sub(w.start) >= l.period {
+					delete(l.windows, key)
+				}
+			}
+		}
+		w = &limiterWindow{start: now}
+		l.windows[dest] = w
+	}
+	if w.sent >= l.count {
+		return false
+	}
+	w.sent++
+	return true
+}
+
+// exhausted checks whether take would fail for the destination without
+// using up the budget.
+func (l *failureLimiter) exhausted(dest string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	w, ok := l.windows[dest]
+	return ok && now.Sub(w.start) < l.period && w.sent >= l.count
+}
+
+// SendFailureReport implements dmarc.FailureReporter.
+//
+// The report is generated immediately since report.Body is not valid after
+// the return, the delivery happens in background.
+func (r *Reporter) SendFailureReport(report dmarc.FailureReport) {
+	if !r.failureReports {
+		return
+	}
+
+	domain := report.Result.PolicyDomain
+	for _, ruf := range report.Result.Record.ReportURIFailure {
+		uri, err := dmarc.ParseReportURI(ruf)
+		if err != nil {
+			r.log.Error("malformed failure report URI", err, "domain", domain, "uri", ruf)
+			continue
+		}
+		if r.failureLimit.exhausted(uri.Address, time.Now()) {
+			r.log.Msg("failure report rate limit exceeded, skipping", "domain", domain, "uri", ruf)
+			continue
+		}
+
+		msgID, err := module.GenerateMsgID()
+		if err != nil {
+			r.log.Error("failed to generate failure report", err, "domain", domain)
+			return
+		}
+
+		var body bytes.Buffer
+		header, err := dmarc.GenerateFailureMessage(dmarc.Envelope{
+			MsgID:        "<" + msgID + "@" + r.hostname + ">",
+			From:         r.from,
+			To:           uri.Address,
+			Submitter:    r.hostname,
+			PolicyDomain: domain,
+		}, report, r.failureOpts, &body)
+		if err != nil {
+			r.log.Error("failed to generate failure report", err, "domain", domain)
+			continue
+		}
+		if uri.MaxSize != 0 && int64(body.Len()) > uri.MaxSize {
+			r.log.Msg("failure report exceeds the size limit, skipping", "domain", domain, "uri", ruf)
+			continue
+		}
+
+		r.failureWg.Add(1)
+		go func(ruf, rcpt string) {
+			defer r.failureWg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+
+			if err := r.verifyDestination(ctx, domain, rcpt); err != nil {
+				r.log.Error("failed to send DMARC failure report", err, "domain", domain, "uri", ruf)
+				return
+			}
+			// Reports to destinations that did not authorize them should not
+			// use up the budget.
+			if !r.failureLimit.take(rcpt, time.Now()) {
+				r.log.Msg("failure report rate limit exceeded, skipping", "domain", domain, "uri", ruf)
+				return
+			}
+
+			if err := r.deliverFailureReport(ctx, msgID, rcpt, domain, header, body.Bytes()); err != nil {
+				r.log.Error("failed to send DMARC failure report", err, "domain", domain, "uri", ruf)
+				return
+			}
+			r.log.Msg("sent DMARC failure report", "domain", domain, "uri", ruf, "msg_id", msgID)
+		}(ruf, uri.Address)
+	}
+}
+
+func (r *Reporter) deliverFailureReport(ctx context.Context, msgID, rcpt, domain string, header textproto.Header, body []byte) error {
+	return r.sender.Deliver(ctx, aggreport.Message{
+		ID:     msgID,
+		Rcpt:   rcpt,
+		Domain: domain,
+		Header: header,
+		Body:   body,
+	})
+}
@@ -0,0 +1,255 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package reporter implements the module that collects DMARC evaluation
+// results and sends aggregate reports (RFC 7489 Section 7.2) to domains that
+// request them.
+package reporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/aggreport"
+	"github.com/foxcpp/maddy/internal/dmarc"
+)
+
+const modName = "dmarc_reporter"
+
+type Reporter struct {
+	instName string
+	log      log.Logger
+	resolver dmarc.Resolver
+
+	hostname    string
+	orgName     string
+	contactInfo string
+	from        string
+	deliverTo   module.DeliveryTarget
+	stateFile   string
+
+	failureReports bool
+	failureOpts    dmarc.FailureReportOptions
+	failureLimit   *failureLimiter
+	failureWg      sync.WaitGroup
+
+	collector *aggreport.Collector
+	sender    *aggreport.Sender
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Reporter{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (r *Reporter) Name() string {
+	return modName
+}
+
+func (r *Reporter) InstanceName() string {
+	return r.instName
+}
+
+func (r *Reporter) Init(cfg *config.Map) error {
+	var failureInclude string
+
+	cfg.Bool("debug", true, false, &r.log.Debug)
+	cfg.String("hostname", true, true, "", &r.hostname)
+	cfg.String("organization", false, false, "", &r.orgName)
+	cfg.String("contact_info", false, false, "", &r.contactInfo)
+	cfg.String("from", false, true, "", &r.from)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &r.deliverTo)
+	cfg.String("state_file", false, false, "", &r.stateFile)
+	cfg.Bool("failure_reports", false, false, &r.failureReports)
+	cfg.Enum("failure_include", false, false, []string{"headers", "full"}, "headers", &failureInclude)
+	cfg.Bool("failure_redact", false, true, &r.failureOpts.RedactAddresses)
+	cfg.Custom("failure_rate_limit", false, false, func() (interface{}, error) {
+		return &failureLimiter{count: 5, period: time.Hour}, nil
+	}, rateLimitDirective, &r.failureLimit)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	r.failureOpts.IncludeBody = failureInclude == "full"
+
+	if _, _, err := address.Split(r.from); err != nil {
+		return fmt.Errorf("%s: malformed from address: %w", modName, err)
+	}
+	if r.orgName == "" {
+		r.orgName = r.hostname
+	}
+	if r.stateFile == "" {
+		r.stateFile = "dmarc_reports.json"
+		if r.instName != "" {
+			r.stateFile = "dmarc_reports_" + r.instName + ".json"
+		}
+	}
+	if !filepath.IsAbs(r.stateFile) {
+		r.stateFile = filepath.Join(config.StateDirectory, r.stateFile)
+	}
+	r.collector = aggreport.NewCollector(time.Now(), dmarc.NewResults)
+	r.initSender()
+
+	if err := r.sender.Start(); err != nil {
+		return fmt.Errorf("%s: failed to load state: %w", modName, err)
+	}
+	return nil
+}
+
+func (r *Reporter) initSender() {
+	r.sender = &aggreport.Sender{
+		Kind:      "DMARC",
+		Log:       r.log,
+		From:      r.from,
+		DeliverTo: r.deliverTo,
+		StateFile: r.stateFile,
+		Collector: r.collector,
+		Prepare:   r.prepareReports,
+		Check: func(ctx context.Context, msg aggreport.Message) error {
+			return r.verifyDestination(ctx, msg.Domain, msg.Rcpt)
+		},
+	}
+}
+
+// RecordEvaluation implements dmarc.Reporter.
+func (r *Reporter) RecordEvaluation(ev dmarc.Evaluation) {
+	r.collector.Update(func(res aggreport.Results) {
+		res.(*dmarc.Results).Add(ev)
+	})
+}
+
+func (r *Reporter) Close() error {
+	r.failureWg.Wait()
+
+	if r.sender != nil {
+		if err := r.sender.Close(); err != nil {
+			return fmt.Errorf("%s: failed to save state: %w", modName, err)
+		}
+	}
+	return nil
+}
+
+// prepareReports generates reports for the period ending at now.
+func (r *Reporter) prepareReports(_ context.Context, now time.Time) []aggreport.Message {
+	start, collected := r.collector.Flush(now)
+	period := dmarc.DateRange{Begin: start.Unix(), End: now.Unix()}
+	results := collected.(*dmarc.Results).ByDomain()
+
+	var msgs []aggreport.Message
+	for domain, res := range results {
+		report := dmarc.Feedback{
+			Version: "1.0",
+			ReportMetadata: dmarc.ReportMetadata{
+				OrgName:          r.orgName,
+				Email:            r.from,
+				ExtraContactInfo: r.contactInfo,
+				ReportID:         fmt.Sprintf("%d.%s@%s", period.Begin, domain, r.hostname),
+				DateRange:        period,
+			},
+			PolicyPublished: res.Policy,
+			Records:         res.Records,
+		}
+
+		for _, rua := range res.RUA {
+			msg, err := r.reportMessage(rua, domain, report)
+			if err != nil {
+				r.log.Error("failed to generate DMARC report", err, "domain", domain, "uri", rua)
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+var errTooBig = errors.New("report exceeds the size limit")
+
+func (r *Reporter) reportMessage(rua, domain string, report dmarc.Feedback) (aggreport.Message, error) {
+	uri, err := dmarc.ParseReportURI(rua)
+	if err != nil {
+		return aggreport.Message{}, err
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return aggreport.Message{}, err
+	}
+
+	var body bytes.Buffer
+	header, err := dmarc.GenerateMessage(dmarc.Envelope{
+		MsgID:        "<" + msgID + "@" + r.hostname + ">",
+		From:         r.from,
+		To:           uri.Address,
+		Submitter:    r.hostname,
+		PolicyDomain: domain,
+	}, report, &body)
+	if err != nil {
+		return aggreport.Message{}, err
+	}
+	if uri.MaxSize != 0 && int64(body.Len()) > uri.MaxSize {
+		return aggreport.Message{}, errTooBig
+	}
+
+	return aggreport.Message{
+		ID:       msgID,
+		Rcpt:     uri.Address,
+		Domain:   domain,
+		URI:      rua,
+		ReportID: report.ReportMetadata.ReportID,
+		Header:   header,
+		Body:     body.Bytes(),
+	}, nil
+}
+
+// verifyDestination checks whether reports about domain can be sent to rcpt,
+// see RFC 7489 Section 7.1.
+func (r *Reporter) verifyDestination(ctx context.Context, domain, rcpt string) error {
+	_, rcptDomain, err := address.Split(rcpt)
+	if err != nil {
+		return exterrors.WithTemporary(err, false)
+	}
+	ok, err := dmarc.VerifyExternalDestination(ctx, r.resolver, domain, rcptDomain)
+	if err != nil {
+		return fmt.Errorf("failed to verify external destination: %w", err)
+	}
+	if !ok {
+		return exterrors.WithTemporary(fmt.Errorf("%s did not authorize reports for %s", rcptDomain, domain), false)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
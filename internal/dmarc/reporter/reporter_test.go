@@ -0,0 +1,197 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package reporter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/aggreport"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func evaluation(domain string, rua ...string) dmarc.Evaluation {
+	return dmarc.Evaluation{
+		Time:     time.Now(),
+		SourceIP: net.IPv4(192, 0, 2, 1),
+		Result: dmarc.EvalResult{
+			Authres:      authres.DMARCResult{Value: authres.ResultFail, From: domain},
+			PolicyDomain: domain,
+			Record: &dmarc.Record{
+				Policy:             dmarc.PolicyReject,
+				ReportURIAggregate: rua,
+			},
+		},
+		Policy: dmarc.PolicyReject,
+		AuthResults: []authres.Result{
+			&authres.SPFResult{Value: authres.ResultFail, From: domain},
+		},
+	}
+}
+
+func TestReporter_SendReports(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	tgt := testutils.Target{}
+	r := &Reporter{
+		log: testutils.Logger(t, modName),
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"example.org._report._dmarc.reports.example.net.": {
+				TXT: []string{"v=DMARC1"},
+			},
+		}},
+		hostname:  "mx.example.com",
+		orgName:   "Example",
+		from:      "dmarc@mx.example.com",
+		deliverTo: &tgt,
+		stateFile: filepath.Join(dir, "state.json"),
+		collector: aggreport.NewCollector(time.Now(), dmarc.NewResults),
+	}
+	r.initSender()
+
+	r.RecordEvaluation(evaluation("example.org",
+		"mailto:dmarc@example.org",
+		"mailto:dmarc@reports.example.net",
+		"mailto:dmarc@unrelated.example.com",
+		"mailto:small@example.org!1",
+		"https://example.org/dmarc"))
+	r.RecordEvaluation(evaluation("example.com"))
+	r.sender.SendReports(time.Now())
+
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("wrong amount of messages sent: %d", len(tgt.Messages))
+	}
+	for i, rcpt := range []string{"dmarc@example.org", "dmarc@reports.example.net"} {
+		msg := tgt.Messages[i]
+		if msg.MailFrom != "dmarc@mx.example.com" {
+			t.Errorf("wrong MAIL FROM: %v", msg.MailFrom)
+		}
+		if len(msg.RcptTo) != 1 || msg.RcptTo[0] != rcpt {
+			t.Errorf("wrong recipients: %v", msg.RcptTo)
+		}
+		if msg.Header.Get("To") != rcpt {
+			t.Errorf("wrong To field: %v", msg.Header.Get("To"))
+		}
+	}
+}
+
+func TestReporter_SendFailureReport(t *testing.T) {
+	tgt := testutils.Target{}
+	r := &Reporter{
+		log:            testutils.Logger(t, modName),
+		resolver:       &mockdns.Resolver{},
+		hostname:       "mx.example.com",
+		from:           "dmarc@mx.example.com",
+		deliverTo:      &tgt,
+		failureReports: true,
+		failureLimit:   &failureLimiter{count: 2, period: time.Hour},
+	}
+	r.initSender()
+
+	ev := evaluation("example.org")
+	ev.Result.Record.ReportURIFailure = []string{"mailto:ruf@example.org"}
+	for i := 0; i < 3; i++ {
+		r.SendFailureReport(dmarc.FailureReport{
+			Evaluation: ev,
+			MailFrom:   "sender@example.org",
+			AuthservID: "mx.example.com",
+		})
+		// testutils.Target is not safe for concurrent use.
+		r.failureWg.Wait()
+	}
+
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("wrong amount of messages sent: %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "ruf@example.org" {
+		t.Errorf("wrong recipients: %v", msg.RcptTo)
+	}
+	if ct := msg.Header.Get("Content-Type"); !strings.Contains(ct, "report-type=feedback-report") {
+		t.Errorf("wrong content type: %v", ct)
+	}
+}
+
+func TestReporter_SendFailureReport_Unauthorized(t *testing.T) {
+	tgt := testutils.Target{}
+	resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{}}
+	r := &Reporter{
+		log:            testutils.Logger(t, modName),
+		resolver:       resolver,
+		hostname:       "mx.example.com",
+		from:           "dmarc@mx.example.com",
+		deliverTo:      &tgt,
+		failureReports: true,
+		failureLimit:   &failureLimiter{count: 2, period: time.Hour},
+	}
+	r.initSender()
+
+	ev := evaluation("example.org")
+	ev.Result.Record.ReportURIFailure = []string{"mailto:ruf@reports.example.net"}
+	send := func() {
+		r.SendFailureReport(dmarc.FailureReport{
+			Evaluation: ev,
+			MailFrom:   "sender@example.org",
+			AuthservID: "mx.example.com",
+		})
+		r.failureWg.Wait()
+	}
+
+	// Not authorized yet, should not use up the budget.
+	send()
+	send()
+	if len(tgt.Messages) != 0 {
+		t.Fatalf("report is sent to an unauthorized destination")
+	}
+
+	resolver.Zones["example.org._report._dmarc.reports.example.net."] = mockdns.Zone{
+		TXT: []string{"v=DMARC1"},
+	}
+	send()
+	send()
+	send()
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("wrong amount of messages sent: %d", len(tgt.Messages))
+	}
+}
+
+func TestFailureLimiter(t *testing.T) {
+	l := failureLimiter{count: 1, period: time.Hour}
+	now := time.Now()
+	if !l.take("a@example.org", now) {
+		t.Error("first report is limited")
+	}
+	if l.take("a@example.org", now.Add(time.Minute)) {
+		t.Error("second report is not limited")
+	}
+	if !l.take("b@example.org", now.Add(time.Minute)) {
+		t.Error("report for other destination is limited")
+	}
+	if !l.take("a@example.org", now.Add(time.Hour)) {
+		t.Error("report is limited after the period end")
+	}
+}
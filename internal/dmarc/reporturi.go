@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dmarc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/internal/aggreport"
+	"golang.org/x/net/publicsuffix"
+)
+
+// ReportURI is the parsed address from the rua or ruf tag of the policy
+// record.
+type ReportURI struct {
+	// Mailbox the reports should be sent to.
+	Address string
+
+	// Maximum size of the report the receiver is willing to accept, 0 if
+	// there is no limit.
+	MaxSize int64
+}
+
+var ErrUnsupportedURI = aggreport.ErrUnsupportedURI
+
+// ParseReportURI parses the report URI including the optional size limit,
+// see RFC 7489 Section 6.2. Only mailto: URIs are supported,
+// ErrUnsupportedURI is returned for other schemes.
+func ParseReportURI(uri string) (ReportURI, error) {
+	var res ReportURI
+
+	if idx := strings.LastIndexByte(uri, '!'); idx != -1 {
+		size, err := parseReportSize(uri[idx+1:])
+		if err != nil {
+			return ReportURI{}, fmt.Errorf("dmarc: malformed size limit: %w", err)
+		}
+		res.MaxSize = size
+		uri = uri[:idx]
+	}
+
+	rcpt, err := aggreport.ParseMailtoURI(uri)
+	if err != nil {
+		return ReportURI{}, err
+	}
+	res.Address = rcpt
+	return res, nil
+}
+
+func parseReportSize(s string) (int64, error) {
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		case 't':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * mult, nil
+}
+
+// VerifyExternalDestination checks whether the owner of destDomain agreed to
+// receive reports about policyDomain, see RFC 7489 Section 7.1.
+//
+// If both domains belong to the same organizational domain, no check is
+// done.
+func VerifyExternalDestination(ctx context.Context, r Resolver, policyDomain, destDomain string) (bool, error) {
+	policyOrg, err := publicsuffix.EffectiveTLDPlusOne(policyDomain)
+	if err != nil {
+		return false, err
+	}
+	destOrg, err := publicsuffix.EffectiveTLDPlusOne(destDomain)
+	if err != nil {
+		return false, err
+	}
+	if strings.EqualFold(policyOrg, destOrg) {
+		return true, nil
+	}
+
+	txts, err := r.LookupTXT(ctx, dns.FQDN(policyDomain+"._report._dmarc."+destDomain))
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
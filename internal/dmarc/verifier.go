@@ -23,11 +23,13 @@ import (
 	"math/rand"
 	"net"
 	"runtime/trace"
+	"strconv"
 	"strings"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/foxcpp/maddy/internal/arc"
 )
 
 type verifyData struct {
@@ -57,10 +59,20 @@ type Verifier struct {
 
 	resolver Resolver
 
-	// TODO(GH #206): DMARC reporting
-	// FailureReportFunc is the callback that is called when a failure report
-	// is generated. If it is nil - failure reports generation is disabled.
-	//FailureReportFunc func(textproto.Header, io.Reader)
+	// TrustedARCSealers contains domains of intermediaries whose ARC results
+	// are trusted. If the message fails the alignment check but has a valid
+	// ARC chain sealed by one of these domains and the sealer recorded the
+	// passing DMARC, DKIM or SPF result for the From domain, the policy is not
+	// applied.
+	TrustedARCSealers []string
+
+	// header is saved by FetchRecord to read ARC-Authentication-Results.
+	header textproto.Header
+
+	// FailureReportFunc is the callback that is called by ReportFailure if
+	// the policy requests a failure report. If it is nil - failure reports
+	// generation is disabled.
+	FailureReportFunc func(FailureReport)
 }
 
 func NewVerifier(r Resolver) *Verifier {
@@ -82,6 +94,8 @@ func (v *Verifier) Close() error {
 //
 // If panic occurs in the lookup goroutine - call to Apply will panic.
 func (v *Verifier) FetchRecord(ctx context.Context, header textproto.Header) {
+	v.header = header
+
 	fromDomain, err := ExtractFromDomain(header)
 	if err != nil {
 		v.fetchCh <- verifyData{
@@ -157,11 +171,20 @@ func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
 	}
 
 	result := EvaluateAlignment(data.fromDomain, data.record, authRes)
+	result.PolicyDomain = data.policyDomain
+	result.Record = data.record
 	if result.Authres.Value == authres.ResultPass || result.Authres.Value == authres.ResultNone {
 		return result, dmarc.PolicyNone
 	}
 
+	if sealer := v.trustedARCSealer(data.fromDomain, data.record, authRes); sealer != "" {
+		result.ARCOverride = sealer
+		result.Authres.Reason += ", policy overridden by trusted ARC sealer " + sealer
+		return result, dmarc.PolicyNone
+	}
+
 	if data.record.Percent != nil && rand.Int31n(100) > int32(*data.record.Percent) {
+		result.SampledOut = true
 		return result, dmarc.PolicyNone
 	}
 
@@ -172,3 +195,64 @@ func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
 
 	return result, policy
 }
+
+// trustedARCSealer returns the domain of the sealer if authRes contains the
+// passing ARC result from one of TrustedARCSealers and the
+// ARC-Authentication-Results field added by the sealer shows that the message
+// passed DMARC or aligned DKIM or SPF checks for fromDomain.
+func (v *Verifier) trustedARCSealer(fromDomain string, record *Record, authRes []authres.Result) string {
+	for _, res := range authRes {
+		arcRes, ok := res.(*authres.GenericResult)
+		if !ok || arcRes.Method != "arc" || arcRes.Value != authres.ResultPass {
+			continue
+		}
+		sealer := arcRes.Params["header.d"]
+		trusted := false
+		for _, domain := range v.TrustedARCSealers {
+			if strings.EqualFold(sealer, domain) {
+				trusted = true
+			}
+		}
+		if !trusted {
+			continue
+		}
+
+		instance, err := strconv.Atoi(arcRes.Params["header.i"])
+		if err != nil {
+			continue
+		}
+		sealerRes, err := arc.AuthResults(v.header, instance)
+		if err != nil {
+			continue
+		}
+		for i, res := range sealerRes {
+			switch res := res.(type) {
+			case *authres.DMARCResult:
+				if res.Value == authres.ResultPass && strings.EqualFold(res.From, fromDomain) {
+					return sealer
+				}
+			case *authres.SPFResult:
+				// smtp.mailfrom is often the whole address.
+				if at := strings.LastIndexByte(res.From, '@'); at != -1 {
+					spfRes := *res
+					spfRes.From = res.From[at+1:]
+					sealerRes[i] = &spfRes
+				}
+			}
+		}
+		eval := EvaluateAlignment(fromDomain, record, sealerRes)
+		if eval.DKIMAligned || eval.SPFAligned {
+			return sealer
+		}
+	}
+	return ""
+}
+
+// ReportFailure calls FailureReportFunc if the policy record requests a
+// failure report for the evaluation result.
+func (v *Verifier) ReportFailure(report FailureReport) {
+	if v.FailureReportFunc == nil || !FailureReportRequested(report.Evaluation) {
+		return
+	}
+	v.FailureReportFunc(report)
+}
@@ -217,3 +217,65 @@ func TestDMARC(t *testing.T) {
 		&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
 	}, PolicyQuarantine, authres.ResultFail)
 }
+
+func TestDMARC_TrustedARC(t *testing.T) {
+	test := func(trusted []string, aar string, arcRes *authres.GenericResult, policyApplied Policy) {
+		t.Helper()
+		v := NewVerifier(&mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"_dmarc.example.com.": {
+				TXT: []string{"v=DMARC1; p=reject"},
+			},
+		}})
+		v.TrustedARCSealers = trusted
+		defer v.Close()
+
+		hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(
+			"ARC-Authentication-Results: " + aar + "\r\n" +
+				"From: hello@example.com\r\n\r\n")))
+		if err != nil {
+			panic(err)
+		}
+		v.FetchRecord(context.Background(), hdr)
+		evalRes, policy := v.Apply([]authres.Result{
+			&authres.DKIMResult{Value: authres.ResultFail, Domain: "example.com"},
+			&authres.SPFResult{Value: authres.ResultPass, From: "lists.example.org", Helo: "mx.example.org"},
+			arcRes,
+		})
+
+		if policy != policyApplied {
+			t.Errorf("expected applied policy to be '%v', got '%v'", policyApplied, policy)
+		}
+		if evalRes.Authres.Value != authres.ResultFail {
+			t.Errorf("expected DMARC result to be 'fail', got '%v'", evalRes.Authres.Value)
+		}
+		if (policyApplied == PolicyNone) != (evalRes.ARCOverride != "") {
+			t.Errorf("unexpected ARCOverride value: %q", evalRes.ARCOverride)
+		}
+	}
+
+	arcPass := &authres.GenericResult{
+		Method: "arc",
+		Value:  authres.ResultPass,
+		Params: map[string]string{"header.d": "lists.example.org", "header.i": "1"},
+	}
+	arcFail := &authres.GenericResult{
+		Method: "arc",
+		Value:  authres.ResultFail,
+		Params: map[string]string{"header.d": "lists.example.org", "header.i": "1"},
+	}
+	dkimPass := "i=1; lists.example.org; dkim=pass header.d=example.com"
+
+	test(nil, dkimPass, arcPass, PolicyReject)
+	test([]string{"lists.example.net"}, dkimPass, arcPass, PolicyReject)
+	test([]string{"Lists.Example.org"}, dkimPass, arcPass, PolicyNone)
+	test([]string{"lists.example.org"}, dkimPass, arcFail, PolicyReject)
+
+	// Sealer results are checked against the From domain.
+	test([]string{"lists.example.org"}, "i=1; lists.example.org; dmarc=pass header.from=example.com", arcPass, PolicyNone)
+	test([]string{"lists.example.org"}, "i=1; lists.example.org; spf=pass smtp.mailfrom=hello@example.com", arcPass, PolicyNone)
+	test([]string{"lists.example.org"}, "i=1; lists.example.org; dkim=fail header.d=example.com", arcPass, PolicyReject)
+	test([]string{"lists.example.org"}, "i=1; lists.example.org; dkim=pass header.d=example.net", arcPass, PolicyReject)
+	test([]string{"lists.example.org"}, "i=1; lists.example.org; dmarc=pass header.from=example.net", arcPass, PolicyReject)
+	// Results of a different instance are not used.
+	test([]string{"lists.example.org"}, "i=2; lists.example.org; dkim=pass header.d=example.com", arcPass, PolicyReject)
+}
@@ -36,6 +36,10 @@ import (
 )
 
 type ReportingMTAInfo struct {
+	// Envelope identifier specified by the message sender using the ENVID
+	// parameter (RFC 3461), included as 'Original-Envelope-Id' field.
+	OriginalEnvelopeID string
+
 	ReportingMTA    string
 	ReceivedFromMTA string
 
@@ -57,6 +61,10 @@ func (info ReportingMTAInfo) WriteTo(utf8 bool, w io.Writer) error {
 	// MIME generator here.
 	h := textproto.Header{}
 
+	if info.OriginalEnvelopeID != "" {
+		h.Add("Original-Envelope-Id", EncodeXtext(info.OriginalEnvelopeID))
+	}
+
 	if info.ReportingMTA == "" {
 		return errors.New("dsn: Reporting-MTA field is mandatory")
 	}
@@ -114,6 +122,11 @@ const (
 )
 
 type RecipientInfo struct {
+	// Original recipient address specified by the message sender using the
+	// ORCPT parameter (RFC 3461), included as 'Original-Recipient' field.
+	// Should be in the TYPE;ADDRESS form, e.g. 'rfc822;test@example.org'.
+	OriginalRecipient string
+
 	FinalRecipient string
 	RemoteMTA      string
 
@@ -122,6 +135,10 @@ type RecipientInfo struct {
 
 	// DiagnosticCode is the error that will be returned to the sender.
 	DiagnosticCode error
+
+	// Time after which the delivery will not be retried anymore. Used only
+	// with ActionDelayed. Optional.
+	WillRetryUntil time.Time
 }
 
 func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
@@ -129,6 +146,10 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 	// MIME generator here.
 	h := textproto.Header{}
 
+	if info.OriginalRecipient != "" {
+		h.Add("Original-Recipient", info.OriginalRecipient)
+	}
+
 	if info.FinalRecipient == "" {
 		return errors.New("dsn: Final-Recipient is required")
 	}
@@ -157,7 +178,7 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 		h.Add("Diagnostic-Code", fmt.Sprintf("smtp; %d %d.%d.%d %s",
 			smtpErr.Code, smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2],
 			strings.ReplaceAll(strings.ReplaceAll(smtpErr.Message, "\n", " "), "\r", " ")))
-	} else if utf8 {
+	} else if utf8 && info.DiagnosticCode != nil {
 		// It might contain Unicode, so don't include it if we are not allowed to.
 		// ... I didn't bother implementing mangling logic to remove Unicode
 		// characters.
@@ -176,6 +197,10 @@ func (info RecipientInfo) WriteTo(utf8 bool, w io.Writer) error {
 		h.Add("Remote-MTA", "dns; "+remoteMTA)
 	}
 
+	if info.Action == ActionDelayed && !info.WillRetryUntil.IsZero() {
+		h.Add("Will-Retry-Until", info.WillRetryUntil.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	}
+
 	return textproto.WriteHeader(w, h)
 }
 
@@ -187,8 +212,11 @@ type Envelope struct {
 
 // GenerateDSN is a top-level function that should be used for generation of the DSNs.
 //
+// If failedBody is not nil, the full message is included in the DSN, otherwise
+// only the header is included.
+//
 // DSN header will be returned, body itself will be written to outWriter.
-func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, outWriter io.Writer) (textproto.Header, error) {
+func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo, failedHeader textproto.Header, failedBody io.Reader, outWriter io.Writer) (textproto.Header, error) {
 	partWriter := textproto.NewMultipartWriter(outWriter)
 
 	reportHeader := textproto.Header{}
@@ -200,7 +228,14 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	reportHeader.Add("Auto-Submitted", "auto-replied")
 	reportHeader.Add("To", envelope.To)
 	reportHeader.Add("From", envelope.From)
-	reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	switch {
+	case onlyAction(rcptsInfo, ActionDelayed):
+		reportHeader.Add("Subject", "Delayed Mail (still being retried)")
+	case onlyAction(rcptsInfo, ActionDelivered, ActionRelayed):
+		reportHeader.Add("Subject", "Successful Mail Delivery Report")
+	default:
+		reportHeader.Add("Subject", "Undelivered Mail Returned to Sender")
+	}
 
 	defer partWriter.Close()
 
@@ -210,9 +245,33 @@ func GenerateDSN(utf8 bool, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsIn
 	if err := writeMachineReadablePart(utf8, partWriter, mtaInfo, rcptsInfo); err != nil {
 		return textproto.Header{}, err
 	}
+	if failedBody != nil {
+		return reportHeader, writeMessage(utf8, partWriter, failedHeader, failedBody)
+	}
 	return reportHeader, writeHeader(utf8, partWriter, failedHeader)
 }
 
+// onlyAction checks whether all recipients have one of the specified actions.
+// E.g. the DSN is a delay warning if all recipients have the "delayed" action.
+func onlyAction(rcptsInfo []RecipientInfo, actions ...Action) bool {
+	if len(rcptsInfo) == 0 {
+		return false
+	}
+	for _, rcpt := range rcptsInfo {
+		matched := false
+		for _, action := range actions {
+			if rcpt.Action == action {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
 func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Header) error {
 	partHeader := textproto.Header{}
 	partHeader.Add("Content-Description", "Undelivered message header")
@@ -229,6 +288,26 @@ func writeHeader(utf8 bool, w *textproto.MultipartWriter, header textproto.Heade
 	return textproto.WriteHeader(headerWriter, header)
 }
 
+func writeMessage(utf8 bool, w *textproto.MultipartWriter, header textproto.Header, body io.Reader) error {
+	partHeader := textproto.Header{}
+	partHeader.Add("Content-Description", "Undelivered message")
+	if utf8 {
+		partHeader.Add("Content-Type", "message/global")
+	} else {
+		partHeader.Add("Content-Type", "message/rfc822")
+	}
+	partHeader.Add("Content-Transfer-Encoding", "8bit")
+	msgWriter, err := w.CreatePart(partHeader)
+	if err != nil {
+		return err
+	}
+	if err := textproto.WriteHeader(msgWriter, header); err != nil {
+		return err
+	}
+	_, err = io.Copy(msgWriter, body)
+	return err
+}
+
 func writeMachineReadablePart(utf8 bool, w *textproto.MultipartWriter, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
 	machineHeader := textproto.Header{}
 	if utf8 {
@@ -271,6 +350,36 @@ Last delivery attempt: {{.LastAttemptDate}}
 
 `))
 
+// deliveredText is the text of the human-readable part of DSN that is sent
+// when the delivery notification is requested by the sender.
+var deliveredText = template.Must(template.New("dsn-delivered-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message was successfully delivered to the recipients listed below.
+This notification was sent because you requested it.
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+
+`))
+
+// delayedText is the text of the human-readable part of DSN that is sent
+// when the message is still being retried.
+var delayedText = template.Must(template.New("dsn-delayed-text").Parse(`
+This is the mail delivery system at {{.ReportingMTA}}.
+
+Your message could not be delivered to one or more recipients yet.
+Delivery will be retried, you do not need to resend the message.
+
+Contact the postmaster for further assistance, provide the Message ID (below):
+
+Message ID: {{.XMessageID}}
+Arrival: {{.ArrivalDate}}
+Last delivery attempt: {{.LastAttemptDate}}
+
+`))
+
 func writeHumanReadablePart(w *textproto.MultipartWriter, envelope Envelope, mtaInfo ReportingMTAInfo, rcptsInfo []RecipientInfo) error {
 	humanHeader := textproto.Header{}
 	humanHeader.Add("Content-Transfer-Encoding", "8bit")
@@ -284,12 +393,30 @@ func writeHumanReadablePart(w *textproto.MultipartWriter, envelope Envelope, mta
 	mtaInfo.ArrivalDate = mtaInfo.ArrivalDate.Truncate(time.Second)
 	mtaInfo.LastAttemptDate = mtaInfo.LastAttemptDate.Truncate(time.Second)
 
-	if err := failedText.Execute(humanWriter, mtaInfo); err != nil {
+	text := failedText
+	switch {
+	case onlyAction(rcptsInfo, ActionDelayed):
+		text = delayedText
+	case onlyAction(rcptsInfo, ActionDelivered, ActionRelayed):
+		text = deliveredText
+	}
+	if err := text.Execute(humanWriter, mtaInfo); err != nil {
 		return err
 	}
 
 	for _, rcpt := range rcptsInfo {
-		if _, err := fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode); err != nil {
+		var err error
+		switch {
+		case rcpt.Action == ActionDelivered || rcpt.Action == ActionRelayed:
+			_, err = fmt.Fprintf(humanWriter, "Delivered to %s\n", rcpt.FinalRecipient)
+		case rcpt.Action == ActionDelayed && rcpt.DiagnosticCode == nil:
+			_, err = fmt.Fprintf(humanWriter, "Delivery to %s is delayed\n", rcpt.FinalRecipient)
+		case rcpt.Action == ActionDelayed:
+			_, err = fmt.Fprintf(humanWriter, "Delivery to %s is delayed, last error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode)
+		default:
+			_, err = fmt.Fprintf(humanWriter, "Delivery to %s failed with error: %v\n", rcpt.FinalRecipient, rcpt.DiagnosticCode)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,67 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dsn
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EncodeXtext encodes the string using the xtext encoding defined in
+// RFC 3461 Section 4.
+func EncodeXtext(raw string) string {
+	var out strings.Builder
+	out.Grow(len(raw))
+	for _, ch := range []byte(raw) {
+		if ch == '+' || ch == '=' || ch < '!' || ch > '~' {
+			fmt.Fprintf(&out, "+%02X", ch)
+			continue
+		}
+		out.WriteByte(ch)
+	}
+	return out.String()
+}
+
+// DecodeXtext decodes the string encoded using the xtext encoding.
+func DecodeXtext(val string) (string, error) {
+	if !strings.Contains(val, "+") {
+		return val, nil
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(val))
+	for i := 0; i < len(val); i++ {
+		if val[i] != '+' {
+			sb.WriteByte(val[i])
+			continue
+		}
+		if i+2 >= len(val) {
+			return "", errors.New("truncated hex escape")
+		}
+		b, err := strconv.ParseUint(val[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("malformed hex escape")
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+	return sb.String(), nil
+}
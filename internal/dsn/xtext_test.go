@@ -0,0 +1,45 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dsn
+
+import "testing"
+
+func TestXtext(t *testing.T) {
+	for _, val := range []string{"", "abc", "a+b=c", "a b\x01", "+"} {
+		enc := EncodeXtext(val)
+		dec, err := DecodeXtext(enc)
+		if err != nil {
+			t.Errorf("DecodeXtext(%q): %v", enc, err)
+			continue
+		}
+		if dec != val {
+			t.Errorf("wrong round-trip result for %q: %q => %q", val, enc, dec)
+		}
+	}
+
+	if enc := EncodeXtext("a+b=c d"); enc != "a+2Bb+3Dc+20d" {
+		t.Errorf("wrong encoding: %s", enc)
+	}
+
+	for _, val := range []string{"+", "+4", "+ZZ"} {
+		if _, err := DecodeXtext(val); err == nil {
+			t.Errorf("DecodeXtext(%q): expected an error", val)
+		}
+	}
+}
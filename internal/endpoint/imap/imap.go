@@ -48,6 +48,7 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/proxy_protocol"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 )
 
@@ -63,6 +64,9 @@ type Endpoint struct {
 
 	saslAuth auth.SASLAuth
 
+	// nil if PROXY protocol is not used.
+	proxyProtocol *proxy_protocol.Config
+
 	Log log.Logger
 }
 
@@ -94,6 +98,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("io_errors", false, false, &ioErrors)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -168,6 +173,10 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 		endp.Log.Printf("listening on %v", addr)
 
+		if endp.proxyProtocol != nil {
+			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
+		}
+
 		if addr.IsTLS() {
 			if endp.tlsConfig == nil {
 				return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
@@ -0,0 +1,235 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package mtasts implements the HTTP endpoint serving MTA-STS policies
+// (RFC 8461) for local domains.
+package mtasts
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	modName = "mtasts"
+
+	policyPath = "/.well-known/mta-sts.txt"
+
+	// Maximum max_age value allowed by RFC 8461 Section 3.2.
+	maxMaxAge = 31557600 * time.Second
+)
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	domains   map[string]struct{}
+	policy    string
+	policyID  string
+	tlsConfig *tls.Config
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var (
+		hostname string
+		domains  []string
+		mxs      []string
+		mode     string
+		maxAge   time.Duration
+		rua      []string
+	)
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.String("hostname", true, true, "", &hostname)
+	cfg.StringList("domains", false, true, nil, &domains)
+	cfg.StringList("mx", false, false, nil, &mxs)
+	cfg.Enum("mode", false, false, []string{"enforce", "testing", "none"}, "testing", &mode)
+	cfg.Duration("max_age", false, false, 7*24*time.Hour, &maxAge)
+	cfg.StringList("tls_reporting", false, false, nil, &rua)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(mxs) == 0 {
+		mxs = []string{hostname}
+	}
+	if maxAge <= 0 || maxAge > maxMaxAge {
+		return fmt.Errorf("%s: max_age should be between 1 second and 1 year", modName)
+	}
+
+	e.domains = make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		e.domains[dns.FQDN(strings.ToLower(domain))] = struct{}{}
+	}
+	e.policy = buildPolicy(mode, mxs, maxAge)
+	e.policyID = policyID(e.policy)
+
+	e.serv.Handler = e
+
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on HTTPS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			defer e.listenersWg.Done()
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && err != http.ErrServerClosed {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+		}()
+	}
+
+	e.printRecords(domains, rua)
+
+	return nil
+}
+
+func buildPolicy(mode string, mxs []string, maxAge time.Duration) string {
+	var policy strings.Builder
+	policy.WriteString("version: STSv1\r\n")
+	policy.WriteString("mode: " + mode + "\r\n")
+	for _, mx := range mxs {
+		policy.WriteString("mx: " + strings.TrimSuffix(mx, ".") + "\r\n")
+	}
+	policy.WriteString("max_age: " + strconv.FormatInt(int64(maxAge/time.Second), 10) + "\r\n")
+	return policy.String()
+}
+
+// policyID derives the policy identifier from its contents so it changes
+// automatically when the configuration is changed.
+func policyID(policy string) string {
+	sum := sha256.Sum256([]byte(policy))
+	return hex.EncodeToString(sum[:])[:32]
+}
+
+// printRecords logs DNS records that should be published for the served
+// policies to take effect.
+func (e *Endpoint) printRecords(domains, rua []string) {
+	for _, domain := range domains {
+		domain = dns.FQDN(domain)
+		e.logger.Printf("publish the following DNS records for %s:", domain)
+		e.logger.Printf(`mta-sts.%s CNAME (or A/AAAA) pointing to this server`, domain)
+		e.logger.Printf(`_mta-sts.%s TXT "v=STSv1; id=%s"`, domain, e.policyID)
+		if len(rua) != 0 {
+			e.logger.Printf(`_smtp._tls.%s TXT "v=TLSRPTv1; rua=%s"`, domain, strings.Join(rua, ","))
+		}
+	}
+}
+
+func (e *Endpoint) policyDomain(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = dns.FQDN(strings.ToLower(host))
+
+	if !strings.HasPrefix(host, "mta-sts.") {
+		return "", errors.New("not a policy host")
+	}
+	domain := strings.TrimPrefix(host, "mta-sts.")
+	if _, ok := e.domains[domain]; !ok {
+		return "", errors.New("unknown policy domain")
+	}
+	return domain, nil
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != policyPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain, err := e.policyDomain(r.Host)
+	if err != nil {
+		e.logger.DebugMsg("policy request rejected", "host", r.Host, "reason", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	e.logger.DebugMsg("serving policy", "domain", domain, "remote_addr", r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.policy)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write([]byte(e.policy))
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package mtasts
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testEndpoint(t *testing.T, children []config.Node) *Endpoint {
+	mod, err := New(modName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mod.(*Endpoint)
+	e.logger = testutils.Logger(t, modName)
+
+	err = e.Init(config.NewMap(map[string]interface{}{
+		"hostname": "mx.example.org",
+	}, config.Node{Children: children}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEndpoint_Policy(t *testing.T) {
+	e := testEndpoint(t, []config.Node{
+		{Name: "domains", Args: []string{"example.org", "Example.COM"}},
+		{Name: "mode", Args: []string{"enforce"}},
+		{Name: "max_age", Args: []string{"24h"}},
+	})
+	defer e.Close()
+
+	for _, host := range []string{"mta-sts.example.org", "mta-sts.example.com:443", "MTA-STS.EXAMPLE.ORG"} {
+		req := httptest.NewRequest("GET", "https://"+host+"/.well-known/mta-sts.txt", nil)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status: %v", host, resp.StatusCode)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		want := "version: STSv1\r\nmode: enforce\r\nmx: mx.example.org\r\nmax_age: 86400\r\n"
+		if string(body) != want {
+			t.Errorf("%s: wrong policy:\n%s", host, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("%s: wrong Content-Type: %s", host, ct)
+		}
+	}
+
+	for _, url := range []string{
+		"https://mta-sts.example.net/.well-known/mta-sts.txt",
+		"https://example.org/.well-known/mta-sts.txt",
+		"https://mta-sts.example.org/",
+	} {
+		req := httptest.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if w.Result().StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %v", url, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestEndpoint_PolicyID(t *testing.T) {
+	e1 := testEndpoint(t, []config.Node{
+		{Name: "domains", Args: []string{"example.org"}},
+		{Name: "mx", Args: []string{"mx1.example.org", "mx2.example.org"}},
+	})
+	defer e1.Close()
+	e2 := testEndpoint(t, []config.Node{
+		{Name: "domains", Args: []string{"example.org"}},
+		{Name: "mx", Args: []string{"mx1.example.org"}},
+	})
+	defer e2.Close()
+
+	if e1.policyID == e2.policyID {
+		t.Error("policy ID is not changed when the policy is changed")
+	}
+	if len(e1.policyID) > 32 {
+		t.Error("policy ID is too long:", e1.policyID)
+	}
+}
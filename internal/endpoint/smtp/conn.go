@@ -0,0 +1,608 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// go-smtp has no way to register additional commands or EHLO keywords, so
+// they are handled by extConn that sits between the client connection and the
+// server. It passes all other traffic as is and keeps just enough of the
+// protocol state to not interpret message contents as commands.
+//
+// extConn needs to see the plaintext, so it also terminates TLS, both implicit
+// and using STARTTLS. The server itself runs with TLS disabled and everything
+// that depends on it (STARTTLS, REQUIRETLS and AUTH advertisement, refusing
+// AUTH over plaintext) is done here instead.
+//
+// XCLIENT and STARTTLS require the server to forget the state of the
+// connection, including HELO/EHLO and AUTH. go-smtp does not allow to reset it,
+// so the client connection is passed to the server again as a new one (see
+// extConn.restart).
+
+type extListener struct {
+	net.Listener
+	endp *Endpoint
+
+	// implicitTLS is set for listeners that expect TLS handshake right after
+	// the connection is established (smtps://).
+	implicitTLS bool
+
+	acceptOnce sync.Once
+	accepted   chan acceptResult
+	// restarted contains client connections that are passed to the server
+	// again, see extConn.restart.
+	restarted chan *extConn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newExtListener(l net.Listener, endp *Endpoint, implicitTLS bool) *extListener {
+	return &extListener{
+		Listener:    l,
+		endp:        endp,
+		implicitTLS: implicitTLS,
+		accepted:    make(chan acceptResult),
+		restarted:   make(chan *extConn),
+		done:        make(chan struct{}),
+	}
+}
+
+func (l *extListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		select {
+		case l.accepted <- acceptResult{conn: conn, err: err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (l *extListener) Accept() (net.Conn, error) {
+	l.acceptOnce.Do(func() { go l.acceptLoop() })
+
+	select {
+	case c := <-l.restarted:
+		return c, nil
+	case res := <-l.accepted:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return l.newConn(res.conn)
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *extListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *extListener) newConn(conn net.Conn) (*extConn, error) {
+	c := &extConn{
+		Conn:             conn,
+		l:                l,
+		rw:               conn,
+		br:               bufio.NewReader(conn),
+		tlsConfig:        l.endp.tlsConfig,
+		insecureAuth:     l.endp.insecureAuth,
+		authDisabled:     l.endp.serv.AuthDisabled,
+		maxFutureRelease: l.endp.maxFutureRelease,
+		mtPriority:       l.endp.mtPriorityMax != nil,
+		allowXCLIENT:     l.endp.xclientTrust != nil && l.endp.xclientTrust.Contains(conn.RemoteAddr()),
+		allowXFORWARD:    l.endp.xforwardTrust != nil && l.endp.xforwardTrust.Contains(conn.RemoteAddr()),
+	}
+	if l.implicitTLS {
+		// The handshake happens when the server writes the greeting, limit
+		// the time the client has to complete it.
+		if timeout := l.endp.serv.ReadTimeout; timeout != 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		c.setTLS(tls.Server(conn, l.endp.tlsConfig))
+	}
+	return c, nil
+}
+
+const (
+	extModeCommand = iota
+	// Message body after DATA, passed through until the terminating dot.
+	extModeData
+	// BDAT chunk, passed through until chunkLeft bytes are read.
+	extModeChunk
+)
+
+// extConn handles commands not supported by go-smtp and passes everything
+// else to the server.
+//
+// The server reads commands one line per Read call, so by the time the next
+// Read happens the response to the previous command is already written and
+// its code is recorded in lastCode.
+//
+// Each connection seen by the server has its own extConn, a restarted client
+// connection gets a new one.
+type extConn struct {
+	net.Conn
+	l *extListener
+
+	tlsConfig    *tls.Config
+	insecureAuth bool
+	authDisabled bool
+
+	// maxFutureRelease is the max. HOLDFOR interval, zero if FUTURERELEASE
+	// is disabled.
+	maxFutureRelease time.Duration
+	// mtPriority is true if MT-PRIORITY is enabled.
+	mtPriority bool
+
+	allowXCLIENT  bool
+	allowXFORWARD bool
+
+	// rw is either the underlying connection or the TLS connection on top
+	// of it.
+	connLock sync.Mutex
+	rw       net.Conn
+	tlsConn  *tls.Conn
+	// detached is set when the client connection is passed to the server
+	// again, closing extConn then does not close the client connection.
+	detached bool
+
+	// Read side, accessed only by the reading goroutine.
+	br        *bufio.Reader
+	mode      int
+	pending   []byte
+	partial   bool // in the middle of a long line
+	lineStart bool // at the beginning of a message body line
+	chunkLeft uint64
+	lastCmd   string
+	lastResps int
+	helo      bool
+
+	// Write side.
+	wLock       sync.Mutex
+	wbuf        []byte
+	resp        []byte
+	resps       int
+	lastCode    int
+	swallow     int
+	ehloPending bool
+	// authenticated is set once the client is authenticated using AUTH or
+	// XCLIENT LOGIN.
+	authenticated bool
+
+	stateLock  sync.Mutex
+	xclient    *xclientState
+	xforward   *xclientState
+	mailParams mailParams
+}
+
+func (c *extConn) setTLS(tlsConn *tls.Conn) {
+	c.connLock.Lock()
+	c.rw = tlsConn
+	c.tlsConn = tlsConn
+	c.connLock.Unlock()
+	c.br = bufio.NewReader(tlsConn)
+}
+
+func (c *extConn) conn() (net.Conn, *tls.Conn) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return c.rw, c.tlsConn
+}
+
+// TLSConnectionState returns the state of the TLS connection, ok is false if
+// TLS is not used.
+func (c *extConn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	_, tlsConn := c.conn()
+	if tlsConn == nil {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+func (c *extConn) isTLS() bool {
+	_, tlsConn := c.conn()
+	return tlsConn != nil
+}
+
+// authAllowed reports whether AUTH can be used on the connection in its
+// current state.
+func (c *extConn) authAllowed() bool {
+	return c.insecureAuth || c.isTLS()
+}
+
+func (c *extConn) isAuthenticated() bool {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	return c.authenticated
+}
+
+func (c *extConn) Close() error {
+	c.connLock.Lock()
+	rw, detached := c.rw, c.detached
+	c.connLock.Unlock()
+	if detached {
+		return nil
+	}
+	return rw.Close()
+}
+
+// restart passes the client connection to the server again as a new
+// connection with the XCLIENT attributes set to xclient. The server starts
+// over and sends the greeting, it is not sent to the client if
+// swallowGreeting is set.
+//
+// Read should return io.EOF after a successful restart so the server closes
+// c and the session associated with it.
+func (c *extConn) restart(xclient *xclientState, swallowGreeting bool) error {
+	rw, tlsConn := c.conn()
+	nc := &extConn{
+		Conn:             c.Conn,
+		l:                c.l,
+		tlsConfig:        c.tlsConfig,
+		insecureAuth:     c.insecureAuth,
+		authDisabled:     c.authDisabled,
+		maxFutureRelease: c.maxFutureRelease,
+		mtPriority:       c.mtPriority,
+		allowXCLIENT:     c.allowXCLIENT,
+		allowXFORWARD:    c.allowXFORWARD,
+		rw:               rw,
+		tlsConn:          tlsConn,
+		br:               c.br,
+		xclient:          xclient,
+	}
+	if swallowGreeting {
+		nc.swallow = 1
+	}
+	nc.authenticated = xclient != nil && xclient.login != ""
+
+	c.connLock.Lock()
+	c.detached = true
+	c.connLock.Unlock()
+
+	select {
+	case c.l.restarted <- nc:
+		return nil
+	case <-c.l.done:
+		rw.Close()
+		return net.ErrClosed
+	}
+}
+
+func (c *extConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *extConn) serverState() (resps, code int) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	return c.resps, c.lastCode
+}
+
+func (c *extConn) fill() error {
+	switch c.mode {
+	case extModeChunk:
+		buf := make([]byte, 4096)
+		if uint64(len(buf)) > c.chunkLeft {
+			buf = buf[:c.chunkLeft]
+		}
+		n, err := c.br.Read(buf)
+		c.chunkLeft -= uint64(n)
+		if c.chunkLeft == 0 {
+			c.mode = extModeCommand
+		}
+		c.pending = buf[:n]
+		if n == 0 {
+			return err
+		}
+		return nil
+	case extModeData:
+		line, err := c.readLine()
+		if len(line) == 0 {
+			return err
+		}
+		if c.lineStart && (string(line) == ".\r\n" || string(line) == ".\n") {
+			c.mode = extModeCommand
+		}
+		c.lineStart = !c.partial
+		c.pending = line
+		return nil
+	}
+
+	resps, code := c.serverState()
+	switch c.lastCmd {
+	case "DATA":
+		if code == 354 && resps == c.lastResps+1 {
+			c.lastCmd = ""
+			c.mode = extModeData
+			c.lineStart = true
+			return nil
+		}
+	case "BDAT":
+		// The chunk is read before the response is sent, unless it is too
+		// big. In that case the chunk is discarded after the response.
+		if resps == c.lastResps || code == 552 {
+			c.lastCmd = ""
+			if c.chunkLeft != 0 {
+				c.mode = extModeChunk
+			}
+			return nil
+		}
+	}
+
+	wasPartial := c.partial
+	line, err := c.readLine()
+	if len(line) == 0 {
+		return err
+	}
+	if wasPartial || (c.lastCmd == "AUTH" && code == 334) {
+		// Continuation of a long line or SASL exchange.
+		c.pending = line
+		return nil
+	}
+
+	cmd, arg := string(bytes.TrimRight(line, "\r\n")), ""
+	if i := strings.IndexByte(cmd, ' '); i != -1 {
+		cmd, arg = cmd[:i], cmd[i+1:]
+	}
+	cmd = strings.ToUpper(cmd)
+
+	switch cmd {
+	case "XCLIENT":
+		return c.handleXCLIENT(arg)
+	case "XFORWARD":
+		return c.handleXFORWARD(arg)
+	case "STARTTLS":
+		if c.tlsConfig != nil {
+			return c.handleSTARTTLS()
+		}
+		// Let the server reject it.
+	case "HELO", "EHLO", "LHLO":
+		c.helo = true
+		if cmd != "HELO" {
+			c.wLock.Lock()
+			c.ehloPending = true
+			c.wLock.Unlock()
+		}
+	case "QUIT", "NOOP":
+	case "RSET":
+		c.stateLock.Lock()
+		c.xforward = nil
+		c.stateLock.Unlock()
+	default:
+		if cmd == "AUTH" && !c.authDisabled && !c.authAllowed() {
+			return c.reply("523 5.7.10 TLS is required")
+		}
+	}
+
+	if cmd == "MAIL" && !c.partial {
+		newLine, params, errResp := c.parseMailParams(line, time.Now())
+		if errResp != "" {
+			return c.reply(errResp)
+		}
+		line = newLine
+		c.stateLock.Lock()
+		c.mailParams = params
+		c.stateLock.Unlock()
+	}
+
+	if cmd == "BDAT" {
+		c.chunkLeft = 0
+		if fields := strings.Fields(arg); len(fields) != 0 {
+			c.chunkLeft, _ = strconv.ParseUint(fields[0], 10, 32)
+		}
+	}
+
+	c.lastCmd = cmd
+	c.lastResps = resps
+	c.pending = line
+	return nil
+}
+
+// readLine reads the next line. Lines longer than the buffer are returned in
+// parts, c.partial is set if the returned part does not end the line.
+func (c *extConn) readLine() ([]byte, error) {
+	line, err := c.br.ReadSlice('\n')
+	c.partial = err == bufio.ErrBufferFull
+	if c.partial {
+		err = nil
+	}
+	return append([]byte(nil), line...), err
+}
+
+func (c *extConn) reply(resp string) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	rw, _ := c.conn()
+	_, err := rw.Write([]byte(resp + "\r\n"))
+	return err
+}
+
+func (c *extConn) handleSTARTTLS() error {
+	if c.isTLS() {
+		return c.reply("502 5.5.1 Already running in TLS")
+	}
+	if err := c.reply("220 2.0.0 Ready to start TLS"); err != nil {
+		return err
+	}
+
+	// Commands pipelined after STARTTLS are discarded together with the
+	// old reader (RFC 3207 Section 5).
+	tlsConn := tls.Server(c.Conn, c.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.setTLS(tlsConn)
+
+	// The server must discard any knowledge obtained from the client
+	// (RFC 3207 Section 4.2), the new connection starts without it,
+	// including XCLIENT attributes.
+	if err := c.restart(nil, true); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (c *extConn) Write(b []byte) (int, error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	c.wbuf = append(c.wbuf, b...)
+	for {
+		i := bytes.IndexByte(c.wbuf, '\n')
+		if i == -1 {
+			break
+		}
+		line := c.wbuf[:i+1]
+		c.wbuf = c.wbuf[i+1:]
+		c.resp = append(c.resp, line...)
+
+		if len(line) >= 4 && line[3] == '-' {
+			continue
+		}
+		code, _ := strconv.Atoi(string(line[:3]))
+		if err := c.flushResp(code); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.wbuf) == 0 {
+		c.wbuf = nil
+	}
+
+	return len(b), nil
+}
+
+func (c *extConn) flushResp(code int) error {
+	resp := c.resp
+	c.resp = nil
+	c.resps++
+	c.lastCode = code
+	if code == 235 {
+		// Only sent for the successful AUTH.
+		c.authenticated = true
+	}
+
+	if c.swallow > 0 {
+		c.swallow--
+		return nil
+	}
+	if c.ehloPending {
+		c.ehloPending = false
+		if code == 250 {
+			resp = c.extendEHLO(resp)
+		}
+	}
+
+	rw, _ := c.conn()
+	_, err := rw.Write(resp)
+	return err
+}
+
+// extendEHLO adds extensions implemented by extConn to the EHLO response and
+// removes AUTH if it is not allowed on this connection.
+func (c *extConn) extendEHLO(resp []byte) []byte {
+	lines := bytes.SplitAfter(resp, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	var exts [][]byte
+	if c.isTLS() {
+		exts = append(exts, []byte("250-REQUIRETLS\r\n"))
+	} else if c.tlsConfig != nil {
+		exts = append(exts, []byte("250-STARTTLS\r\n"))
+	}
+	// FUTURERELEASE is a submission feature, anonymous clients should not be
+	// able to park messages in the queue (RFC 4865).
+	if c.maxFutureRelease != 0 && c.authenticated {
+		exts = append(exts, []byte("250-"+futureReleaseKeyword(c.maxFutureRelease, time.Now())+"\r\n"))
+	}
+	if c.mtPriority {
+		exts = append(exts, []byte("250-MT-PRIORITY\r\n"))
+	}
+	if c.allowXCLIENT {
+		exts = append(exts, []byte("250-XCLIENT "+xclientAttrs+"\r\n"))
+	}
+	if c.allowXFORWARD {
+		exts = append(exts, []byte("250-XFORWARD "+xforwardAttrs+"\r\n"))
+	}
+
+	res := make([][]byte, 0, len(lines)+len(exts))
+	res = append(res, lines[0])
+	res = append(res, exts...)
+	for _, line := range lines[1:] {
+		if fields := strings.Fields(string(line[4:])); len(fields) != 0 &&
+			strings.EqualFold(fields[0], "AUTH") && !c.authAllowed() {
+			continue
+		}
+		res = append(res, line)
+	}
+
+	var out bytes.Buffer
+	for i, line := range res {
+		if len(line) < 4 {
+			out.Write(line)
+			continue
+		}
+		out.Write(line[:3])
+		if i == len(res)-1 {
+			out.WriteByte(' ')
+		} else {
+			out.WriteByte('-')
+		}
+		out.Write(line[4:])
+	}
+	return out.Bytes()
+}
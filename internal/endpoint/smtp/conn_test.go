@@ -0,0 +1,132 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/foxcpp/maddy/internal/tls"
+)
+
+var testTLSNode = config.Node{
+	Name: "tls",
+	Args: []string{"self_signed"},
+}
+
+func (c *rawClient) starttls() {
+	c.t.Helper()
+
+	c.cmd("STARTTLS", "220")
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+}
+
+func TestSMTPEndpoint_STARTTLS(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		testTLSNode,
+		{
+			Name: "xclient_trust",
+			Args: []string{"127.0.0.0/8"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if !hasLine(ehlo, "STARTTLS") || hasLine(ehlo, "AUTH") || hasLine(ehlo, "REQUIRETLS") {
+		t.Fatal("Wrong EHLO response:", ehlo)
+	}
+	c.cmd("AUTH PLAIN AHVzZXIAcGFzcw==", "523")
+
+	c.starttls()
+	c.cmd("MAIL FROM:<sender@example.org>", "502")
+	ehlo = c.cmd("EHLO mx.example.org", "250")
+	if hasLine(ehlo, "STARTTLS") || !hasLine(ehlo, "AUTH") || !hasLine(ehlo, "REQUIRETLS") || !hasLine(ehlo, "XCLIENT ") {
+		t.Fatal("Wrong EHLO response:", ehlo)
+	}
+	c.cmd("STARTTLS", "502")
+
+	// XCLIENT works inside TLS and keeps it.
+	c.cmd("XCLIENT ADDR=192.0.2.1 NAME=client.example.org", "220")
+	c.cmd("EHLO mx.example.org", "250")
+	c.cmd("AUTH PLAIN AHVzZXIAcGFzcw==", "235")
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+	c.cmd("QUIT", "221")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	conn := tgt.Messages[0].MsgMeta.Conn
+	if !conn.TLS.HandshakeComplete || conn.Proto != "ESMTPS" {
+		t.Error("TLS is not recorded in the connection state:", conn.Proto)
+	}
+	tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Error("Wrong remote address:", conn.RemoteAddr)
+	}
+}
+
+func TestSMTPEndpoint_ImplicitTLS(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpointAt(t, "tls://127.0.0.1:"+testPort, "smtp", nil, &tgt, nil, []config.Node{
+		testTLSNode,
+		{
+			Name: "xforward_trust",
+			Args: []string{"127.0.0.0/8"},
+		},
+	})
+	defer endp.Close()
+
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+testPort, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	defer c.conn.Close()
+	c.expect("220")
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if hasLine(ehlo, "STARTTLS") || !hasLine(ehlo, "REQUIRETLS") || !hasLine(ehlo, "XFORWARD ") {
+		t.Fatal("Wrong EHLO response:", ehlo)
+	}
+	c.cmd("STARTTLS", "502")
+	c.cmd("XFORWARD ADDR=192.0.2.1", "250")
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+	c.cmd("QUIT", "221")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if msgConn := tgt.Messages[0].MsgMeta.Conn; !msgConn.TLS.HandshakeComplete || msgConn.Proto != "ESMTPS" {
+		t.Error("TLS is not recorded in the connection state:", msgConn.Proto)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// MAIL FROM parameters that go-smtp does not know about are handled by
+// extConn. They are removed from the command before it is passed to the
+// server and the values are picked up by the session (see takeMailParams).
+
+// mailParams contains values of MAIL FROM parameters handled by extConn.
+type mailParams struct {
+	// holdUntil is the release time requested using HOLDFOR or HOLDUNTIL
+	// (FUTURERELEASE, RFC 4865).
+	holdUntil time.Time
+
+	// priority is the value of MT-PRIORITY (RFC 6710), valid only if
+	// prioritySet is true.
+	priority    int
+	prioritySet bool
+}
+
+// futureReleaseKeyword returns the FUTURERELEASE EHLO keyword with the
+// maximum interval and the maximum release time computed for now.
+func futureReleaseKeyword(maxInterval time.Duration, now time.Time) string {
+	return "FUTURERELEASE " + strconv.FormatInt(int64(maxInterval/time.Second), 10) + " " +
+		now.Add(maxInterval).UTC().Format(time.RFC3339)
+}
+
+// parseMailParams extracts the parameters handled by extConn from the MAIL
+// command line. Returned line is passed to the server.
+//
+// If the parameters are not valid, the error response is returned and the
+// command should not be passed to the server.
+//
+// HOLDFOR and HOLDUNTIL are accepted only from authenticated clients.
+func (c *extConn) parseMailParams(line []byte, now time.Time) (newLine []byte, params mailParams, errResp string) {
+	// Parameters follow the path, which can contain spaces in the quoted
+	// local-part. If there is no path, the server will reject the command
+	// anyway.
+	pathEnd := bytes.LastIndexByte(line, '>')
+	if pathEnd == -1 {
+		return line, params, ""
+	}
+
+	var (
+		kept       []string
+		holdSet    bool
+		paramsSeen bool
+	)
+	futureRelease := c.maxFutureRelease != 0 && c.isAuthenticated()
+	for _, param := range strings.Fields(string(line[pathEnd+1:])) {
+		key, val := param, ""
+		if i := strings.IndexByte(param, '='); i != -1 {
+			key, val = param[:i], param[i+1:]
+		}
+
+		switch strings.ToUpper(key) {
+		case "HOLDFOR", "HOLDUNTIL":
+			if !futureRelease {
+				// Let the server reject it.
+				kept = append(kept, param)
+				continue
+			}
+			paramsSeen = true
+			if holdSet {
+				return nil, params, "501 5.5.4 Only one of HOLDFOR and HOLDUNTIL can be used"
+			}
+			holdSet = true
+
+			if strings.EqualFold(key, "HOLDFOR") {
+				secs, err := strconv.ParseUint(val, 10, 32)
+				if err != nil {
+					return nil, params, "501 5.5.4 Malformed HOLDFOR value"
+				}
+				if time.Duration(secs)*time.Second > c.maxFutureRelease {
+					return nil, params, "554 5.5.4 HOLDFOR value exceeds the maximum future release interval"
+				}
+				params.holdUntil = now.Add(time.Duration(secs) * time.Second)
+			} else {
+				holdUntil, err := time.Parse(time.RFC3339, val)
+				if err != nil {
+					return nil, params, "501 5.5.4 Malformed HOLDUNTIL value"
+				}
+				if holdUntil.After(now.Add(c.maxFutureRelease)) {
+					return nil, params, "554 5.5.4 HOLDUNTIL value exceeds the maximum future release time"
+				}
+				// The time in the past means immediate release.
+				if holdUntil.After(now) {
+					params.holdUntil = holdUntil
+				}
+			}
+		case "MT-PRIORITY":
+			if !c.mtPriority {
+				kept = append(kept, param)
+				continue
+			}
+			paramsSeen = true
+			if params.prioritySet {
+				return nil, params, "501 5.5.4 Duplicate MT-PRIORITY parameter"
+			}
+			priority, err := strconv.Atoi(val)
+			if err != nil || len(strings.TrimLeft(val, "+-")) != 1 || priority < module.MinPriority || priority > module.MaxPriority {
+				return nil, params, "501 5.5.4 Malformed MT-PRIORITY value"
+			}
+			params.priority = priority
+			params.prioritySet = true
+		default:
+			kept = append(kept, param)
+		}
+	}
+	if !paramsSeen {
+		return line, params, ""
+	}
+
+	newLine = append([]byte(nil), line[:pathEnd+1]...)
+	for _, param := range kept {
+		newLine = append(newLine, ' ')
+		newLine = append(newLine, param...)
+	}
+	newLine = append(newLine, '\r', '\n')
+	return newLine, params, ""
+}
+
+// takeMailParams returns values of the parameters of the last MAIL command.
+func (c *extConn) takeMailParams() mailParams {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	params := c.mailParams
+	c.mailParams = mailParams{}
+	return params
+}
@@ -0,0 +1,176 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestSMTPDelivery_FutureRelease(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "max_future_release",
+			Args: []string{"24h"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	c.cmd("EHLO mx.example.org", "250")
+	c.cmd("AUTH PLAIN AHVzZXIAcGFzcw==", "235")
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if !hasLine(ehlo, "FUTURERELEASE 86400 ") {
+		t.Fatal("Wrong EHLO response:", ehlo)
+	}
+
+	c.cmd("MAIL FROM:<sender@example.org> HOLDFOR=x", "501")
+	c.cmd("MAIL FROM:<sender@example.org> HOLDFOR=60 HOLDUNTIL=2030-01-01T00:00:00Z", "501")
+	c.cmd("MAIL FROM:<sender@example.org> HOLDFOR=86401", "554")
+	c.cmd("MAIL FROM:<sender@example.org> HOLDUNTIL="+time.Now().Add(48*time.Hour).UTC().Format(time.RFC3339), "554")
+
+	start := time.Now()
+	c.cmd("MAIL FROM:<sender@example.org> HOLDFOR=60 BODY=8BITMIME", "250")
+	c.cmd("RCPT TO:<rcpt@example.com>", "250")
+	c.cmd("DATA", "354")
+	c.cmd(testMsg+".", "250")
+
+	holdUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	c.cmd("MAIL FROM:<sender@example.org> HOLDUNTIL="+holdUntil.Format(time.RFC3339), "250")
+	c.cmd("RCPT TO:<rcpt@example.com>", "250")
+	c.cmd("DATA", "354")
+	c.cmd(testMsg+".", "250")
+
+	// Not inherited by the next transaction.
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+
+	if len(tgt.Messages) != 3 {
+		t.Fatal("Expected 3 messages, got", len(tgt.Messages))
+	}
+	meta := tgt.Messages[0].MsgMeta
+	if meta.HoldUntil.Before(start.Add(60*time.Second)) || meta.HoldUntil.After(time.Now().Add(60*time.Second)) {
+		t.Error("Wrong HoldUntil for HOLDFOR:", meta.HoldUntil)
+	}
+	if meta.SMTPOpts.Body != "8BITMIME" {
+		t.Error("Other parameters are lost:", meta.SMTPOpts.Body)
+	}
+	if meta := tgt.Messages[1].MsgMeta; !meta.HoldUntil.Equal(holdUntil) {
+		t.Error("Wrong HoldUntil for HOLDUNTIL:", meta.HoldUntil)
+	}
+	if meta := tgt.Messages[2].MsgMeta; !meta.HoldUntil.IsZero() {
+		t.Error("HoldUntil is set for the message without HOLDFOR:", meta.HoldUntil)
+	}
+}
+
+func TestSMTPDelivery_FutureRelease_Unauthenticated(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "max_future_release",
+			Args: []string{"24h"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if hasLine(ehlo, "FUTURERELEASE") {
+		t.Fatal("FUTURERELEASE is advertised:", ehlo)
+	}
+	c.cmd("MAIL FROM:<sender@example.org> HOLDFOR=60", "500")
+	c.cmd("MAIL FROM:<sender@example.org> HOLDUNTIL="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339), "500")
+
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected 1 message, got", len(tgt.Messages))
+	}
+	if meta := tgt.Messages[0].MsgMeta; !meta.HoldUntil.IsZero() {
+		t.Error("HoldUntil is set:", meta.HoldUntil)
+	}
+}
+
+func TestSMTPDelivery_FutureRelease_Disabled(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if hasLine(ehlo, "FUTURERELEASE") {
+		t.Fatal("FUTURERELEASE is advertised:", ehlo)
+	}
+	c.cmd("MAIL FROM:<sender@example.org> HOLDFOR=60", "500")
+}
+
+func TestSMTPDelivery_MTPriority(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "mt_priority",
+			Args: []string{"2"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if !hasLine(ehlo, "MT-PRIORITY") {
+		t.Fatal("Wrong EHLO response:", ehlo)
+	}
+
+	c.cmd("MAIL FROM:<sender@example.org> MT-PRIORITY=10", "501")
+	c.cmd("MAIL FROM:<sender@example.org> MT-PRIORITY=x", "501")
+	c.cmd("MAIL FROM:<sender@example.org> MT-PRIORITY=1 MT-PRIORITY=2", "501")
+
+	for _, priority := range []string{"5", "-3", "+1"} {
+		c.cmd("MAIL FROM:<sender@example.org> MT-PRIORITY="+priority, "250")
+		c.cmd("RCPT TO:<rcpt@example.com>", "250")
+		c.cmd("DATA", "354")
+		c.cmd(testMsg+".", "250")
+	}
+
+	c.cmd("AUTH PLAIN AHVzZXIAcGFzcw==", "235")
+	c.cmd("MAIL FROM:<sender@example.org> MT-PRIORITY=5", "250")
+	c.cmd("RCPT TO:<rcpt@example.com>", "250")
+	c.cmd("DATA", "354")
+	c.cmd(testMsg+".", "250")
+
+	if len(tgt.Messages) != 4 {
+		t.Fatal("Expected 4 messages, got", len(tgt.Messages))
+	}
+	// Priority is clamped for unauthenticated clients.
+	for i, expected := range []int{2, -3, 1, 5} {
+		if priority := tgt.Messages[i].MsgMeta.Priority; priority != expected {
+			t.Errorf("Wrong priority for message %d: %d (expected %d)", i, priority, expected)
+		}
+	}
+}
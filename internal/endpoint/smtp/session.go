@@ -36,17 +36,22 @@ import (
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 )
 
 type Session struct {
 	endp *Endpoint
+	conn *smtp.Conn
 
 	// Specific for this session.
 	// sessionCtx is not used for cancellation or timeouts, only for tracing.
-	sessionCtx       context.Context
-	cancelRDNS       func()
+	sessionCtx context.Context
+	cancelRDNS func()
+	// started is set once connection-level checks are passed and connState
+	// is populated, see start.
+	started          bool
 	connState        module.ConnState
 	repeatedMailErrs int
 	loggedRcptErrors int
@@ -61,6 +66,7 @@ type Session struct {
 	msgTask     *trace.Task
 	mailFrom    string
 	opts        smtp.MailOptions
+	mailParams  mailParams
 	msgMeta     *module.MsgMetadata
 	delivery    module.Delivery
 	deliveryErr error
@@ -68,6 +74,150 @@ type Session struct {
 	log log.Logger
 }
 
+// start populates the connection state and runs early checks. It is done once
+// per session, when the client authenticates or starts the first transaction.
+//
+// Returned error is already wrapped for the SMTP command.
+func (s *Session) start(command string) error {
+	if s.started {
+		return nil
+	}
+
+	state := module.ConnectionState{
+		Hostname:   s.conn.Hostname(),
+		LocalAddr:  s.conn.Conn().LocalAddr(),
+		RemoteAddr: s.conn.Conn().RemoteAddr(),
+	}
+	if ec, ok := s.extConn(); ok {
+		state.TLS, _ = ec.TLSConnectionState()
+	}
+
+	xclient := s.xclientState()
+	if xclient != nil {
+		xclient.applyConn(&state)
+	}
+
+	// Executed before authentication and session initialization.
+	if err := s.endp.pipeline.RunEarlyChecks(context.TODO(), &state); err != nil {
+		return s.endp.wrapErr("", true, command, err)
+	}
+
+	s.connState.ConnectionState = state
+	if s.endp.serv.LMTP {
+		s.connState.Proto = "LMTP"
+	} else {
+		// Check if TLS connection state struct is poplated.
+		// If it is - we are ssing TLS.
+		if state.TLS.HandshakeComplete {
+			s.connState.Proto = "ESMTPS"
+		} else {
+			s.connState.Proto = "ESMTP"
+		}
+	}
+	if xclient != nil && xclient.proto != "" {
+		s.connState.Proto = xclient.proto
+	}
+
+	if xclient != nil && xclient.rdnsSet {
+		s.connState.RDNSName = xclient.rdnsFuture()
+	} else if s.endp.resolver != nil {
+		rdnsCtx, cancelRDNS := context.WithCancel(s.sessionCtx)
+		s.connState.RDNSName = future.New()
+		s.cancelRDNS = cancelRDNS
+		go s.fetchRDNSName(rdnsCtx, s.connState.RemoteAddr, s.connState.RDNSName)
+	}
+
+	s.started = true
+	return nil
+}
+
+func (s *Session) extConn() (*extConn, bool) {
+	if s.conn == nil {
+		return nil, false
+	}
+	ec, ok := s.conn.Conn().(*extConn)
+	return ec, ok
+}
+
+// xclientState returns connection attributes overridden using XCLIENT, nil if
+// there are none.
+func (s *Session) xclientState() *xclientState {
+	ec, ok := s.extConn()
+	if !ok {
+		return nil
+	}
+	return ec.overrides()
+}
+
+// transactionConnState returns the connection state for the new transaction
+// with attributes set using XFORWARD applied.
+//
+// Early checks are run again if XFORWARD changed the client address or
+// hostname since the message comes from a different client.
+func (s *Session) transactionConnState(ctx context.Context) (*module.ConnState, error) {
+	ec, ok := s.extConn()
+	if !ok {
+		return &s.connState, nil
+	}
+	xforward := ec.takeXFORWARD()
+	if xforward == nil {
+		return &s.connState, nil
+	}
+
+	connState := s.connState
+	xforward.applyConn(&connState.ConnectionState)
+	if xforward.ip != nil || xforward.port != 0 || xforward.helo != "" {
+		if err := s.endp.pipeline.RunEarlyChecks(ctx, &connState.ConnectionState); err != nil {
+			return nil, err
+		}
+	}
+	if xforward.proto != "" {
+		connState.Proto = xforward.proto
+	}
+	if xforward.rdnsSet {
+		connState.RDNSName = xforward.rdnsFuture()
+	} else if (xforward.ip != nil || xforward.port != 0) && s.endp.resolver != nil {
+		connState.RDNSName = future.New()
+		go s.fetchRDNSName(s.sessionCtx, connState.RemoteAddr, connState.RDNSName)
+	}
+	return &connState, nil
+}
+
+func (s *Session) AuthPlain(username, password string) error {
+	if s.endp.serv.AuthDisabled {
+		return smtp.ErrAuthUnsupported
+	}
+
+	if err := s.start("AUTH"); err != nil {
+		return err
+	}
+
+	err := s.endp.saslAuth.AuthPlain(username, password)
+	if err != nil {
+		s.log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
+
+		failedLogins.WithLabelValues(s.endp.name).Inc()
+
+		if exterrors.IsTemporary(err) {
+			return &smtp.SMTPError{
+				Code:         454,
+				EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+				Message:      "Temporary authentication failure",
+			}
+		}
+
+		return &smtp.SMTPError{
+			Code:         535,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+			Message:      "Invalid credentials",
+		}
+	}
+
+	s.connState.AuthUser = username
+	s.connState.AuthPassword = password
+	return nil
+}
+
 func (s *Session) Reset() {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
@@ -75,6 +225,9 @@ func (s *Session) Reset() {
 	if s.delivery != nil {
 		s.abort(s.msgCtx)
 	}
+	// Deferred MAIL FROM error applies only to the aborted transaction, the
+	// next one might come from a different client (XFORWARD).
+	s.deliveryErr = nil
 	s.endp.Log.DebugMsg("reset")
 }
 
@@ -104,6 +257,7 @@ func (s *Session) cleanSession() {
 
 	s.mailFrom = ""
 	s.opts = smtp.MailOptions{}
+	s.mailParams = mailParams{}
 	s.msgMeta = nil
 	s.delivery = nil
 	s.deliveryErr = nil
@@ -112,10 +266,24 @@ func (s *Session) cleanSession() {
 }
 
 func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.MailOptions) (string, error) {
-	var err error
+	connState, err := s.transactionConnState(ctx)
+	if err != nil {
+		return "", err
+	}
 	msgMeta := &module.MsgMetadata{
-		Conn:     &s.connState,
-		SMTPOpts: opts,
+		Conn:      connState,
+		AuthUser:  s.connState.AuthUser,
+		SMTPOpts:  opts,
+		HoldUntil: s.mailParams.holdUntil,
+	}
+	if s.mailParams.prioritySet {
+		msgMeta.Priority = s.mailParams.priority
+		// Only authenticated clients are trusted to raise the priority above
+		// the configured limit (RFC 6710 Section 4). Lowering it is always
+		// fine.
+		if s.connState.AuthUser == "" && msgMeta.Priority > *s.endp.mtPriorityMax {
+			msgMeta.Priority = *s.endp.mtPriorityMax
+		}
 	}
 
 	if s.connState.AuthUser != "" {
@@ -203,13 +371,24 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	return msgMeta.ID, nil
 }
 
-func (s *Session) Mail(from string, opts smtp.MailOptions) error {
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
+	if s.endp.authAlwaysRequired && s.connState.AuthUser == "" {
+		return smtp.ErrAuthRequired
+	}
+	if err := s.start("MAIL"); err != nil {
+		return err
+	}
+
+	if ec, ok := s.extConn(); ok {
+		s.mailParams = ec.takeMailParams()
+	}
+
 	if !s.endp.deferServerReject {
 		// Will initialize s.msgCtx.
-		msgID, err := s.startDelivery(s.sessionCtx, from, opts)
+		msgID, err := s.startDelivery(s.sessionCtx, from, *opts)
 		if err != nil {
 			if err != context.DeadlineExceeded {
 				s.log.Error("MAIL FROM error", err, "msg_id", msgID)
@@ -220,17 +399,17 @@ func (s *Session) Mail(from string, opts smtp.MailOptions) error {
 
 	// Keep the MAIL FROM argument for deferred startDelivery.
 	s.mailFrom = from
-	s.opts = opts
+	s.opts = *opts
 
 	return nil
 }
 
-func (s *Session) fetchRDNSName(ctx context.Context) {
+func (s *Session) fetchRDNSName(ctx context.Context, addr net.Addr, res *future.Future) {
 	defer trace.StartRegion(ctx, "rDNS fetch").End()
 
-	tcpAddr, ok := s.connState.RemoteAddr.(*net.TCPAddr)
+	tcpAddr, ok := addr.(*net.TCPAddr)
 	if !ok {
-		s.connState.RDNSName.Set(nil, nil)
+		res.Set(nil, nil)
 		return
 	}
 
@@ -238,7 +417,7 @@ func (s *Session) fetchRDNSName(ctx context.Context) {
 	if err != nil {
 		dnsErr, ok := err.(*net.DNSError)
 		if ok && dnsErr.IsNotFound {
-			s.connState.RDNSName.Set(nil, nil)
+			res.Set(nil, nil)
 			return
 		}
 
@@ -249,16 +428,16 @@ func (s *Session) fetchRDNSName(ctx context.Context) {
 			// rDNS name was not actually needed. So do not log cancelation
 			// error if that's the case.
 
-			s.log.Error("rDNS error", exterrors.WithFields(err, misc), "src_ip", s.connState.RemoteAddr)
+			s.log.Error("rDNS error", exterrors.WithFields(err, misc), "src_ip", addr)
 		}
-		s.connState.RDNSName.Set(nil, err)
+		res.Set(nil, err)
 		return
 	}
 
-	s.connState.RDNSName.Set(name, nil)
+	res.Set(name, nil)
 }
 
-func (s *Session) Rcpt(to string) error {
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -286,7 +465,7 @@ func (s *Session) Rcpt(to string) error {
 	rcptCtx, rcptTask := trace.NewTask(s.msgCtx, "RCPT TO")
 	defer rcptTask.End()
 
-	if err := s.rcpt(rcptCtx, to); err != nil {
+	if err := s.rcpt(rcptCtx, to, opts); err != nil {
 		if s.loggedRcptErrors < s.endp.maxLoggedRcptErrors {
 			s.log.Error("RCPT error", err, "rcpt", to, "msg_id", s.msgMeta.ID)
 			s.loggedRcptErrors++
@@ -300,7 +479,7 @@ func (s *Session) Rcpt(to string) error {
 	return nil
 }
 
-func (s *Session) rcpt(ctx context.Context, to string) error {
+func (s *Session) rcpt(ctx context.Context, to string, opts *smtp.RcptOptions) error {
 	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
 	// used.
 	if !address.IsASCII(to) && !s.opts.UTF8 {
@@ -319,7 +498,19 @@ func (s *Session) rcpt(ctx context.Context, to string) error {
 		}
 	}
 
-	return s.delivery.AddRcpt(ctx, cleanTo)
+	// Should be set before AddRcpt since targets may use it right away.
+	if opts != nil && (len(opts.Notify) != 0 || opts.OriginalRecipient != "") {
+		if s.msgMeta.RcptOpts == nil {
+			s.msgMeta.RcptOpts = make(map[string]smtp.RcptOptions)
+		}
+		s.msgMeta.RcptOpts[cleanTo] = *opts
+	}
+
+	if err := s.delivery.AddRcpt(ctx, cleanTo); err != nil {
+		delete(s.msgMeta.RcptOpts, cleanTo)
+		return err
+	}
+	return nil
 }
 
 func (s *Session) Logout() error {
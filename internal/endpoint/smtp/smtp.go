@@ -39,13 +39,12 @@ import (
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
 	"github.com/foxcpp/maddy/framework/dns"
-	"github.com/foxcpp/maddy/framework/exterrors"
-	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/proxy_protocol"
 	"golang.org/x/net/idna"
 )
 
@@ -59,8 +58,27 @@ type Endpoint struct {
 	resolver  dns.Resolver
 	limits    *limits.Group
 
+	// nil if PROXY protocol is not used.
+	proxyProtocol *proxy_protocol.Config
+	// Connections allowed to use XCLIENT and XFORWARD, nil if the
+	// commands are disabled.
+	xclientTrust  config.Networks
+	xforwardTrust config.Networks
+
+	// TLS is terminated by extConn, the server itself sees only plaintext
+	// connections.
+	tlsConfig    *tls.Config
+	insecureAuth bool
+
 	buffer func(r io.Reader) (buffer.Buffer, error)
 
+	// maxFutureRelease is the max. hold interval for FUTURERELEASE, zero if
+	// the extension is disabled.
+	maxFutureRelease time.Duration
+	// mtPriorityMax is the max. MT-PRIORITY value accepted from
+	// unauthenticated clients, nil if the extension is disabled.
+	mtPriorityMax *int
+
 	authAlwaysRequired  bool
 	submission          bool
 	lmtp                bool
@@ -103,6 +121,10 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	endp.serv.LMTP = endp.lmtp
 	endp.serv.EnableSMTPUTF8 = true
 	endp.serv.EnableREQUIRETLS = true
+	endp.serv.EnableDSN = true
+	// Restrictions on AUTH over plaintext connections are enforced by
+	// extConn.
+	endp.serv.AllowInsecureAuth = true
 	if err := endp.setConfig(cfg); err != nil {
 		return err
 	}
@@ -117,13 +139,6 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		addresses = append(addresses, saddr)
 	}
 
-	if err := endp.setupListeners(addresses); err != nil {
-		for _, l := range endp.listeners {
-			l.Close()
-		}
-		return err
-	}
-
 	allLocal := true
 	for _, addr := range addresses {
 		if addr.Scheme != "unix" && !strings.HasPrefix(addr.Host, "127.0.0.") {
@@ -131,15 +146,22 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		}
 	}
 
-	if endp.serv.AllowInsecureAuth && !allLocal {
+	if endp.insecureAuth && !allLocal {
 		endp.Log.Println("authentication over unencrypted connections is allowed, this is insecure configuration and should be used only for testing!")
 	}
-	if endp.serv.TLSConfig == nil {
+	if endp.tlsConfig == nil {
 		if !allLocal {
 			endp.Log.Println("TLS is disabled, this is insecure configuration and should be used only for testing!")
 		}
 
-		endp.serv.AllowInsecureAuth = true
+		endp.insecureAuth = true
+	}
+
+	if err := endp.setupListeners(addresses); err != nil {
+		for _, l := range endp.listeners {
+			l.Close()
+		}
+		return err
 	}
 
 	return nil
@@ -233,9 +255,10 @@ func bufferModeDirective(m *config.Map, node config.Node) (interface{}, error) {
 
 func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	var (
-		hostname string
-		err      error
-		ioDebug  bool
+		hostname    string
+		err         error
+		ioDebug     bool
+		maxMsgBytes int
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
@@ -244,9 +267,11 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	cfg.String("hostname", true, true, "", &hostname)
 	cfg.Duration("write_timeout", false, false, 1*time.Minute, &endp.serv.WriteTimeout)
 	cfg.Duration("read_timeout", false, false, 10*time.Minute, &endp.serv.ReadTimeout)
-	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &endp.serv.MaxMessageBytes)
+	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &maxMsgBytes)
 	cfg.Int("max_recipients", false, false, 20000, &endp.serv.MaxRecipients)
 	cfg.Int("max_received", false, false, 50, &endp.maxReceived)
+	cfg.Duration("max_future_release", false, false, 0, &endp.maxFutureRelease)
+	cfg.Custom("mt_priority", false, false, nil, module.PriorityDirective, &endp.mtPriorityMax)
 	cfg.Custom("buffer", false, false, func() (interface{}, error) {
 		path := filepath.Join(config.StateDirectory, "buffer")
 		if err := os.MkdirAll(path, 0700); err != nil {
@@ -254,9 +279,10 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return autoBufferMode(1*1024*1024 /* 1 MiB */, path), nil
 	}, bufferModeDirective, &endp.buffer)
-	cfg.Custom("tls", true, endp.name != "lmtp", nil, tls2.TLSDirective, &endp.serv.TLSConfig)
-	cfg.Bool("insecure_auth", endp.name == "lmtp", false, &endp.serv.AllowInsecureAuth)
+	cfg.Custom("tls", true, endp.name != "lmtp", nil, tls2.TLSDirective, &endp.tlsConfig)
+	cfg.Bool("insecure_auth", endp.name == "lmtp", false, &endp.insecureAuth)
 	cfg.Int("smtp_max_line_length", false, false, 4000, &endp.serv.MaxLineLength)
+	cfg.Bool("binarymime", false, false, &endp.serv.EnableBINARYMIME)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
 	cfg.Bool("defer_sender_reject", false, true, &endp.deferServerReject)
@@ -270,12 +296,17 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &endp.limits)
+	cfg.Custom("proxy_protocol", false, false, nil, proxy_protocol.ProxyProtocolDirective, &endp.proxyProtocol)
+	cfg.Custom("xclient_trust", false, false, nil, trustedNetsDirective, &endp.xclientTrust)
+	cfg.Custom("xforward_trust", false, false, nil, trustedNetsDirective, &endp.xforwardTrust)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
 		return err
 	}
 
+	endp.serv.MaxMessageBytes = int64(maxMsgBytes)
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.3.
 	endp.serv.Domain, err = idna.ToASCII(hostname)
 	if err != nil {
@@ -300,7 +331,8 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	}
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		// The code below lacks handling to set AuthPassword. Don't
-		// override sasl.Plain handler so Login() will be called as usual.
+		// override sasl.Plain handler so Session.AuthPlain will be called
+		// as usual.
 		if mech == sasl.Plain {
 			continue
 		}
@@ -308,13 +340,13 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		mech := mech
 
 		endp.serv.EnableAuth(mech, func(c *smtp.Conn) sasl.Server {
-			state := c.State()
-			if err := endp.pipeline.RunEarlyChecks(context.TODO(), &state); err != nil {
-				return auth.FailingSASLServ{Err: endp.wrapErr("", true, "AUTH", err)}
+			s := c.Session().(*Session)
+			if err := s.start("AUTH"); err != nil {
+				return auth.FailingSASLServ{Err: err}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, state.RemoteAddr, func(id string) error {
-				c.SetSession(endp.newSession(false, id, "", &state))
+			return endp.saslAuth.CreateSASL(mech, s.connState.RemoteAddr, func(id string) error {
+				s.connState.AuthUser = id
 				return nil
 			})
 		})
@@ -338,12 +370,15 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 		endp.Log.Printf("listening on %v", addr)
 
-		if addr.IsTLS() {
-			if endp.serv.TLSConfig == nil {
-				return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
-			}
-			l = tls.NewListener(l, endp.serv.TLSConfig)
+		if endp.proxyProtocol != nil {
+			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
+		}
+
+		if addr.IsTLS() && endp.tlsConfig == nil {
+			l.Close()
+			return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
 		}
+		l = newExtListener(l, endp, addr.IsTLS())
 
 		endp.listeners = append(endp.listeners, l)
 
@@ -360,85 +395,31 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	return nil
 }
 
-func (endp *Endpoint) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	if endp.serv.AuthDisabled {
-		return nil, smtp.ErrAuthUnsupported
-	}
-
-	// Executed before authentication and session initialization.
-	if err := endp.pipeline.RunEarlyChecks(context.TODO(), state); err != nil {
-		return nil, endp.wrapErr("", true, "AUTH", err)
-	}
-
-	err := endp.saslAuth.AuthPlain(username, password)
-	if err != nil {
-		endp.Log.Error("authentication failed", err, "username", username, "src_ip", state.RemoteAddr)
-
-		failedLogins.WithLabelValues(endp.name).Inc()
-
-		if exterrors.IsTemporary(err) {
-			return nil, &smtp.SMTPError{
-				Code:         454,
-				EnhancedCode: smtp.EnhancedCode{4, 7, 0},
-				Message:      "Temporary authentication failure",
-			}
-		}
-
-		return nil, &smtp.SMTPError{
-			Code:         535,
-			EnhancedCode: smtp.EnhancedCode{5, 7, 8},
-			Message:      "Invalid credentials",
-		}
-	}
-
-	return endp.newSession(false, username, password, state), nil
-}
-
-func (endp *Endpoint) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	if endp.authAlwaysRequired {
-		return nil, smtp.ErrAuthRequired
-	}
-
-	// Executed before authentication and session initialization.
-	if err := endp.pipeline.RunEarlyChecks(context.TODO(), state); err != nil {
-		return nil, endp.wrapErr("", true, "MAIL", err)
-	}
-
-	return endp.newSession(true, "", "", state), nil
-}
-
-func (endp *Endpoint) newSession(anonymous bool, username, password string, state *smtp.ConnectionState) smtp.Session {
+func (endp *Endpoint) NewSession(conn *smtp.Conn) (smtp.Session, error) {
 	s := &Session{
-		endp: endp,
-		log:  endp.Log,
-		connState: module.ConnState{
-			ConnectionState: *state,
-			AuthUser:        username,
-			AuthPassword:    password,
-		},
+		endp:       endp,
+		conn:       conn,
+		log:        endp.Log,
 		sessionCtx: context.Background(),
 	}
 
-	if endp.serv.LMTP {
-		s.connState.Proto = "LMTP"
-	} else {
-		// Check if TLS connection state struct is poplated.
-		// If it is - we are ssing TLS.
-		if state.TLS.HandshakeComplete {
-			s.connState.Proto = "ESMTPS"
-		} else {
-			s.connState.Proto = "ESMTP"
+	// go-smtp creates a new session for each HELO/EHLO and replaces the
+	// previous one without calling Logout, so the transaction it had in
+	// progress has to be aborted here. The authenticated user is kept since
+	// go-smtp does not allow AUTH again on the same connection.
+	if conn != nil {
+		if prev, ok := conn.Session().(*Session); ok && prev != nil {
+			if err := prev.Logout(); err != nil {
+				endp.Log.Error("session logout failed", err)
+			}
+			s.connState.AuthUser = prev.connState.AuthUser
+			s.connState.AuthPassword = prev.connState.AuthPassword
 		}
 	}
-
-	if endp.resolver != nil {
-		rdnsCtx, cancelRDNS := context.WithCancel(s.sessionCtx)
-		s.connState.RDNSName = future.New()
-		s.cancelRDNS = cancelRDNS
-		go s.fetchRDNSName(rdnsCtx)
+	if xclient := s.xclientState(); xclient != nil && xclient.login != "" {
+		s.connState.AuthUser = xclient.login
 	}
-
-	return s
+	return s, nil
 }
 
 func (endp *Endpoint) Close() error {
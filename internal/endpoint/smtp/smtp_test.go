@@ -19,10 +19,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
+	"context"
 	"flag"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -48,8 +50,13 @@ const testMsg = "From: <sender@example.org>\r\n" +
 
 func testEndpoint(t *testing.T, modName string, authMod module.PlainAuth, tgt module.DeliveryTarget, checks []module.Check, cfg []config.Node) *Endpoint {
 	t.Helper()
+	return testEndpointAt(t, "tcp://127.0.0.1:"+testPort, modName, authMod, tgt, checks, cfg)
+}
+
+func testEndpointAt(t *testing.T, addr, modName string, authMod module.PlainAuth, tgt module.DeliveryTarget, checks []module.Check, cfg []config.Node) *Endpoint {
+	t.Helper()
 
-	mod, err := New(modName, []string{"tcp://127.0.0.1:" + testPort})
+	mod, err := New(modName, []string{addr})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,15 +74,24 @@ func testEndpoint(t *testing.T, modName string, authMod module.PlainAuth, tgt mo
 	}
 	endp.Log = testutils.Logger(t, "smtp")
 
+	hasTLS := false
+	for _, node := range cfg {
+		if node.Name == "tls" {
+			hasTLS = true
+		}
+	}
+	if !hasTLS {
+		cfg = append(cfg, config.Node{
+			Name: "tls",
+			Args: []string{"off"},
+		})
+	}
+
 	cfg = append(cfg,
 		config.Node{
 			Name: "hostname",
 			Args: []string{"mx.example.com"},
 		},
-		config.Node{
-			Name: "tls",
-			Args: []string{"off"},
-		},
 		config.Node{ // To make it succeed, pipeline is actually replaced below.
 			Name: "deliver_to",
 			Args: []string{"dummy"},
@@ -124,7 +140,7 @@ func submitMsgOpts(t *testing.T, cl *smtp.Client, from string, rcpts []string, o
 		return err
 	}
 	for _, rcpt := range rcpts {
-		if err := cl.Rcpt(rcpt); err != nil {
+		if err := cl.Rcpt(rcpt, nil); err != nil {
 			return err
 		}
 	}
@@ -180,6 +196,47 @@ func TestSMTPDelivery(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_ProxyProtocol(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "proxy_protocol",
+			Args: []string{"127.0.0.0/8"},
+		},
+	})
+	defer endp.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 12345 25\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := smtp.NewClient(conn, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.com"}, testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	tcpAddr, ok := msg.MsgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(net.IPv4(192, 0, 2, 1)) || tcpAddr.Port != 12345 {
+		t.Error("Wrong remote address:", msg.MsgMeta.Conn.RemoteAddr)
+	}
+	if !strings.Contains(msg.Header.Get("Received"), "[192.0.2.1]") {
+		t.Error("Wrong Received contents:", msg.Header.Get("Received"))
+	}
+}
+
 func TestSMTPDelivery_rDNSError(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
@@ -337,9 +394,9 @@ func TestSMTPDeliver_CheckError_Deferred(t *testing.T) {
 		}
 	}
 
-	checkErr(cl.Rcpt("test1@example.org"))
-	checkErr(cl.Rcpt("test1@example.org"))
-	checkErr(cl.Rcpt("test2@example.org"))
+	checkErr(cl.Rcpt("test1@example.org", nil))
+	checkErr(cl.Rcpt("test1@example.org", nil))
+	checkErr(cl.Rcpt("test2@example.org", nil))
 }
 
 func TestSMTPDelivery_Multi(t *testing.T) {
@@ -380,6 +437,127 @@ func TestSMTPDelivery_Multi(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_DSN(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Hello("mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cl.Extension("DSN"); !ok {
+		t.Fatal("DSN extension is not advertised")
+	}
+	err = cl.Mail("sender@example.org", &smtp.MailOptions{
+		Return:     smtp.DSNReturnHeaders,
+		EnvelopeID: "QQ314159",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcptOpts := smtp.RcptOptions{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     "rcpt1-orig@example.com",
+	}
+	if err := cl.Rcpt("rcpt1@example.com", &rcptOpts); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("rcpt2@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msgMeta := tgt.Messages[0].MsgMeta
+	if msgMeta.SMTPOpts.Return != smtp.DSNReturnHeaders {
+		t.Error("Wrong RET value:", msgMeta.SMTPOpts.Return)
+	}
+	if msgMeta.SMTPOpts.EnvelopeID != "QQ314159" {
+		t.Error("Wrong ENVID value:", msgMeta.SMTPOpts.EnvelopeID)
+	}
+	if opts := msgMeta.RcptOptsFor("rcpt1@example.com"); !reflect.DeepEqual(opts, rcptOpts) {
+		t.Errorf("Wrong RCPT TO options: %+v", opts)
+	}
+	if opts := msgMeta.RcptOptsFor("rcpt2@example.com"); !reflect.DeepEqual(opts, smtp.RcptOptions{}) {
+		t.Errorf("Wrong RCPT TO options: %+v", opts)
+	}
+}
+
+func TestSMTPDelivery_BINARYMIMEDisabled(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := cl.Hello("mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := cl.Extension("BINARYMIME"); ok {
+		t.Fatal("BINARYMIME extension is advertised by default")
+	}
+}
+
+func TestSMTPDelivery_BDAT(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "binarymime",
+			Args: []string{"yes"},
+		},
+	})
+	defer endp.Close()
+
+	// go-smtp.Client does not support BDAT.
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if !hasLine(ehlo, "BINARYMIME") || !hasLine(ehlo, "CHUNKING") {
+		t.Fatal("Wrong EHLO response:", ehlo)
+	}
+	c.cmd("MAIL FROM:<sender@example.org> BODY=BINARYMIME", "250")
+	c.cmd("RCPT TO:<rcpt@example.com>", "250")
+	chunk := "From: <sender@example.org>\r\n\r\nfoo\x00bar\n"
+	if _, err := c.conn.Write([]byte("BDAT " + strconv.Itoa(len(chunk)) + " LAST\r\n" + chunk)); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("250")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MsgMeta.SMTPOpts.Body != smtp.BodyBinaryMIME {
+		t.Error("Wrong BODY value:", msg.MsgMeta.SMTPOpts.Body)
+	}
+	if string(msg.Body) != "foo\x00bar\n" {
+		t.Errorf("Wrong body: %q", msg.Body)
+	}
+}
+
 func TestSMTPDelivery_AbortData(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
@@ -397,7 +575,7 @@ func TestSMTPDelivery_AbortData(t *testing.T) {
 	if err := cl.Mail("sender@example.org", nil); err != nil {
 		t.Fatal(err)
 	}
-	if err := cl.Rcpt("test@example.com"); err != nil {
+	if err := cl.Rcpt("test@example.com", nil); err != nil {
 		t.Fatal(err)
 	}
 	data, err := cl.Data()
@@ -435,7 +613,7 @@ func TestSMTPDelivery_EmptyMessage(t *testing.T) {
 	if err := cl.Mail("sender@example.org", nil); err != nil {
 		t.Fatal(err)
 	}
-	if err := cl.Rcpt("test@example.com"); err != nil {
+	if err := cl.Rcpt("test@example.com", nil); err != nil {
 		t.Fatal(err)
 	}
 	data, err := cl.Data()
@@ -474,7 +652,7 @@ func TestSMTPDelivery_AbortLogout(t *testing.T) {
 	if err := cl.Mail("sender@example.org", nil); err != nil {
 		t.Fatal(err)
 	}
-	if err := cl.Rcpt("test@example.com"); err != nil {
+	if err := cl.Rcpt("test@example.com", nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -488,6 +666,59 @@ func TestSMTPDelivery_AbortLogout(t *testing.T) {
 	}
 }
 
+// abortTarget wraps testutils.Target and reports aborted deliveries.
+type abortTarget struct {
+	testutils.Target
+	aborted chan struct{}
+}
+
+type abortDelivery struct {
+	module.Delivery
+	aborted chan struct{}
+}
+
+func (at *abortTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	delivery, err := at.Target.Start(ctx, msgMeta, mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return abortDelivery{Delivery: delivery, aborted: at.aborted}, nil
+}
+
+func (ad abortDelivery) Abort(ctx context.Context) error {
+	ad.aborted <- struct{}{}
+	return ad.Delivery.Abort(ctx)
+}
+
+func TestSMTPDelivery_AbortEHLO(t *testing.T) {
+	tgt := abortTarget{aborted: make(chan struct{}, 10)}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	c.cmd("EHLO mx.example.org", "250")
+	c.cmd("MAIL FROM:<sender@example.org>", "250")
+	c.cmd("RCPT TO:<test@example.com>", "250")
+
+	// EHLO in the middle of the transaction starts a new session, the
+	// delivery of the previous one should not be left open.
+	c.cmd("EHLO mx.example.org", "250")
+	select {
+	case <-tgt.aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery is not aborted")
+	}
+
+	c.send("sender@example.org", "rcpt1@example.com", testMsg)
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	testutils.CheckMsgID(t, &msg, "sender@example.org", []string{"rcpt1@example.com"}, "")
+}
+
 func TestSMTPDelivery_Reset(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
@@ -502,7 +733,7 @@ func TestSMTPDelivery_Reset(t *testing.T) {
 	if err := cl.Mail("from-garbage@example.org", nil); err != nil {
 		t.Fatal(err)
 	}
-	if err := cl.Rcpt("to-garbage@example.org"); err != nil {
+	if err := cl.Rcpt("to-garbage@example.org", nil); err != nil {
 		t.Fatal(err)
 	}
 	if err := cl.Reset(); err != nil {
@@ -0,0 +1,261 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dsn"
+)
+
+// XCLIENT and XFORWARD are Postfix extensions used by SMTP proxies and content
+// filters to pass the information about the original client.
+//
+// See http://www.postfix.org/XCLIENT_README.html and
+// http://www.postfix.org/XFORWARD_README.html.
+//
+// The commands are handled by extConn, see conn.go.
+
+const (
+	xclientUnavailable = "[UNAVAILABLE]"
+	xclientTempUnavail = "[TEMPUNAVAIL]"
+
+	xclientAttrs  = "NAME ADDR PORT PROTO HELO LOGIN"
+	xforwardAttrs = "NAME ADDR PORT PROTO HELO IDENT SOURCE"
+)
+
+var errXclientTempUnavail = errors.New("smtp: rDNS name is temporary unavailable (XCLIENT)")
+
+// xclientState contains connection attributes received via XCLIENT or
+// XFORWARD.
+type xclientState struct {
+	ip   net.IP
+	port int
+	helo string
+
+	// rdnsSet is true if NAME was specified. rdnsName is empty if the name is
+	// not available.
+	rdnsSet  bool
+	rdnsName string
+	rdnsErr  error
+
+	login string
+	proto string
+}
+
+// applyConn applies the ADDR, PORT and HELO attributes.
+func (st *xclientState) applyConn(state *module.ConnectionState) {
+	if st.helo != "" {
+		state.Hostname = st.helo
+	}
+	if st.ip == nil && st.port == 0 {
+		return
+	}
+
+	addr := &net.TCPAddr{}
+	if tcpAddr, ok := state.RemoteAddr.(*net.TCPAddr); ok {
+		*addr = *tcpAddr
+	}
+	if st.ip != nil {
+		addr.IP = st.ip
+	}
+	if st.port != 0 {
+		addr.Port = st.port
+	}
+	if addr.IP == nil {
+		// Only PORT is specified for a non-TCP connection.
+		return
+	}
+	state.RemoteAddr = addr
+}
+
+func (st *xclientState) rdnsFuture() *future.Future {
+	f := future.New()
+	if st.rdnsName == "" {
+		f.Set(nil, st.rdnsErr)
+	} else {
+		f.Set(st.rdnsName, nil)
+	}
+	return f
+}
+
+// parseAttrs parses arguments of XCLIENT or XFORWARD and updates st.
+//
+// Returned error message is sent to the client as is.
+func (st *xclientState) parseAttrs(arg, allowed string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return errors.New("Attribute name=value pair required")
+	}
+
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("Attribute name=value pair required")
+		}
+		name := strings.ToUpper(parts[0])
+		if !strings.Contains(" "+allowed+" ", " "+name+" ") {
+			return fmt.Errorf("Bad attribute name: %s", parts[0])
+		}
+		val, err := dsn.DecodeXtext(parts[1])
+		if err != nil {
+			return fmt.Errorf("Bad %s attribute value: %v", name, err)
+		}
+		unavail := val == xclientUnavailable || val == xclientTempUnavail
+
+		switch name {
+		case "NAME":
+			st.rdnsSet = true
+			st.rdnsName, st.rdnsErr = "", nil
+			switch val {
+			case xclientUnavailable:
+			case xclientTempUnavail:
+				st.rdnsErr = errXclientTempUnavail
+			default:
+				st.rdnsName = strings.TrimSuffix(val, ".")
+			}
+		case "ADDR":
+			if unavail {
+				st.ip = nil
+				continue
+			}
+			if len(val) > 5 && strings.EqualFold(val[:5], "IPV6:") {
+				val = val[5:]
+			}
+			st.ip = net.ParseIP(val)
+			if st.ip == nil {
+				return fmt.Errorf("Bad ADDR attribute value: %s", val)
+			}
+		case "PORT":
+			if unavail {
+				st.port = 0
+				continue
+			}
+			port, err := strconv.ParseUint(val, 10, 16)
+			if err != nil || port == 0 {
+				return fmt.Errorf("Bad PORT attribute value: %s", val)
+			}
+			st.port = int(port)
+		case "HELO":
+			if unavail {
+				st.helo = ""
+				continue
+			}
+			st.helo = val
+		case "LOGIN":
+			if unavail {
+				st.login = ""
+				continue
+			}
+			st.login = val
+		case "PROTO":
+			if unavail {
+				st.proto = ""
+				continue
+			}
+			st.proto = strings.ToUpper(val)
+			if st.proto != "SMTP" && st.proto != "ESMTP" {
+				return fmt.Errorf("Bad PROTO attribute value: %s", val)
+			}
+		case "IDENT", "SOURCE":
+			// Accepted for compatibility, not used.
+		}
+	}
+	return nil
+}
+
+func trustedNetsDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one trusted source is required")
+	}
+	return config.ParseNetworks(node, node.Args)
+}
+
+// overrides returns attributes set using XCLIENT, nil if there are none.
+func (c *extConn) overrides() *xclientState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.xclient == nil {
+		return nil
+	}
+	st := *c.xclient
+	return &st
+}
+
+// takeXFORWARD returns attributes set using XFORWARD and clears them so they
+// are not applied to the next transaction.
+func (c *extConn) takeXFORWARD() *xclientState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	st := c.xforward
+	c.xforward = nil
+	return st
+}
+
+func (c *extConn) handleXCLIENT(arg string) error {
+	if !c.allowXCLIENT {
+		return c.reply("550 5.7.0 Insufficient authorization")
+	}
+
+	st := xclientState{}
+	if xclient := c.overrides(); xclient != nil {
+		st = *xclient
+	}
+	if err := st.parseAttrs(arg, xclientAttrs); err != nil {
+		return c.reply("501 5.5.4 " + err.Error())
+	}
+
+	// The session starts over as if the client connected from the specified
+	// address, the server sends the greeting for the new connection.
+	if err := c.restart(&st, false); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (c *extConn) handleXFORWARD(arg string) error {
+	if !c.allowXFORWARD {
+		return c.reply("550 5.7.0 Insufficient authorization")
+	}
+	if !c.helo {
+		return c.reply("502 5.5.1 Please introduce yourself first.")
+	}
+
+	c.stateLock.Lock()
+	st := xclientState{}
+	if c.xforward != nil {
+		st = *c.xforward
+	}
+	if err := st.parseAttrs(arg, xforwardAttrs); err != nil {
+		c.stateLock.Unlock()
+		return c.reply("501 5.5.4 " + err.Error())
+	}
+	c.xforward = &st
+	c.stateLock.Unlock()
+
+	return c.reply("250 2.0.0 Ok")
+}
@@ -0,0 +1,386 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRaw(t *testing.T) *rawClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect("220")
+	return c
+}
+
+// expect reads the response and checks that it starts with the code. All
+// response lines are returned.
+func (c *rawClient) expect(code string) []string {
+	c.t.Helper()
+
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			break
+		}
+	}
+	if !strings.HasPrefix(lines[0], code) {
+		c.t.Fatalf("Expected %s, got %v", code, lines)
+	}
+	return lines
+}
+
+func (c *rawClient) cmd(cmd, code string) []string {
+	c.t.Helper()
+
+	if _, err := c.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+func (c *rawClient) send(from, rcpt, body string) {
+	c.t.Helper()
+
+	c.cmd("MAIL FROM:<"+from+">", "250")
+	c.cmd("RCPT TO:<"+rcpt+">", "250")
+	c.cmd("DATA", "354")
+	c.cmd(body+".", "250")
+}
+
+func hasLine(lines []string, prefix string) bool {
+	for _, l := range lines {
+		if strings.HasPrefix(l[4:], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSMTPDelivery_XCLIENT(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "xclient_trust",
+			Args: []string{"127.0.0.0/8"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if !hasLine(ehlo, "XCLIENT ") || hasLine(ehlo, "XFORWARD ") {
+		t.Fatal("Wrong EHLO response:", ehlo)
+	}
+	if !strings.HasPrefix(ehlo[len(ehlo)-1], "250 ") {
+		t.Fatal("Malformed EHLO response:", ehlo)
+	}
+
+	c.cmd("XCLIENT ADDR=192.0.2.1 PORT=1234 NAME=client.example.org HELO=client.example.org+zz", "501")
+	c.cmd("XCLIENT ADDR=192.0.2.1 PORT=1234 NAME=client.example.org HELO=client.example.org", "220")
+	c.cmd("MAIL FROM:<sender@example.org>", "502")
+	c.cmd("EHLO mx.example.org", "250")
+	// The line that looks like the command is a part of the message.
+	c.send("sender@example.org", "rcpt@example.com", testMsg+"XCLIENT ADDR=192.0.2.2\r\n")
+	c.cmd("QUIT", "221")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	tcpAddr, ok := msg.MsgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(net.IPv4(192, 0, 2, 1)) || tcpAddr.Port != 1234 {
+		t.Error("Wrong remote address:", msg.MsgMeta.Conn.RemoteAddr)
+	}
+	if msg.MsgMeta.Conn.Hostname != "client.example.org" {
+		t.Error("Wrong hostname:", msg.MsgMeta.Conn.Hostname)
+	}
+	if !strings.Contains(msg.Header.Get("Received"), "from client.example.org (client.example.org [192.0.2.1])") {
+		t.Error("Wrong Received contents:", msg.Header.Get("Received"))
+	}
+	if !strings.HasSuffix(string(msg.Body), "XCLIENT ADDR=192.0.2.2\r\n") {
+		t.Errorf("Wrong body: %q", msg.Body)
+	}
+}
+
+func TestSMTPDelivery_XCLIENT_Login(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "xclient_trust",
+			Args: []string{"127.0.0.1"},
+		},
+		{
+			Name: "auth",
+			Args: []string{"dummy"},
+		},
+		{
+			Name: "insecure_auth",
+			Args: []string{"yes"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	c.cmd("EHLO mx.example.org", "250")
+	c.cmd("MAIL FROM:<sender@example.org>", "502")
+	c.cmd("XCLIENT LOGIN=user", "220")
+	c.cmd("EHLO mx.example.org", "250")
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if user := tgt.Messages[0].MsgMeta.AuthUser; user != "user" {
+		t.Error("Wrong AuthUser:", user)
+	}
+
+	// XCLIENT discards the authentication, AUTH can be used again.
+	c.cmd("XCLIENT LOGIN=[UNAVAILABLE]", "220")
+	c.cmd("EHLO mx.example.org", "250")
+	c.cmd("MAIL FROM:<sender@example.org>", "502")
+	c.cmd("AUTH PLAIN AHVzZXIAcGFzcw==", "235")
+	c.cmd("MAIL FROM:<sender@example.org>", "250")
+}
+
+func TestSMTPDelivery_XCLIENT_Untrusted(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "xclient_trust",
+			Args: []string{"192.0.2.0/24"},
+		},
+		{
+			Name: "xforward_trust",
+			Args: []string{"192.0.2.0/24"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if hasLine(ehlo, "XCLIENT ") || hasLine(ehlo, "XFORWARD ") {
+		t.Fatal("Extensions are advertised for untrusted client:", ehlo)
+	}
+	c.cmd("XCLIENT ADDR=192.0.2.1", "550")
+	c.cmd("XFORWARD ADDR=192.0.2.1", "550")
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	tcpAddr, ok := tgt.Messages[0].MsgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("Wrong remote address:", tgt.Messages[0].MsgMeta.Conn.RemoteAddr)
+	}
+}
+
+func TestSMTPDelivery_XFORWARD(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "xforward_trust",
+			Args: []string{"127.0.0.1"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	ehlo := c.cmd("EHLO mx.example.org", "250")
+	if hasLine(ehlo, "XCLIENT ") || !hasLine(ehlo, "XFORWARD ") {
+		t.Fatal("Wrong EHLO response:", ehlo)
+	}
+	c.cmd("XCLIENT ADDR=192.0.2.1", "550")
+	c.cmd("XFORWARD ADDR=IPV6:2001:db8::1 NAME=[UNAVAILABLE]", "250")
+	c.cmd("XFORWARD HELO=client.example.org PROTO=SMTP SOURCE=REMOTE", "250")
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+
+	// Attributes are used only for one transaction.
+	// Also make sure BDAT chunks are not interpreted as commands.
+	chunk := testMsg + "XFORWARD ADDR=192.0.2.1\r\n"
+	c.cmd("MAIL FROM:<sender@example.org>", "250")
+	c.cmd("RCPT TO:<rcpt@example.com>", "250")
+	c.cmd("BDAT "+strconv.Itoa(len(chunk))+"\r\n"+strings.TrimSuffix(chunk, "\r\n"), "250")
+	c.cmd("BDAT 0 LAST", "250")
+
+	if len(tgt.Messages) != 2 {
+		t.Fatal("Expected 2 messages, got", len(tgt.Messages))
+	}
+	if body := string(tgt.Messages[1].Body); !strings.HasSuffix(body, "XFORWARD ADDR=192.0.2.1\r\n") {
+		t.Errorf("Wrong body: %q", body)
+	}
+	conn := tgt.Messages[0].MsgMeta.Conn
+	tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Error("Wrong remote address:", conn.RemoteAddr)
+	}
+	if conn.Hostname != "client.example.org" || conn.Proto != "SMTP" {
+		t.Error("Wrong hostname or protocol:", conn.Hostname, conn.Proto)
+	}
+	if received := tgt.Messages[0].Header.Get("Received"); !strings.HasPrefix(received, "from client.example.org ([2001:db8::1])") ||
+		!strings.Contains(received, " with SMTP ") {
+		t.Error("Wrong Received contents:", received)
+	}
+
+	conn = tgt.Messages[1].MsgMeta.Conn
+	tcpAddr, ok = conn.RemoteAddr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) || conn.Hostname != "mx.example.org" {
+		t.Error("Wrong connection state for the second message:", conn.RemoteAddr, conn.Hostname)
+	}
+}
+
+// addrCheck rejects connections from the specified IP.
+type addrCheck struct {
+	testutils.Check
+	reject net.IP
+}
+
+func (c *addrCheck) CheckConnection(ctx context.Context, state *module.ConnectionState) error {
+	if tcpAddr, ok := state.RemoteAddr.(*net.TCPAddr); ok && tcpAddr.IP.Equal(c.reject) {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Go away",
+		}
+	}
+	return nil
+}
+
+func TestSMTPDelivery_XCLIENT_EarlyChecks(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&addrCheck{reject: net.IPv4(192, 0, 2, 66)},
+	}, []config.Node{
+		{
+			Name: "xclient_trust",
+			Args: []string{"127.0.0.1"},
+		},
+		{
+			Name: "xforward_trust",
+			Args: []string{"127.0.0.1"},
+		},
+	})
+	defer endp.Close()
+
+	c := dialRaw(t)
+	defer c.conn.Close()
+
+	c.cmd("EHLO mx.example.org", "250")
+	c.cmd("XCLIENT ADDR=192.0.2.66", "220")
+	c.cmd("EHLO mx.example.org", "250")
+	c.cmd("MAIL FROM:<sender@example.org>", "550")
+
+	c.cmd("XCLIENT ADDR=192.0.2.1", "220")
+	c.cmd("EHLO mx.example.org", "250")
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+
+	c.cmd("XFORWARD ADDR=192.0.2.66", "250")
+	// Server rejects are deferred to RCPT by default.
+	c.cmd("MAIL FROM:<sender@example.org>", "250")
+	c.cmd("RCPT TO:<rcpt@example.com>", "550")
+	c.cmd("RSET", "250")
+	// Attributes are discarded with the failed transaction.
+	c.send("sender@example.org", "rcpt@example.com", testMsg)
+
+	if len(tgt.Messages) != 2 {
+		t.Fatal("Expected 2 messages, got", len(tgt.Messages))
+	}
+	for _, msg := range tgt.Messages {
+		tcpAddr, ok := msg.MsgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+		if !ok || !tcpAddr.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Error("Wrong remote address:", msg.MsgMeta.Conn.RemoteAddr)
+		}
+	}
+}
+
+func TestSMTPDelivery_XCLIENT_Client(t *testing.T) {
+	// Make sure the usual client works fine with the extensions enabled.
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "xclient_trust",
+			Args: []string{"127.0.0.1"},
+		},
+		{
+			Name: "xforward_trust",
+			Args: []string{"127.0.0.1"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := cl.Extension("XCLIENT"); !ok {
+		t.Error("XCLIENT is not advertised")
+	}
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.com"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 2 {
+		t.Fatal("Expected 2 messages, got", len(tgt.Messages))
+	}
+	testutils.CheckMsgID(t, &tgt.Messages[0], "sender@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"}, "")
+}
@@ -0,0 +1,238 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limiters
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Adaptive is a limiter that restricts both concurrency and rate and allows to
+// adjust these limits at run-time.
+//
+// Limits are adjusted using the additive increase/multiplicative decrease
+// approach: Backoff halves both limits (but not below the minimum values) and
+// each IncreaseAfter calls to Success increase them by one step, up to the
+// maximum values.
+//
+// Rate is specified in amount of Take calls per second. Both maximum values
+// should be positive.
+type Adaptive struct {
+	MaxConcurrency int
+	MaxRate        float64
+	MinRate        float64
+	IncreaseAfter  int
+
+	lock        sync.Mutex
+	concurrency int
+	inflight    int
+	rate        float64
+	tokens      float64
+	lastFill    time.Time
+	successes   int
+	closed      bool
+
+	// Closed and replaced each time waiting Take calls should re-check the
+	// state.
+	wake chan struct{}
+}
+
+func NewAdaptive(maxConcurrency int, maxRate, minRate float64, increaseAfter int) *Adaptive {
+	if increaseAfter <= 0 {
+		increaseAfter = 1
+	}
+	if minRate > maxRate {
+		minRate = maxRate
+	}
+	return &Adaptive{
+		MaxConcurrency: maxConcurrency,
+		MaxRate:        maxRate,
+		MinRate:        minRate,
+		IncreaseAfter:  increaseAfter,
+		concurrency:    maxConcurrency,
+		rate:           maxRate,
+		tokens:         1,
+		lastFill:       time.Now(),
+		wake:           make(chan struct{}),
+	}
+}
+
+func (a *Adaptive) notify() {
+	close(a.wake)
+	a.wake = make(chan struct{})
+}
+
+func (a *Adaptive) fill(now time.Time) {
+	a.tokens += now.Sub(a.lastFill).Seconds() * a.rate
+	a.lastFill = now
+	// Allow only a small burst.
+	if a.tokens > 1 {
+		a.tokens = 1
+	}
+}
+
+// tryTake attempts to acquire the resource. If it is not possible, it returns
+// the channel that will be closed when the state changes and the time to wait
+// before the rate limit allows the next Take (zero if it is the concurrency
+// limit that blocks).
+func (a *Adaptive) tryTake() (bool, <-chan struct{}, time.Duration, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return false, nil, 0, ErrClosed
+	}
+
+	if a.inflight >= a.concurrency {
+		return false, a.wake, 0, nil
+	}
+
+	a.fill(time.Now())
+	if a.tokens < 1 {
+		wait := time.Duration((1 - a.tokens) / a.rate * float64(time.Second))
+		return false, a.wake, wait, nil
+	}
+	a.tokens--
+
+	a.inflight++
+	return true, nil, 0, nil
+}
+
+func (a *Adaptive) Take() bool {
+	return a.TakeContext(context.Background()) == nil
+}
+
+func (a *Adaptive) TakeContext(ctx context.Context) error {
+	for {
+		ok, wake, wait, err := a.tryTake()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if wait != 0 {
+			timer = time.NewTimer(wait)
+			timerC = timer.C
+		}
+
+		select {
+		case <-wake:
+		case <-timerC:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (a *Adaptive) Release() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.inflight == 0 {
+		panic("limiters: mismatched Release call")
+	}
+	a.inflight--
+	a.notify()
+}
+
+func (a *Adaptive) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.closed = true
+	a.notify()
+}
+
+// Backoff reduces the limits.
+func (a *Adaptive) Backoff() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.successes = 0
+
+	a.concurrency /= 2
+	if a.concurrency < 1 {
+		a.concurrency = 1
+	}
+
+	a.fill(time.Now())
+	a.rate /= 2
+	if a.rate < a.MinRate {
+		a.rate = a.MinRate
+	}
+}
+
+// Success increases the limits after IncreaseAfter calls.
+func (a *Adaptive) Success() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.throttled() {
+		return
+	}
+
+	a.successes++
+	if a.successes < a.IncreaseAfter {
+		return
+	}
+	a.successes = 0
+
+	a.concurrency++
+	if a.concurrency > a.MaxConcurrency {
+		a.concurrency = a.MaxConcurrency
+	}
+
+	a.fill(time.Now())
+	a.rate += a.MinRate
+	if a.rate > a.MaxRate {
+		a.rate = a.MaxRate
+	}
+
+	a.notify()
+}
+
+// Limits returns the current effective limits.
+func (a *Adaptive) Limits() (concurrency int, rate float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.concurrency, a.rate
+}
+
+func (a *Adaptive) throttled() bool {
+	return a.concurrency < a.MaxConcurrency || a.rate < a.MaxRate
+}
+
+// Idle reports whether the limits are at their maximum values and there are
+// no resources taken, in which case the limiter can be safely discarded.
+func (a *Adaptive) Idle() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return !a.throttled() && a.inflight == 0
+}
@@ -0,0 +1,110 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limiters
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdaptive(t *testing.T) {
+	a := NewAdaptive(8, 100, 10, 2)
+	defer a.Close()
+
+	checkLimits := func(conc int, rate float64) {
+		t.Helper()
+		actualConc, actualRate := a.Limits()
+		if actualConc != conc || actualRate != rate {
+			t.Errorf("wrong limits: %d %v, expected %d %v", actualConc, actualRate, conc, rate)
+		}
+	}
+
+	checkLimits(8, 100)
+	if !a.Idle() {
+		t.Error("limiter should be idle")
+	}
+
+	a.Backoff()
+	checkLimits(4, 50)
+	a.Backoff()
+	a.Backoff()
+	a.Backoff()
+	checkLimits(1, 10)
+
+	a.Success()
+	checkLimits(1, 10)
+	a.Success()
+	checkLimits(2, 20)
+
+	for i := 0; i < 20; i++ {
+		a.Success()
+	}
+	checkLimits(8, 100)
+	if !a.Idle() {
+		t.Error("limiter should be idle after recovery")
+	}
+}
+
+func TestAdaptive_Concurrency(t *testing.T) {
+	a := NewAdaptive(2, 1000, 1000, 1)
+	defer a.Close()
+
+	if err := a.TakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.TakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.TakeContext(ctx); err == nil {
+		t.Fatal("Take should block when the concurrency limit is reached")
+	}
+
+	taken := make(chan struct{})
+	go func() {
+		a.Take()
+		close(taken)
+	}()
+	a.Release()
+	select {
+	case <-taken:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Take was not woken up by Release")
+	}
+}
+
+func TestAdaptive_Rate(t *testing.T) {
+	a := NewAdaptive(10, 20, 20, 1)
+	defer a.Close()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := a.TakeContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		a.Release()
+	}
+	// First Take happens immediately, others should be spread 50ms apart.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Error("rate limit is not enforced, elapsed:", elapsed)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	maddyarc "github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "modify.arc"
+
+var signDefault = []string{
+	"From",
+	"Sender",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-Id",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"DKIM-Signature",
+	"List-Id",
+	"List-Help",
+	"List-Unsubscribe",
+	"List-Post",
+	"List-Owner",
+	"List-Archive",
+}
+
+type Modifier struct {
+	instName string
+
+	domain     string
+	selector   string
+	authservID string
+	signer     crypto.Signer
+	signHeader []string
+
+	resolver dns.Resolver
+	log      log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &Modifier{
+		instName: instName,
+		resolver: dns.DefaultResolver(),
+		log:      log.Logger{Name: modName},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 2:
+		m.domain = inlineArgs[0]
+		m.selector = inlineArgs[1]
+	default:
+		return nil, errors.New("modify.arc: domain and selector are expected as inline arguments")
+	}
+
+	return m, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		keyPathTemplate string
+		newKeyAlgo      string
+	)
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("domain", false, false, m.domain, &m.domain)
+	cfg.String("selector", false, false, m.selector, &m.selector)
+	cfg.String("hostname", true, false, "", &m.authservID)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
+	cfg.Enum("newkey_algo", false, false,
+		[]string{"rsa4096", "rsa2048"}, "rsa2048", &newKeyAlgo)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.domain == "" {
+		return errors.New("modify.arc: domain is not specified")
+	}
+	if m.selector == "" {
+		return errors.New("modify.arc: selector is not specified")
+	}
+	if m.authservID == "" {
+		return errors.New("modify.arc: hostname is not specified")
+	}
+
+	keyValues := strings.NewReplacer("{domain}", m.domain, "{selector}", m.selector)
+	keyPath := keyValues.Replace(keyPathTemplate)
+
+	signer, newKey, err := dkim.LoadOrGenerateKey(m.log, keyPath, newKeyAlgo)
+	if err != nil {
+		return err
+	}
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		return fmt.Errorf("modify.arc: %s: only RSA keys can be used for ARC", keyPath)
+	}
+	if newKey {
+		m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+			"put its contents into TXT record for %s._domainkey.%s to make sealing work",
+			newKeyAlgo, keyPath, dkim.DNSRecordPath(keyPath), m.selector, m.domain)
+	}
+	m.signer = signer
+
+	// ARC fields are never EAI-aware, always use A-labels.
+	m.domain, err = idna.ToASCII(m.domain)
+	if err != nil {
+		return fmt.Errorf("modify.arc: unable to convert domain to A-labels form: %w", err)
+	}
+	m.selector, err = idna.ToASCII(m.selector)
+	if err != nil {
+		return fmt.Errorf("modify.arc: unable to convert selector to A-labels form: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
+	seen := make(map[string]struct{})
+
+	res := make([]string, 0, len(m.signHeader))
+	for _, key := range m.signHeader {
+		if _, ok := seen[strings.ToLower(key)]; ok {
+			continue
+		}
+		seen[strings.ToLower(key)] = struct{}{}
+
+		for field := h.FieldsByKey(key); field.Next(); {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// authResults returns the value of the topmost Authentication-Results field
+// added by this server.
+func (m *Modifier) authResults(h *textproto.Header, cv authres.ResultValue) string {
+	for field := h.FieldsByKey("Authentication-Results"); field.Next(); {
+		identity, _, err := authres.Parse(field.Value())
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(identity, m.authservID) {
+			return field.Value()
+		}
+	}
+
+	return strings.TrimSpace(authres.Format(m.authservID, []authres.Result{
+		&authres.GenericResult{Method: "arc", Value: cv},
+	}))
+}
+
+type state struct {
+	m   *Modifier
+	log log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &state{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.arc/RewriteBody").End()
+
+	r, err := body.Open()
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": modName})
+	}
+	res := maddyarc.Verify(ctx, s.m.resolver, *h, r)
+	r.Close()
+
+	if res.Value == authres.ResultTempError {
+		s.log.Msg("unable to validate the existing chain, not sealing", "reason", res.Reason)
+		return nil
+	}
+	s.log.DebugMsg("existing chain validated", "cv", res.Value, "reason", res.Reason)
+
+	r, err = body.Open()
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": modName})
+	}
+	defer r.Close()
+
+	err = maddyarc.Seal(h, r, &maddyarc.SealOptions{
+		Domain:          s.m.domain,
+		Selector:        s.m.selector,
+		Signer:          s.m.signer,
+		AuthResults:     s.m.authResults(h, res.Value),
+		ChainValidation: res.Value,
+		HeaderKeys:      s.m.fieldsToSign(h),
+	})
+	if err != nil {
+		if errors.Is(err, maddyarc.ErrChainFailed) {
+			s.log.DebugMsg("chain is already marked as failed, not sealing")
+			return nil
+		}
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": modName})
+	}
+
+	s.log.DebugMsg("sealed", "domain", s.m.domain, "cv", res.Value)
+	return nil
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,149 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	maddyarc "github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestModifier(t *testing.T, dir string, zones map[string]mockdns.Zone) *Modifier {
+	t.Helper()
+
+	mod, err := New("", "test", nil, []string{"example.org", "arc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+	m.resolver = &mockdns.Resolver{Zones: zones}
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.org"},
+			},
+			{
+				Name: "key_path",
+				Args: []string{filepath.Join(dir, "{domain}_{selector}.key")},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dnsRecord, err := ioutil.ReadFile(filepath.Join(dir, "example.org_arc.dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones["arc._domainkey.example.org."] = mockdns.Zone{TXT: []string{string(dnsRecord)}}
+
+	return m
+}
+
+func sealTestMsg(t *testing.T, m *Modifier, hdr textproto.Header, body []byte) textproto.Header {
+	t.Helper()
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if err := state.RewriteBody(context.Background(), &hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		t.Fatal(err)
+	}
+	return hdr
+}
+
+func TestSeal(t *testing.T) {
+	dir := testutils.Dir(t)
+	zones := map[string]mockdns.Zone{}
+	m := newTestModifier(t, dir, zones)
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "heya")
+	hdr.Add("To", "<list@example.org>")
+	hdr.Add("From", "<hello@example.com>")
+	hdr.Add("Authentication-Results", "other.example.net; spf=fail")
+	hdr.Add("Authentication-Results", "mx.example.org; spf=pass smtp.mailfrom=example.com")
+	body := []byte("hello there\r\n")
+
+	hdr = sealTestMsg(t, m, hdr, body)
+	if val := hdr.Get("ARC-Authentication-Results"); val != "i=1; mx.example.org; spf=pass smtp.mailfrom=example.com" {
+		t.Errorf("Wrong ARC-Authentication-Results: %q", val)
+	}
+	if val := hdr.Get("ARC-Seal"); !strings.Contains(val, "cv=none;") || !strings.Contains(val, "d=example.org;") {
+		t.Errorf("Wrong ARC-Seal: %q", val)
+	}
+
+	res := maddyarc.Verify(context.Background(), m.resolver, hdr, bytes.NewReader(body))
+	if res.Value != authres.ResultPass {
+		t.Fatal("Sealed message does not verify:", res.Value, res.Reason)
+	}
+
+	// Seal it again, as if the message passed through another forwarder.
+	hdr.Del("Authentication-Results")
+	hdr = sealTestMsg(t, m, hdr, body)
+	if val := hdr.Get("ARC-Authentication-Results"); val != "i=2; mx.example.org; arc=pass" {
+		t.Errorf("Wrong ARC-Authentication-Results: %q", val)
+	}
+	res = maddyarc.Verify(context.Background(), m.resolver, hdr, bytes.NewReader(body))
+	if res.Value != authres.ResultPass || res.Instance != 2 {
+		t.Fatal("Sealed message does not verify:", res.Value, res.Instance, res.Reason)
+	}
+}
+
+func TestSeal_BrokenChain(t *testing.T) {
+	dir := testutils.Dir(t)
+	zones := map[string]mockdns.Zone{}
+	m := newTestModifier(t, dir, zones)
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<hello@example.com>")
+	hdr = sealTestMsg(t, m, hdr, []byte("hello there\r\n"))
+
+	// Body is modified after the first seal.
+	body := []byte("hi there\r\n")
+	hdr = sealTestMsg(t, m, hdr, body)
+	if val := hdr.Get("ARC-Seal"); !strings.Contains(val, "i=2;") || !strings.Contains(val, "cv=fail;") {
+		t.Fatalf("Wrong ARC-Seal: %q", val)
+	}
+
+	// No more sets are added.
+	hdr = sealTestMsg(t, m, hdr, body)
+	if val := hdr.Get("ARC-Seal"); !strings.Contains(val, "i=2;") {
+		t.Fatalf("Chain marked as failed is sealed again: %q", val)
+	}
+}
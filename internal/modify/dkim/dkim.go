@@ -24,7 +24,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"path/filepath"
 	"runtime/trace"
 	"strings"
 	"time"
@@ -205,16 +204,13 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
 		keyPath := keyValues.Replace(keyPathTemplate)
 
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+		signer, newKey, err := LoadOrGenerateKey(m.log, keyPath, newKeyAlgo)
 		if err != nil {
 			return err
 		}
 
 		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-			}
+			dnsPath := DNSRecordPath(keyPath)
 			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
 				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
 				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
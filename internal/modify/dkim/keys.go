@@ -32,13 +32,20 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+
+	"github.com/foxcpp/maddy/framework/log"
 )
 
-func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
+// LoadOrGenerateKey loads the private key from keyPath. If the file does not
+// exist, a new key is generated using the newKeyAlgo algorithm and saved
+// along with the TXT record contents (see DNSRecordPath).
+//
+// It is also used by modify.arc to share keys with modify.dkim.
+func LoadOrGenerateKey(l log.Logger, keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
 	f, err := os.Open(keyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			pkey, err = m.generateAndWrite(keyPath, newKeyAlgo)
+			pkey, err = generateAndWrite(l, keyPath, newKeyAlgo)
 			return pkey, true, err
 		}
 		return nil, false, err
@@ -92,12 +99,12 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 	}
 }
 
-func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer, error) {
+func generateAndWrite(l log.Logger, keyPath, newKeyAlgo string) (crypto.Signer, error) {
 	wrapErr := func(err error) error {
 		return fmt.Errorf("modify.dkim: generate %s: %w", keyPath, err)
 	}
 
-	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
+	l.Printf("generating a new %s keypair...", newKeyAlgo)
 
 	var (
 		pkey     crypto.Signer
@@ -169,11 +176,7 @@ func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, e
 		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
 	}
 
-	dnsPath := keyPath + ".dns"
-	if filepath.Ext(keyPath) == ".key" {
-		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-	}
-	dnsF, err := os.Create(dnsPath)
+	dnsF, err := os.Create(DNSRecordPath(keyPath))
 	if err != nil {
 		return "", err
 	}
@@ -181,5 +184,14 @@ func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, e
 	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
 		return "", err
 	}
-	return dnsPath, nil
+	return dnsF.Name(), nil
+}
+
+// DNSRecordPath returns the path of the file with TXT record contents for
+// the key stored in keyPath.
+func DNSRecordPath(keyPath string) string {
+	if filepath.Ext(keyPath) == ".key" {
+		return keyPath[:len(keyPath)-4] + ".dns"
+	}
+	return keyPath + ".dns"
 }
@@ -41,7 +41,7 @@ func TestKeyLoad_new(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	signer, newKey, err := m.loadOrGenerateKey(filepath.Join(dir, "testkey.key"), "ed25519")
+	signer, newKey, err := LoadOrGenerateKey(m.log, filepath.Join(dir, "testkey.key"), "ed25519")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -95,7 +95,7 @@ func TestKeyLoad_existing_pkcs8(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	signer, newKey, err := m.loadOrGenerateKey(filepath.Join(dir, "testkey.key"), "ed25519")
+	signer, newKey, err := LoadOrGenerateKey(m.log, filepath.Join(dir, "testkey.key"), "ed25519")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,7 +105,7 @@ func TestKeyLoad_existing_pkcs8(t *testing.T) {
 
 	blob := signer.Public().(ed25519.PublicKey)
 	if signerKey := base64.StdEncoding.EncodeToString(blob); signerKey != pubkeyEd25519 {
-		t.Fatalf("wrong public key returned by loadOrGenerateKey, \nwant %s\ngot  %s", pubkeyEd25519, signerKey)
+		t.Fatalf("wrong public key returned by LoadOrGenerateKey, \nwant %s\ngot  %s", pubkeyEd25519, signerKey)
 	}
 }
 
@@ -151,7 +151,7 @@ func TestKeyLoad_existing_pkcs1(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	signer, newKey, err := m.loadOrGenerateKey(filepath.Join(dir, "testkey.key"), "rsa2048")
+	signer, newKey, err := LoadOrGenerateKey(m.log, filepath.Join(dir, "testkey.key"), "rsa2048")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -161,9 +161,9 @@ func TestKeyLoad_existing_pkcs1(t *testing.T) {
 
 	pubkey := signer.Public().(*rsa.PublicKey)
 	if pubkey.E != 65537 {
-		t.Fatalf("wrong public key returned by loadOrGenerateKey, got %d", pubkey.E)
+		t.Fatalf("wrong public key returned by LoadOrGenerateKey, got %d", pubkey.E)
 	}
 	if pubkey.N.String() != "23617257632228188386824425094266725423560758883229529475904285522114491665694237598874002862630696077162868821164059728985148713872807170386818903503533709975391952347175641552635505497204925274569104682448177717429244936284920784061388978739927939000424446717818401440783667723710780854637197555911253613285419663410256437304926940168312631109994734698918250930969511949067760562140706765511288141008942649676427142664185811322596443990204153105455693515405445788622172538582060141770589195075185467867938584021491237815987395835392935511032761463924045865609068314478096903374718657496007822964380498648030935260591" {
-		t.Fatalf("wrong public key returned by loadOrGenerateKey, got %s", pubkey.N.String())
+		t.Fatalf("wrong public key returned by LoadOrGenerateKey, got %s", pubkey.N.String())
 	}
 }
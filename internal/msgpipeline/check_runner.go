@@ -20,7 +20,9 @@ package msgpipeline
 
 import (
 	"context"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
@@ -47,6 +49,7 @@ type checkRunner struct {
 	doDMARC       bool
 	didDMARCFetch bool
 	dmarcVerify   *dmarc.Verifier
+	dmarcReporter dmarc.Reporter
 
 	log log.Logger
 
@@ -283,7 +286,7 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 	})
 }
 
-func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
+func (cr *checkRunner) applyResults(hostname string, header *textproto.Header, body buffer.Buffer) error {
 	if cr.mergedRes.Quarantine {
 		cr.msgMeta.Quarantine = true
 	}
@@ -291,6 +294,12 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	if cr.doDMARC {
 		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
+		if dmarcRes.ARCOverride != "" {
+			cr.log.Msg("DMARC policy overridden by trusted ARC sealer", "sealer", dmarcRes.ARCOverride)
+		}
+		if cr.dmarcReporter != nil {
+			cr.reportDMARC(hostname, *header, body, dmarcRes, policy)
+		}
 		switch policy {
 		case dmarc.PolicyReject:
 			code := 550
@@ -336,6 +345,31 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	return nil
 }
 
+// reportDMARC passes the DMARC evaluation result to the dmarcReporter and
+// requests the failure report if necessary.
+func (cr *checkRunner) reportDMARC(hostname string, header textproto.Header, body buffer.Buffer, res dmarc.EvalResult, policy dmarc.Policy) {
+	ev := dmarc.Evaluation{
+		Time:        time.Now(),
+		Result:      res,
+		Policy:      policy,
+		AuthResults: cr.mergedRes.AuthResult,
+	}
+	if cr.msgMeta.Conn != nil {
+		if tcpAddr, ok := cr.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+			ev.SourceIP = tcpAddr.IP
+		}
+	}
+	cr.dmarcReporter.RecordEvaluation(ev)
+
+	cr.dmarcVerify.ReportFailure(dmarc.FailureReport{
+		Evaluation: ev,
+		MailFrom:   cr.mailFrom,
+		AuthservID: hostname,
+		Header:     header.Copy(),
+		Body:       body,
+	})
+}
+
 func (cr *checkRunner) close() {
 	cr.dmarcVerify.Close()
 	for _, state := range cr.states {
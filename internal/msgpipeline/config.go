@@ -29,6 +29,7 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/modify"
 )
 
@@ -44,6 +45,9 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	arcSealers      []string
+	dmarcReporter   dmarc.Reporter
+	priority        *int
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -116,6 +120,12 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'default_source' block")
 			}
 			defaultSrcRaw = node.Children
+		case "priority":
+			priority, err := module.PriorityDirective(nil, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+			cfg.priority = priority.(*int)
 		case "dmarc":
 			switch len(node.Args) {
 			case 1:
@@ -129,6 +139,21 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
+		case "trusted_arc_sealers":
+			if len(node.Args) == 0 {
+				return msgpipelineCfg{}, config.NodeErr(node, "at least one domain is required")
+			}
+			for _, domain := range node.Args {
+				domain, err := dns.ForLookup(domain)
+				if err != nil {
+					return msgpipelineCfg{}, config.NodeErr(node, "invalid domain: %v", err)
+				}
+				cfg.arcSealers = append(cfg.arcSealers, domain)
+			}
+		case "dmarc_reports":
+			if err := modconfig.GroupFromNode("dmarc_reporter", node.Args, node, globals, &cfg.dmarcReporter); err != nil {
+				return msgpipelineCfg{}, err
+			}
 		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
@@ -179,6 +204,12 @@ func parseMsgPipelineSrcCfg(globals map[string]interface{}, nodes []config.Node)
 			}
 
 			src.modifiers.Modifiers = append(src.modifiers.Modifiers, modifiers.Modifiers...)
+		case "priority":
+			priority, err := module.PriorityDirective(nil, node)
+			if err != nil {
+				return sourceBlock{}, err
+			}
+			src.priority = priority.(*int)
 		case "destination_in":
 			var tbl module.Table
 			if err := modconfig.ModuleFromNode("table", node.Args, config.Node{}, globals, &tbl); err != nil {
@@ -268,6 +268,49 @@ func TestMsgPipelineCfg_SourceIn(t *testing.T) {
 	}
 }
 
+func TestMsgPipelineCfg_Priority(t *testing.T) {
+	for _, str := range []string{
+		`priority 10
+		deliver_to dummy`,
+		`priority
+		deliver_to dummy`,
+		`source example.org {
+			priority high
+			deliver_to dummy
+		}
+		default_source {
+			reject
+		}`,
+	} {
+		cfg, _ := parser.Read(strings.NewReader(str), "literal")
+		if _, err := parseMsgPipelineRootCfg(nil, cfg); err == nil {
+			t.Errorf("expected parse error for %q", str)
+		}
+	}
+
+	str := `
+		priority 3
+		source example.org {
+			priority -1
+			deliver_to dummy
+		}
+		default_source {
+			deliver_to dummy
+		}
+	`
+	cfg, _ := parser.Read(strings.NewReader(str), "literal")
+	parsed, err := parseMsgPipelineRootCfg(nil, cfg)
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if parsed.priority == nil || *parsed.priority != 3 {
+		t.Errorf("wrong global priority: %v", parsed.priority)
+	}
+	if prio := parsed.perSource["example.org"].priority; prio == nil || *prio != -1 {
+		t.Errorf("wrong source priority: %v", prio)
+	}
+}
+
 func TestMsgPipelineCfg_DestIn(t *testing.T) {
 	str := `
 		destination_in dummy {
@@ -22,7 +22,6 @@ import (
 	"context"
 
 	"github.com/emersion/go-message/textproto"
-	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
@@ -30,6 +29,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/sync/errgroup"
@@ -76,6 +76,7 @@ type sourceBlock struct {
 	rcptIn      []rcptIn
 	perRcpt     map[string]*rcptBlock
 	defaultRcpt *rcptBlock
+	priority    *int
 }
 
 type rcptBlock struct {
@@ -93,7 +94,7 @@ func New(globals map[string]interface{}, cfg []config.Node) (*MsgPipeline, error
 	}, err
 }
 
-func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *smtp.ConnectionState) error {
+func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *module.ConnectionState) error {
 	eg, checkCtx := errgroup.WithContext(ctx)
 
 	// TODO: See if there is some point in parallelization of this
@@ -127,6 +128,11 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.dmarcVerify.TrustedARCSealers = d.arcSealers
+	dd.checkRunner.dmarcReporter = d.dmarcReporter
+	if fr, ok := d.dmarcReporter.(dmarc.FailureReporter); ok {
+		dd.checkRunner.dmarcVerify.FailureReportFunc = fr.SendFailureReport
+	}
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
@@ -161,6 +167,13 @@ func (dd *msgpipelineDelivery) start(ctx context.Context, msgMeta *module.MsgMet
 	}
 	dd.sourceBlock = sourceBlock
 
+	switch {
+	case sourceBlock.priority != nil:
+		msgMeta.Priority = *sourceBlock.priority
+	case dd.d.priority != nil:
+		msgMeta.Priority = *dd.d.priority
+	}
+
 	if err := dd.checkRunner.checkConnSender(ctx, sourceBlock.checks, mailFrom); err != nil {
 		return err
 	}
@@ -391,7 +404,7 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		header.Add("Received", received)
 	}
 
-	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header); err != nil {
+	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header, body); err != nil {
 		return err
 	}
 
@@ -90,6 +90,45 @@ func TestMsgPipeline_PerSourceDomainSplit(t *testing.T) {
 	testutils.CheckTestMessage(t, &orgTarget, 0, "sender@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"})
 }
 
+func TestMsgPipeline_Priority(t *testing.T) {
+	target := testutils.Target{}
+	globalPriority, orgPriority := 2, -5
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			priority: &globalPriority,
+			perSource: map[string]sourceBlock{
+				"example.org": {
+					perRcpt:  map[string]*rcptBlock{},
+					priority: &orgPriority,
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+			},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+	testutils.DoTestDelivery(t, &d, "sender@example.org", []string{"rcpt@example.com"})
+
+	if len(target.Messages) != 2 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 2, len(target.Messages))
+	}
+	if prio := target.Messages[0].MsgMeta.Priority; prio != globalPriority {
+		t.Errorf("wrong priority for the default source: %d", prio)
+	}
+	if prio := target.Messages[1].MsgMeta.Priority; prio != orgPriority {
+		t.Errorf("wrong priority for the example.org source: %d", prio)
+	}
+}
+
 func TestMsgPipeline_SourceIn(t *testing.T) {
 	tblTarget, comTarget := testutils.Target{InstName: "tblTarget"}, testutils.Target{InstName: "comTarget"}
 	d := MsgPipeline{
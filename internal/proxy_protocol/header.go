@@ -0,0 +1,328 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy_protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TLV types defined by the PROXY protocol specification (Section 2.2.7).
+const (
+	TypeALPN      = 0x01
+	TypeAuthority = 0x02
+	TypeCRC32C    = 0x03
+	TypeNoop      = 0x04
+	TypeUniqueID  = 0x05
+	TypeSSL       = 0x20
+	TypeNetNS     = 0x30
+
+	// Sub-types of TypeSSL.
+	typeSSLVersion = 0x21
+	typeSSLCN      = 0x22
+	typeSSLCipher  = 0x23
+	typeSSLSigAlg  = 0x24
+	typeSSLKeyAlg  = 0x25
+)
+
+// Bits of SSLInfo.Client.
+const (
+	ClientSSL      = 0x01
+	ClientCertConn = 0x02
+	ClientCertSess = 0x04
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Max. length of the v1 header including CRLF.
+const v1MaxLength = 107
+
+// TLV is the additional information sent in the v2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// SSLInfo is the information about the TLS connection between the client
+// and the proxy (PP2_TYPE_SSL).
+type SSLInfo struct {
+	// Combination of ClientSSL, ClientCertConn, ClientCertSess.
+	Client byte
+	// Zero if the client certificate was verified.
+	Verify uint32
+
+	Version    string
+	CommonName string
+	Cipher     string
+	SigAlg     string
+	KeyAlg     string
+}
+
+// Header is the parsed PROXY protocol header.
+type Header struct {
+	Version int
+
+	// Local is true for v2 LOCAL command (or v1 UNKNOWN protocol), in this
+	// case addresses are not set and the connection endpoints should be
+	// used.
+	Local bool
+
+	Source      net.Addr
+	Destination net.Addr
+
+	// Set only for v2 headers.
+	TLVs []TLV
+	SSL  *SSLInfo
+}
+
+// TLV returns the value of the first TLV with the specified type.
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ReadHeader reads the PROXY protocol header (v1 or v2) from the reader.
+// Only the bytes of the header are consumed.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, fmt.Errorf("proxy_protocol: failed to read header: %w", err)
+	}
+	if string(start) == "PROXY" {
+		return readV1(r)
+	}
+
+	sig, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("proxy_protocol: failed to read header: %w", err)
+	}
+	if bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+
+	return nil, errors.New("proxy_protocol: missing header")
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy_protocol: failed to read header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == v1MaxLength {
+			return nil, errors.New("proxy_protocol: v1 header is too long")
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("proxy_protocol: malformed v1 header")
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) < 2 || parts[0] != "PROXY" {
+		return nil, errors.New("proxy_protocol: malformed v1 header")
+	}
+
+	hdr := &Header{Version: 1}
+	switch parts[1] {
+	case "UNKNOWN":
+		hdr.Local = true
+		return hdr, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("proxy_protocol: unknown v1 protocol: %s", parts[1])
+	}
+	if len(parts) != 6 {
+		return nil, errors.New("proxy_protocol: malformed v1 header")
+	}
+
+	srcIP, dstIP := net.ParseIP(parts[2]), net.ParseIP(parts[3])
+	if srcIP == nil || dstIP == nil {
+		return nil, errors.New("proxy_protocol: malformed address in v1 header")
+	}
+	if (srcIP.To4() != nil) != (parts[1] == "TCP4") || (dstIP.To4() != nil) != (parts[1] == "TCP4") {
+		return nil, errors.New("proxy_protocol: address family mismatch in v1 header")
+	}
+	srcPort, err := parsePort(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	dstPort, err := parsePort(parts[5])
+	if err != nil {
+		return nil, err
+	}
+
+	hdr.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+	hdr.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	return hdr, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("proxy_protocol: malformed port: %s", s)
+	}
+	return int(port), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("proxy_protocol: failed to read header: %w", err)
+	}
+
+	verCmd, fam := fixed[12], fixed[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy_protocol: unsupported version: %d", verCmd>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("proxy_protocol: failed to read header: %w", err)
+	}
+
+	hdr := &Header{Version: 2}
+	switch verCmd & 0xF {
+	case 0x0: // LOCAL
+		hdr.Local = true
+		return hdr, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxy_protocol: unknown v2 command: %d", verCmd&0xF)
+	}
+
+	var addrLen int
+	switch fam {
+	case 0x11, 0x12: // TCP/UDP over IPv4
+		addrLen = 12
+		if len(body) < addrLen {
+			return nil, errors.New("proxy_protocol: truncated v2 header")
+		}
+		hdr.Source, hdr.Destination = v2Addrs(fam, body[0:4], body[4:8], body[8:10], body[10:12])
+	case 0x21, 0x22: // TCP/UDP over IPv6
+		addrLen = 36
+		if len(body) < addrLen {
+			return nil, errors.New("proxy_protocol: truncated v2 header")
+		}
+		hdr.Source, hdr.Destination = v2Addrs(fam, body[0:16], body[16:32], body[32:34], body[34:36])
+	case 0x31, 0x32: // Unix sockets
+		addrLen = 216
+		if len(body) < addrLen {
+			return nil, errors.New("proxy_protocol: truncated v2 header")
+		}
+		network := "unix"
+		if fam == 0x32 {
+			network = "unixgram"
+		}
+		hdr.Source = &net.UnixAddr{Name: string(bytes.TrimRight(body[0:108], "\x00")), Net: network}
+		hdr.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(body[108:216], "\x00")), Net: network}
+	default: // AF_UNSPEC, addresses should be ignored.
+		hdr.Local = true
+		return hdr, nil
+	}
+
+	var err error
+	hdr.TLVs, err = parseTLVs(body[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	if ssl, ok := hdr.TLV(TypeSSL); ok {
+		hdr.SSL, err = parseSSL(ssl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hdr, nil
+}
+
+func v2Addrs(fam byte, src, dst, srcPort, dstPort []byte) (net.Addr, net.Addr) {
+	srcIP := make(net.IP, len(src))
+	copy(srcIP, src)
+	dstIP := make(net.IP, len(dst))
+	copy(dstIP, dst)
+
+	if fam&0xF == 0x2 {
+		return &net.UDPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(srcPort))},
+			&net.UDPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(dstPort))}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(srcPort))},
+		&net.TCPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(dstPort))}
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) != 0 {
+		if len(b) < 3 {
+			return nil, errors.New("proxy_protocol: truncated TLV")
+		}
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, errors.New("proxy_protocol: truncated TLV")
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+l]})
+		b = b[3+l:]
+	}
+	return tlvs, nil
+}
+
+func parseSSL(b []byte) (*SSLInfo, error) {
+	if len(b) < 5 {
+		return nil, errors.New("proxy_protocol: truncated SSL TLV")
+	}
+	info := &SSLInfo{
+		Client: b[0],
+		Verify: binary.BigEndian.Uint32(b[1:5]),
+	}
+
+	subTLVs, err := parseTLVs(b[5:])
+	if err != nil {
+		return nil, err
+	}
+	for _, tlv := range subTLVs {
+		switch tlv.Type {
+		case typeSSLVersion:
+			info.Version = string(tlv.Value)
+		case typeSSLCN:
+			info.CommonName = string(tlv.Value)
+		case typeSSLCipher:
+			info.Cipher = string(tlv.Value)
+		case typeSSLSigAlg:
+			info.SigAlg = string(tlv.Value)
+		case typeSSLKeyAlg:
+			info.KeyAlg = string(tlv.Value)
+		}
+	}
+	return info, nil
+}
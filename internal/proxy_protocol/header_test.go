@@ -0,0 +1,191 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy_protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func v2Header(cmd, fam byte, body []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(body)))
+	return append(b, body...)
+}
+
+func tlv(typ byte, value []byte) []byte {
+	b := []byte{typ, 0, 0}
+	binary.BigEndian.PutUint16(b[1:3], uint16(len(value)))
+	return append(b, value...)
+}
+
+func TestReadHeader_V1(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want *Header
+	}{
+		{
+			"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n",
+			&Header{
+				Version:     1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 25},
+			},
+		},
+		{
+			"PROXY TCP6 2001:db8::1 2001:db8::2 56324 993\r\n",
+			&Header{
+				Version:     1,
+				Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 993},
+			},
+		},
+		{
+			"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n",
+			&Header{Version: 1, Local: true},
+		},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", nil},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n", nil},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 056324 25\r\n", nil},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n", nil},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 1 25\r\n", nil},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n", nil},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", nil},
+		{"EHLO example.org\r\n", nil},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.in + "EHLO"))
+		hdr, err := ReadHeader(r)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got none", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(hdr, tc.want) {
+			t.Errorf("%q: wrong result: %+v", tc.in, hdr)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "EHLO" {
+			t.Errorf("%q: wrong remaining data: %q", tc.in, rest)
+		}
+	}
+}
+
+func TestReadHeader_V2(t *testing.T) {
+	var ssl []byte
+	ssl = append(ssl, ClientSSL|ClientCertConn, 0, 0, 0, 0)
+	ssl = append(ssl, tlv(typeSSLVersion, []byte("TLSv1.3"))...)
+	ssl = append(ssl, tlv(typeSSLCN, []byte("client.example.org"))...)
+	ssl = append(ssl, tlv(typeSSLCipher, []byte("TLS_AES_128_GCM_SHA256"))...)
+
+	body := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0, 25}
+	body = append(body, tlv(TypeAuthority, []byte("mx.example.org"))...)
+	body = append(body, tlv(TypeSSL, ssl)...)
+
+	r := bufio.NewReader(bytes.NewReader(append(v2Header(0x1, 0x11, body), "EHLO"...)))
+	hdr, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(hdr.Source, &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 56324}) {
+		t.Error("Wrong source:", hdr.Source)
+	}
+	if !reflect.DeepEqual(hdr.Destination, &net.TCPAddr{IP: net.IP{198, 51, 100, 1}, Port: 25}) {
+		t.Error("Wrong destination:", hdr.Destination)
+	}
+	if authority, ok := hdr.TLV(TypeAuthority); !ok || string(authority) != "mx.example.org" {
+		t.Errorf("Wrong authority: %q", authority)
+	}
+	wantSSL := &SSLInfo{
+		Client:     ClientSSL | ClientCertConn,
+		Version:    "TLSv1.3",
+		CommonName: "client.example.org",
+		Cipher:     "TLS_AES_128_GCM_SHA256",
+	}
+	if !reflect.DeepEqual(hdr.SSL, wantSSL) {
+		t.Errorf("Wrong SSL info: %+v", hdr.SSL)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "EHLO" {
+		t.Errorf("Wrong remaining data: %q", rest)
+	}
+}
+
+func TestReadHeader_V2IPv6(t *testing.T) {
+	body := make([]byte, 36)
+	copy(body[0:16], net.ParseIP("2001:db8::1"))
+	copy(body[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(body[32:34], 56324)
+	binary.BigEndian.PutUint16(body[34:36], 993)
+
+	hdr, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x1, 0x21, body))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hdr.Source, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}) {
+		t.Error("Wrong source:", hdr.Source)
+	}
+	if !reflect.DeepEqual(hdr.Destination, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 993}) {
+		t.Error("Wrong destination:", hdr.Destination)
+	}
+}
+
+func TestReadHeader_V2Local(t *testing.T) {
+	// LOCAL command is used for health checks, addresses are ignored.
+	r := bufio.NewReader(bytes.NewReader(append(v2Header(0x0, 0x11, make([]byte, 12)), "EHLO"...)))
+	hdr, err := ReadHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hdr.Local || hdr.Source != nil {
+		t.Errorf("Wrong result: %+v", hdr)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "EHLO" {
+		t.Errorf("Wrong remaining data: %q", rest)
+	}
+}
+
+func TestReadHeader_V2Malformed(t *testing.T) {
+	for name, in := range map[string][]byte{
+		"truncated body":  v2Header(0x1, 0x11, make([]byte, 12))[:20],
+		"short addresses": v2Header(0x1, 0x21, make([]byte, 12)),
+		"bad command":     v2Header(0x2, 0x11, make([]byte, 12)),
+		"truncated TLV":   v2Header(0x1, 0x11, append(make([]byte, 12), TypeNoop, 0, 5, 1)),
+		"short SSL TLV":   v2Header(0x1, 0x11, append(make([]byte, 12), tlv(TypeSSL, []byte{1, 0})...)),
+		"bad version": func() []byte {
+			b := v2Header(0x1, 0x11, make([]byte, 12))
+			b[12] = 0x11
+			return b
+		}(),
+	} {
+		if _, err := ReadHeader(bufio.NewReader(bytes.NewReader(in))); err == nil {
+			t.Errorf("%s: expected an error, got none", name)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package proxy_protocol implements the PROXY protocol (v1 and v2) used by
+// load balancers and proxies to pass the original client address.
+//
+// See https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt.
+package proxy_protocol
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// How long to wait for the header from the trusted source.
+const headerTimeout = 10 * time.Second
+
+// Config specifies which connections are expected to start with the PROXY
+// protocol header.
+type Config struct {
+	trust config.Networks
+}
+
+func parseTrust(cfg *Config, node config.Node, args []string) error {
+	nets, err := config.ParseNetworks(node, args)
+	if err != nil {
+		return err
+	}
+	cfg.trust = append(cfg.trust, nets...)
+	return nil
+}
+
+// ProxyProtocolDirective parses the proxy_protocol configuration directive.
+//
+// Syntax:
+//
+//	proxy_protocol [trusted sources...] {
+//	    trust <trusted sources...>
+//	}
+//
+// Sources are IP addresses or networks in CIDR notation.
+func ProxyProtocolDirective(m *config.Map, node config.Node) (interface{}, error) {
+	cfg := &Config{}
+	if err := parseTrust(cfg, node, node.Args); err != nil {
+		return nil, err
+	}
+	for _, child := range node.Children {
+		switch child.Name {
+		case "trust":
+			if err := parseTrust(cfg, child, child.Args); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, config.NodeErr(child, "unknown directive: %s", child.Name)
+		}
+	}
+	if len(cfg.trust) == 0 {
+		return nil, config.NodeErr(node, "at least one trusted source is required")
+	}
+	return cfg, nil
+}
+
+// Trusted reports whether the connection from addr is expected to start with
+// the PROXY protocol header.
+//
+// Connections over Unix sockets are always trusted.
+func (cfg *Config) Trusted(addr net.Addr) bool {
+	return cfg.trust.Contains(addr)
+}
+
+// Conn is the connection with the PROXY protocol header already consumed.
+//
+// RemoteAddr and LocalAddr return addresses from the header unless the
+// header uses the LOCAL command.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	Header *Header
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.Header.Local || c.Header.Source == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.Header.Source
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.Header.Local || c.Header.Destination == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.Header.Destination
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+type listener struct {
+	net.Listener
+	cfg *Config
+	log log.Logger
+
+	results chan acceptResult
+
+	// Closed when the underlying listener fails.
+	done     chan struct{}
+	doneErr  error
+	doneOnce sync.Once
+}
+
+// NewListener returns the listener that reads the PROXY protocol header for
+// connections from trusted sources.
+//
+// Connections from trusted sources without the valid header are rejected.
+// Connections from other sources are passed through as is.
+func NewListener(l net.Listener, cfg *Config, log log.Logger) net.Listener {
+	pl := &listener{
+		Listener: l,
+		cfg:      cfg,
+		log:      log,
+		results:  make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go pl.serve()
+	return pl
+}
+
+func (l *listener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// Let the server handle it.
+				select {
+				case l.results <- acceptResult{err: err}:
+				case <-l.done:
+				}
+				continue
+			}
+			l.doneOnce.Do(func() {
+				l.doneErr = err
+				close(l.done)
+			})
+			return
+		}
+
+		if !l.cfg.Trusted(conn.RemoteAddr()) {
+			l.deliver(conn)
+			continue
+		}
+
+		// Do not block other connections while waiting for the header.
+		go l.handshake(conn)
+	}
+}
+
+func (l *listener) handshake(conn net.Conn) {
+	if err := conn.SetReadDeadline(time.Now().Add(headerTimeout)); err != nil {
+		l.log.Error("failed to set deadline", err, "src_addr", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	hdr, err := ReadHeader(br)
+	if err != nil {
+		l.log.Error("failed to read PROXY header", err, "src_addr", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		l.log.Error("failed to reset deadline", err, "src_addr", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	pConn := &Conn{Conn: conn, r: br, Header: hdr}
+	if hdr.SSL != nil {
+		l.log.DebugMsg("PROXY header", "proxy_addr", conn.RemoteAddr(), "src_addr", pConn.RemoteAddr(),
+			"proxy_tls", hdr.SSL.Client&ClientSSL != 0, "proxy_tls_version", hdr.SSL.Version,
+			"proxy_tls_cipher", hdr.SSL.Cipher)
+	} else {
+		l.log.DebugMsg("PROXY header", "proxy_addr", conn.RemoteAddr(), "src_addr", pConn.RemoteAddr())
+	}
+
+	l.deliver(pConn)
+}
+
+func (l *listener) deliver(conn net.Conn) {
+	select {
+	case l.results <- acceptResult{conn: conn}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.results:
+		return res.conn, res.err
+	case <-l.done:
+		return nil, l.doneErr
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy_protocol
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testListener(t *testing.T, trust ...string) net.Listener {
+	t.Helper()
+
+	cfg, err := ProxyProtocolDirective(nil, config.Node{
+		Name:     "proxy_protocol",
+		Children: []config.Node{{Name: "trust", Args: trust}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l, cfg.(*Config), testutils.Logger(t, "proxy_protocol"))
+	t.Cleanup(func() { pl.Close() })
+	return pl
+}
+
+func acceptAndRead(t *testing.T, l net.Listener) (net.Conn, string) {
+	t.Helper()
+
+	type result struct {
+		conn net.Conn
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		data, err := ioutil.ReadAll(conn)
+		ch <- result{conn: conn, data: data, err: err}
+	}()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		res.conn.Close()
+		return res.conn, string(res.data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept timed out")
+	}
+	return nil, ""
+}
+
+func sendAndClose(t *testing.T, addr, data string) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestListener_Trusted(t *testing.T) {
+	l := testListener(t, "127.0.0.1")
+
+	sendAndClose(t, l.Addr().String(), "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO")
+	conn, data := acceptAndRead(t, l)
+
+	if data != "EHLO" {
+		t.Errorf("Wrong data: %q", data)
+	}
+	if conn.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Error("Wrong remote address:", conn.RemoteAddr())
+	}
+	if conn.LocalAddr().String() != "198.51.100.1:25" {
+		t.Error("Wrong local address:", conn.LocalAddr())
+	}
+}
+
+func TestListener_TrustedNoHeader(t *testing.T) {
+	l := testListener(t, "127.0.0.0/8")
+
+	// Connection without header is dropped, Accept returns the next one.
+	sendAndClose(t, l.Addr().String(), "EHLO example.org\r\n")
+	sendAndClose(t, l.Addr().String(), "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO")
+
+	conn, data := acceptAndRead(t, l)
+	if data != "EHLO" || conn.RemoteAddr().String() != "192.0.2.1:56324" {
+		t.Errorf("Wrong connection accepted: %v, %q", conn.RemoteAddr(), data)
+	}
+}
+
+func TestListener_Untrusted(t *testing.T) {
+	l := testListener(t, "192.0.2.0/24", "2001:db8::1")
+
+	// Header is not interpreted for untrusted sources.
+	sendAndClose(t, l.Addr().String(), "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO")
+	conn, data := acceptAndRead(t, l)
+
+	if data != "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO" {
+		t.Errorf("Wrong data: %q", data)
+	}
+	if tcpAddr := conn.RemoteAddr().(*net.TCPAddr); !tcpAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Error("Wrong remote address:", conn.RemoteAddr())
+	}
+}
+
+func TestListener_Close(t *testing.T) {
+	l := testListener(t, "127.0.0.1")
+	l.Close()
+
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+}
+
+func TestProxyProtocolDirective(t *testing.T) {
+	for _, node := range []config.Node{
+		{Name: "proxy_protocol"},
+		{Name: "proxy_protocol", Args: []string{"not-an-ip"}},
+		{Name: "proxy_protocol", Args: []string{"10.0.0.0/33"}},
+		{Name: "proxy_protocol", Children: []config.Node{{Name: "trusted", Args: []string{"10.0.0.1"}}}},
+	} {
+		if _, err := ProxyProtocolDirective(nil, node); err == nil {
+			t.Errorf("Expected an error for %+v", node)
+		}
+	}
+
+	cfg, err := ProxyProtocolDirective(nil, config.Node{
+		Name: "proxy_protocol",
+		Args: []string{"10.0.0.0/8", "2001:db8::1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, trusted := range map[string]bool{
+		"10.1.2.3:1":          true,
+		"11.0.0.1:1":          false,
+		"[2001:db8::1]:1":     true,
+		"[2001:db8::2]:1":     false,
+		"[::ffff:10.0.0.1]:1": true,
+	} {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.(*Config).Trusted(tcpAddr) != trusted {
+			t.Errorf("Wrong result for %s, want %v", addr, trusted)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtpconn
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc is the signature of the function used to estabilish network
+// connections.
+type DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Proxy is the SOCKS5 or HTTP CONNECT proxy server to estabilish outbound
+// connections through.
+//
+// Only the connection is tunneled, STARTTLS and any security checks are done
+// by the C object as usual.
+type Proxy struct {
+	// Scheme is one of "socks5" or "http".
+	Scheme string
+	// Address is the host:port of the proxy server.
+	Address string
+
+	// Credentials to authenticate with. Optional.
+	Username string
+	Password string
+}
+
+// ParseProxy parses the proxy URL in the form scheme://[user:pass@]host:port,
+// where scheme is socks5 or http.
+func ParseProxy(s string) (*Proxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("smtpconn: malformed proxy URL: %w", err)
+	}
+
+	p := &Proxy{Scheme: u.Scheme}
+	port := u.Port()
+	switch p.Scheme {
+	case "socks5", "socks5h":
+		p.Scheme = "socks5"
+		if port == "" {
+			port = "1080"
+		}
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+	default:
+		return nil, fmt.Errorf("smtpconn: unsupported proxy scheme: %s", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("smtpconn: proxy address is required")
+	}
+	p.Address = net.JoinHostPort(u.Hostname(), port)
+	if u.Path != "" && u.Path != "/" {
+		return nil, errors.New("smtpconn: proxy URL should not contain a path")
+	}
+
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+
+	return p, nil
+}
+
+type dialFuncDialer DialFunc
+
+func (d dialFuncDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d dialFuncDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// Dial connects to addr through the proxy. forward is used to connect to the
+// proxy server itself.
+func (p *Proxy) Dial(ctx context.Context, forward DialFunc, network, addr string) (net.Conn, error) {
+	// Only TCP can be tunneled, e.g. LMTP over Unix socket is always used
+	// directly.
+	if !strings.HasPrefix(network, "tcp") {
+		return forward(ctx, network, addr)
+	}
+
+	switch p.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if p.Username != "" {
+			auth = &proxy.Auth{User: p.Username, Password: p.Password}
+		}
+		d, err := proxy.SOCKS5("tcp", p.Address, auth, dialFuncDialer(forward))
+		if err != nil {
+			return nil, err
+		}
+		conn, err := d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("smtpconn: proxy %s: %w", p.Address, err)
+		}
+		return conn, nil
+	case "http":
+		return p.dialCONNECT(ctx, forward, addr)
+	default:
+		return nil, fmt.Errorf("smtpconn: unsupported proxy scheme: %s", p.Scheme)
+	}
+}
+
+// bufferedConn is the net.Conn that returns data buffered while reading the
+// proxy response before reading from the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (p *Proxy) dialCONNECT(ctx context.Context, forward DialFunc, addr string) (net.Conn, error) {
+	conn, err := forward(ctx, "tcp", p.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure context cancellation interrupts the handshake.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if p.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smtpconn: proxy %s: %w", p.Address, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("smtpconn: proxy %s: %w", p.Address, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("smtpconn: proxy %s: CONNECT failed: %s", p.Address, resp.Status)
+	}
+
+	if br.Buffered() != 0 {
+		return bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// ProxyTable selects the proxy to use depending on the destination domain.
+type ProxyTable struct {
+	// Proxy to use for destinations not listed in Domains. nil means direct
+	// connections.
+	Default *Proxy
+	// Domain -> Proxy mapping. Subdomains of the listed domains use the same
+	// proxy.
+	Domains map[string]*Proxy
+}
+
+// ProxyDirective is the config.Map.Callback mapper for the proxy directive.
+//
+// Syntax:
+//
+//	proxy URL [domains...]
+//
+// If no domains are specified, the proxy is used for all destinations.
+func (t *ProxyTable) ProxyDirective(_ *config.Map, node config.Node) error {
+	if len(node.Args) == 0 {
+		return config.NodeErr(node, "proxy URL is required")
+	}
+	p, err := ParseProxy(node.Args[0])
+	if err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+
+	if len(node.Args) == 1 {
+		if t.Default != nil {
+			return config.NodeErr(node, "default proxy is already set")
+		}
+		t.Default = p
+		return nil
+	}
+
+	if t.Domains == nil {
+		t.Domains = map[string]*Proxy{}
+	}
+	for _, domain := range node.Args[1:] {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if _, ok := t.Domains[domain]; ok {
+			return config.NodeErr(node, "duplicate proxy for %s", domain)
+		}
+		t.Domains[domain] = p
+	}
+	return nil
+}
+
+// For returns the proxy to use for the domain or nil if the connection
+// should be estabilished directly.
+func (t *ProxyTable) For(domain string) *Proxy {
+	if t == nil {
+		return nil
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for {
+		if p, ok := t.Domains[domain]; ok {
+			return p
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot == -1 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return t.Default
+}
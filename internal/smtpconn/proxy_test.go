@@ -0,0 +1,347 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtpconn
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// proxyHandshake reads the proxy request from the client and returns the
+// address to connect to.
+type proxyHandshake func(conn net.Conn, br *bufio.Reader) (string, error)
+
+// testProxy starts the proxy server that uses handshake to process requests
+// and returns its address together with the channel receiving requested
+// addresses.
+func testProxy(t *testing.T, handshake proxyHandshake) (string, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+
+	targets := make(chan string, 10)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				addr, err := handshake(conn, br)
+				if err != nil {
+					t.Log("proxy handshake:", err)
+					return
+				}
+				targets <- addr
+
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Log("proxy dial:", err)
+					return
+				}
+				defer upstream.Close()
+
+				go func() {
+					io.Copy(upstream, br)
+					upstream.Close()
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), targets
+}
+
+func httpHandshake(user, pass string) proxyHandshake {
+	return func(conn net.Conn, br *bufio.Reader) (string, error) {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect {
+			io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+			return "", errors.New("unexpected method: " + req.Method)
+		}
+		if user != "" {
+			creds := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+			if req.Header.Get("Proxy-Authorization") != "Basic "+creds {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return "", errors.New("wrong credentials")
+			}
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return "", err
+		}
+		return req.Host, nil
+	}
+}
+
+func socks5Handshake(user, pass string) proxyHandshake {
+	return func(conn net.Conn, br *bufio.Reader) (string, error) {
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return "", err
+		}
+		methods := make([]byte, hdr[1])
+		if _, err := io.ReadFull(br, methods); err != nil {
+			return "", err
+		}
+
+		if user == "" {
+			if _, err := conn.Write([]byte{5, 0}); err != nil {
+				return "", err
+			}
+		} else {
+			if _, err := conn.Write([]byte{5, 2}); err != nil {
+				return "", err
+			}
+			// RFC 1929 username/password negotiation.
+			ver := make([]byte, 2)
+			if _, err := io.ReadFull(br, ver); err != nil {
+				return "", err
+			}
+			gotUser := make([]byte, ver[1])
+			if _, err := io.ReadFull(br, gotUser); err != nil {
+				return "", err
+			}
+			passLen, err := br.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			gotPass := make([]byte, passLen)
+			if _, err := io.ReadFull(br, gotPass); err != nil {
+				return "", err
+			}
+			if string(gotUser) != user || string(gotPass) != pass {
+				conn.Write([]byte{1, 1})
+				return "", errors.New("wrong credentials")
+			}
+			if _, err := conn.Write([]byte{1, 0}); err != nil {
+				return "", err
+			}
+		}
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(br, req); err != nil {
+			return "", err
+		}
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, 4)
+			if _, err := io.ReadFull(br, ip); err != nil {
+				return "", err
+			}
+			host = net.IP(ip).String()
+		case 3:
+			l, err := br.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			name := make([]byte, l)
+			if _, err := io.ReadFull(br, name); err != nil {
+				return "", err
+			}
+			host = string(name)
+		default:
+			return "", errors.New("unexpected address type")
+		}
+		port := make([]byte, 2)
+		if _, err := io.ReadFull(br, port); err != nil {
+			return "", err
+		}
+
+		if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+	}
+}
+
+func TestProxy(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		scheme    string
+		handshake proxyHandshake
+		userinfo  string
+	}{
+		{"http", "http", httpHandshake("", ""), ""},
+		{"http auth", "http", httpHandshake("user", "pass"), "user:pass@"},
+		{"socks5", "socks5", socks5Handshake("", ""), ""},
+		{"socks5 auth", "socks5", socks5Handshake("user", "pass"), "user:pass@"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+			defer srv.Close()
+			defer testutils.CheckSMTPConnLeak(t, srv)
+
+			proxyAddr, targets := testProxy(t, tc.handshake)
+			p, err := ParseProxy(tc.scheme + "://" + tc.userinfo + proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := New()
+			c.Log = testutils.Logger(t, "smtpconn")
+			c.Proxy = p
+			if _, err := c.Connect(context.Background(), config.Endpoint{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			}, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if target := <-targets; target != "127.0.0.1:"+testPort {
+				t.Fatal("Wrong address requested from proxy:", target)
+			}
+
+			rcpts := []string{"test@example.invalid"}
+			if err := doTestDelivery(t, c, "test@example.org", rcpts, smtp.MailOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			be.CheckMsg(t, 0, "test@example.org", rcpts)
+		})
+	}
+}
+
+func TestProxy_AuthFail(t *testing.T) {
+	for _, tc := range []struct {
+		scheme    string
+		handshake proxyHandshake
+	}{
+		{"http", httpHandshake("user", "pass")},
+		{"socks5", socks5Handshake("user", "pass")},
+	} {
+		proxyAddr, _ := testProxy(t, tc.handshake)
+		p, err := ParseProxy(tc.scheme + "://user:wrong@" + proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := New()
+		c.Log = testutils.Logger(t, "smtpconn")
+		c.Proxy = p
+		if _, err := c.Connect(context.Background(), config.Endpoint{
+			Scheme: "tcp",
+			Host:   "127.0.0.1",
+			Port:   testPort,
+		}, false, nil); err == nil {
+			c.Close()
+			t.Errorf("%s: expected an error, got none", tc.scheme)
+		}
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want *Proxy
+	}{
+		{"socks5://127.0.0.1", &Proxy{Scheme: "socks5", Address: "127.0.0.1:1080"}},
+		{"socks5h://proxy.example.org:9050", &Proxy{Scheme: "socks5", Address: "proxy.example.org:9050"}},
+		{"http://user:pass@[::1]", &Proxy{Scheme: "http", Address: "[::1]:80", Username: "user", Password: "pass"}},
+		{"http://proxy.example.org:3128/", &Proxy{Scheme: "http", Address: "proxy.example.org:3128"}},
+		{"https://proxy.example.org", nil},
+		{"http://proxy.example.org/path", nil},
+		{"socks5://", nil},
+	} {
+		p, err := ParseProxy(tc.url)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got none", tc.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.url, err)
+			continue
+		}
+		if *p != *tc.want {
+			t.Errorf("%s: wrong result: %+v", tc.url, p)
+		}
+	}
+}
+
+func TestProxyTable(t *testing.T) {
+	var table ProxyTable
+	for _, args := range [][]string{
+		{"socks5://127.0.0.1:1080"},
+		{"http://127.0.0.2:3128", "example.org", "EXAMPLE.com."},
+	} {
+		if err := table.ProxyDirective(nil, config.Node{Name: "proxy", Args: args}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := table.ProxyDirective(nil, config.Node{Name: "proxy", Args: []string{"socks5://127.0.0.3"}}); err == nil {
+		t.Error("Expected an error for duplicate default proxy")
+	}
+
+	for domain, addr := range map[string]string{
+		"example.org":         "127.0.0.2:3128",
+		"mx.example.org.":     "127.0.0.2:3128",
+		"example.com":         "127.0.0.2:3128",
+		"example.net":         "127.0.0.1:1080",
+		"notexample.org":      "127.0.0.1:1080",
+		"org":                 "127.0.0.1:1080",
+		"mx.sub.example.com.": "127.0.0.2:3128",
+	} {
+		if p := table.For(domain); p == nil || p.Address != addr {
+			t.Errorf("Wrong proxy for %s: %+v", domain, p)
+		}
+	}
+
+	var empty *ProxyTable
+	if p := empty.For("example.org"); p != nil {
+		t.Error("Expected no proxy, got", p)
+	}
+}
@@ -25,6 +25,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 // - Wrapping of returned errors using the exterrors package.
 // - SMTPUTF8/IDNA support.
 // - TLS support mode (don't use, attempt, require).
+// - Connections through SOCKS5 and HTTP CONNECT proxies.
 package smtpconn
 
 import (
@@ -52,6 +53,10 @@ type C struct {
 	// DialContext by New.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
 
+	// Proxy to estabilish connections through. Dialer is used to connect to
+	// the proxy server. Can be nil.
+	Proxy *Proxy
+
 	// Hostname to sent in the EHLO/HELO command. Set to
 	// 'localhost.localdomain' by New. Expected to be encoded in ACE form.
 	Hostname string
@@ -146,26 +151,20 @@ func (c *C) wrapClientErr(err error, serverName string) error {
 // Connect actually estabilishes the network connection with the remote host,
 // executes HELO/EHLO and optionally STARTTLS command.
 func (c *C) Connect(ctx context.Context, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, err error) {
-	didTLS, cl, err := c.attemptConnect(ctx, false, endp, starttls, tlsConfig)
+	didTLS, err = c.attemptConnect(ctx, false, endp, starttls, tlsConfig)
 	if err != nil {
 		return false, c.wrapClientErr(err, endp.Host)
 	}
-
-	c.serverName = endp.Host
-	c.cl = cl
 	return didTLS, nil
 }
 
 // ConnectLMTP estabilishes the network connection with the remote host and
 // sends LHLO command, negotiating LMTP use.
 func (c *C) ConnectLMTP(ctx context.Context, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, err error) {
-	didTLS, cl, err := c.attemptConnect(ctx, true, endp, starttls, tlsConfig)
+	didTLS, err = c.attemptConnect(ctx, true, endp, starttls, tlsConfig)
 	if err != nil {
 		return false, c.wrapClientErr(err, endp.Host)
 	}
-
-	c.serverName = endp.Host
-	c.cl = cl
 	return didTLS, nil
 }
 
@@ -186,11 +185,15 @@ func (err TLSError) Unwrap() error {
 	return err.Err
 }
 
-func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, cl *smtp.Client, err error) {
+func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, err error) {
 	var conn net.Conn
-	conn, err = c.Dialer(ctx, endp.Network(), endp.Address())
+	if c.Proxy != nil {
+		conn, err = c.Proxy.Dial(ctx, c.Dialer, endp.Network(), endp.Address())
+	} else {
+		conn, err = c.Dialer(ctx, endp.Network(), endp.Address())
+	}
 	if err != nil {
-		return false, nil, err
+		return false, err
 	}
 
 	if endp.IsTLS() {
@@ -199,6 +202,7 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 		conn = tls.Client(conn, cfg)
 	}
 
+	var cl *smtp.Client
 	if lmtp {
 		cl, err = smtp.NewClientLMTP(conn, endp.Host)
 	} else {
@@ -206,21 +210,24 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 	}
 	if err != nil {
 		conn.Close()
-		return false, nil, err
+		return false, err
 	}
 
 	// i18n: hostname is already expected to be in A-labels form.
 	if err := cl.Hello(c.Hostname); err != nil {
 		cl.Close()
-		return false, nil, err
+		return false, err
 	}
 
+	c.serverName = endp.Host
+	c.cl = cl
+
 	if endp.IsTLS() || !starttls {
-		return endp.IsTLS(), cl, nil
+		return endp.IsTLS(), nil
 	}
 
 	if ok, _ := cl.Extension("STARTTLS"); !ok {
-		return false, cl, nil
+		return false, nil
 	}
 
 	cfg := tlsConfig.Clone()
@@ -230,25 +237,33 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 		// We attempt to send the proper QUIT command though, in case the error happened
 		// *after* the handshake (e.g. PKI verification fail), we don't log the error in
 		// this case though.
-		if err := cl.Quit(); err != nil {
-			cl.Close()
+		if err := c.cl.Quit(); err != nil {
+			c.cl.Close()
 		}
+		c.cl = nil
+		c.serverName = ""
 
-		return false, nil, TLSError{err}
+		return false, TLSError{err}
 	}
 
-	return true, cl, nil
+	return true, nil
 }
 
 // Mail sends the MAIL FROM command to the remote server.
 //
 // SIZE and REQUIRETLS options are forwarded to the remote server as-is.
+// DSN options (RET and ENVID) are forwarded if supported by the remote server.
 // SMTPUTF8 is forwarded if supported by the remote server, if it is not
 // supported - attempt will be done to convert addresses to the ASCII form, if
 // this is not possible, the corresponding method (Mail or Rcpt) will fail.
+// BODY=BINARYMIME messages are rejected since they can be sent only using
+// BDAT, which go-smtp.Client does not support, and no conversion is
+// implemented.
 func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error {
 	defer trace.StartRegion(ctx, "smtpconn/MAIL FROM").End()
 
+	c.rcpts = nil
+
 	outOpts := smtp.MailOptions{
 		// Future extensions may add additional fields that should not be
 		// copied blindly. So we copy only fields we know should be handled
@@ -256,6 +271,8 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 
 		Size:       opts.Size,
 		RequireTLS: opts.RequireTLS,
+		Return:     opts.Return,
+		EnvelopeID: opts.EnvelopeID,
 	}
 
 	// INTERNATIONALIZATION: Use SMTPUTF8 is possible, attempt to convert addresses otherwise.
@@ -282,6 +299,17 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 		}
 	}
 
+	if opts.Body == smtp.BodyBinaryMIME {
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 3},
+			Message:      "BINARYMIME messages cannot be relayed, conversion is not implemented",
+			Misc: map[string]interface{}{
+				"remote_server": c.serverName,
+			},
+		}
+	}
+
 	if err := c.cl.Mail(from, &outOpts); err != nil {
 		return c.wrapClientErr(err, c.serverName)
 	}
@@ -299,6 +327,16 @@ func (c *C) ServerName() string {
 	return c.serverName
 }
 
+// SupportsDSN reports whether the remote server supports the DSN extension
+// (RFC 3461). If it does, DSN parameters are forwarded to it.
+func (c *C) SupportsDSN() bool {
+	if c.cl == nil {
+		return false
+	}
+	ok, _ := c.cl.Extension("DSN")
+	return ok
+}
+
 func (c *C) Client() *smtp.Client {
 	return c.cl
 }
@@ -307,7 +345,10 @@ func (c *C) Client() *smtp.Client {
 //
 // If the address is non-ASCII and cannot be converted to ASCII and the remote
 // server does not support SMTPUTF8, error will be returned.
-func (c *C) Rcpt(ctx context.Context, to string) error {
+//
+// DSN options (NOTIFY and ORCPT) are forwarded if supported by the remote
+// server.
+func (c *C) Rcpt(ctx context.Context, to string, opts smtp.RcptOptions) error {
 	defer trace.StartRegion(ctx, "smtpconn/RCPT TO").End()
 
 	// If necessary, the extension flag is enabled in Start.
@@ -327,7 +368,7 @@ func (c *C) Rcpt(ctx context.Context, to string) error {
 		}
 	}
 
-	if err := c.cl.Rcpt(to); err != nil {
+	if err := c.cl.Rcpt(to, &opts); err != nil {
 		return c.wrapClientErr(err, c.serverName)
 	}
 
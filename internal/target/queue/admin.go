@@ -0,0 +1,355 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dsn"
+)
+
+// Control requests are used to modify the queue state from a different
+// process (i.e. maddyctl) without racing with the running server.
+//
+// The request is saved in the queue storage (e.g. as ID.ctl file in the
+// control subdirectory of the queue directory, containing the action name).
+// Running Queue periodically checks the storage for requests (see
+// controlSlot) and executes them for messages that are not being delivered
+// at the moment.
+const (
+	controlFlush  = "flush"
+	controlDelete = "delete"
+	controlBounce = "bounce"
+)
+
+// controlSlot is the TimeWheel value used to schedule scans for control
+// requests.
+type controlSlot struct{}
+
+// startDelivery marks the message as being delivered. It returns false if the
+// message is being modified by a control request at the moment, in this case
+// the delivery attempt is dropped and the slot is saved to be rescheduled
+// once the control request is done (unless it removes the message).
+func (q *Queue) startDelivery(slot queueSlot) bool {
+	q.msgStateLock.Lock()
+	defer q.msgStateLock.Unlock()
+
+	if dropped, ok := q.controlled[slot.ID]; ok {
+		q.controlled[slot.ID] = append(dropped, slot)
+		return false
+	}
+	q.delivering[slot.ID]++
+	return true
+}
+
+func (q *Queue) doneDelivery(id string) {
+	q.msgStateLock.Lock()
+	defer q.msgStateLock.Unlock()
+
+	q.delivering[id]--
+	if q.delivering[id] <= 0 {
+		delete(q.delivering, id)
+	}
+}
+
+// startControl marks the message as being modified by a control request. It
+// returns false if the message is being delivered at the moment.
+func (q *Queue) startControl(id string) bool {
+	q.msgStateLock.Lock()
+	defer q.msgStateLock.Unlock()
+
+	if q.delivering[id] != 0 {
+		return false
+	}
+	if _, ok := q.controlled[id]; !ok {
+		q.controlled[id] = nil
+	}
+	return true
+}
+
+// doneControl unmarks the message and returns delivery attempts dropped while
+// the control request was processed.
+func (q *Queue) doneControl(id string) []queueSlot {
+	q.msgStateLock.Lock()
+	defer q.msgStateLock.Unlock()
+
+	dropped := q.controlled[id]
+	delete(q.controlled, id)
+	return dropped
+}
+
+func (q *Queue) processControl() {
+	controls, err := q.store.PendingControls()
+	if err != nil {
+		q.Log.Error("failed to read control requests", err)
+		return
+	}
+
+	for id, action := range controls {
+		q.applyControl(id, action)
+	}
+}
+
+func (q *Queue) applyControl(id, action string) {
+	if !q.startControl(id) {
+		// Delivery is in progress, request will be handled during the next
+		// scan.
+		q.Log.Debugf("delaying control request for %s, delivery is in progress", id)
+		return
+	}
+
+	// Scheduled delivery attempts are taken out of the TimeWheel while the
+	// request is processed. Unless the message is removed, they are put back
+	// even if the request fails, otherwise the message would be left
+	// unscheduled until the restart.
+	scheduled := q.wheel.Remove(func(value interface{}) bool {
+		slot, ok := value.(queueSlot)
+		return ok && slot.ID == id
+	})
+	var (
+		removed bool
+		flush   bool
+	)
+	defer func() {
+		// Should be done only after doneControl, otherwise dispatch might
+		// drop it.
+		dropped := q.doneControl(id)
+		if !removed {
+			q.rescheduleControlled(id, flush, scheduled, dropped)
+		}
+	}()
+
+	if err := q.store.ClearControl(id); err != nil {
+		q.Log.Error("failed to remove control request", err, "msg_id", id)
+		return
+	}
+
+	switch action {
+	case controlFlush, controlDelete, controlBounce:
+	default:
+		q.Log.Msg("unknown control request, ignoring", "msg_id", id, "action", action)
+		return
+	}
+
+	meta, err := q.store.ReadMeta(id)
+	if err != nil {
+		q.Log.Debugf("ignoring control request %s for %s: %v", action, id, err)
+		removed = errors.Is(err, os.ErrNotExist)
+		return
+	}
+
+	switch action {
+	case controlFlush:
+		q.Log.Msg("delivery requested by administrator", "msg_id", id)
+		flush = true
+	case controlDelete:
+		q.Log.Msg("message removed by administrator", "msg_id", id)
+		q.removeMessage(&module.MsgMetadata{ID: id})
+		q.stopWaiting(id, meta.To)
+		removed = true
+	case controlBounce:
+		meta, header, body, err := q.store.Open(id)
+		if err != nil {
+			q.Log.Error("failed to read message", err, "msg_id", id)
+			return
+		}
+		if meta.RcptErrs == nil {
+			meta.RcptErrs = map[string]*smtp.SMTPError{}
+		}
+		for _, rcpt := range meta.To {
+			msg := "Message delivery cancelled by the administrator"
+			if lastErr := meta.RcptErrs[rcpt]; lastErr != nil {
+				msg += ", last error: " + lastErr.Message
+			}
+			meta.RcptErrs[rcpt] = &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+				Message:      msg,
+			}
+		}
+		q.Log.Msg("message bounced by administrator", "msg_id", id, "rcpts", meta.To)
+		q.emitDSN(meta, header, body, meta.To, dsn.ActionFailed)
+		q.removeMessage(meta.MsgMeta)
+		q.stopWaiting(id, meta.To)
+		removed = true
+	}
+}
+
+// rescheduleControlled puts the message back into the TimeWheel after the
+// control request is processed. Delivery attempts scheduled before the
+// request and dropped during it are merged into a single one that happens at
+// the earliest time of them (now if the delivery is requested explicitly).
+func (q *Queue) rescheduleControlled(id string, flush bool, scheduled []TimeSlot, dropped []queueSlot) {
+	if !flush && len(scheduled) == 0 && len(dropped) == 0 {
+		return
+	}
+
+	var (
+		priorities []int
+		at         time.Time
+	)
+	for i, ts := range scheduled {
+		priorities = append(priorities, ts.Value.(queueSlot).Priority)
+		if i == 0 || ts.Time.Before(at) {
+			at = ts.Time
+		}
+	}
+	for _, qs := range dropped {
+		priorities = append(priorities, qs.Priority)
+	}
+
+	slot := queueSlot{ID: id}
+	for i, p := range priorities {
+		if i == 0 || p > slot.Priority {
+			slot.Priority = p
+		}
+	}
+	if flush || len(dropped) != 0 {
+		at = time.Time{}
+	}
+	q.wheel.Add(at, slot)
+}
+
+// Admin provides access to the queue storage for administration utilities.
+//
+// Admin never modifies queued messages directly. Instead, it creates control
+// requests that are executed by the running Queue instance. If the server is
+// not running, requests are executed on the next start-up before any delivery
+// attempts are made.
+type Admin struct {
+	q *Queue
+}
+
+// Admin processes the configuration block without starting the delivery and
+// returns the Admin object for the queue storage.
+func (q *Queue) Admin(cfg *config.Map) (*Admin, error) {
+	cfg.AllowUnknown()
+	cfg.String("location", false, false, q.location, &q.location)
+	cfg.Custom("storage", false, false, nil, adminStorageDirective, &q.store)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+	if q.store == nil {
+		if err := q.resolveLocation(); err != nil {
+			return nil, err
+		}
+		q.store = &fsStore{location: q.location, log: q.Log}
+	}
+	return &Admin{q: q}, nil
+}
+
+func checkMsgID(id string) error {
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return fmt.Errorf("queue: malformed message ID: %s", id)
+	}
+	return nil
+}
+
+// List returns meta-data for all messages in the queue ordered by the
+// enqueue time.
+func (a *Admin) List() ([]*QueueMetadata, error) {
+	ids, err := a.q.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*QueueMetadata
+	for _, id := range ids {
+		meta, err := a.q.store.ReadMeta(id)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Delivered while we were reading the directory.
+				continue
+			}
+			return nil, fmt.Errorf("queue: failed to read meta-data for %s: %w", id, err)
+		}
+		if meta.MsgMeta.ID == "" {
+			meta.MsgMeta.ID = id
+		}
+		res = append(res, meta)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].FirstAttempt.Before(res[j].FirstAttempt)
+	})
+	return res, nil
+}
+
+// Read returns meta-data and header of the queued message.
+func (a *Admin) Read(id string) (*QueueMetadata, textproto.Header, error) {
+	if err := checkMsgID(id); err != nil {
+		return nil, textproto.Header{}, err
+	}
+
+	meta, err := a.q.store.ReadMeta(id)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, textproto.Header{}, fmt.Errorf("queue: no such message: %s", id)
+		}
+		return nil, textproto.Header{}, err
+	}
+
+	header, err := a.q.store.ReadHeader(id)
+	if err != nil {
+		return nil, textproto.Header{}, err
+	}
+
+	return meta, header, nil
+}
+
+// Flush requests an immediate delivery attempt for the message.
+func (a *Admin) Flush(id string) error {
+	return a.request(id, controlFlush)
+}
+
+// Delete requests removal of the message from the queue without generating
+// a DSN.
+func (a *Admin) Delete(id string) error {
+	return a.request(id, controlDelete)
+}
+
+// Bounce requests the message to be considered permanently failed for all
+// remaining recipients. DSN is generated if the queue is configured to do so.
+func (a *Admin) Bounce(id string) error {
+	return a.request(id, controlBounce)
+}
+
+func (a *Admin) request(id, action string) error {
+	if err := checkMsgID(id); err != nil {
+		return err
+	}
+
+	if _, err := a.q.store.ReadMeta(id); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("queue: no such message: %s", id)
+		}
+		return err
+	}
+
+	return a.q.store.RequestControl(id, action)
+}
@@ -0,0 +1,381 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func waitQueueEmpty(t *testing.T, q *Queue, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		msgs, err := (&Admin{q: q}).List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("queue is not empty")
+}
+
+func TestQueueAdmin_List(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": errors.New("you shall not pass"),
+			},
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	adm := &Admin{q: q}
+	var msgs []*QueueMetadata
+	for i := 0; i < 100; i++ {
+		var err error
+		msgs, err = adm.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 1 && msgs[0].TriesCount["tester1@example.org"] == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("wrong amount of messages: %v", len(msgs))
+	}
+	if msgs[0].MsgMeta.ID != id {
+		t.Errorf("wrong message ID: %v", msgs[0].MsgMeta.ID)
+	}
+	if !reflect.DeepEqual(msgs[0].To, []string{"tester1@example.org"}) {
+		t.Errorf("wrong recipients: %v", msgs[0].To)
+	}
+	if msgs[0].RcptErrs["tester1@example.org"] == nil {
+		t.Errorf("missing last error")
+	}
+
+	_, hdr, err := adm.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Get("A") != "1" {
+		t.Errorf("wrong header read: %v", hdr)
+	}
+
+	if _, _, err := adm.Read("../" + id); err == nil {
+		t.Errorf("expected an error for a malformed ID")
+	}
+}
+
+func TestQueueAdmin_Flush(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": errors.New("you shall not pass"),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	if err := (&Admin{q: q}).Flush(id); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	waitQueueEmpty(t, q, 5*time.Second)
+}
+
+func TestQueueAdmin_Delete(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": errors.New("you shall not pass"),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	if err := (&Admin{q: q}).Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	waitQueueEmpty(t, q, 5*time.Second)
+
+	time.Sleep(1 * time.Second)
+
+	if len(dt.committed) != 0 {
+		t.Errorf("message was delivered after removal")
+	}
+	if len(dsnTarget.committed) != 0 {
+		t.Errorf("DSN was generated for a removed message")
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueAdmin_Bounce(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	if err := (&Admin{q: q}).Bounce(id); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+
+	waitQueueEmpty(t, q, 5*time.Second)
+	checkQueueDir(t, q, []string{})
+}
+
+// failingOpenStore is the Store that fails Open calls while failOpen is set.
+type failingOpenStore struct {
+	Store
+	failOpen int32
+}
+
+func (s *failingOpenStore) Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	if atomic.LoadInt32(&s.failOpen) != 0 {
+		return nil, textproto.Header{}, nil, errors.New("injected failure")
+	}
+	return s.Store.Open(id)
+}
+
+func scheduledSlots(q *Queue, id string) []TimeSlot {
+	var slots []TimeSlot
+	q.wheel.Remove(func(value interface{}) bool {
+		if slot, ok := value.(queueSlot); ok && slot.ID == id {
+			slots = append(slots, TimeSlot{Value: slot})
+		}
+		return false
+	})
+	return slots
+}
+
+func TestQueueAdmin_StoreError(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dir, err := ioutil.TempDir("", "maddy-tests-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &failingOpenStore{Store: &fsStore{location: dir, log: log.Logger{Out: log.NopOutput{}}}}
+	q := newTestQueueStore(t, &dt, dir, store)
+	q.initialRetryTime = time.Hour
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	for i := 0; i < 100 && len(scheduledSlots(q, id)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	atomic.StoreInt32(&store.failOpen, 1)
+	if err := (&Admin{q: q}).Bounce(id); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		controls, err := store.PendingControls()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(controls) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let the control request finish.
+	time.Sleep(100 * time.Millisecond)
+
+	if len(dsnTarget.committed) != 0 {
+		t.Fatal("DSN was generated despite the failure")
+	}
+	if slots := scheduledSlots(q, id); len(slots) != 1 {
+		t.Fatalf("message is not rescheduled after the failed bounce, slots: %v", slots)
+	}
+
+	atomic.StoreInt32(&store.failOpen, 0)
+	if err := (&Admin{q: q}).Flush(id); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+	waitQueueEmpty(t, q, 5*time.Second)
+}
+
+func TestQueue_ControlDroppedDelivery(t *testing.T) {
+	dispatched := make(chan TimeSlot, 1)
+	q := &Queue{
+		delivering: map[string]int{},
+		controlled: map[string][]queueSlot{},
+	}
+	q.wheel = NewTimeWheel(func(slot TimeSlot) {
+		dispatched <- slot
+	})
+	defer q.wheel.Close()
+
+	if !q.startControl("id") {
+		t.Fatal("startControl failed")
+	}
+	if q.startDelivery(queueSlot{ID: "id", Priority: 3}) {
+		t.Fatal("delivery is started during the control request")
+	}
+	dropped := q.doneControl("id")
+	q.rescheduleControlled("id", false, nil, dropped)
+
+	select {
+	case slot := <-dispatched:
+		if qs := slot.Value.(queueSlot); qs.ID != "id" || qs.Priority != 3 {
+			t.Fatalf("wrong slot rescheduled: %+v", qs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dropped delivery is not rescheduled")
+	}
+	if !q.startDelivery(queueSlot{ID: "id"}) {
+		t.Fatal("delivery is not started after the control request")
+	}
+}
+
+func TestQueueStore_ControlDir(t *testing.T) {
+	t.Parallel()
+
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	store := &fsStore{location: dir, log: log.Logger{Out: log.NopOutput{}}}
+
+	controls, err := store.PendingControls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(controls) != 0 {
+		t.Fatal("Unexpected control requests:", controls)
+	}
+
+	if err := store.RequestControl("msg1", controlFlush); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fsControlDir, "msg1.ctl")); err != nil {
+		t.Fatal("Control request is not in the control directory:", err)
+	}
+
+	controls, err = store.PendingControls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(controls, map[string]string{"msg1": controlFlush}) {
+		t.Fatal("Wrong control requests:", controls)
+	}
+
+	if err := store.ClearControl("msg1"); err != nil {
+		t.Fatal(err)
+	}
+	controls, err = store.PendingControls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(controls) != 0 {
+		t.Fatal("Control request is not cleared:", controls)
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// Per-destination domain state tracking.
+//
+// After domainFailThreshold consecutive connection-level failures (X.4.X
+// temporary errors) for a domain, all deliveries to it are deferred for the
+// backoff period. After that, a single "probe" delivery is allowed. If it
+// fails at the connection level again, the domain is deferred again for twice
+// as long (up to domainMaxBackoff). The first delivery that reaches the
+// destination resets the state and all messages waiting for the domain are
+// retried immediately.
+//
+// Additionally, at most domainMaxParallelism deliveries can be in progress
+// for each domain.
+//
+// The state is kept in memory only.
+
+// Delay used for messages deferred because of domainMaxParallelism. They
+// are usually retried earlier, once a delivery to the domain completes.
+const domainWaitRetry = 1 * time.Minute
+
+type domainState struct {
+	connFailures  int
+	backoff       time.Duration
+	deferredUntil time.Time
+
+	// ID of the message used to probe the domain after the backoff
+	// period.
+	probeID string
+
+	active int
+
+	// IDs of messages that have recipients deferred because of the domain
+	// state.
+	waiting map[string]struct{}
+}
+
+func (ds *domainState) isDeferred(threshold int) bool {
+	return threshold != 0 && ds.connFailures >= threshold
+}
+
+func rcptDomain(rcpt string) string {
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(domain)
+}
+
+// isConnFailure checks whether the error indicates that the destination is
+// not reachable.
+func isConnFailure(err error) bool {
+	if err == nil || !exterrors.IsTemporaryOrUnspec(err) {
+		return false
+	}
+	return toSMTPErr(err).EnhancedCode[1] == 4
+}
+
+// acquireDomains splits the message recipients into ones that can be
+// attempted now and ones that should be deferred because of the domain
+// state.
+//
+// For deferred recipients the earliest time they should be tried is returned.
+// releaseDomains should be called for attempted recipients once delivery
+// completes.
+func (q *Queue) acquireDomains(id string, rcpts []string) (attempt []string, deferred map[string]time.Time) {
+	q.domainsLock.Lock()
+	defer q.domainsLock.Unlock()
+
+	now := time.Now()
+	acquired := make(map[string]bool)
+	retryAt := make(map[string]time.Time)
+	for _, rcpt := range rcpts {
+		domain := rcptDomain(rcpt)
+
+		ok, seen := acquired[domain]
+		if !seen {
+			var until time.Time
+			ok, until = q.acquireDomain(id, domain, now)
+			acquired[domain] = ok
+			retryAt[domain] = until
+		}
+
+		if ok {
+			attempt = append(attempt, rcpt)
+			continue
+		}
+		if deferred == nil {
+			deferred = make(map[string]time.Time)
+		}
+		deferred[rcpt] = retryAt[domain]
+	}
+	return attempt, deferred
+}
+
+func (q *Queue) acquireDomain(id, domain string, now time.Time) (bool, time.Time) {
+	ds := q.domains[domain]
+	if ds == nil {
+		ds = &domainState{waiting: map[string]struct{}{}}
+		q.domains[domain] = ds
+	}
+
+	wait := func(until time.Time) (bool, time.Time) {
+		ds.waiting[id] = struct{}{}
+		q.updateDomainMetrics(domain, ds)
+		return false, until
+	}
+
+	if now.Before(ds.deferredUntil) {
+		return wait(ds.deferredUntil)
+	}
+	if q.domainMaxParallelism != 0 && ds.active >= q.domainMaxParallelism {
+		return wait(now.Add(domainWaitRetry))
+	}
+	if ds.isDeferred(q.domainFailThreshold) {
+		if ds.probeID != "" {
+			return wait(now.Add(ds.backoff))
+		}
+		ds.probeID = id
+	}
+
+	ds.active++
+	delete(ds.waiting, id)
+	q.updateDomainMetrics(domain, ds)
+	return true, time.Time{}
+}
+
+// releaseDomains updates the domain state using the delivery results and
+// reschedules messages waiting for the domains if possible.
+func (q *Queue) releaseDomains(id string, attempted []string, errs map[string]error) {
+	// Domain is considered unreachable only if all recipients failed with
+	// connection-level errors.
+	connFailed := make(map[string]bool)
+	for _, rcpt := range attempted {
+		domain := rcptDomain(rcpt)
+		failed, seen := connFailed[domain]
+		if !seen {
+			failed = true
+		}
+		connFailed[domain] = failed && isConnFailure(errs[rcpt])
+	}
+
+	var wake []string
+
+	q.domainsLock.Lock()
+	now := time.Now()
+	for domain, failed := range connFailed {
+		ds := q.domains[domain]
+		if ds == nil {
+			continue
+		}
+		ds.active--
+		wasProbe := ds.probeID == id
+		if wasProbe {
+			ds.probeID = ""
+		}
+
+		switch {
+		case failed:
+			ds.connFailures++
+			if !ds.isDeferred(q.domainFailThreshold) {
+				break
+			}
+			if ds.backoff == 0 {
+				ds.backoff = q.domainBackoff
+			} else if wasProbe {
+				ds.backoff *= 2
+				if q.domainMaxBackoff != 0 && ds.backoff > q.domainMaxBackoff {
+					ds.backoff = q.domainMaxBackoff
+				}
+			}
+			if wasProbe || ds.deferredUntil.Before(now) {
+				ds.deferredUntil = now.Add(ds.backoff)
+				q.Log.Msg("destination domain is unreachable, deferring deliveries",
+					"domain", domain, "backoff", ds.backoff, "failures", ds.connFailures)
+			}
+		case ds.isDeferred(q.domainFailThreshold):
+			q.Log.Msg("destination domain is reachable again", "domain", domain)
+			fallthrough
+		default:
+			ds.connFailures = 0
+			ds.backoff = 0
+			ds.deferredUntil = time.Time{}
+		}
+
+		if !ds.isDeferred(q.domainFailThreshold) {
+			limit := len(ds.waiting)
+			if q.domainMaxParallelism != 0 && q.domainMaxParallelism-ds.active < limit {
+				limit = q.domainMaxParallelism - ds.active
+			}
+			for waitingID := range ds.waiting {
+				if limit <= 0 {
+					break
+				}
+				wake = append(wake, waitingID)
+				delete(ds.waiting, waitingID)
+				limit--
+			}
+		}
+
+		q.updateDomainMetrics(domain, ds)
+		if ds.active == 0 && len(ds.waiting) == 0 && ds.connFailures == 0 {
+			delete(q.domains, domain)
+		}
+	}
+	q.domainsLock.Unlock()
+
+	for _, waitingID := range wake {
+		q.wakeMessage(waitingID)
+	}
+}
+
+// stopWaiting removes the message from the waiting sets of the recipient
+// domains. It should be called once the message is not going to be retried
+// for them, otherwise the entry is never removed.
+func (q *Queue) stopWaiting(id string, rcpts []string) {
+	q.domainsLock.Lock()
+	defer q.domainsLock.Unlock()
+
+	for _, rcpt := range rcpts {
+		domain := rcptDomain(rcpt)
+		ds := q.domains[domain]
+		if ds == nil {
+			continue
+		}
+		delete(ds.waiting, id)
+		q.updateDomainMetrics(domain, ds)
+		if ds.active == 0 && len(ds.waiting) == 0 && ds.connFailures == 0 {
+			delete(q.domains, domain)
+		}
+	}
+}
+
+// wakeMessage reschedules the delivery attempt for the message to happen now.
+//
+// If the message is not in the TimeWheel (i.e. being delivered right now), it
+// is left alone.
+func (q *Queue) wakeMessage(id string) {
+	var priority int
+	removed := q.wheel.Remove(func(value interface{}) bool {
+		slot, ok := value.(queueSlot)
+		if !ok || slot.ID != id {
+			return false
+		}
+		priority = slot.Priority
+		return true
+	})
+	if len(removed) != 0 {
+		q.wheel.Add(time.Time{}, queueSlot{ID: id, Priority: priority})
+	}
+}
+
+func (q *Queue) updateDomainMetrics(domain string, ds *domainState) {
+	if ds.isDeferred(q.domainFailThreshold) {
+		domainDeferred.WithLabelValues(q.name, domain).Set(1)
+	} else {
+		domainDeferred.DeleteLabelValues(q.name, domain)
+	}
+	if ds.active != 0 {
+		domainDeliveries.WithLabelValues(q.name, domain).Set(float64(ds.active))
+	} else {
+		domainDeliveries.DeleteLabelValues(q.name, domain)
+	}
+	if len(ds.waiting) != 0 {
+		domainWaiting.WithLabelValues(q.name, domain).Set(float64(len(ds.waiting)))
+	} else {
+		domainWaiting.DeleteLabelValues(q.name, domain)
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestDomainBackoff(t *testing.T) {
+	t.Parallel()
+
+	q := newTestQueue(t, &unreliableTarget{})
+	q.domainFailThreshold = 2
+	q.domainBackoff = 1 * time.Hour
+	q.domainMaxBackoff = 3 * time.Hour
+	defer cleanQueue(t, q)
+
+	connErr := &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 4, 1},
+		Message:      "Connection refused",
+	}
+	rcptErr := &exterrors.SMTPError{
+		Code:         450,
+		EnhancedCode: exterrors.EnhancedCode{4, 2, 0},
+		Message:      "Mailbox busy",
+	}
+
+	attempt := func(id string, rcpts ...string) ([]string, map[string]time.Time) {
+		t.Helper()
+		return q.acquireDomains(id, rcpts)
+	}
+	fail := func(id string, err error, rcpts ...string) {
+		t.Helper()
+		errs := make(map[string]error)
+		for _, rcpt := range rcpts {
+			errs[rcpt] = err
+		}
+		q.releaseDomains(id, rcpts, errs)
+	}
+
+	// Recipient-level errors are not counted.
+	attempt("0", "a@example.org")
+	fail("0", rcptErr, "a@example.org")
+	attempt("0", "a@example.org")
+	fail("0", rcptErr, "a@example.org")
+
+	for _, id := range []string{"1", "2"} {
+		ok, deferred := attempt(id, "a@example.org", "b@example.com")
+		if len(deferred) != 0 || len(ok) != 2 {
+			t.Fatalf("recipients deferred before the threshold is reached: %v", deferred)
+		}
+		fail(id, connErr, "a@example.org")
+		fail(id, nil, "b@example.com")
+	}
+
+	ok, deferred := attempt("3", "a@example.org", "b@example.com")
+	if !reflect.DeepEqual(ok, []string{"b@example.com"}) {
+		t.Fatalf("wrong attempted recipients: %v", ok)
+	}
+	if until := deferred["a@example.org"]; time.Until(until) < 59*time.Minute {
+		t.Fatalf("wrong deferral time: %v", until)
+	}
+	fail("3", nil, "b@example.com")
+
+	// Make the backoff period expire. Only one message should be allowed
+	// to probe the domain.
+	q.domainsLock.Lock()
+	q.domains["example.org"].deferredUntil = time.Now()
+	q.domainsLock.Unlock()
+
+	if ok, _ := attempt("4", "a@example.org"); len(ok) != 1 {
+		t.Fatal("probe delivery is not allowed")
+	}
+	if ok, _ := attempt("5", "a@example.org"); len(ok) != 0 {
+		t.Fatal("concurrent delivery is allowed during the probe")
+	}
+	fail("4", connErr, "a@example.org")
+
+	q.domainsLock.Lock()
+	ds := q.domains["example.org"]
+	if ds.backoff != 2*time.Hour {
+		t.Errorf("backoff is not doubled after failed probe: %v", ds.backoff)
+	}
+	ds.deferredUntil = time.Now()
+	q.domainsLock.Unlock()
+
+	// Successful probe resets the state.
+	attempt("5", "a@example.org")
+	fail("5", nil, "a@example.org")
+
+	q.domainsLock.Lock()
+	if ds := q.domains["example.org"]; ds != nil {
+		t.Errorf("domain state is not reset: %+v", ds)
+	}
+	q.domainsLock.Unlock()
+
+	if _, deferred := attempt("6", "a@example.org"); len(deferred) != 0 {
+		t.Fatal("recipients deferred after successful probe")
+	}
+	fail("6", errors.New("whatever"), "a@example.org")
+}
+
+func TestDomainBackoff_Parallelism(t *testing.T) {
+	t.Parallel()
+
+	q := newTestQueue(t, &unreliableTarget{})
+	q.domainMaxParallelism = 1
+	defer cleanQueue(t, q)
+
+	if ok, _ := q.acquireDomains("1", []string{"a@example.org"}); len(ok) != 1 {
+		t.Fatal("first delivery is not allowed")
+	}
+	ok, deferred := q.acquireDomains("2", []string{"a@example.org", "b@example.com"})
+	if !reflect.DeepEqual(ok, []string{"b@example.com"}) || len(deferred) != 1 {
+		t.Fatalf("wrong deferred recipients: %v", deferred)
+	}
+	q.releaseDomains("2", ok, nil)
+
+	q.releaseDomains("1", []string{"a@example.org"}, nil)
+
+	// Waiting message should be rescheduled and the state discarded.
+	q.domainsLock.Lock()
+	defer q.domainsLock.Unlock()
+	if ds := q.domains["example.org"]; ds != nil {
+		t.Fatalf("domain state is not reset: %+v", ds)
+	}
+}
+
+func TestDomainBackoff_ExpiredWaiting(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.maxLifetime = 1 * time.Nanosecond
+	q.domainMaxParallelism = 1
+	defer cleanQueue(t, q)
+
+	// Keep the domain busy so the message is deferred.
+	if ok, _ := q.acquireDomains("busy", []string{"tester2@example.org"}); len(ok) != 1 {
+		t.Fatal("first delivery is not allowed")
+	}
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	// Deferred, but the message is expired already.
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(msg.Body, []byte("Action: failed")) {
+		t.Errorf("DSN is not a failure notification")
+	}
+	checkQueueDir(t, q, []string{})
+
+	q.domainsLock.Lock()
+	if ds := q.domains["example.org"]; len(ds.waiting) != 0 {
+		t.Errorf("removed message is left in the waiting set: %v", ds.waiting)
+	}
+	q.domainsLock.Unlock()
+
+	q.releaseDomains("busy", []string{"tester2@example.org"}, nil)
+
+	q.domainsLock.Lock()
+	defer q.domainsLock.Unlock()
+	if ds := q.domains["example.org"]; ds != nil {
+		t.Fatalf("domain state is not discarded: %+v", ds)
+	}
+}
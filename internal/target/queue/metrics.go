@@ -30,6 +30,39 @@ var queuedMsgs = prometheus.NewGaugeVec(
 	[]string{"module", "location"},
 )
 
+var (
+	domainDeferred = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "queue",
+			Name:      "domain_deferred",
+			Help:      "Whether deliveries to the destination domain are deferred because it is unreachable",
+		},
+		[]string{"module", "domain"},
+	)
+	domainDeliveries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "queue",
+			Name:      "domain_deliveries",
+			Help:      "Amount of deliveries in progress for the destination domain",
+		},
+		[]string{"module", "domain"},
+	)
+	domainWaiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "queue",
+			Name:      "domain_waiting",
+			Help:      "Amount of messages waiting for the destination domain to become available",
+		},
+		[]string{"module", "domain"},
+	)
+)
+
 func init() {
 	prometheus.MustRegister(queuedMsgs)
+	prometheus.MustRegister(domainDeferred)
+	prometheus.MustRegister(domainDeliveries)
+	prometheus.MustRegister(domainWaiting)
 }
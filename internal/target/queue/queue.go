@@ -59,17 +59,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math"
 	"os"
 	"path/filepath"
-	"runtime"
 	"runtime/debug"
 	"runtime/trace"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -94,6 +91,15 @@ type partialError struct {
 	// Underlying error objects for each recipient.
 	Errs map[string]error
 
+	// DSN responsibility for successfully delivered recipients, see
+	// module.DSNDelivery. Missing recipients are assumed to be
+	// module.DSNDelivered.
+	Handover map[string]module.DSNHandover
+
+	// LeaseLost is set if the delivery was aborted because the message is
+	// now handled by a different node, see leasingStore.
+	LeaseLost bool
+
 	// Fields can be accessed without holding this lock, but only after
 	// target.BodyNonAtomic/Body returns.
 	statusLock *sync.Mutex
@@ -122,6 +128,7 @@ var dontRecover = false
 type Queue struct {
 	name             string
 	location         string
+	store            Store
 	hostname         string
 	autogenMsgDomain string
 	wheel            *TimeWheel
@@ -130,11 +137,41 @@ type Queue struct {
 
 	// Retry delay is calculated using the following formula:
 	// initialRetryTime * retryTimeScale ^ (TriesCount - 1)
+	// and is limited by maxRetryTime, if it is not zero.
+	//
+	// If retryDelays or codeRetryDelays apply, they are used instead.
+	// See retry.go for details.
 
 	initialRetryTime time.Duration
 	retryTimeScale   float64
+	maxRetryTime     time.Duration
+	retryDelays      []time.Duration
+	codeRetryDelays  []codeRetryDelays
 	maxTries         int
 
+	// If not zero, all recipients that are still failing after the
+	// message is in the queue for that long are considered permanently
+	// failed.
+	maxLifetime time.Duration
+
+	// Target used for recipients that can't be delivered using the main
+	// one, see switchToFallback.
+	fallbackTarget     module.DeliveryTarget
+	fallbackAfterTries int
+	fallbackAfterTime  time.Duration
+
+	// Per-destination domain state, see domains.go.
+	domainFailThreshold  int
+	domainBackoff        time.Duration
+	domainMaxBackoff     time.Duration
+	domainMaxParallelism int
+	domainsLock          sync.Mutex
+	domains              map[string]*domainState
+
+	// Time spent in the queue after which "delayed" DSN is sent to the
+	// sender. Sorted in ascending order.
+	delayWarnings []time.Duration
+
 	// If any delivery is scheduled in less than postInitDelay
 	// after Init, its delay will be increased by postInitDelay.
 	//
@@ -147,13 +184,23 @@ type Queue struct {
 	// after start-up for whatever reason it will not affect the queue.
 	postInitDelay time.Duration
 
+	// Interval between scans for control requests created by
+	// administration utilities, see admin.go.
+	controlPollInterval time.Duration
+
 	Log    log.Logger
 	Target module.DeliveryTarget
 
 	deliveryWg sync.WaitGroup
-	// Buffered channel used to restrict count of deliveries attempted
-	// in parallel.
-	deliverySemaphore chan struct{}
+	// Used to restrict count of deliveries attempted in parallel.
+	deliverySemaphore *prioritySemaphore
+
+	// IDs of messages that are being delivered or modified by control
+	// requests. These operations are never done concurrently for the same
+	// message.
+	msgStateLock sync.Mutex
+	delivering   map[string]int
+	controlled   map[string][]queueSlot
 }
 
 type QueueMetadata struct {
@@ -177,11 +224,26 @@ type QueueMetadata struct {
 
 	FirstAttempt time.Time
 	LastAttempt  time.Time
+
+	// Values from Queue.delayWarnings "delayed" DSN was already sent for.
+	DelayWarningsSent []time.Duration
+
+	// Recipients that are delivered using the fallback target instead of
+	// the main one.
+	FallbackRcpts map[string]bool
+
+	// If set, no delivery attempts are made before that time (future
+	// release, RFC 4865). Cleared once the message is released.
+	HoldUntil time.Time
 }
 
 type queueSlot struct {
 	ID string
 
+	// Message priority, copied from MsgMetadata to be available without
+	// reading meta-data from disk.
+	Priority int
+
 	// If nil - Hdr and Body are invalid, all values should be read from
 	// disk.
 	Meta *QueueMetadata
@@ -191,11 +253,12 @@ type queueSlot struct {
 
 func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	q := &Queue{
-		name:             instName,
-		initialRetryTime: 15 * time.Minute,
-		retryTimeScale:   1.25,
-		postInitDelay:    10 * time.Second,
-		Log:              log.Logger{Name: "queue"},
+		name:                instName,
+		initialRetryTime:    15 * time.Minute,
+		retryTimeScale:      1.25,
+		postInitDelay:       10 * time.Second,
+		controlPollInterval: 5 * time.Second,
+		Log:                 log.Logger{Name: "queue"},
 	}
 	switch len(inlineArgs) {
 	case 0:
@@ -212,18 +275,47 @@ func (q *Queue) Init(cfg *config.Map) error {
 	var maxParallelism int
 	cfg.Bool("debug", true, false, &q.Log.Debug)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
+	cfg.Duration("max_queue_lifetime", false, false, 0, &q.maxLifetime)
+	cfg.Duration("retry_initial_delay", false, false, 15*time.Minute, &q.initialRetryTime)
+	cfg.Float("retry_scale", false, false, 1.25, &q.retryTimeScale)
+	cfg.Duration("retry_max_delay", false, false, 0, &q.maxRetryTime)
+	cfg.Custom("retry_delays", false, false, nil, durationListDirective, &q.retryDelays)
+	cfg.Callback("retry_delays_for_code", func(m *config.Map, node config.Node) error {
+		codeDelays, err := parseCodeRetryDelays(node)
+		if err != nil {
+			return err
+		}
+		q.codeRetryDelays = append(q.codeRetryDelays, codeDelays)
+		return nil
+	})
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
+	cfg.Int("max_domain_parallelism", false, false, 0, &q.domainMaxParallelism)
+	cfg.Int("domain_failure_threshold", false, false, 5, &q.domainFailThreshold)
+	cfg.Duration("domain_backoff", false, false, 5*time.Minute, &q.domainBackoff)
+	cfg.Duration("domain_max_backoff", false, false, 1*time.Hour, &q.domainMaxBackoff)
 	cfg.String("location", false, false, q.location, &q.location)
+	cfg.Custom("storage", false, false, nil, storageDirective, &q.store)
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
+	cfg.Custom("fallback", false, false, nil, modconfig.DeliveryDirective, &q.fallbackTarget)
+	cfg.Int("fallback_after_tries", false, false, 5, &q.fallbackAfterTries)
+	cfg.Duration("fallback_after_time", false, false, 0, &q.fallbackAfterTime)
 	cfg.String("hostname", true, true, "", &q.hostname)
 	cfg.String("autogenerated_msg_domain", true, false, "", &q.autogenMsgDomain)
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
+	cfg.Custom("delay_warnings", false, false, nil, durationListDirective, &q.delayWarnings)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	if q.retryTimeScale < 1 {
+		return errors.New("queue: retry_scale should be at least 1")
+	}
+	sort.Slice(q.delayWarnings, func(i, j int) bool {
+		return q.delayWarnings[i] < q.delayWarnings[j]
+	})
+
 	if q.dsnPipeline != nil {
 		if q.autogenMsgDomain == "" {
 			return errors.New("queue: autogenerated_msg_domain is required if bounce {} is specified")
@@ -232,29 +324,52 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Hostname = q.hostname
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug}
 	}
+	if q.store == nil {
+		if err := q.resolveLocation(); err != nil {
+			return err
+		}
+
+		// TODO: Check location write permissions.
+		if err := os.MkdirAll(q.location, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	return q.start(maxParallelism)
+}
+
+func (q *Queue) resolveLocation() error {
 	if q.location == "" && q.name == "" {
 		return errors.New("queue: need explicit location directive or inline argument if defined inline")
 	}
 	if q.location == "" {
 		q.location = filepath.Join(config.StateDirectory, q.name)
 	}
-
-	// TODO: Check location write permissions.
-	if err := os.MkdirAll(q.location, os.ModePerm); err != nil {
-		return err
-	}
-
-	return q.start(maxParallelism)
+	return nil
 }
 
 func (q *Queue) start(maxParallelism int) error {
 	q.wheel = NewTimeWheel(q.dispatch)
-	q.deliverySemaphore = make(chan struct{}, maxParallelism)
+	q.deliverySemaphore = newPrioritySemaphore(maxParallelism)
+	q.delivering = make(map[string]int)
+	q.controlled = make(map[string][]queueSlot)
+	q.domains = make(map[string]*domainState)
+	if q.store == nil {
+		q.store = &fsStore{location: q.location, log: q.Log}
+	}
 
-	if err := q.readDiskQueue(); err != nil {
+	if err := q.loadMessages(true); err != nil {
 		return err
 	}
 
+	// Pending control requests are executed before any messages loaded
+	// from disk are tried (thanks to postInitDelay).
+	q.wheel.Add(time.Time{}, controlSlot{})
+
+	if ls, ok := q.store.(leasingStore); ok {
+		q.wheel.Add(time.Now().Add(ls.RenewInterval()), leaseSlot{})
+	}
+
 	q.Log.Debugf("delivery target: %T", q.Target)
 
 	return nil
@@ -264,36 +379,57 @@ func (q *Queue) Close() error {
 	q.wheel.Close()
 	q.deliveryWg.Wait()
 
-	return nil
+	return q.store.Close()
 }
 
-// discardBroken changes the name of metadata file to have .meta_broken
-// extension.
-//
-// Further attempts to deliver (due to a timewheel) it will fail due to
-// non-existent meta-data file.
+// discardBroken excludes the message from further processing, see
+// Store.MarkBroken.
 //
 // No error handling is done since this function is called from panic handler.
 func (q *Queue) discardBroken(id string) {
-	err := os.Rename(filepath.Join(q.location, id+".meta"), filepath.Join(q.location, id+".meta_broken"))
-	if err != nil {
+	if err := q.store.MarkBroken(id); err != nil {
 		// Note: Global logger is used in case there is something wrong with Queue.Log.
 		log.Printf("can't mark the queue message as broken: %v", err)
 	}
 }
 
 func (q *Queue) dispatch(value TimeSlot) {
+	if _, ok := value.Value.(controlSlot); ok {
+		q.deliveryWg.Add(1)
+		go func() {
+			defer q.deliveryWg.Done()
+			q.processControl()
+			q.wheel.Add(time.Now().Add(q.controlPollInterval), controlSlot{})
+		}()
+		return
+	}
+	if _, ok := value.Value.(leaseSlot); ok {
+		q.deliveryWg.Add(1)
+		go func() {
+			defer q.deliveryWg.Done()
+			q.maintainLeases()
+		}()
+		return
+	}
+
 	slot := value.Value.(queueSlot)
 
 	q.Log.Debugln("starting delivery for", slot.ID)
 
 	q.deliveryWg.Add(1)
 	go func() {
+		defer q.deliveryWg.Done()
+
+		if !q.startDelivery(slot) {
+			q.Log.Debugln("message is modified by a control request, postponing delivery attempt", slot.ID)
+			return
+		}
+		defer q.doneDelivery(slot.ID)
+
 		q.Log.Debugln("waiting on delivery semaphore for", slot.ID)
-		q.deliverySemaphore <- struct{}{}
+		q.deliverySemaphore.Acquire(slot.Priority)
 		defer func() {
-			<-q.deliverySemaphore
-			q.deliveryWg.Done()
+			q.deliverySemaphore.Release()
 
 			if dontRecover {
 				return
@@ -307,6 +443,17 @@ func (q *Queue) dispatch(value TimeSlot) {
 		}()
 
 		q.Log.Debugln("delivery semaphore acquired for", slot.ID)
+		if ls, ok := q.store.(leasingStore); ok {
+			owned, err := ls.Owned(slot.ID)
+			if err != nil {
+				q.Log.Error("lease check failed", err, slot.ID)
+				return
+			}
+			if !owned {
+				q.Log.Msg("message is handled by a different node, dropping delivery attempt", "msg_id", slot.ID)
+				return
+			}
+		}
 		var (
 			meta *QueueMetadata
 			hdr  textproto.Header
@@ -314,14 +461,11 @@ func (q *Queue) dispatch(value TimeSlot) {
 		)
 		if slot.Meta == nil {
 			var err error
-			meta, hdr, body, err = q.openMessage(slot.ID)
+			meta, hdr, body, err = q.store.Open(slot.ID)
 			if err != nil {
 				q.Log.Error("read message", err, slot.ID)
 				return
 			}
-			if meta == nil {
-				panic("wtf")
-			}
 		} else {
 			meta = slot.Meta
 			hdr = *slot.Hdr
@@ -353,9 +497,11 @@ func toSMTPErr(err error) *smtp.SMTPError {
 	if ok {
 		res.Code = ctxCode
 	}
-	ctxEnchCode, ok := ctxInfo["smtp_enchcode"].(smtp.EnhancedCode)
-	if ok {
+	switch ctxEnchCode := ctxInfo["smtp_enchcode"].(type) {
+	case smtp.EnhancedCode:
 		res.EnhancedCode = ctxEnchCode
+	case exterrors.EnhancedCode:
+		res.EnhancedCode = smtp.EnhancedCode(ctxEnchCode)
 	}
 	ctxMsg, ok := ctxInfo["smtp_msg"].(string)
 	if ok {
@@ -375,12 +521,75 @@ func toSMTPErr(err error) *smtp.SMTPError {
 func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 
-	partialErr := q.deliver(meta, header, body)
-	dl.Debugf("errors: %v", partialErr.Errs)
+	if !meta.HoldUntil.IsZero() {
+		// Either the hold time passed or the delivery was requested
+		// by the administrator.
+		meta.HoldUntil = time.Time{}
+	}
 
-	// While iterating the list of recipients we also pick the smallest tries count
-	// and use it to calculate the delay for the next attempt.
-	smallestTriesCount := 999999
+	allRcpts := meta.To
+
+	// Recipients switched to the fallback target are not subject to the
+	// destination domain state since they are not delivered directly.
+	var primaryRcpts, fallbackRcpts []string
+	for _, rcpt := range allRcpts {
+		if meta.FallbackRcpts[rcpt] {
+			fallbackRcpts = append(fallbackRcpts, rcpt)
+		} else {
+			primaryRcpts = append(primaryRcpts, rcpt)
+		}
+	}
+
+	attemptRcpts, deferredRcpts := q.acquireDomains(meta.MsgMeta.ID, primaryRcpts)
+	if len(deferredRcpts) != 0 {
+		dl.Msg("delivery deferred due to the destination domain state", "rcpts", len(deferredRcpts))
+	}
+	// Deferred recipients that are not retried for the primary target must
+	// leave the domain waiting sets. This also covers the case when the
+	// message is removed or the delivery panics.
+	retried := make(map[string]bool)
+	defer func() {
+		var stale []string
+		for rcpt := range deferredRcpts {
+			if !retried[rcpt] || meta.FallbackRcpts[rcpt] {
+				stale = append(stale, rcpt)
+			}
+		}
+		if len(stale) != 0 {
+			q.stopWaiting(meta.MsgMeta.ID, stale)
+		}
+	}()
+
+	partialErr := partialError{Errs: map[string]error{}}
+	if len(attemptRcpts) != 0 {
+		partialErr = q.deliver(q.Target, meta, attemptRcpts, header, body)
+		q.releaseDomains(meta.MsgMeta.ID, attemptRcpts, partialErr.Errs)
+		dl.Debugf("errors: %v", partialErr.Errs)
+	}
+	if partialErr.LeaseLost {
+		dl.Msg("delivery aborted, message is handled by a different node")
+		return
+	}
+	if len(fallbackRcpts) != 0 {
+		fallbackErr := q.deliver(q.fallbackTarget, meta, fallbackRcpts, header, body)
+		if fallbackErr.LeaseLost {
+			dl.Msg("delivery aborted, message is handled by a different node")
+			return
+		}
+		for rcpt, err := range fallbackErr.Errs {
+			partialErr.Errs[rcpt] = err
+		}
+		for rcpt, handover := range fallbackErr.Handover {
+			if partialErr.Handover == nil {
+				partialErr.Handover = make(map[string]module.DSNHandover)
+			}
+			partialErr.Handover[rcpt] = handover
+		}
+		dl.Debugf("fallback errors: %v", fallbackErr.Errs)
+	}
+	if len(attemptRcpts) != 0 || len(fallbackRcpts) != 0 {
+		meta.LastAttempt = time.Now()
+	}
 
 	if meta.TriesCount == nil {
 		meta.TriesCount = make(map[string]int)
@@ -389,12 +598,49 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	// Check attempted recipients and corresponding errors.
 	// Split list into two parts: recipients that should be retried (newRcpts)
 	// and recipients DSN will be generated for.
-	newRcpts := make([]string, 0, len(partialErr.Errs))
+	newRcpts := make([]string, 0, len(partialErr.Errs)+len(deferredRcpts))
 	failedRcpts := make([]string, 0, len(partialErr.Errs))
-	for _, rcpt := range meta.To {
+	var deliveredRcpts, relayedRcpts []string
+	switched := false
+	for _, rcpt := range allRcpts {
+		if _, ok := deferredRcpts[rcpt]; ok {
+			if q.switchToFallback(meta, rcpt, meta.TriesCount[rcpt], q.expired(meta)) {
+				dl.Msg("switching to the fallback target", "rcpt", rcpt)
+				switched = true
+				newRcpts = append(newRcpts, rcpt)
+				continue
+			}
+
+			// Not attempted, so tries count is not changed.
+			if !q.expired(meta) {
+				newRcpts = append(newRcpts, rcpt)
+				continue
+			}
+
+			if meta.RcptErrs[rcpt] == nil {
+				meta.RcptErrs[rcpt] = &smtp.SMTPError{
+					Code:         451,
+					EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+					Message:      "Destination domain is unreachable",
+				}
+			}
+			dl.Msg("not delivered, queue lifetime exceeded", "rcpt", rcpt)
+			delete(meta.TriesCount, rcpt)
+			failedRcpts = append(failedRcpts, rcpt)
+			continue
+		}
+
 		rcptErr, ok := partialErr.Errs[rcpt]
 		if !ok {
-			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1)
+			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1, "fallback", meta.FallbackRcpts[rcpt])
+			switch partialErr.Handover[rcpt] {
+			case module.DSNDelivered:
+				deliveredRcpts = append(deliveredRcpts, rcpt)
+			case module.DSNRelayed:
+				relayedRcpts = append(relayedRcpts, rcpt)
+			case module.DSNPassedOn:
+				// Next hop is responsible for the DSN.
+			}
 			continue
 		}
 
@@ -403,63 +649,82 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		meta.RcptErrs[rcpt] = toSMTPErr(rcptErr)
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
-		if !temporary || meta.TriesCount[rcpt]+1 == q.maxTries {
-			delete(meta.TriesCount, rcpt)
+		switch {
+		case !temporary:
 			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
-			failedRcpts = append(failedRcpts, rcpt)
+		case q.switchToFallback(meta, rcpt, meta.TriesCount[rcpt]+1, meta.TriesCount[rcpt]+1 == q.maxTries || q.expired(meta)):
+			// Tries counter is not increased so the fallback target gets
+			// at least one attempt.
+			dl.Msg("switching to the fallback target", "rcpt", rcpt, "attempts", meta.TriesCount[rcpt]+1)
+			switched = true
+			newRcpts = append(newRcpts, rcpt)
+			continue
+		case meta.TriesCount[rcpt]+1 == q.maxTries:
+			dl.Msg("not delivered, too many attempts", "rcpt", rcpt)
+		case q.expired(meta):
+			dl.Msg("not delivered, queue lifetime exceeded", "rcpt", rcpt)
+		default:
+			// Temporary error, increase tries counter and requeue.
+			meta.TriesCount[rcpt]++
+			newRcpts = append(newRcpts, rcpt)
 			continue
 		}
 
-		// Temporary error, increase tries counter and requeue.
-		meta.TriesCount[rcpt]++
-		newRcpts = append(newRcpts, rcpt)
-
-		// See smallestTriesCount comment.
-		if count := meta.TriesCount[rcpt]; count < smallestTriesCount {
-			smallestTriesCount = count
-		}
+		delete(meta.TriesCount, rcpt)
+		failedRcpts = append(failedRcpts, rcpt)
 	}
 
 	// Generate DSN for recipients that failed permanently this time.
 	if len(failedRcpts) != 0 {
-		q.emitDSN(meta, header, failedRcpts)
+		q.emitDSN(meta, header, body, failedRcpts, dsn.ActionFailed)
+	}
+	// And for delivered ones, if it was requested.
+	if len(deliveredRcpts) != 0 {
+		q.emitDSN(meta, header, body, deliveredRcpts, dsn.ActionDelivered)
+	}
+	if len(relayedRcpts) != 0 {
+		q.emitDSN(meta, header, body, relayedRcpts, dsn.ActionRelayed)
 	}
 	// No recipients to try, either all failed or all succeeded.
 	if len(newRcpts) == 0 {
-		q.removeFromDisk(meta.MsgMeta)
+		q.removeMessage(meta.MsgMeta)
 		return
 	}
 
 	meta.To = newRcpts
-	meta.LastAttempt = time.Now()
 
-	if err := q.updateMetadataOnDisk(meta); err != nil {
+	q.checkDelayWarnings(meta, header)
+
+	if err := q.store.UpdateMeta(meta); err != nil {
 		dl.Error("meta-data update", err)
 	}
 
-	nextTryTime := time.Now()
-	// Delay between retries grows exponentally, the formula is:
-	// initialRetryTime * retryTimeScale ^ (smallestTriesCount - 1)
-	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
-	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	nextTryTime := q.nextTryTime(meta, deferredRcpts)
+	if switched {
+		// Try the fallback target right away.
+		nextTryTime = time.Now()
+	}
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
 		"rcpts", meta.To)
 
+	for _, rcpt := range newRcpts {
+		retried[rcpt] = true
+	}
 	q.wheel.Add(nextTryTime, queueSlot{
-		ID: meta.MsgMeta.ID,
+		ID:       meta.MsgMeta.ID,
+		Priority: meta.MsgMeta.Priority,
 
 		// Do not keep (meta-)data in memory to reduce usage.  At this point,
-		// it is safe on disk and next try will reread it.
+		// it is safe in the storage and next try will reread it.
 		Meta: nil,
 		Hdr:  nil,
 		Body: nil,
 	})
 }
 
-func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) partialError {
+func (q *Queue) deliver(tgt module.DeliveryTarget, meta *QueueMetadata, rcpts []string, header textproto.Header, body buffer.Buffer) partialError {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 	perr := partialError{
 		Errs:       map[string]error{},
@@ -474,11 +739,11 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	defer msgTask.End()
 
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
-	delivery, err := q.Target.Start(mailCtx, msgMeta, meta.From)
+	delivery, err := tgt.Start(mailCtx, msgMeta, meta.From)
 	mailTask.End()
 	if err != nil {
 		dl.Debugf("target.Start failed: %v", err)
-		for _, rcpt := range meta.To {
+		for _, rcpt := range rcpts {
 			perr.Errs[rcpt] = err
 		}
 		return perr
@@ -486,7 +751,7 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	dl.Debugf("target.Start OK")
 
 	var acceptedRcpts []string
-	for _, rcpt := range meta.To {
+	for _, rcpt := range rcpts {
 		rcptCtx, rcptTask := trace.NewTask(msgCtx, "RCPT TO")
 		if err := delivery.AddRcpt(rcptCtx, rcpt); err != nil {
 			dl.Debugf("delivery.AddRcpt %s failed: %v", rcpt, err)
@@ -512,6 +777,21 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 		}
 	}
 
+	// The message should not be delivered if a different node took it
+	// over while recipients were checked.
+	if err := q.renewLease(meta.MsgMeta.ID); err != nil {
+		dl.Debugf("delivery.Abort (lease renewal failed: %v)", err)
+		if errors.Is(err, errLeaseLost) {
+			perr.LeaseLost = true
+		} else {
+			expandToPartialErr(err)
+		}
+		if err := delivery.Abort(msgCtx); err != nil {
+			dl.Error("delivery.Abort failed", err)
+		}
+		return perr
+	}
+
 	bodyCtx, bodyTask := trace.NewTask(msgCtx, "DATA")
 	defer bodyTask.End()
 
@@ -545,9 +825,19 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	if err := delivery.Commit(bodyCtx); err != nil {
 		dl.Debugf("delivery.Commit failed: %v", err)
 		expandToPartialErr(err)
+		return perr
 	}
 	dl.Debugf("delivery.Commit OK")
 
+	if dsnDelivery, ok := delivery.(module.DSNDelivery); ok {
+		perr.Handover = make(map[string]module.DSNHandover, len(acceptedRcpts))
+		for _, rcpt := range acceptedRcpts {
+			if perr.Errs[rcpt] == nil {
+				perr.Handover[rcpt] = dsnDelivery.DSNHandover(rcpt)
+			}
+		}
+	}
+
 	return perr
 }
 
@@ -568,8 +858,8 @@ func (qd *queueDelivery) Body(ctx context.Context, header textproto.Header, body
 	defer trace.StartRegion(ctx, "queue/Body").End()
 
 	// Body buffer initially passed to us may not be valid after "delivery" to queue completes.
-	// storeNewMessage returns a new buffer object created from message blob stored on disk.
-	storedBody, err := qd.q.storeNewMessage(qd.meta, header, body)
+	// Store.Create returns a new buffer object created from the stored message blob.
+	storedBody, err := qd.q.store.Create(qd.meta, header, body)
 	if err != nil {
 		return err
 	}
@@ -583,7 +873,7 @@ func (qd *queueDelivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "queue/Abort").End()
 
 	if qd.body != nil {
-		qd.q.removeFromDisk(qd.meta.MsgMeta)
+		qd.q.removeMessage(qd.meta.MsgMeta)
 	}
 	return nil
 }
@@ -595,12 +885,21 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
-	qd.q.wheel.Add(time.Time{}, queueSlot{
-		ID:   qd.meta.MsgMeta.ID,
-		Meta: qd.meta,
-		Hdr:  &qd.header,
-		Body: qd.body,
-	})
+	if qd.meta.HoldUntil.IsZero() {
+		qd.q.wheel.Add(time.Time{}, queueSlot{
+			ID:       qd.meta.MsgMeta.ID,
+			Priority: qd.meta.MsgMeta.Priority,
+			Meta:     qd.meta,
+			Hdr:      &qd.header,
+			Body:     qd.body,
+		})
+	} else {
+		// Message may be held for a long time, do not keep it in memory.
+		qd.q.wheel.Add(qd.meta.HoldUntil, queueSlot{
+			ID:       qd.meta.MsgMeta.ID,
+			Priority: qd.meta.MsgMeta.Priority,
+		})
+	}
 	qd.meta = nil
 	qd.body = nil
 	return nil
@@ -614,95 +913,51 @@ func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom
 		FirstAttempt: time.Now(),
 		LastAttempt:  time.Now(),
 	}
+	if msgMeta.HoldUntil.After(meta.FirstAttempt) {
+		// Queue lifetime and delay warnings are counted from the release
+		// time.
+		meta.HoldUntil = msgMeta.HoldUntil
+		meta.FirstAttempt = msgMeta.HoldUntil
+		target.DeliveryLogger(q.Log, msgMeta).Msg("message is held for future release", "hold_until", meta.HoldUntil)
+	}
 	return &queueDelivery{q: q, meta: meta}, nil
 }
 
-func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
-	id := msgMeta.ID
+func (q *Queue) removeMessage(msgMeta *module.MsgMetadata) {
 	dl := target.DeliveryLogger(q.Log, msgMeta)
-
-	// Order is important.
-	// If we remove header and body but can't remove meta now - readDiskQueue
-	// will detect and report it.
-	headerPath := filepath.Join(q.location, id+".header")
-	if err := os.Remove(headerPath); err != nil {
-		dl.Error("failed to remove header from disk", err)
-	}
-	bodyPath := filepath.Join(q.location, id+".body")
-	if err := os.Remove(bodyPath); err != nil {
-		dl.Error("failed to remove body from disk", err)
-	}
-	metaPath := filepath.Join(q.location, id+".meta")
-	if err := os.Remove(metaPath); err != nil {
-		dl.Error("failed to remove meta-data from disk", err)
+	if err := q.store.Remove(msgMeta.ID); err != nil {
+		dl.Error("failed to remove message from the storage", err)
+		return
 	}
-	dl.Debugf("removed message from disk")
+	dl.Debugf("removed message from the storage")
 }
 
-func (q *Queue) readDiskQueue() error {
-	dirInfo, err := ioutil.ReadDir(q.location)
+// loadMessages schedules delivery for messages returned by Store.Acquire.
+//
+// If initial is true, delivery is additionally delayed by postInitDelay.
+func (q *Queue) loadMessages(initial bool) error {
+	ids, err := q.store.Acquire()
 	if err != nil {
 		return err
 	}
 
-	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
-
 	loadedCount := 0
-	for _, entry := range dirInfo {
-		// We start loading from meta-data files and then check whether ID.header and ID.body exist.
-		// This allows us to properly detect dangling body files.
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
-			continue
-		}
-		id := entry.Name()[:len(entry.Name())-5]
-
-		meta, err := q.readMessageMeta(id)
+	for _, id := range ids {
+		meta, err := q.store.ReadMeta(id)
 		if err != nil {
 			q.Log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
 			continue
 		}
 
-		// Check header file existence.
-		if _, err := os.Stat(filepath.Join(q.location, id+".header")); err != nil {
-			if os.IsNotExist(err) {
-				q.Log.Printf("header file doesn't exist for msg ID = %s", id)
-				q.tryRemoveDanglingFile(id + ".meta")
-				q.tryRemoveDanglingFile(id + ".body")
-			} else {
-				q.Log.Printf("skipping nonstat'able header file: %v (msg ID = %s)", err, id)
-			}
-			continue
-		}
-
-		// Check body file existence.
-		if _, err := os.Stat(filepath.Join(q.location, id+".body")); err != nil {
-			if os.IsNotExist(err) {
-				q.Log.Printf("body file doesn't exist for msg ID = %s", id)
-				q.tryRemoveDanglingFile(id + ".meta")
-				q.tryRemoveDanglingFile(id + ".header")
-			} else {
-				q.Log.Printf("skipping nonstat'able body file: %v (msg ID = %s)", err, id)
-			}
-			continue
-		}
-
-		smallestTriesCount := 999999
-		for _, count := range meta.TriesCount {
-			if smallestTriesCount > count {
-				smallestTriesCount = count
-			}
-		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
-
-		if time.Until(nextTryTime) < q.postInitDelay {
+		nextTryTime := q.nextTryTime(meta, nil)
+		if initial && time.Until(nextTryTime) < q.postInitDelay {
 			nextTryTime = time.Now().Add(q.postInitDelay)
 		}
 
 		q.Log.Debugf("will try to deliver (msg ID = %s) in %v (%v)", id, time.Until(nextTryTime), nextTryTime)
 		q.wheel.Add(nextTryTime, queueSlot{
-			ID: id,
+			ID:       id,
+			Priority: meta.MsgMeta.Priority,
 		})
 		loadedCount++
 	}
@@ -714,119 +969,33 @@ func (q *Queue) readDiskQueue() error {
 	return nil
 }
 
-func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
-	id := meta.MsgMeta.ID
-
-	headerPath := filepath.Join(q.location, id+".header")
-	headerFile, err := os.Create(headerPath)
-	if err != nil {
-		return nil, err
-	}
-	defer headerFile.Close()
-
-	if err := textproto.WriteHeader(headerFile, header); err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	bodyReader, err := body.Open()
-	if err != nil {
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-	defer bodyReader.Close()
-
-	bodyPath := filepath.Join(q.location, id+".body")
-	bodyFile, err := os.Create(bodyPath)
-	if err != nil {
-		return nil, err
-	}
-	defer bodyFile.Close()
-
-	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	if err := q.updateMetadataOnDisk(meta); err != nil {
-		q.tryRemoveDanglingFile(id + ".body")
-		q.tryRemoveDanglingFile(id + ".header")
-		return nil, err
-	}
-
-	if err := headerFile.Sync(); err != nil {
-		return nil, err
-	}
-
-	if err := bodyFile.Sync(); err != nil {
-		return nil, err
-	}
-
-	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
-}
-
-func (q *Queue) updateMetadataOnDisk(meta *QueueMetadata) error {
-	metaPath := filepath.Join(q.location, meta.MsgMeta.ID+".meta")
-
-	var file *os.File
-	var err error
-	if runtime.GOOS == "windows" {
-		file, err = os.Create(metaPath)
-		if err != nil {
-			return err
-		}
-	} else {
-		file, err = os.Create(metaPath + ".new")
-		if err != nil {
-			return err
-		}
-	}
-	defer file.Close()
-
-	metaCopy := *meta
-	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
-	metaCopy.MsgMeta.Conn = nil
+// leaseSlot is the TimeWheel value used to schedule lease renewal for
+// storages shared between multiple nodes, see leasingStore.
+type leaseSlot struct{}
 
-	if err := json.NewEncoder(file).Encode(metaCopy); err != nil {
-		return err
-	}
+func (q *Queue) maintainLeases() {
+	ls := q.store.(leasingStore)
+	defer q.wheel.Add(time.Now().Add(ls.RenewInterval()), leaseSlot{})
 
-	if err := file.Sync(); err != nil {
-		return err
+	if err := ls.Renew(); err != nil {
+		q.Log.Error("failed to renew message leases", err)
+		return
 	}
 
-	if runtime.GOOS != "windows" {
-		if err := os.Rename(metaPath+".new", metaPath); err != nil {
-			return err
-		}
+	// Take over messages of nodes that are gone.
+	if err := q.loadMessages(false); err != nil {
+		q.Log.Error("failed to acquire messages", err)
 	}
-
-	return nil
 }
 
-func (q *Queue) readMessageMeta(id string) (*QueueMetadata, error) {
-	metaPath := filepath.Join(q.location, id+".meta")
-	file, err := os.Open(metaPath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	meta := &QueueMetadata{}
-
-	meta.MsgMeta = &module.MsgMetadata{}
-
-	// There is a couple of problems we have to solve before we would be able to
-	// serialize ConnState.
-	// 1. future.Future can't be serialized.
-	// 2. net.Addr can't be deserialized because we don't know the concrete type.
-
-	if err := json.NewDecoder(file).Decode(meta); err != nil {
-		return nil, err
+// renewLease extends the lease on the message before it is passed to the
+// target. It is a no-op for storages that are not shared.
+func (q *Queue) renewLease(id string) error {
+	ls, ok := q.store.(leasingStore)
+	if !ok {
+		return nil
 	}
-
-	return meta, nil
+	return ls.RenewMessage(id)
 }
 
 type BufferedReadCloser struct {
@@ -834,58 +1003,71 @@ type BufferedReadCloser struct {
 	io.Closer
 }
 
-func (q *Queue) tryRemoveDanglingFile(name string) {
-	if err := os.Remove(filepath.Join(q.location, name)); err != nil {
-		q.Log.Error("dangling file remove failed", err)
-		return
-	}
-	q.Log.Printf("removed dangling file %s", name)
+func (q *Queue) InstanceName() string {
+	return q.name
 }
 
-func (q *Queue) openMessage(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
-	meta, err := q.readMessageMeta(id)
-	if err != nil {
-		return nil, textproto.Header{}, nil, err
-	}
+func (q *Queue) Name() string {
+	return "queue"
+}
 
-	bodyPath := filepath.Join(q.location, id+".body")
-	_, err = os.Stat(bodyPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			q.tryRemoveDanglingFile(id + ".meta")
+// checkDelayWarnings sends "delayed" DSN for the remaining recipients if the
+// message is in the queue for longer than any of the configured delayWarnings
+// values it was not sent for yet.
+//
+// Multiple thresholds passed at once result in a single DSN.
+func (q *Queue) checkDelayWarnings(meta *QueueMetadata, header textproto.Header) {
+	sent := make(map[time.Duration]bool, len(meta.DelayWarningsSent))
+	for _, warn := range meta.DelayWarningsSent {
+		sent[warn] = true
+	}
+
+	inQueue := time.Since(meta.FirstAttempt)
+	needWarning := false
+	for _, warn := range q.delayWarnings {
+		if warn > inQueue {
+			break
 		}
-		return nil, textproto.Header{}, nil, nil
-	}
-	body := buffer.FileBuffer{Path: bodyPath}
-
-	headerPath := filepath.Join(q.location, id+".header")
-	headerFile, err := os.Open(headerPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			q.tryRemoveDanglingFile(id + ".meta")
-			q.tryRemoveDanglingFile(id + ".body")
+		if sent[warn] {
+			continue
 		}
-		return nil, textproto.Header{}, nil, nil
+		meta.DelayWarningsSent = append(meta.DelayWarningsSent, warn)
+		needWarning = true
 	}
 
-	bufferedHeader := bufio.NewReader(headerFile)
-	header, err := textproto.ReadHeader(bufferedHeader)
-	if err != nil {
-		return nil, textproto.Header{}, nil, nil
+	if needWarning {
+		q.emitDSN(meta, header, nil, meta.To, dsn.ActionDelayed)
 	}
-
-	return meta, header, body, nil
-}
-
-func (q *Queue) InstanceName() string {
-	return q.name
 }
 
-func (q *Queue) Name() string {
-	return "queue"
+// notifyRequested checks whether the message sender wants to get the DSN with
+// the specified action for the recipient, as specified using the NOTIFY
+// parameter (RFC 3461). If NOTIFY is not specified, only failure and delay
+// notifications are sent.
+func notifyRequested(msgMeta *module.MsgMetadata, rcpt string, action dsn.Action) bool {
+	notify := msgMeta.RcptOptsFor(rcpt).Notify
+	if len(notify) == 0 {
+		return action == dsn.ActionFailed || action == dsn.ActionDelayed
+	}
+
+	var want smtp.DSNNotify
+	switch action {
+	case dsn.ActionFailed:
+		want = smtp.DSNNotifyFailure
+	case dsn.ActionDelayed:
+		want = smtp.DSNNotifyDelayed
+	case dsn.ActionDelivered, dsn.ActionRelayed:
+		want = smtp.DSNNotifySuccess
+	}
+	for _, n := range notify {
+		if n == want {
+			return true
+		}
+	}
+	return false
 }
 
-func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
+func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, body buffer.Buffer, rcpts []string, action dsn.Action) {
 	// If, apparently, we have no DSN msgpipeline configured - do nothing.
 	if q.dsnPipeline == nil {
 		return
@@ -896,6 +1078,17 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 		return
 	}
 
+	requestedRcpts := make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		if notifyRequested(meta.MsgMeta, rcpt, action) {
+			requestedRcpts = append(requestedRcpts, rcpt)
+		}
+	}
+	if len(requestedRcpts) == 0 {
+		return
+	}
+	rcpts = requestedRcpts
+
 	dsnID, err := module.GenerateMsgID()
 	if err != nil {
 		q.Log.Error("rand.Rand error", err)
@@ -908,19 +1101,21 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 		To:    meta.MsgMeta.OriginalFrom,
 	}
 	mtaInfo := dsn.ReportingMTAInfo{
-		ReportingMTA:    q.hostname,
-		XSender:         meta.From,
-		XMessageID:      meta.MsgMeta.ID,
-		ArrivalDate:     meta.FirstAttempt,
-		LastAttemptDate: meta.LastAttempt,
+		OriginalEnvelopeID: meta.MsgMeta.SMTPOpts.EnvelopeID,
+		ReportingMTA:       q.hostname,
+		XSender:            meta.From,
+		XMessageID:         meta.MsgMeta.ID,
+		ArrivalDate:        meta.FirstAttempt,
+		LastAttemptDate:    meta.LastAttempt,
 	}
 	if !meta.MsgMeta.DontTraceSender && meta.MsgMeta.Conn != nil {
 		mtaInfo.ReceivedFromMTA = meta.MsgMeta.Conn.Hostname
 	}
 
-	rcptInfo := make([]dsn.RecipientInfo, 0, len(meta.RcptErrs))
-	for _, rcpt := range failedRcpts {
+	rcptInfo := make([]dsn.RecipientInfo, 0, len(rcpts))
+	for _, rcpt := range rcpts {
 		rcptErr := meta.RcptErrs[rcpt]
+		rcptOpts := meta.MsgMeta.RcptOptsFor(rcpt)
 		// rcptErr is stored in RcptErrs using the effective recipient address,
 		// not the original one.
 
@@ -929,19 +1124,48 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 			rcpt = originalRcpt
 		}
 
-		rcptInfo = append(rcptInfo, dsn.RecipientInfo{
+		info := dsn.RecipientInfo{
 			FinalRecipient: rcpt,
-			Action:         dsn.ActionFailed,
-			Status:         rcptErr.EnhancedCode,
-			DiagnosticCode: rcptErr,
-		})
+			Action:         action,
+		}
+		switch {
+		case action == dsn.ActionDelivered || action == dsn.ActionRelayed:
+			info.Status = smtp.EnhancedCode{2, 0, 0}
+		case rcptErr != nil:
+			info.Status = rcptErr.EnhancedCode
+			info.DiagnosticCode = rcptErr
+		default:
+			// Not attempted yet, see acquireDomains.
+			info.Status = smtp.EnhancedCode{4, 0, 0}
+		}
+		if rcptOpts.OriginalRecipient != "" {
+			info.OriginalRecipient = strings.ToLower(string(rcptOpts.OriginalRecipientType)) + ";" + rcptOpts.OriginalRecipient
+		}
+		if action == dsn.ActionDelayed && q.maxLifetime != 0 {
+			info.WillRetryUntil = meta.FirstAttempt.Add(q.maxLifetime)
+		}
+		rcptInfo = append(rcptInfo, info)
 	}
 
-	var dsnBodyBlob bytes.Buffer
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
-	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, &dsnBodyBlob)
+
+	// Full message is returned only in failure notifications and only if
+	// requested, see RFC 3461 Section 4.3.
+	var failedBody io.Reader
+	if action == dsn.ActionFailed && meta.MsgMeta.SMTPOpts.Return == smtp.DSNReturnFull && body != nil {
+		bodyR, err := body.Open()
+		if err != nil {
+			dl.Error("failed to open body for DSN", err)
+		} else {
+			defer bodyR.Close()
+			failedBody = bodyR
+		}
+	}
+
+	var dsnBodyBlob bytes.Buffer
+	dsnHeader, err := dsn.GenerateDSN(meta.MsgMeta.SMTPOpts.UTF8, dsnEnvelope, mtaInfo, rcptInfo, header, failedBody, &dsnBodyBlob)
 	if err != nil {
-		dl.Error("failed to generate fail DSN", err)
+		dl.Error("failed to generate DSN", err, "action", action)
 		return
 	}
 	dsnBody := buffer.MemoryBuffer{Slice: dsnBodyBlob.Bytes()}
@@ -953,7 +1177,7 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 			RequireTLS: meta.MsgMeta.SMTPOpts.RequireTLS,
 		},
 	}
-	dl.Msg("generated failed DSN", "dsn_id", dsnID)
+	dl.Msg("generated DSN", "dsn_id", dsnID, "action", action)
 
 	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
 	defer msgTask.End()
@@ -25,6 +25,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -33,6 +34,7 @@ import (
 	"time"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
@@ -63,13 +65,21 @@ func cleanQueue(t *testing.T, q *Queue) {
 }
 
 func newTestQueueDir(t *testing.T, target module.DeliveryTarget, dir string) *Queue {
+	return newTestQueueStore(t, target, dir, nil)
+}
+
+// newTestQueueStore returns a testing queue using the specified storage. If
+// store is nil, messages are stored in dir.
+func newTestQueueStore(t *testing.T, target module.DeliveryTarget, dir string, store Store) *Queue {
 	mod, _ := NewQueue("", "queue", nil, nil)
 	q := mod.(*Queue)
 	q.initialRetryTime = 0
 	q.retryTimeScale = 1
 	q.postInitDelay = 0
+	q.controlPollInterval = 50 * time.Millisecond
 	q.maxTries = 5
 	q.location = dir
+	q.store = store
 	q.Target = target
 
 	if testing.Verbose() {
@@ -215,6 +225,9 @@ func checkQueueDir(t *testing.T, q *Queue, expectedIDs []string) {
 	// Queue implementation uses file names in the following format:
 	// DELIVERY_ID.SOMETHING
 	for _, file := range dir {
+		if file.IsDir() && file.Name() == fsControlDir {
+			continue
+		}
 		if file.IsDir() {
 			t.Fatalf("queue should not create subdirectories in the store, but there is %s dir in it", file.Name())
 		}
@@ -512,6 +525,202 @@ func TestQueueDelivery_SerializationRoundtrip(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueStore_AuthUser(t *testing.T) {
+	t.Parallel()
+
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	store := &fsStore{location: dir, log: log.Logger{Out: log.NopOutput{}}}
+
+	meta := &QueueMetadata{
+		MsgMeta: &module.MsgMetadata{
+			ID:       "msg1",
+			AuthUser: "user",
+			Conn: &module.ConnState{
+				Proto: "ESMTPA",
+				ConnectionState: module.ConnectionState{
+					Hostname:   "mx.example.org",
+					RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2525},
+				},
+				AuthUser:     "user",
+				AuthPassword: "password",
+			},
+		},
+		From: "tester@example.com",
+		To:   []string{"tester1@example.org"},
+	}
+	if _, err := store.Create(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	readMeta, err := store.ReadMeta("msg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readMeta.MsgMeta.Conn != nil {
+		t.Error("connection state is saved:", readMeta.MsgMeta.Conn)
+	}
+	if user := readMeta.MsgMeta.AuthUser; user != "user" {
+		t.Error("Wrong AuthUser:", user)
+	}
+}
+
+func TestQueueDelivery_Hold(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	holdUntil := time.Now().Add(1 * time.Second)
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		HoldUntil:    holdUntil,
+	})
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	if time.Now().Before(holdUntil) {
+		t.Errorf("message was delivered before the release time")
+	}
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	waitQueueEmpty(t, q, 5*time.Second)
+}
+
+func TestQueueDelivery_HoldRestart(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	deliveryID := testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		HoldUntil:    time.Now().Add(1 * time.Hour),
+	})
+
+	q.Close()
+	checkQueueDir(t, q, []string{deliveryID})
+
+	q = newTestQueueDir(t, &dt, q.location)
+
+	time.Sleep(500 * time.Millisecond)
+	if len(dt.committed) != 0 {
+		t.Fatalf("held message was delivered")
+	}
+
+	adm := &Admin{q: q}
+	msgs, err := adm.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].HoldUntil.IsZero() {
+		t.Fatalf("held message is not listed correctly: %+v", msgs)
+	}
+
+	// Explicit flush releases the message.
+	if err := adm.Flush(deliveryID); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	waitQueueEmpty(t, q, 5*time.Second)
+	q.Close()
+}
+
+func TestQueueDelivery_Fallback(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	fallback := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.fallbackTarget = &fallback
+	q.fallbackAfterTries = 2
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+
+	// First attempt, tester2 succeeds.
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester2@example.org"}, "")
+	// Second attempt fails, tester1 is switched to the fallback target.
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	msg = readMsgChanTimeout(t, fallback.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	waitQueueEmpty(t, q, 5*time.Second)
+	if dt.passedMessages != 2 {
+		t.Errorf("main target was used %d times", dt.passedMessages)
+	}
+}
+
+func TestQueueDelivery_FallbackInsteadOfBounce(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+	}
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	fallback := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away too"), true),
+			},
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.maxTries = 1
+	q.fallbackTarget = &fallback
+	q.fallbackAfterTries = 0
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	// Message is not bounced, but gets one attempt using the fallback target.
+	readMsgChanTimeout(t, fallback.aborted, 5*time.Second)
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(msg.Body, []byte("Action: failed")) {
+		t.Errorf("DSN is not a failure notification")
+	}
+
+	waitQueueEmpty(t, q, 5*time.Second)
+	if dt.passedMessages != 1 || fallback.passedMessages != 1 {
+		t.Errorf("wrong amount of attempts: main %d, fallback %d", dt.passedMessages, fallback.passedMessages)
+	}
+}
+
 func TestQueueDelivery_DeserlizationCleanUp(t *testing.T) {
 	t.Parallel()
 
@@ -829,6 +1038,266 @@ func TestQueueDSN_RcptRewrite(t *testing.T) {
 	}
 }
 
+func TestQueueDSN_Lifetime(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.maxLifetime = 1 * time.Nanosecond
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	// Temporary failure, but the message is expired already.
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(msg.Body, []byte("Action: failed")) {
+		t.Errorf("DSN is not a failure notification")
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if dt.passedMessages != 1 {
+		t.Errorf("delivery was retried for an expired message")
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDSN_DelayWarning(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	q.delayWarnings = []time.Duration{1 * time.Nanosecond}
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+
+	// First attempt, tester2 succeeds.
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	// Second attempt, no recipients succeeded.
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+	// Third attempt, tester1 succeeds.
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !reflect.DeepEqual(msg.RcptTo, []string{"tester@example.com"}) {
+		t.Fatalf("wrong RCPT TO address in DSN: %v", msg.RcptTo)
+	}
+	if !bytes.Contains(msg.Body, []byte("Action: delayed")) {
+		t.Errorf("DSN is not a delay warning")
+	}
+	if bytes.Contains(msg.Body, []byte("tester2@example.org")) {
+		t.Errorf("DSN mentions the delivered recipient")
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	if dsnTarget.passedMessages != 1 {
+		t.Errorf("dsnTarget accepted %d messages, warning should be sent once", dsnTarget.passedMessages)
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueDSN_Notify(t *testing.T) {
+	t.Parallel()
+
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+				"tester2@example.org": exterrors.WithTemporary(errors.New("go away"), false),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org", "tester3@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		SMTPOpts: smtp.MailOptions{
+			Return:     smtp.DSNReturnFull,
+			EnvelopeID: "QQ314159",
+		},
+		RcptOpts: map[string]smtp.RcptOptions{
+			"tester1@example.org": {
+				Notify: []smtp.DSNNotify{smtp.DSNNotifyNever},
+			},
+			"tester3@example.org": {
+				Notify:                []smtp.DSNNotify{smtp.DSNNotifySuccess},
+				OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+				OriginalRecipient:     "tester3-orig@example.org",
+			},
+		},
+	})
+
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	failMsg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(failMsg.Body, []byte("Action: failed")) {
+		t.Errorf("DSN is not a failure notification")
+	}
+	if bytes.Contains(failMsg.Body, []byte("tester1@example.org")) {
+		t.Errorf("DSN mentions the recipient with NOTIFY=NEVER")
+	}
+	if !bytes.Contains(failMsg.Body, []byte("Original-Envelope-Id: QQ314159")) {
+		t.Errorf("DSN does not contain the envelope ID")
+	}
+	if !bytes.Contains(failMsg.Body, []byte("Content-Description: Undelivered message\r\n")) {
+		t.Errorf("DSN does not contain the message body with RET=FULL")
+	}
+
+	successMsg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(successMsg.Body, []byte("Action: delivered")) {
+		t.Errorf("DSN is not a success notification")
+	}
+	if !bytes.Contains(successMsg.Body, []byte("Original-Recipient: rfc822;tester3-orig@example.org")) {
+		t.Errorf("DSN does not contain the original recipient")
+	}
+	if bytes.Contains(successMsg.Body, []byte("Content-Description: Undelivered message\r\n")) {
+		t.Errorf("Success DSN contains the message body")
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	if dsnTarget.passedMessages != 2 {
+		t.Errorf("dsnTarget accepted %d messages", dsnTarget.passedMessages)
+	}
+	checkQueueDir(t, q, []string{})
+}
+
+// relayTarget is an unreliableTarget that reports the same DSN handover for
+// all recipients, as if they were relayed.
+type relayTarget struct {
+	unreliableTarget
+	handover module.DSNHandover
+}
+
+type relayTargetDelivery struct {
+	*unreliableTargetDelivery
+	handover module.DSNHandover
+}
+
+func (rt *relayTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	delivery, err := rt.unreliableTarget.Start(ctx, msgMeta, mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	return &relayTargetDelivery{
+		unreliableTargetDelivery: delivery.(*unreliableTargetDelivery),
+		handover:                 rt.handover,
+	}, nil
+}
+
+func (rtd *relayTargetDelivery) DSNHandover(string) module.DSNHandover {
+	return rtd.handover
+}
+
+func testQueueDSNRelay(t *testing.T, handover module.DSNHandover) *unreliableTarget {
+	dsnTarget := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	dt := relayTarget{
+		unreliableTarget: unreliableTarget{
+			committed: make(chan testutils.Msg, 10),
+			aborted:   make(chan testutils.Msg, 10),
+		},
+		handover: handover,
+	}
+	q := newTestQueue(t, &dt)
+	q.hostname = "mx.example.org"
+	q.autogenMsgDomain = "example.org"
+	q.dsnPipeline = &dsnTarget
+	defer cleanQueue(t, q)
+
+	testutils.DoTestDeliveryMeta(t, q, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		RcptOpts: map[string]smtp.RcptOptions{
+			"tester1@example.org": {
+				Notify: []smtp.DSNNotify{smtp.DSNNotifySuccess},
+			},
+		},
+	})
+
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	time.Sleep(500 * time.Millisecond)
+	checkQueueDir(t, q, []string{})
+	return &dsnTarget
+}
+
+func TestQueueDSN_Relayed(t *testing.T) {
+	t.Parallel()
+
+	// The next hop does not support DSN, so "relayed" DSN is generated
+	// instead of "delivered" (RFC 3461 Section 5.2.2).
+	dsnTarget := testQueueDSNRelay(t, module.DSNRelayed)
+
+	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
+	if !bytes.Contains(msg.Body, []byte("Action: relayed")) {
+		t.Errorf("DSN is not a relay notification")
+	}
+	if dsnTarget.passedMessages != 1 {
+		t.Errorf("dsnTarget accepted %d messages", dsnTarget.passedMessages)
+	}
+}
+
+func TestQueueDSN_PassedOn(t *testing.T) {
+	t.Parallel()
+
+	// The next hop supports DSN and is responsible for the notification.
+	dsnTarget := testQueueDSNRelay(t, module.DSNPassedOn)
+
+	if dsnTarget.passedMessages != 0 {
+		t.Errorf("DSN is generated for the recipient passed to a DSN-capable server")
+	}
+}
+
 func init() {
 	dontRecover = true
 }
@@ -0,0 +1,215 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// codeRetryDelays is the retry schedule used for recipients that failed with
+// an error matching the specified enhanced status code prefix.
+type codeRetryDelays struct {
+	// 1 to 3 first elements of the enhanced status code.
+	code   []int
+	delays []time.Duration
+}
+
+func (crd codeRetryDelays) match(code smtp.EnhancedCode) bool {
+	for i, part := range crd.code {
+		if code[i] != part {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCodeRetryDelays(node config.Node) (codeRetryDelays, error) {
+	if len(node.Args) < 2 {
+		return codeRetryDelays{}, config.NodeErr(node, "expected at least 2 arguments")
+	}
+
+	codeParts := strings.Split(node.Args[0], ".")
+	if len(codeParts) > 3 {
+		return codeRetryDelays{}, config.NodeErr(node, "malformed enhanced status code: %s", node.Args[0])
+	}
+	code := make([]int, 0, len(codeParts))
+	for _, part := range codeParts {
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 {
+			return codeRetryDelays{}, config.NodeErr(node, "malformed enhanced status code: %s", node.Args[0])
+		}
+		code = append(code, i)
+	}
+	if code[0] != 4 {
+		return codeRetryDelays{}, config.NodeErr(node, "only temporary errors (4.X.X) are retried")
+	}
+
+	delays, err := durationListDirective(nil, config.Node{
+		Name: node.Name,
+		Args: node.Args[1:],
+		File: node.File,
+		Line: node.Line,
+	})
+	if err != nil {
+		return codeRetryDelays{}, err
+	}
+
+	return codeRetryDelays{
+		code:   code,
+		delays: delays.([]time.Duration),
+	}, nil
+}
+
+// durationListDirective parses a directive with one or more duration
+// arguments.
+func durationListDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Children) != 0 {
+		return nil, config.NodeErr(node, "can't declare block here")
+	}
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one argument is required")
+	}
+
+	res := make([]time.Duration, 0, len(node.Args))
+	for _, arg := range node.Args {
+		dur, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		if dur <= 0 {
+			return nil, config.NodeErr(node, "duration must be positive")
+		}
+		res = append(res, dur)
+	}
+	return res, nil
+}
+
+// retryDelay returns the delay before the next delivery attempt for the
+// recipient that failed triesCount times, last time with rcptErr.
+//
+// Explicit schedules (codeRetryDelays and retryDelays, in that order) are
+// preferred. The last value of an explicit schedule is used for all attempts
+// beyond its length. If no explicit schedule is configured, delay grows
+// exponentially.
+func (q *Queue) retryDelay(triesCount int, rcptErr *smtp.SMTPError) time.Duration {
+	if triesCount < 1 {
+		triesCount = 1
+	}
+
+	delays := q.retryDelays
+	if rcptErr != nil {
+		// Use the most specific match.
+		matchLen := 0
+		for _, crd := range q.codeRetryDelays {
+			if len(crd.code) > matchLen && crd.match(rcptErr.EnhancedCode) {
+				delays = crd.delays
+				matchLen = len(crd.code)
+			}
+		}
+	}
+
+	if len(delays) != 0 {
+		if triesCount > len(delays) {
+			return delays[len(delays)-1]
+		}
+		return delays[triesCount-1]
+	}
+
+	delay := float64(q.initialRetryTime) * math.Pow(q.retryTimeScale, float64(triesCount-1))
+	if q.maxRetryTime != 0 && delay > float64(q.maxRetryTime) {
+		return q.maxRetryTime
+	}
+	if delay > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// nextTryTime returns the time when the next delivery attempt should be made
+// for the message. That is the earliest time one of remaining recipients should
+// be retried. Recipients in notBefore are not retried before the specified
+// time.
+//
+// If maxLifetime is set, the last attempt is made right before the message
+// expires. Messages held for future release are not tried before the release
+// time.
+func (q *Queue) nextTryTime(meta *QueueMetadata, notBefore map[string]time.Time) time.Time {
+	if !meta.HoldUntil.IsZero() {
+		return meta.HoldUntil
+	}
+
+	var next time.Time
+	for _, rcpt := range meta.To {
+		rcptNext := meta.LastAttempt.Add(q.retryDelay(meta.TriesCount[rcpt], meta.RcptErrs[rcpt]))
+		if rcptNotBefore, ok := notBefore[rcpt]; ok && rcptNext.Before(rcptNotBefore) {
+			rcptNext = rcptNotBefore
+		}
+		if next.IsZero() || rcptNext.Before(next) {
+			next = rcptNext
+		}
+	}
+
+	if q.maxLifetime != 0 {
+		expiry := meta.FirstAttempt.Add(q.maxLifetime)
+		if next.After(expiry) {
+			next = expiry
+		}
+	}
+
+	return next
+}
+
+// expired checks whether the message is in the queue for longer than
+// maxLifetime.
+func (q *Queue) expired(meta *QueueMetadata) bool {
+	return q.maxLifetime != 0 && time.Since(meta.FirstAttempt) >= q.maxLifetime
+}
+
+// switchToFallback checks whether the recipient should be delivered using
+// the fallback target from now on and marks it as such.
+//
+// The switch happens if the recipient failed (failures) at least
+// fallbackAfterTries times, if the message is in the queue for longer than
+// fallbackAfterTime or if the recipient would be considered permanently failed
+// otherwise (giveUp).
+func (q *Queue) switchToFallback(meta *QueueMetadata, rcpt string, failures int, giveUp bool) bool {
+	if q.fallbackTarget == nil || meta.FallbackRcpts[rcpt] {
+		return false
+	}
+
+	switch {
+	case giveUp:
+	case q.fallbackAfterTries != 0 && failures >= q.fallbackAfterTries:
+	case q.fallbackAfterTime != 0 && time.Since(meta.FirstAttempt) >= q.fallbackAfterTime:
+	default:
+		return false
+	}
+
+	if meta.FallbackRcpts == nil {
+		meta.FallbackRcpts = make(map[string]bool)
+	}
+	meta.FallbackRcpts[rcpt] = true
+	return true
+}
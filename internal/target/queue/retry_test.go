@@ -0,0 +1,115 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestRetryDelay(t *testing.T) {
+	q := &Queue{
+		initialRetryTime: 10 * time.Minute,
+		retryTimeScale:   2,
+		maxRetryTime:     time.Hour,
+	}
+	for _, codeCfg := range [][]string{
+		{"4.7", "5m", "10m"},
+		{"4.7.1", "1m"},
+		{"4", "30m"},
+	} {
+		crd, err := parseCodeRetryDelays(config.Node{Name: "retry_delays_for_code", Args: codeCfg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.codeRetryDelays = append(q.codeRetryDelays, crd)
+	}
+
+	test := func(triesCount int, code smtp.EnhancedCode, expected time.Duration) {
+		t.Helper()
+		var rcptErr *smtp.SMTPError
+		if code[0] != 0 {
+			rcptErr = &smtp.SMTPError{Code: 451, EnhancedCode: code}
+		}
+		delay := q.retryDelay(triesCount, rcptErr)
+		if delay != expected {
+			t.Errorf("wrong delay for attempt %d, code %v: %v (expected %v)", triesCount, code, delay, expected)
+		}
+	}
+
+	test(1, smtp.EnhancedCode{}, 10*time.Minute)
+	test(2, smtp.EnhancedCode{}, 20*time.Minute)
+	test(3, smtp.EnhancedCode{}, 40*time.Minute)
+	test(4, smtp.EnhancedCode{}, time.Hour)
+	test(100, smtp.EnhancedCode{}, time.Hour)
+	test(1, smtp.EnhancedCode{5, 0, 0}, 10*time.Minute)
+	test(1, smtp.EnhancedCode{4, 7, 0}, 5*time.Minute)
+	test(2, smtp.EnhancedCode{4, 7, 0}, 10*time.Minute)
+	test(3, smtp.EnhancedCode{4, 7, 0}, 10*time.Minute)
+	test(2, smtp.EnhancedCode{4, 7, 1}, 1*time.Minute)
+	test(1, smtp.EnhancedCode{4, 4, 1}, 30*time.Minute)
+
+	q.codeRetryDelays = nil
+	q.retryDelays = []time.Duration{time.Minute, 2 * time.Minute}
+	test(1, smtp.EnhancedCode{4, 4, 1}, 1*time.Minute)
+	test(3, smtp.EnhancedCode{4, 4, 1}, 2*time.Minute)
+}
+
+func TestRetryDelay_CodeValidation(t *testing.T) {
+	for _, args := range [][]string{
+		{"4.7"},
+		{"5.7", "1m"},
+		{"4.7.1.1", "1m"},
+		{"4.a", "1m"},
+		{"4.7", "-1m"},
+	} {
+		if _, err := parseCodeRetryDelays(config.Node{Name: "retry_delays_for_code", Args: args}); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
+
+func TestNextTryTime(t *testing.T) {
+	q := &Queue{
+		initialRetryTime: 10 * time.Minute,
+		retryTimeScale:   2,
+	}
+	now := time.Now()
+	meta := &QueueMetadata{
+		To: []string{"a@example.org", "b@example.org"},
+		TriesCount: map[string]int{
+			"a@example.org": 3,
+			"b@example.org": 2,
+		},
+		FirstAttempt: now.Add(-time.Hour),
+		LastAttempt:  now,
+	}
+
+	if next := q.nextTryTime(meta, nil); !next.Equal(now.Add(20 * time.Minute)) {
+		t.Errorf("wrong next try time: %v", next.Sub(now))
+	}
+
+	q.maxLifetime = time.Hour + 5*time.Minute
+	if next := q.nextTryTime(meta, nil); !next.Equal(now.Add(5 * time.Minute)) {
+		t.Errorf("next try time is not limited by lifetime: %v", next.Sub(now))
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// prioritySemaphore restricts the amount of deliveries attempted in parallel.
+//
+// If all slots are busy, waiting deliveries get them in order of the message
+// priority (see module.MsgMetadata.Priority). Deliveries with equal
+// priority are served in FIFO order.
+type prioritySemaphore struct {
+	lock    sync.Mutex
+	free    int
+	seq     uint64
+	waiters waitQueue
+}
+
+type semWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+type waitQueue []*semWaiter
+
+func (wq waitQueue) Len() int { return len(wq) }
+
+func (wq waitQueue) Less(i, j int) bool {
+	if wq[i].priority != wq[j].priority {
+		return wq[i].priority > wq[j].priority
+	}
+	return wq[i].seq < wq[j].seq
+}
+
+func (wq waitQueue) Swap(i, j int) { wq[i], wq[j] = wq[j], wq[i] }
+
+func (wq *waitQueue) Push(x interface{}) { *wq = append(*wq, x.(*semWaiter)) }
+
+func (wq *waitQueue) Pop() interface{} {
+	old := *wq
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*wq = old[:len(old)-1]
+	return w
+}
+
+func newPrioritySemaphore(size int) *prioritySemaphore {
+	return &prioritySemaphore{free: size}
+}
+
+// Acquire blocks until a slot is available for the delivery with the
+// specified priority.
+func (s *prioritySemaphore) Acquire(priority int) {
+	s.lock.Lock()
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		s.lock.Unlock()
+		return
+	}
+
+	w := &semWaiter{
+		priority: priority,
+		seq:      s.seq,
+		ready:    make(chan struct{}),
+	}
+	s.seq++
+	heap.Push(&s.waiters, w)
+	s.lock.Unlock()
+
+	<-w.ready
+}
+
+// Release frees the slot acquired using Acquire, passing it to the waiting
+// delivery with the highest priority, if any.
+func (s *prioritySemaphore) Release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.waiters) == 0 {
+		s.free++
+		return
+	}
+	w := heap.Pop(&s.waiters).(*semWaiter)
+	close(w.ready)
+}
@@ -0,0 +1,76 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrioritySemaphore(t *testing.T) {
+	t.Parallel()
+
+	s := newPrioritySemaphore(1)
+	s.Acquire(0)
+
+	order := make(chan int, 4)
+	for i, priority := range []int{0, 5, -3, 5} {
+		priority := priority
+		go func() {
+			s.Acquire(priority)
+			order <- priority
+		}()
+
+		// Wait for the goroutine to block so FIFO order for equal priorities
+		// is deterministic.
+		for j := 0; ; j++ {
+			s.lock.Lock()
+			waiting := len(s.waiters)
+			s.lock.Unlock()
+			if waiting == i+1 {
+				break
+			}
+			if j == 100 {
+				t.Fatal("Acquire does not block")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	var got []int
+	for i := 0; i < 4; i++ {
+		s.Release()
+		select {
+		case priority := <-order:
+			got = append(got, priority)
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiter was not woken up")
+		}
+	}
+
+	if !reflect.DeepEqual(got, []int{5, 5, 0, -3}) {
+		t.Errorf("wrong order: %v", got)
+	}
+
+	s.Release()
+	if s.free != 1 {
+		t.Errorf("wrong amount of free slots: %d", s.free)
+	}
+}
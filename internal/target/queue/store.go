@@ -0,0 +1,487 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Store is the persistent storage for queued messages.
+//
+// Errors returned for missing messages should match os.ErrNotExist (as
+// checked by errors.Is).
+type Store interface {
+	// Create saves the new message. The returned buffer should be used to
+	// read the message body afterwards since the passed one may be
+	// invalidated after the message is accepted by the queue.
+	Create(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error)
+
+	// UpdateMeta replaces meta-data of the saved message.
+	UpdateMeta(meta *QueueMetadata) error
+
+	ReadMeta(id string) (*QueueMetadata, error)
+	ReadHeader(id string) (textproto.Header, error)
+
+	// Open reads all message data.
+	Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error)
+
+	Remove(id string) error
+
+	// MarkBroken excludes the message from any further processing without
+	// removing its data so it can be inspected manually.
+	MarkBroken(id string) error
+
+	// List returns IDs of all messages in the storage.
+	List() ([]string, error)
+
+	// Acquire returns IDs of messages that are not handled by any running
+	// Queue instance and makes them handled by the current one.
+	Acquire() ([]string, error)
+
+	// RequestControl saves the control request (see admin.go) for the
+	// message.
+	RequestControl(id, action string) error
+
+	// PendingControls returns control requests that should be executed by
+	// the current Queue instance, keyed by the message ID.
+	PendingControls() (map[string]string, error)
+
+	// ClearControl removes the executed control request.
+	ClearControl(id string) error
+
+	Close() error
+}
+
+// leasingStore is implemented by storages that can be shared between
+// multiple Queue instances, possibly running on different nodes.
+//
+// Each message is leased by a single instance for a limited time and only
+// that instance attempts its delivery. Leases are renewed periodically and
+// messages with expired leases are picked up by other instances via Acquire.
+type leasingStore interface {
+	Store
+
+	// Renew extends the leases of all messages handled by the current
+	// instance.
+	Renew() error
+
+	// Owned checks whether the current instance still holds the lease on
+	// the message.
+	Owned(id string) (bool, error)
+
+	// RenewMessage extends the lease on the message. errLeaseLost is
+	// returned if the current instance no longer holds it.
+	RenewMessage(id string) error
+
+	// RenewInterval is the interval between Renew calls required to
+	// keep the leases.
+	RenewInterval() time.Duration
+}
+
+func storageDirective(m *config.Map, node config.Node) (interface{}, error) {
+	return openStorage(m, node, false)
+}
+
+// adminStorageDirective is the storageDirective variant used by Queue.Admin.
+func adminStorageDirective(m *config.Map, node config.Node) (interface{}, error) {
+	return openStorage(m, node, true)
+}
+
+func openStorage(m *config.Map, node config.Node, admin bool) (interface{}, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument")
+	}
+
+	switch node.Args[0] {
+	case "fs":
+		if len(node.Children) != 0 {
+			return nil, config.NodeErr(node, "fs storage has no options, use location directive instead")
+		}
+		return nil, nil
+	case "sql":
+		return newSQLStore(config.NewMap(m.Globals, node), admin)
+	default:
+		return nil, config.NodeErr(node, "unknown storage type: %s", node.Args[0])
+	}
+}
+
+// fsStore keeps messages in a directory, each message is represented by
+// three files: ID.meta (JSON-serialized QueueMetadata), ID.header and ID.body.
+// Control requests are stored as ID.ctl files in the control subdirectory
+// so they can be polled without listing all messages.
+//
+// fsStore can't be shared between multiple Queue instances.
+type fsStore struct {
+	location string
+	log      log.Logger
+
+	loaded bool
+}
+
+func (s *fsStore) Create(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	id := meta.MsgMeta.ID
+
+	headerPath := filepath.Join(s.location, id+".header")
+	headerFile, err := os.Create(headerPath)
+	if err != nil {
+		return nil, err
+	}
+	defer headerFile.Close()
+
+	if err := textproto.WriteHeader(headerFile, header); err != nil {
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	bodyReader, err := body.Open()
+	if err != nil {
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+	defer bodyReader.Close()
+
+	bodyPath := filepath.Join(s.location, id+".body")
+	bodyFile, err := os.Create(bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer bodyFile.Close()
+
+	if _, err := io.Copy(bodyFile, bodyReader); err != nil {
+		s.tryRemoveDanglingFile(id + ".body")
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	if err := s.UpdateMeta(meta); err != nil {
+		s.tryRemoveDanglingFile(id + ".body")
+		s.tryRemoveDanglingFile(id + ".header")
+		return nil, err
+	}
+
+	if err := headerFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	if err := bodyFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	return buffer.FileBuffer{Path: bodyPath, LenHint: body.Len()}, nil
+}
+
+func (s *fsStore) UpdateMeta(meta *QueueMetadata) error {
+	metaPath := filepath.Join(s.location, meta.MsgMeta.ID+".meta")
+
+	var file *os.File
+	var err error
+	if runtime.GOOS == "windows" {
+		file, err = os.Create(metaPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		file, err = os.Create(metaPath + ".new")
+		if err != nil {
+			return err
+		}
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(serializableMeta(meta)); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Rename(metaPath+".new", metaPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serializableMeta returns the copy of meta with fields that can't be
+// serialized removed.
+func serializableMeta(meta *QueueMetadata) *QueueMetadata {
+	metaCopy := *meta
+	metaCopy.MsgMeta = meta.MsgMeta.DeepCopy()
+
+	// There is a couple of problems we have to solve before we would be able to
+	// serialize ConnState.
+	// 1. future.Future can't be serialized.
+	// 2. net.Addr can't be deserialized because we don't know the concrete type.
+	// Values needed after the message is loaded (such as AuthUser) are kept in
+	// dedicated MsgMetadata fields instead.
+	metaCopy.MsgMeta.Conn = nil
+
+	return &metaCopy
+}
+
+func decodeMeta(r io.Reader) (*QueueMetadata, error) {
+	meta := &QueueMetadata{}
+	meta.MsgMeta = &module.MsgMetadata{}
+	if err := json.NewDecoder(r).Decode(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *fsStore) ReadMeta(id string) (*QueueMetadata, error) {
+	metaPath := filepath.Join(s.location, id+".meta")
+	file, err := os.Open(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeMeta(file)
+}
+
+func (s *fsStore) ReadHeader(id string) (textproto.Header, error) {
+	headerFile, err := os.Open(filepath.Join(s.location, id+".header"))
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	defer headerFile.Close()
+
+	return textproto.ReadHeader(bufio.NewReader(headerFile))
+}
+
+func (s *fsStore) tryRemoveDanglingFile(name string) {
+	if err := os.Remove(filepath.Join(s.location, name)); err != nil {
+		s.log.Error("dangling file remove failed", err)
+		return
+	}
+	s.log.Printf("removed dangling file %s", name)
+}
+
+func (s *fsStore) Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	meta, err := s.ReadMeta(id)
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	bodyPath := filepath.Join(s.location, id+".body")
+	_, err = os.Stat(bodyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.tryRemoveDanglingFile(id + ".meta")
+		}
+		return nil, textproto.Header{}, nil, fmt.Errorf("queue: missing body: %w", err)
+	}
+	body := buffer.FileBuffer{Path: bodyPath}
+
+	headerPath := filepath.Join(s.location, id+".header")
+	headerFile, err := os.Open(headerPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.tryRemoveDanglingFile(id + ".meta")
+			s.tryRemoveDanglingFile(id + ".body")
+		}
+		return nil, textproto.Header{}, nil, fmt.Errorf("queue: missing header: %w", err)
+	}
+	defer headerFile.Close()
+
+	header, err := textproto.ReadHeader(bufio.NewReader(headerFile))
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	return meta, header, body, nil
+}
+
+func (s *fsStore) Remove(id string) error {
+	// Order is important.
+	// If we remove header and body but can't remove meta now - Acquire
+	// will detect and report it during the next start-up.
+	var errs []string
+	for _, suffix := range []string{".header", ".body", ".meta"} {
+		if err := os.Remove(filepath.Join(s.location, id+suffix)); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// MarkBroken changes the name of metadata file to have .meta_broken
+// extension.
+//
+// Further attempts to deliver it will fail due to non-existent meta-data
+// file.
+func (s *fsStore) MarkBroken(id string) error {
+	return os.Rename(filepath.Join(s.location, id+".meta"), filepath.Join(s.location, id+".meta_broken"))
+}
+
+func (s *fsStore) List() ([]string, error) {
+	dirInfo, err := ioutil.ReadDir(s.location)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(entry.Name(), ".meta"))
+	}
+	return ids, nil
+}
+
+// Acquire returns all valid messages in the directory on the first call
+// since there is only one Queue instance using it. Files of partially
+// removed messages are cleaned up.
+func (s *fsStore) Acquire() ([]string, error) {
+	if s.loaded {
+		return nil, nil
+	}
+
+	dirInfo, err := ioutil.ReadDir(s.location)
+	if err != nil {
+		return nil, err
+	}
+	s.loaded = true
+
+	// TODO(GH #209): Rewrite this function to pass all sub-tests in TestQueueDelivery_DeserializationCleanUp/NoMeta.
+
+	var ids []string
+	for _, entry := range dirInfo {
+		// We start loading from meta-data files and then check whether ID.header and ID.body exist.
+		// This allows us to properly detect dangling body files.
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := entry.Name()[:len(entry.Name())-5]
+
+		if _, err := s.ReadMeta(id); err != nil {
+			s.log.Printf("failed to read meta-data, skipping: %v (msg ID = %s)", err, id)
+			continue
+		}
+
+		// Check header file existence.
+		if _, err := os.Stat(filepath.Join(s.location, id+".header")); err != nil {
+			if os.IsNotExist(err) {
+				s.log.Printf("header file doesn't exist for msg ID = %s", id)
+				s.tryRemoveDanglingFile(id + ".meta")
+				s.tryRemoveDanglingFile(id + ".body")
+			} else {
+				s.log.Printf("skipping nonstat'able header file: %v (msg ID = %s)", err, id)
+			}
+			continue
+		}
+
+		// Check body file existence.
+		if _, err := os.Stat(filepath.Join(s.location, id+".body")); err != nil {
+			if os.IsNotExist(err) {
+				s.log.Printf("body file doesn't exist for msg ID = %s", id)
+				s.tryRemoveDanglingFile(id + ".meta")
+				s.tryRemoveDanglingFile(id + ".header")
+			} else {
+				s.log.Printf("skipping nonstat'able body file: %v (msg ID = %s)", err, id)
+			}
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// fsControlDir is the subdirectory of the fsStore location that contains
+// control requests.
+const fsControlDir = "control"
+
+func (s *fsStore) RequestControl(id, action string) error {
+	ctlDir := filepath.Join(s.location, fsControlDir)
+	if err := os.MkdirAll(ctlDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so the server will never see
+	// incomplete request.
+	ctlPath := filepath.Join(ctlDir, id+".ctl")
+	if err := ioutil.WriteFile(ctlPath+".new", []byte(action+"\n"), 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(ctlPath+".new", ctlPath); err != nil {
+		os.Remove(ctlPath + ".new")
+		return err
+	}
+	return nil
+}
+
+func (s *fsStore) PendingControls() (map[string]string, error) {
+	ctlDir := filepath.Join(s.location, fsControlDir)
+	dirInfo, err := ioutil.ReadDir(ctlDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	controls := make(map[string]string)
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".ctl") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".ctl")
+
+		actionBlob, err := ioutil.ReadFile(filepath.Join(ctlDir, entry.Name()))
+		if err != nil {
+			s.log.Error("failed to read control request", err, "msg_id", id)
+			continue
+		}
+		controls[id] = strings.TrimSpace(string(actionBlob))
+	}
+	return controls, nil
+}
+
+func (s *fsStore) ClearControl(id string) error {
+	return os.Remove(filepath.Join(s.location, fsControlDir, id+".ctl"))
+}
+
+func (s *fsStore) Close() error {
+	return nil
+}
@@ -0,0 +1,449 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	_ "github.com/lib/pq"
+)
+
+// sqlStore keeps messages in a SQL database table, allowing multiple Queue
+// instances to share it.
+//
+// Each row contains the lease owner (node ID of the Queue instance handling
+// the message) and the lease expiry time. Leases are acquired using
+// conditional updates so only one instance can get each expired lease.
+type sqlStore struct {
+	db        *sql.DB
+	driver    string
+	table     string
+	nodeID    string
+	leaseTime time.Duration
+	maxSize   int
+
+	acquired bool
+}
+
+var errLeaseLost = errors.New("queue: message is leased by another node")
+
+// newSQLStore opens the storage using the configuration block.
+//
+// If admin is true, the storage is opened for the Admin object and has no
+// node ID: it can't acquire leases and can't modify messages other than by
+// creating control requests. The table is also expected to exist already.
+func newSQLStore(cfg *config.Map, admin bool) (*sqlStore, error) {
+	var (
+		s        sqlStore
+		dsnParts []string
+	)
+	cfg.String("driver", false, true, "", &s.driver)
+	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	cfg.String("table_name", false, false, "maddy_queue", &s.table)
+	cfg.String("node_id", false, false, "", &s.nodeID)
+	cfg.Duration("lease_time", false, false, 5*time.Minute, &s.leaseTime)
+	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &s.maxSize)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if s.leaseTime < 3*time.Second {
+		return nil, config.NodeErr(cfg.Block, "lease_time should be at least 3 seconds")
+	}
+	if admin {
+		// Leases are never owned by an empty node ID.
+		s.nodeID = ""
+	} else if s.nodeID == "" {
+		nodeID, err := loadNodeID(filepath.Join(config.StateDirectory, "queue_node_id_"+s.table))
+		if err != nil {
+			return nil, config.NodeErr(cfg.Block, "failed to load node ID: %v", err)
+		}
+		s.nodeID = nodeID
+	}
+
+	db, err := sql.Open(s.driver, strings.Join(dsnParts, " "))
+	if err != nil {
+		return nil, config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	s.db = db
+	if s.driver == "sqlite3" {
+		// SQLite does not allow concurrent writes anyway.
+		db.SetMaxOpenConns(1)
+	}
+
+	if admin {
+		return &s, nil
+	}
+
+	blobType := "BLOB"
+	if s.driver == "postgres" {
+		blobType = "BYTEA"
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+		id TEXT NOT NULL PRIMARY KEY,
+		meta TEXT NOT NULL,
+		header ` + blobType + ` NOT NULL,
+		body ` + blobType + ` NOT NULL,
+		lease_owner TEXT NOT NULL DEFAULT '',
+		lease_until BIGINT NOT NULL DEFAULT 0,
+		broken INTEGER NOT NULL DEFAULT 0,
+		control TEXT NOT NULL DEFAULT ''
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, config.NodeErr(cfg.Block, "failed to create table: %v", err)
+	}
+
+	return &s, nil
+}
+
+// loadNodeID reads the node ID from the file, generating and saving it if
+// the file does not exist. The ID should stay the same across restarts so
+// the messages handled before the restart are picked up immediately, hostname
+// is not reliable for that (e.g. in containers).
+func loadNodeID(path string) (string, error) {
+	saved, err := ioutil.ReadFile(path)
+	if err == nil {
+		if nodeID := strings.TrimSpace(string(saved)); nodeID != "" {
+			return nodeID, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	randPart := make([]byte, 8)
+	if _, err := rand.Read(randPart); err != nil {
+		return "", err
+	}
+	nodeID := hostname + "-" + hex.EncodeToString(randPart)
+
+	if err := ioutil.WriteFile(path, []byte(nodeID+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return nodeID, nil
+}
+
+// query rewrites ?-placeholders into the form expected by the driver.
+func (s *sqlStore) query(q string) string {
+	if s.driver != "postgres" {
+		return q
+	}
+
+	var (
+		res strings.Builder
+		idx int
+	)
+	for _, chr := range q {
+		if chr == '?' {
+			idx++
+			res.WriteString("$" + strconv.Itoa(idx))
+			continue
+		}
+		res.WriteRune(chr)
+	}
+	return res.String()
+}
+
+func (s *sqlStore) leaseExpiry() int64 {
+	return time.Now().Add(s.leaseTime).Unix()
+}
+
+func noSuchMessage(id string) error {
+	return fmt.Errorf("queue: no such message: %s: %w", id, os.ErrNotExist)
+}
+
+func checkAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+func (s *sqlStore) Create(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	metaBlob, err := json.Marshal(serializableMeta(meta))
+	if err != nil {
+		return nil, err
+	}
+
+	var headerBlob bytes.Buffer
+	if err := textproto.WriteHeader(&headerBlob, header); err != nil {
+		return nil, err
+	}
+
+	// The body is stored as a single value and is read into memory for
+	// that, so the size is checked first.
+	if body.Len() > s.maxSize {
+		return nil, &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message:      "Message is too big for the queue storage",
+			TargetName:   "queue",
+			Misc: map[string]interface{}{
+				"size":     body.Len(),
+				"max_size": s.maxSize,
+			},
+		}
+	}
+
+	bodyReader, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyReader.Close()
+	bodyBlob := make([]byte, body.Len())
+	if _, err := io.ReadFull(bodyReader, bodyBlob); err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.Exec(s.query(`INSERT INTO `+s.table+` (id, meta, header, body, lease_owner, lease_until)
+		VALUES (?, ?, ?, ?, ?, ?)`),
+		meta.MsgMeta.ID, string(metaBlob), headerBlob.Bytes(), bodyBlob, s.nodeID, s.leaseExpiry())
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.MemoryBuffer{Slice: bodyBlob}, nil
+}
+
+func (s *sqlStore) UpdateMeta(meta *QueueMetadata) error {
+	metaBlob, err := json.Marshal(serializableMeta(meta))
+	if err != nil {
+		return err
+	}
+
+	return checkAffected(s.db.Exec(s.query(`UPDATE `+s.table+` SET meta = ? WHERE id = ? AND lease_owner = ?`),
+		string(metaBlob), meta.MsgMeta.ID, s.nodeID))
+}
+
+func (s *sqlStore) ReadMeta(id string) (*QueueMetadata, error) {
+	var metaBlob string
+	err := s.db.QueryRow(s.query(`SELECT meta FROM `+s.table+` WHERE id = ? AND broken = 0`), id).Scan(&metaBlob)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, noSuchMessage(id)
+		}
+		return nil, err
+	}
+
+	return decodeMeta(strings.NewReader(metaBlob))
+}
+
+func (s *sqlStore) ReadHeader(id string) (textproto.Header, error) {
+	var headerBlob []byte
+	err := s.db.QueryRow(s.query(`SELECT header FROM `+s.table+` WHERE id = ? AND broken = 0`), id).Scan(&headerBlob)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return textproto.Header{}, noSuchMessage(id)
+		}
+		return textproto.Header{}, err
+	}
+
+	return textproto.ReadHeader(bufio.NewReader(bytes.NewReader(headerBlob)))
+}
+
+func (s *sqlStore) Open(id string) (*QueueMetadata, textproto.Header, buffer.Buffer, error) {
+	var (
+		metaBlob   string
+		headerBlob []byte
+		bodyBlob   []byte
+	)
+	err := s.db.QueryRow(s.query(`SELECT meta, header, body FROM `+s.table+` WHERE id = ? AND broken = 0`), id).Scan(
+		&metaBlob, &headerBlob, &bodyBlob)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, textproto.Header{}, nil, noSuchMessage(id)
+		}
+		return nil, textproto.Header{}, nil, err
+	}
+
+	meta, err := decodeMeta(strings.NewReader(metaBlob))
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(headerBlob)))
+	if err != nil {
+		return nil, textproto.Header{}, nil, err
+	}
+
+	return meta, header, buffer.MemoryBuffer{Slice: bodyBlob}, nil
+}
+
+func (s *sqlStore) Remove(id string) error {
+	return checkAffected(s.db.Exec(s.query(`DELETE FROM `+s.table+` WHERE id = ? AND lease_owner = ?`), id, s.nodeID))
+}
+
+func (s *sqlStore) MarkBroken(id string) error {
+	return checkAffected(s.db.Exec(s.query(`UPDATE `+s.table+` SET broken = 1 WHERE id = ? AND lease_owner = ?`), id, s.nodeID))
+}
+
+func (s *sqlStore) List() ([]string, error) {
+	return s.queryIDs(`SELECT id FROM ` + s.table + ` WHERE broken = 0`)
+}
+
+func (s *sqlStore) queryIDs(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(s.query(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Acquire takes over messages with expired leases. On the first call,
+// messages leased by the same node ID are also returned since they are left
+// from the previous run of the server.
+func (s *sqlStore) Acquire() ([]string, error) {
+	now := time.Now().Unix()
+
+	ownerCheck := s.nodeID
+	if s.acquired {
+		// Never matches a node ID.
+		ownerCheck = ""
+	}
+
+	candidates, err := s.queryIDs(`SELECT id FROM `+s.table+` WHERE broken = 0 AND (lease_until < ? OR lease_owner = ?)`,
+		now, ownerCheck)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(candidates))
+	for _, id := range candidates {
+		err := checkAffected(s.db.Exec(s.query(`UPDATE `+s.table+` SET lease_owner = ?, lease_until = ?
+			WHERE id = ? AND broken = 0 AND (lease_until < ? OR lease_owner = ?)`),
+			s.nodeID, s.leaseExpiry(), id, now, ownerCheck))
+		if err != nil {
+			if errors.Is(err, errLeaseLost) {
+				// Taken by a different node first.
+				continue
+			}
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	s.acquired = true
+
+	return ids, nil
+}
+
+func (s *sqlStore) Renew() error {
+	_, err := s.db.Exec(s.query(`UPDATE `+s.table+` SET lease_until = ? WHERE lease_owner = ?`), s.leaseExpiry(), s.nodeID)
+	return err
+}
+
+// RenewMessage extends the lease on the message. errLeaseLost is returned if
+// the lease is expired or held by a different node.
+func (s *sqlStore) RenewMessage(id string) error {
+	return checkAffected(s.db.Exec(s.query(`UPDATE `+s.table+` SET lease_until = ?
+		WHERE id = ? AND broken = 0 AND lease_owner = ? AND lease_until > ?`),
+		s.leaseExpiry(), id, s.nodeID, time.Now().Unix()))
+}
+
+func (s *sqlStore) Owned(id string) (bool, error) {
+	var (
+		owner string
+		until int64
+	)
+	err := s.db.QueryRow(s.query(`SELECT lease_owner, lease_until FROM `+s.table+` WHERE id = ? AND broken = 0`), id).Scan(
+		&owner, &until)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return owner == s.nodeID && until > time.Now().Unix(), nil
+}
+
+func (s *sqlStore) RenewInterval() time.Duration {
+	return s.leaseTime / 3
+}
+
+func (s *sqlStore) RequestControl(id, action string) error {
+	err := checkAffected(s.db.Exec(s.query(`UPDATE `+s.table+` SET control = ? WHERE id = ? AND broken = 0`), action, id))
+	if errors.Is(err, errLeaseLost) {
+		return noSuchMessage(id)
+	}
+	return err
+}
+
+func (s *sqlStore) PendingControls() (map[string]string, error) {
+	rows, err := s.db.Query(s.query(`SELECT id, control FROM `+s.table+`
+		WHERE control <> '' AND broken = 0 AND lease_owner = ?`), s.nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	controls := make(map[string]string)
+	for rows.Next() {
+		var id, action string
+		if err := rows.Scan(&id, &action); err != nil {
+			return nil, err
+		}
+		controls[id] = action
+	}
+	return controls, rows.Err()
+}
+
+func (s *sqlStore) ClearControl(id string) error {
+	return checkAffected(s.db.Exec(s.query(`UPDATE `+s.table+` SET control = '' WHERE id = ? AND lease_owner = ?`), id, s.nodeID))
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,443 @@
+//+build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func newTestSQLStore(t *testing.T, dir, nodeID string, extra ...config.Node) *sqlStore {
+	t.Helper()
+	store, err := newSQLStore(config.NewMap(nil, config.Node{
+		Children: append([]config.Node{
+			{
+				Name: "driver",
+				Args: []string{"sqlite3"},
+			},
+			{
+				Name: "dsn",
+				Args: []string{filepath.Join(dir, "queue.db") + "?_busy_timeout=5000"},
+			},
+			{
+				Name: "node_id",
+				Args: []string{nodeID},
+			},
+		}, extra...),
+	}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// expireLeases makes all messages in the storage available for Acquire, as
+// if the nodes holding them are gone.
+func expireLeases(t *testing.T, s *sqlStore) {
+	t.Helper()
+	if _, err := s.db.Exec(`UPDATE ` + s.table + ` SET lease_until = 0`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLStore_Lease(t *testing.T) {
+	dir := testutils.Dir(t)
+	node1 := newTestSQLStore(t, dir, "node1")
+	defer node1.Close()
+	node2 := newTestSQLStore(t, dir, "node2")
+	defer node2.Close()
+
+	// Nothing to take over from previous runs.
+	for _, s := range []*sqlStore{node1, node2} {
+		ids, err := s.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 0 {
+			t.Fatal("unexpected messages acquired:", ids)
+		}
+	}
+
+	meta := &QueueMetadata{
+		MsgMeta: &module.MsgMetadata{ID: "msg1"},
+		From:    "tester@example.org",
+		To:      []string{"tester1@example.org"},
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Test")
+	if _, err := node1.Create(meta, hdr, buffer.MemoryBuffer{Slice: []byte("foobar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := node2.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatal("message leased by a different node is acquired:", ids)
+	}
+	if owned, err := node2.Owned("msg1"); err != nil || owned {
+		t.Fatal("Owned for a different node:", owned, err)
+	}
+	if err := node2.UpdateMeta(meta); !errors.Is(err, errLeaseLost) {
+		t.Fatal("UpdateMeta for a different node:", err)
+	}
+
+	expireLeases(t, node2)
+
+	ids, err = node2.Acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "msg1" {
+		t.Fatal("expired lease is not acquired:", ids)
+	}
+	if owned, err := node1.Owned("msg1"); err != nil || owned {
+		t.Fatal("Owned for a previous owner:", owned, err)
+	}
+	if err := node1.Remove("msg1"); !errors.Is(err, errLeaseLost) {
+		t.Fatal("Remove for a previous owner:", err)
+	}
+
+	readMeta, readHdr, body, err := node2.Open("msg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readMeta.From != meta.From || readHdr.Get("Subject") != "Test" {
+		t.Fatal("wrong message data:", readMeta, readHdr)
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyBlob, err := ioutil.ReadAll(bodyR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bodyBlob) != "foobar" {
+		t.Fatalf("wrong body: %q", bodyBlob)
+	}
+
+	if err := node2.Remove("msg1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node2.ReadMeta("msg1"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("ReadMeta for removed message:", err)
+	}
+}
+
+func TestSQLStore_RenewMessage(t *testing.T) {
+	dir := testutils.Dir(t)
+	node1 := newTestSQLStore(t, dir, "node1")
+	defer node1.Close()
+	node2 := newTestSQLStore(t, dir, "node2")
+	defer node2.Close()
+
+	meta := &QueueMetadata{
+		MsgMeta: &module.MsgMetadata{ID: "msg1"},
+		From:    "tester@example.org",
+		To:      []string{"tester1@example.org"},
+	}
+	if _, err := node1.Create(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node1.RenewMessage("msg1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.RenewMessage("msg1"); !errors.Is(err, errLeaseLost) {
+		t.Fatal("RenewMessage for a different node:", err)
+	}
+
+	// The lease expired but nobody took the message over yet, the node
+	// should not assume it is still the only one working on it.
+	expireLeases(t, node1)
+	if err := node1.RenewMessage("msg1"); !errors.Is(err, errLeaseLost) {
+		t.Fatal("RenewMessage for an expired lease:", err)
+	}
+}
+
+func TestSQLStore_MaxMessageSize(t *testing.T) {
+	dir := testutils.Dir(t)
+	store := newTestSQLStore(t, dir, "node1", config.Node{
+		Name: "max_message_size",
+		Args: []string{"5B"},
+	})
+	defer store.Close()
+
+	meta := &QueueMetadata{
+		MsgMeta: &module.MsgMetadata{ID: "msg1"},
+		From:    "tester@example.org",
+		To:      []string{"tester1@example.org"},
+	}
+	_, err := store.Create(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar")})
+	if err == nil {
+		t.Fatal("Expected an error for a message over the size limit")
+	}
+	if exterrors.IsTemporaryOrUnspec(err) {
+		t.Fatal("Expected a permanent error, got", err)
+	}
+	if _, err := store.ReadMeta("msg1"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("ReadMeta for a rejected message:", err)
+	}
+}
+
+func TestSQLStore_LeaseOwnerChecks(t *testing.T) {
+	dir := testutils.Dir(t)
+	node1 := newTestSQLStore(t, dir, "node1")
+	defer node1.Close()
+	node2 := newTestSQLStore(t, dir, "node2")
+	defer node2.Close()
+
+	meta := &QueueMetadata{
+		MsgMeta: &module.MsgMetadata{ID: "msg1"},
+		From:    "tester@example.org",
+		To:      []string{"tester1@example.org"},
+	}
+	if _, err := node1.Create(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.RequestControl("msg1", controlFlush); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node2.ClearControl("msg1"); !errors.Is(err, errLeaseLost) {
+		t.Fatal("ClearControl for a different node:", err)
+	}
+	if err := node2.MarkBroken("msg1"); !errors.Is(err, errLeaseLost) {
+		t.Fatal("MarkBroken for a different node:", err)
+	}
+	if _, err := node1.ReadMeta("msg1"); err != nil {
+		t.Fatal("Message is marked broken by a different node:", err)
+	}
+
+	if err := node1.ClearControl("msg1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node1.MarkBroken("msg1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLStore_Admin(t *testing.T) {
+	dir := testutils.Dir(t)
+	node1 := newTestSQLStore(t, dir, "node1")
+	defer node1.Close()
+
+	meta := &QueueMetadata{
+		MsgMeta: &module.MsgMetadata{ID: "msg1"},
+		From:    "tester@example.org",
+		To:      []string{"tester1@example.org"},
+	}
+	if _, err := node1.Create(meta, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar")}); err != nil {
+		t.Fatal(err)
+	}
+
+	stateDir := testutils.Dir(t)
+	oldState := config.StateDirectory
+	config.StateDirectory = stateDir
+	defer func() { config.StateDirectory = oldState }()
+
+	mod, err := NewQueue("target.queue", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adm, err := mod.(*Queue).Admin(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "storage",
+				Args: []string{"sql"},
+				Children: []config.Node{
+					{Name: "driver", Args: []string{"sqlite3"}},
+					{Name: "dsn", Args: []string{filepath.Join(dir, "queue.db") + "?_busy_timeout=5000"}},
+				},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adm.q.store.Close()
+
+	if files, err := ioutil.ReadDir(stateDir); err != nil || len(files) != 0 {
+		t.Fatal("Admin created files in the state directory:", files, err)
+	}
+
+	msgs, err := adm.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].MsgMeta.ID != "msg1" {
+		t.Fatal("Wrong messages listed:", msgs)
+	}
+	if err := adm.Flush("msg1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := adm.q.store.ClearControl("msg1"); !errors.Is(err, errLeaseLost) {
+		t.Fatal("ClearControl for the admin store:", err)
+	}
+
+	controls, err := node1.PendingControls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if controls["msg1"] != controlFlush {
+		t.Fatal("Control request is not passed to the lease owner:", controls)
+	}
+}
+
+func TestSQLStore_NodeID(t *testing.T) {
+	dir := testutils.Dir(t)
+	path := filepath.Join(dir, "node_id")
+
+	nodeID, err := loadNodeID(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeID == "" {
+		t.Fatal("empty node ID generated")
+	}
+
+	// Should stay the same after restart.
+	nodeID2, err := loadNodeID(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeID2 != nodeID {
+		t.Fatalf("node ID changed: %s != %s", nodeID2, nodeID)
+	}
+}
+
+// leaseStealingTarget calls steal when a delivery is started, so the
+// message is taken over by a different node in the middle of the delivery.
+type leaseStealingTarget struct {
+	module.DeliveryTarget
+	steal func()
+}
+
+func (lst leaseStealingTarget) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	lst.steal()
+	return lst.DeliveryTarget.Start(ctx, msgMeta, mailFrom)
+}
+
+func TestQueueDelivery_SQLStoreLeaseLost(t *testing.T) {
+	t.Parallel()
+
+	dir := testutils.Dir(t)
+	dt := unreliableTarget{
+		committed: make(chan testutils.Msg, 10),
+		aborted:   make(chan testutils.Msg, 10),
+	}
+	store2 := newTestSQLStore(t, dir, "node2")
+	defer store2.Close()
+	tgt := leaseStealingTarget{
+		DeliveryTarget: &dt,
+		steal: func() {
+			if _, err := store2.db.Exec(`UPDATE ` + store2.table + ` SET lease_until = 0`); err != nil {
+				t.Error(err)
+			}
+			if _, err := store2.Acquire(); err != nil {
+				t.Error(err)
+			}
+		},
+	}
+
+	q := newTestQueueStore(t, tgt, dir, newTestSQLStore(t, dir, "node1"))
+	defer q.Close()
+
+	deliveryID := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	select {
+	case <-dt.committed:
+		t.Fatal("message is delivered by a node that lost the lease")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if owned, err := store2.Owned(deliveryID); err != nil || !owned {
+		t.Fatal("message is not left to the new owner:", owned, err)
+	}
+}
+
+func TestQueueDelivery_SQLStore(t *testing.T) {
+	t.Parallel()
+
+	dir := testutils.Dir(t)
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueueStore(t, &dt, dir, newTestSQLStore(t, dir, "node1"))
+	defer q.Close()
+
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"}, "")
+
+	waitQueueEmpty(t, q, 5*time.Second)
+}
+
+func TestQueueDelivery_SQLStoreTakeover(t *testing.T) {
+	t.Parallel()
+
+	dir := testutils.Dir(t)
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+
+	q1 := newTestQueueStore(t, &dt, dir, newTestSQLStore(t, dir, "node1"))
+	deliveryID := testutils.DoTestDeliveryMeta(t, q1, "tester@example.com", []string{"tester1@example.org"}, &module.MsgMetadata{
+		OriginalFrom: "tester@example.com",
+		HoldUntil:    time.Now().Add(1 * time.Hour),
+	})
+
+	store2 := newTestSQLStore(t, dir, "node2")
+	q2 := newTestQueueStore(t, &dt, dir, store2)
+	defer q2.Close()
+
+	// Still handled by q1.
+	if owned, err := store2.Owned(deliveryID); err != nil || owned {
+		t.Fatal("message is acquired by a node not holding the lease:", owned, err)
+	}
+
+	// q1 is gone and its leases expire.
+	q1.Close()
+	expireLeases(t, store2)
+	q2.maintainLeases()
+	if owned, err := store2.Owned(deliveryID); err != nil || !owned {
+		t.Fatal("message is not taken over:", owned, err)
+	}
+
+	// Control requests are executed by the new owner.
+	if err := (&Admin{q: q2}).Flush(deliveryID); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	waitQueueEmpty(t, q2, 5*time.Second)
+}
@@ -38,6 +38,9 @@ type TimeWheel struct {
 
 	updateNotify chan time.Time
 	stopNotify   chan struct{}
+	// Closed after the tick goroutine is stopped to unblock pending Add
+	// calls.
+	closed chan struct{}
 
 	dispatch func(TimeSlot)
 }
@@ -47,6 +50,7 @@ func NewTimeWheel(dispatch func(TimeSlot)) *TimeWheel {
 		slots:        list.New(),
 		stopNotify:   make(chan struct{}),
 		updateNotify: make(chan time.Time),
+		closed:       make(chan struct{}),
 		dispatch:     dispatch,
 	}
 	go tw.tick()
@@ -67,7 +71,30 @@ func (tw *TimeWheel) Add(target time.Time, value interface{}) {
 	tw.slots.PushBack(TimeSlot{Time: target, Value: value})
 	tw.slotsLock.Unlock()
 
-	tw.updateNotify <- target
+	select {
+	case tw.updateNotify <- target:
+	case <-tw.closed:
+	}
+}
+
+// Remove removes all slots for which the match function returns true.
+//
+// It returns the removed slots. Slots that are already passed to the dispatch
+// function are not affected.
+func (tw *TimeWheel) Remove(match func(value interface{}) bool) []TimeSlot {
+	tw.slotsLock.Lock()
+	defer tw.slotsLock.Unlock()
+
+	var removed []TimeSlot
+	for e := tw.slots.Front(); e != nil; {
+		next := e.Next()
+		if slot := e.Value.(TimeSlot); match(slot.Value) {
+			tw.slots.Remove(e)
+			removed = append(removed, slot)
+		}
+		e = next
+	}
+	return removed
 }
 
 func (tw *TimeWheel) Close() {
@@ -83,7 +110,7 @@ func (tw *TimeWheel) Close() {
 
 	tw.stopNotify = nil
 
-	close(tw.updateNotify)
+	close(tw.closed)
 }
 
 func (tw *TimeWheel) tick() {
@@ -121,10 +148,22 @@ func (tw *TimeWheel) tick() {
 			select {
 			case <-timer.C:
 				tw.slotsLock.Lock()
-				tw.slots.Remove(closestEl)
+				// Slot could be removed using Remove while we were waiting.
+				stillPresent := false
+				for e := tw.slots.Front(); e != nil; e = e.Next() {
+					if e == closestEl {
+						stillPresent = true
+						break
+					}
+				}
+				if stillPresent {
+					tw.slots.Remove(closestEl)
+				}
 				tw.slotsLock.Unlock()
 
-				tw.dispatch(closestSlot)
+				if stillPresent {
+					tw.dispatch(closestSlot)
+				}
 
 				break selectloop
 			case newTarget := <-tw.updateNotify:
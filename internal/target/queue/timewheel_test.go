@@ -125,3 +125,30 @@ func TestTimeWheelAdd_EmptyUpdWait(t *testing.T) {
 		t.Errorf("Wrong slot value: %v", slot.Value)
 	}
 }
+
+func TestTimeWheelRemove(t *testing.T) {
+	t.Parallel()
+
+	called := make(chan TimeSlot)
+
+	w := NewTimeWheel(func(slot TimeSlot) {
+		called <- slot
+	})
+	defer w.Close()
+
+	w.Add(time.Now().Add(500*time.Millisecond), 1)
+	w.Add(time.Now().Add(1*time.Second), 2)
+
+	removed := w.Remove(func(value interface{}) bool {
+		val, _ := value.(int)
+		return val == 1
+	})
+	if len(removed) != 1 {
+		t.Errorf("Wrong amount of removed slots: %v", len(removed))
+	}
+
+	slot := <-called
+	if val, _ := slot.Value.(int); val != 2 {
+		t.Errorf("Wrong slot value: %v", slot.Value)
+	}
+}
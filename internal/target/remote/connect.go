@@ -30,6 +30,7 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
 	"github.com/foxcpp/maddy/internal/smtpconn"
 )
 
@@ -40,6 +41,15 @@ type mxConn struct {
 	domain   string
 	dnssecOk bool
 
+	// Key used for the connection pool. Includes the source address if
+	// source_ip is used.
+	poolKey string
+
+	// Adaptive throttling state, see throttle.go. throttle is nil if the
+	// destination is not throttled.
+	throttleKey string
+	throttle    *limiters.Adaptive
+
 	// Errors occurred previously on this connection.
 	errored bool
 
@@ -51,6 +61,10 @@ type mxConn struct {
 	// MX/TLS security level established for this connection.
 	mxLevel  module.MXLevel
 	tlsLevel module.TLSLevel
+
+	// The server is configured using the transport table instead of being
+	// selected using MX records, mxLevel is MXNone in this case.
+	routed bool
 }
 
 func (c *mxConn) Usable() bool {
@@ -88,7 +102,7 @@ func isVerifyError(err error) bool {
 // Return values:
 // - tlsLevel    TLS security level that was estabilished.
 // - tlsErr      Error that prevented TLS from working if tlsLevel != TLSAuthenticated
-func (rd *remoteDelivery) connect(ctx context.Context, conn mxConn, host string, tlsCfg *tls.Config) (tlsLevel module.TLSLevel, tlsErr error, err error) {
+func (rd *remoteDelivery) connect(ctx context.Context, conn mxConn, host, port string, tlsCfg *tls.Config) (tlsLevel module.TLSLevel, tlsErr error, err error) {
 	tlsLevel = module.TLSAuthenticated
 	if rd.rt.tlsConfig != nil {
 		tlsCfg = rd.rt.tlsConfig.Clone()
@@ -102,7 +116,7 @@ retry:
 	// TLS errors separately hence starttls=false.
 	_, err = conn.Connect(ctx, config.Endpoint{
 		Host: host,
-		Port: smtpPort,
+		Port: port,
 	}, false, nil)
 	if err != nil {
 		return module.TLSNone, nil, err
@@ -146,26 +160,47 @@ retry:
 	return tlsLevel, tlsErr, nil
 }
 
-func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *net.MX) error {
+// attemptMX connects to the server and checks the connection against
+// security policies.
+//
+// If route specifies the server to use (see transport.go), there is no MX
+// record to authenticate so CheckMX is not called and the connection is
+// marked as routed instead. Places that care about the MX level (REQUIRETLS
+// and local_policy) check that flag explicitly. Such connections are not
+// included in TLS reports either.
+func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *net.MX, route transportRoute) error {
 	mxLevel := module.MXNone
+	port := smtpPort
+	if route.host != "" {
+		port = route.port
+	}
 
 	connCtx, cancel := context.WithCancel(ctx)
 	// Cancel async policy lookups if rd.connect fails.
 	defer cancel()
 
 	for _, p := range rd.policies {
-		policyLevel, err := p.CheckMX(connCtx, mxLevel, conn.domain, record.Host, conn.dnssecOk)
-		if err != nil {
-			return err
-		}
-		if policyLevel > mxLevel {
-			mxLevel = policyLevel
+		if route.host != "" {
+			if l, ok := p.(localPolicy); ok {
+				if err := l.checkRoute(record.Host); err != nil {
+					return err
+				}
+			}
+		} else {
+			policyLevel, err := p.CheckMX(connCtx, mxLevel, conn.domain, record.Host, conn.dnssecOk)
+			if err != nil {
+				rd.reportTLS(connCtx, conn.domain, record.Host, p, err, nil)
+				return err
+			}
+			if policyLevel > mxLevel {
+				mxLevel = policyLevel
+			}
 		}
 
 		p.PrepareConn(ctx, record.Host)
 	}
 
-	tlsLevel, tlsErr, err := rd.connect(connCtx, *conn, record.Host, rd.rt.tlsConfig)
+	tlsLevel, tlsErr, err := rd.connect(connCtx, *conn, record.Host, port, rd.rt.tlsConfig)
 	if err != nil {
 		return err
 	}
@@ -179,6 +214,9 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	for _, p := range rd.policies {
 		policyLevel, err := p.CheckConn(connCtx, mxLevel, tlsLevel, conn.domain, record.Host, tlsState)
 		if err != nil {
+			if route.host == "" {
+				rd.reportTLS(connCtx, conn.domain, record.Host, p, err, tlsErr)
+			}
 			conn.Close()
 			return exterrors.WithFields(err, map[string]interface{}{"tls_err": tlsErr})
 		}
@@ -186,9 +224,13 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 			tlsLevel = policyLevel
 		}
 	}
+	if route.host == "" {
+		rd.reportTLS(connCtx, conn.domain, record.Host, nil, nil, tlsErr)
+	}
 
 	conn.mxLevel = mxLevel
 	conn.tlsLevel = tlsLevel
+	conn.routed = route.host != ""
 
 	mxLevelCnt.WithLabelValues(rd.rt.Name(), mxLevel.String()).Inc()
 	tlsLevelCnt.WithLabelValues(rd.rt.Name(), tlsLevel.String()).Inc()
@@ -196,12 +238,29 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	return nil
 }
 
-func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string) (*smtpconn.C, error) {
+func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string, route transportRoute) (_ *smtpconn.C, retErr error) {
 	if c, ok := rd.connections[domain]; ok {
 		return c.C, nil
 	}
 
-	pooledConn, err := rd.rt.pool.Get(ctx, domain)
+	// The throttle slot is taken before dialing so the lowered concurrency
+	// limits new connections to the destination as well.
+	throttleKey := rd.rt.throttle.key(domain, "")
+	throttle, err := rd.takeThrottle(ctx, throttleKey)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			rd.rt.throttle.release(throttleKey, throttle)
+		}
+	}()
+
+	poolKey := domain
+	if rd.source != nil {
+		poolKey = domain + " " + rd.source.key()
+	}
+	pooledConn, err := rd.rt.pool.Get(ctx, poolKey)
 	if err != nil {
 		return nil, err
 	}
@@ -215,13 +274,18 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 		rd.Log.Msg("reusing cached connection", "domain", domain, "transactions_counter", conn.transactions)
 	} else {
 		rd.Log.DebugMsg("opening new connection", "domain", domain, "cache_ignored", pooledConn != nil)
-		conn, err = rd.newConn(ctx, domain)
+		conn, err = rd.newConn(ctx, domain, route)
 		if err != nil {
 			return nil, err
 		}
+		conn.poolKey = poolKey
 	}
 
 	if rd.msgMeta.SMTPOpts.RequireTLS {
+		// Servers from the transport table are not selected using MX records
+		// so there is no MX record to authenticate. They are authenticated
+		// only by this check: the certificate has to be valid for the host
+		// name from the table.
 		if conn.tlsLevel < module.TLSAuthenticated {
 			conn.Close()
 			return nil, &exterrors.SMTPError{
@@ -233,7 +297,7 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 				},
 			}
 		}
-		if conn.mxLevel < module.MX_MTASTS {
+		if !conn.routed && conn.mxLevel < module.MX_MTASTS {
 			conn.Close()
 			return nil, &exterrors.SMTPError{
 				Code:         550,
@@ -246,6 +310,20 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 		}
 	}
 
+	// With per-MX keys, the MX is known only once the connection is
+	// established.
+	if mxKey := rd.rt.throttle.key(domain, conn.ServerName()); mxKey != throttleKey {
+		rd.rt.throttle.release(throttleKey, throttle)
+		throttleKey = mxKey
+		throttle, err = rd.takeThrottle(ctx, throttleKey)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	conn.throttleKey = throttleKey
+	conn.throttle = throttle
+
 	region := trace.StartRegion(ctx, "remote/limits.TakeDest")
 	if err := rd.rt.limits.TakeDest(ctx, domain); err != nil {
 		region.End()
@@ -267,6 +345,7 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 
 	if err := conn.Mail(ctx, rd.mailFrom, rd.msgMeta.SMTPOpts); err != nil {
 		conn.Close()
+		rd.rt.throttle.report(throttleKey, err)
 		return nil, err
 	}
 
@@ -274,7 +353,13 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 	return conn.C, nil
 }
 
-func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn, error) {
+func (rd *remoteDelivery) takeThrottle(ctx context.Context, key string) (*limiters.Adaptive, error) {
+	region := trace.StartRegion(ctx, "remote/throttle.take")
+	defer region.End()
+	return rd.rt.throttle.take(ctx, key)
+}
+
+func (rd *remoteDelivery) newConn(ctx context.Context, domain string, route transportRoute) (*mxConn, error) {
 	conn := mxConn{
 		reuseLimit: rd.rt.connReuseLimit,
 		C:          smtpconn.New(),
@@ -282,6 +367,10 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 	}
 
 	conn.Dialer = rd.rt.dialer
+	if rd.source != nil {
+		conn.Dialer = rd.rt.dialFrom(rd.source)
+	}
+	conn.Proxy = rd.rt.proxies.For(domain)
 	conn.Log = rd.Log
 	conn.Hostname = rd.rt.hostname
 	conn.AddrInSMTPMsg = true
@@ -290,16 +379,22 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 		p.PrepareDomain(ctx, domain)
 	}
 
-	region := trace.StartRegion(ctx, "remote/LookupMX")
-	dnssecOk, records, err := rd.lookupMX(ctx, domain)
-	region.End()
-	if err != nil {
-		return nil, err
+	var records []*net.MX
+	if route.host != "" {
+		records = []*net.MX{{Host: route.host}}
+	} else {
+		region := trace.StartRegion(ctx, "remote/LookupMX")
+		dnssecOk, mxs, err := rd.lookupMX(ctx, domain)
+		region.End()
+		if err != nil {
+			return nil, err
+		}
+		conn.dnssecOk = dnssecOk
+		records = mxs
 	}
-	conn.dnssecOk = dnssecOk
 
 	var lastErr error
-	region = trace.StartRegion(ctx, "remote/Connect+TLS")
+	region := trace.StartRegion(ctx, "remote/Connect+TLS")
 	for _, record := range records {
 		if record.Host == "." {
 			return nil, &exterrors.SMTPError{
@@ -309,7 +404,10 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 			}
 		}
 
-		if err := rd.attemptMX(ctx, &conn, record); err != nil {
+		if err := rd.attemptMX(ctx, &conn, record, route); err != nil {
+			if isThrottleErr(err) {
+				rd.rt.throttle.backoff(rd.rt.throttle.key(domain, record.Host))
+			}
 			if len(records) != 0 {
 				rd.Log.Error("cannot use MX", err, "remote_server", record.Host, "domain", domain)
 			}
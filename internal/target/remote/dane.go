@@ -25,6 +25,7 @@ import (
 
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
 )
 
 // Used to override verification time for DANE-TA tests.
@@ -45,6 +46,7 @@ func verifyDANE(recs []dns.TLSA, connState tls.ConnectionState) (overridePKIX bo
 		TargetName:   "remote",
 		Misc: map[string]interface{}{
 			"remote_server": connState.ServerName,
+			"tlsrpt_result": tlsrpt.ResultSTARTTLSNotSupported,
 		},
 	}
 
@@ -113,6 +115,7 @@ func verifyDANE(recs []dns.TLSA, connState tls.ConnectionState) (overridePKIX bo
 			TargetName:   "remote",
 			Misc: map[string]interface{}{
 				"remote_server": connState.ServerName,
+				"tlsrpt_result": tlsrpt.ResultValidationFailure,
 			},
 		}
 	}
@@ -153,6 +156,7 @@ func verifyDANE(recs []dns.TLSA, connState tls.ConnectionState) (overridePKIX bo
 		TargetName:   "remote",
 		Misc: map[string]interface{}{
 			"remote_server": connState.ServerName,
+			"tlsrpt_result": tlsrpt.ResultValidationFailure,
 		},
 	}
 }
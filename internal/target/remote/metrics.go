@@ -40,7 +40,29 @@ var tlsLevelCnt = prometheus.NewCounterVec(
 	[]string{"module", "level"},
 )
 
+var throttleConcurrency = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "remote",
+		Name:      "throttle_concurrency",
+		Help:      "Effective concurrency limit for the throttled destination",
+	},
+	[]string{"module", "destination"},
+)
+
+var throttleRate = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "remote",
+		Name:      "throttle_rate",
+		Help:      "Effective rate limit (messages per second) for the throttled destination",
+	},
+	[]string{"module", "destination"},
+)
+
 func init() {
 	prometheus.MustRegister(mxLevelCnt)
 	prometheus.MustRegister(tlsLevelCnt)
+	prometheus.MustRegister(throttleConcurrency)
+	prometheus.MustRegister(throttleRate)
 }
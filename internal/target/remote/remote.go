@@ -32,6 +32,7 @@ import (
 	"runtime/trace"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/address"
@@ -44,6 +45,7 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/limits"
+	"github.com/foxcpp/maddy/internal/smtpconn"
 	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/net/idna"
@@ -64,6 +66,7 @@ type Target struct {
 	tlsConfig *tls.Config
 
 	resolver    dns.Resolver
+	netDialer   net.Dialer
 	dialer      func(ctx context.Context, network, addr string) (net.Conn, error)
 	extResolver *dns.ExtResolver
 
@@ -75,6 +78,23 @@ type Target struct {
 	pool           *pool.P
 	connReuseLimit int
 
+	// Recipient domain -> server address or transportTargets key, see
+	// transport.go.
+	transport        module.Table
+	transportTargets map[string]module.DeliveryTarget
+
+	// TLS reporting (RFC 8460), see tlsrpt.go.
+	tlsReporter *tlsReporter
+
+	// Per-sender source IP selection, see source_ip.go.
+	sourceIP *sourceSelector
+
+	// SOCKS5/HTTP CONNECT proxies to connect to MXs through.
+	proxies smtpconn.ProxyTable
+
+	// Adaptive throttling, see throttle.go. nil if disabled.
+	throttle *throttler
+
 	Log log.Logger
 }
 
@@ -102,6 +122,7 @@ func (rt *Target) Init(cfg *config.Map) error {
 
 	cfg.String("hostname", true, true, "", &rt.hostname)
 	cfg.String("local_ip", false, false, "", &rt.localIP)
+	cfg.Duration("connect_timeout", false, false, 30*time.Second, &rt.netDialer.Timeout)
 	cfg.Bool("debug", true, false, &rt.Log.Debug)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return &tls.Config{}, nil
@@ -130,6 +151,12 @@ func (rt *Target) Init(cfg *config.Map) error {
 	cfg.Bool("requiretls_override", false, true, &rt.allowSecOverride)
 	cfg.Bool("relaxed_requiretls", false, true, &rt.relaxedREQUIRETLS)
 	cfg.Int("conn_reuse_limit", false, false, 10, &rt.connReuseLimit)
+	cfg.Custom("transport", false, false, nil, modconfig.TableDirective, &rt.transport)
+	cfg.Custom("transport_targets", false, false, nil, transportTargetsDirective, &rt.transportTargets)
+	cfg.Custom("tls_reporting", false, false, nil, tlsReportingDirective, &rt.tlsReporter)
+	cfg.Custom("source_ip", false, false, nil, sourceIPDirective, &rt.sourceIP)
+	cfg.Callback("proxy", rt.proxies.ProxyDirective)
+	cfg.Custom("throttling", false, false, nil, throttlingDirective, &rt.throttle)
 
 	poolCfg := pool.Config{
 		MaxKeys:             20000,
@@ -145,6 +172,12 @@ func (rt *Target) Init(cfg *config.Map) error {
 	}
 	rt.pool = pool.New(poolCfg)
 
+	// The source address would be bound to the connection to the proxy, not
+	// to the SMTP connection the remote server sees.
+	if rt.sourceIP != nil && (rt.proxies.Default != nil || len(rt.proxies.Domains) != 0) {
+		return fmt.Errorf("remote: source_ip cannot be used together with proxy")
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	rt.hostname, err = idna.ToASCII(rt.hostname)
 	if err != nil {
@@ -156,9 +189,19 @@ func (rt *Target) Init(cfg *config.Map) error {
 		if err != nil {
 			return fmt.Errorf("remote: failed to parse local IP: %w", err)
 		}
-		rt.dialer = (&net.Dialer{
-			LocalAddr: addr,
-		}).DialContext
+		rt.netDialer.LocalAddr = addr
+	}
+	rt.dialer = rt.netDialer.DialContext
+
+	if rt.tlsReporter != nil {
+		if err := rt.tlsReporter.start(rt); err != nil {
+			return err
+		}
+	}
+
+	if rt.throttle != nil {
+		rt.throttle.modName = rt.Name()
+		rt.throttle.log = rt.Log
 	}
 
 	return nil
@@ -166,6 +209,11 @@ func (rt *Target) Init(cfg *config.Map) error {
 
 func (rt *Target) Close() error {
 	rt.pool.Close()
+	rt.throttle.close()
+
+	if rt.tlsReporter != nil {
+		return rt.tlsReporter.close()
+	}
 
 	return nil
 }
@@ -186,8 +234,16 @@ type remoteDelivery struct {
 
 	recipients  []string
 	connections map[string]*mxConn
+	relays      map[string]*relayDelivery
+
+	// Recipients accepted by servers supporting the DSN extension.
+	dsnRcpts map[string]bool
 
 	policies []module.DeliveryMXAuthPolicy
+
+	// Local addresses to use for connections, nil if the default one should be
+	// used.
+	source *sourceAddrs
 }
 
 func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
@@ -217,6 +273,14 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 		}
 	}
 
+	var source *sourceAddrs
+	if rt.sourceIP != nil {
+		source, err = rt.sourceIP.sourceFor(msgMeta, mailFrom)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Domain is already should be normalized by the message source (e.g.
 	// endpoint/smtp).
 	region := trace.StartRegion(ctx, "remote/limits.Take")
@@ -246,7 +310,10 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 		msgMeta:     msgMeta,
 		Log:         target.DeliveryLogger(rt.Log, msgMeta),
 		connections: map[string]*mxConn{},
+		relays:      map[string]*relayDelivery{},
+		dsnRcpts:    map[string]bool{},
 		policies:    policies,
+		source:      source,
 	}, nil
 }
 
@@ -287,19 +354,60 @@ func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string) error {
 		}
 	}
 
-	conn, err := rd.connectionForDomain(ctx, domain)
+	route, err := rd.rt.lookupTransport(domain)
 	if err != nil {
 		return err
 	}
+	if route.target != nil {
+		if err := rd.addRelayRcpt(ctx, route, to); err != nil {
+			return err
+		}
+		rd.recipients = append(rd.recipients, to)
+		return nil
+	}
 
-	if err := conn.Rcpt(ctx, to); err != nil {
+	conn, err := rd.connectionForDomain(ctx, domain, route)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.Rcpt(ctx, to, rd.msgMeta.RcptOptsFor(to)); err != nil {
+		if isThrottleErr(err) {
+			rd.rt.throttle.backoff(rd.connections[domain].throttleKey)
+		}
 		return moduleError(err)
 	}
 
+	if conn.SupportsDSN() {
+		rd.dsnRcpts[to] = true
+	}
 	rd.recipients = append(rd.recipients, to)
 	return nil
 }
 
+// DSNHandover implements module.DSNDelivery.
+//
+// Recipients delivered to servers that do not support the DSN extension
+// are considered relayed (RFC 3461 Section 5.2.2).
+func (rd *remoteDelivery) DSNHandover(rcptTo string) module.DSNHandover {
+	for _, rel := range rd.relays {
+		for _, rcpt := range rel.rcpts {
+			if rcpt != rcptTo {
+				continue
+			}
+			if dsnDelivery, ok := rel.Delivery.(module.DSNDelivery); ok {
+				return dsnDelivery.DSNHandover(rcptTo)
+			}
+			return module.DSNRelayed
+		}
+	}
+
+	if rd.dsnRcpts[rcptTo] {
+		return module.DSNPassedOn
+	}
+	return module.DSNRelayed
+}
+
 type multipleErrs struct {
 	errs      map[string]error
 	statusLck sync.Mutex
@@ -401,21 +509,48 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 			defer bodyR.Close()
 
 			err = conn.Data(ctx, header, bodyR)
+			rd.rt.throttle.report(conn.throttleKey, err)
 			for _, rcpt := range conn.Rcpts() {
 				c.SetStatus(rcpt, err)
 			}
 			rd.connections[i].errored = err != nil
 		}()
 	}
+	for name, rel := range rd.relays {
+		name, rel := name, rel
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rel.body(ctx, rd.Log, name, c, header, b)
+		}()
+	}
 
 	wg.Wait()
 }
 
+// abortRelays aborts relay deliveries that were not finished by
+// BodyNonAtomic.
+func (rd *remoteDelivery) abortRelays(ctx context.Context) {
+	for name, rel := range rd.relays {
+		if rel.done {
+			continue
+		}
+		if err := rel.Abort(ctx); err != nil {
+			rd.Log.Error("transport target abort failed", err, "transport_target", name)
+		}
+	}
+}
+
 func (rd *remoteDelivery) Abort(ctx context.Context) error {
+	rd.abortRelays(ctx)
 	return rd.Close()
 }
 
 func (rd *remoteDelivery) Commit(ctx context.Context) error {
+	// Relay deliveries are committed by BodyNonAtomic so the errors can be
+	// reported for each recipient, the ones left had no message body.
+	rd.abortRelays(ctx)
+
 	// It is not possible to implement it atomically, so users of remoteDelivery have to
 	// take care of partial failures.
 	return rd.Close()
@@ -424,6 +559,8 @@ func (rd *remoteDelivery) Commit(ctx context.Context) error {
 func (rd *remoteDelivery) Close() error {
 	for _, conn := range rd.connections {
 		rd.rt.limits.ReleaseDest(conn.domain)
+		rd.rt.throttle.release(conn.throttleKey, conn.throttle)
+		conn.throttle = nil
 		conn.transactions++
 
 		if conn.C == nil || conn.transactions > rd.rt.connReuseLimit || conn.C.Client() == nil || conn.errored {
@@ -432,7 +569,7 @@ func (rd *remoteDelivery) Close() error {
 			conn.Close()
 		} else {
 			rd.Log.Debugf("returning connection for %s to pool", conn.ServerName())
-			rd.rt.pool.Return(conn.domain, conn)
+			rd.rt.pool.Return(conn.poolKey, conn)
 		}
 	}
 
@@ -135,6 +135,55 @@ func TestRemoteDelivery(t *testing.T) {
 	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
 }
 
+func TestRemoteDelivery_DSNHandover(t *testing.T) {
+	test := func(enableDSN bool, expected module.DSNHandover) {
+		t.Helper()
+
+		_, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort, func(srv *smtp.Server) {
+			srv.EnableDSN = enableDSN
+		})
+		defer srv.Close()
+		defer testutils.CheckSMTPConnLeak(t, srv)
+		zones := map[string]mockdns.Zone{
+			"example.invalid.": {
+				MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+			},
+			"mx.example.invalid.": {
+				A: []string{"127.0.0.1"},
+			},
+		}
+
+		tgt := testTarget(t, zones, nil, nil)
+		defer tgt.Close()
+
+		delivery, err := tgt.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "test@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.AddRcpt(context.Background(), "test@example.invalid"); err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("B", "2")
+		hdr.Add("A", "1")
+		if err := delivery.Body(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := delivery.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		handover := delivery.(module.DSNDelivery).DSNHandover("test@example.invalid")
+		if handover != expected {
+			t.Errorf("wrong DSN handover with DSN=%v: %v", enableDSN, handover)
+		}
+	}
+
+	// RFC 3461 Section 5.2.2.
+	test(false, module.DSNRelayed)
+	test(true, module.DSNPassedOn)
+}
+
 func TestRemoteDelivery_NoMXFallback(t *testing.T) {
 	tarpit := testutils.FailOnConn(t, "127.0.0.1:"+smtpPort)
 	defer tarpit.Close()
@@ -349,6 +398,36 @@ func TestRemoteDelivery_MAILFROMErr(t *testing.T) {
 	}
 }
 
+func TestRemoteDelivery_BinaryMIME(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	defer tgt.Close()
+
+	// The message can't be converted so it should be bounced instead of
+	// being retried.
+	_, err := testutils.DoTestDeliveryErrMeta(t, tgt, "test@example.com", []string{"test@example.invalid"},
+		&module.MsgMetadata{SMTPOpts: smtp.MailOptions{Body: smtp.BodyBinaryMIME}})
+	testutils.CheckSMTPErr(t, err, 554, exterrors.EnhancedCode{5, 6, 3},
+		"BINARYMIME messages cannot be relayed, conversion is not implemented")
+	if exterrors.IsTemporaryOrUnspec(err) {
+		t.Error("Expected a permanent error, got", err)
+	}
+	if len(be.Messages) != 0 {
+		t.Fatal("Unexpected message delivered:", be.Messages)
+	}
+}
+
 func TestRemoteDelivery_NoMX(t *testing.T) {
 	tarpit := testutils.FailOnConn(t, "127.0.0.1:"+smtpPort)
 	defer tarpit.Close()
@@ -22,7 +22,9 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/foxcpp/go-mtasts"
@@ -33,6 +35,7 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/target"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
 )
 
 type (
@@ -48,6 +51,10 @@ type (
 		domain    string
 		policyFut *future.Future
 		log       log.Logger
+
+		// Failures that would happen if the testing mode policy was enforced,
+		// keyed by MX name. Used for TLS reporting.
+		testFailures map[string]tlsrpt.ResultType
 	}
 )
 
@@ -150,6 +157,7 @@ func (c *mtastsPolicy) Close() error {
 
 func (c *mtastsDelivery) PrepareDomain(ctx context.Context, domain string) {
 	c.policyFut = future.New()
+	c.testFailures = map[string]tlsrpt.ResultType{}
 	go func() {
 		c.policyFut.Set(c.c.mtastsGet(ctx, domain))
 	}()
@@ -171,9 +179,15 @@ func (c *mtastsDelivery) CheckMX(ctx context.Context, mxLevel module.MXLevel, do
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
 				Message:      "Failed to estabilish the module.MX record authenticity (MTA-STS)",
+				Misc: map[string]interface{}{
+					"tlsrpt_result": tlsrpt.ResultValidationFailure,
+				},
 			}
 		}
 		c.log.Msg("MX does not match published non-enforced MTA-STS policy", "mx", mx, "domain", c.domain)
+		if policy.Mode == mtasts.ModeTesting {
+			c.testFailures[mx] = tlsrpt.ResultValidationFailure
+		}
 		return module.MXNone, nil
 	}
 	return module.MX_MTASTS, nil
@@ -188,6 +202,14 @@ func (c *mtastsDelivery) CheckConn(ctx context.Context, mxLevel module.MXLevel,
 	policy := policyI.(*mtasts.Policy)
 
 	if policy.Mode != mtasts.ModeEnforce {
+		if policy.Mode == mtasts.ModeTesting && c.testFailures[mx] == "" {
+			switch {
+			case !tlsState.HandshakeComplete:
+				c.testFailures[mx] = tlsrpt.ResultSTARTTLSNotSupported
+			case tlsState.VerifiedChains == nil:
+				c.testFailures[mx] = tlsrpt.ResultCertificateNotTrusted
+			}
+		}
 		return module.TLSNone, nil
 	}
 
@@ -196,6 +218,9 @@ func (c *mtastsDelivery) CheckConn(ctx context.Context, mxLevel module.MXLevel,
 			Code:         451,
 			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
 			Message:      "TLS is required but unavailable or failed (MTA-STS)",
+			Misc: map[string]interface{}{
+				"tlsrpt_result": tlsrpt.ResultSTARTTLSNotSupported,
+			},
 		}
 	}
 
@@ -206,7 +231,8 @@ func (c *mtastsDelivery) CheckConn(ctx context.Context, mxLevel module.MXLevel,
 			Message: "Recipient server module.TLS certificate is not trusted but " +
 				"authentication is required by MTA-STS",
 			Misc: map[string]interface{}{
-				"tls_level": tlsLevel,
+				"tls_level":     tlsLevel,
+				"tlsrpt_result": tlsrpt.ResultCertificateNotTrusted,
 			},
 		}
 	}
@@ -214,8 +240,36 @@ func (c *mtastsDelivery) CheckConn(ctx context.Context, mxLevel module.MXLevel,
 	return module.TLSNone, nil
 }
 
+func (c *mtastsDelivery) tlsrptPolicy(ctx context.Context, domain, mx string) (*tlsrpt.Policy, tlsrpt.ResultType) {
+	if c.policyFut == nil {
+		return nil, ""
+	}
+	policyI, err := c.policyFut.GetContext(ctx)
+	if err != nil {
+		return nil, ""
+	}
+	policy := policyI.(*mtasts.Policy)
+	if policy.Mode == mtasts.ModeNone {
+		return nil, ""
+	}
+
+	policyStr := []string{"version: STSv1", "mode: " + string(policy.Mode)}
+	for _, mx := range policy.MX {
+		policyStr = append(policyStr, "mx: "+mx)
+	}
+	policyStr = append(policyStr, "max_age: "+strconv.Itoa(policy.MaxAge))
+
+	return &tlsrpt.Policy{
+		Type:   tlsrpt.PolicySTS,
+		String: policyStr,
+		Domain: domain,
+		MXHost: policy.MX,
+	}, c.testFailures[mx]
+}
+
 func (c *mtastsDelivery) Reset(msgMeta *module.MsgMetadata) {
 	c.policyFut = nil
+	c.testFailures = nil
 	if msgMeta != nil {
 		c.log = target.DeliveryLogger(c.c.log, msgMeta)
 	}
@@ -495,7 +549,9 @@ func (c *daneDelivery) CheckConn(ctx context.Context, mxLevel module.MXLevel, tl
 		// We assume DANE failure in both cases as a safety measure.
 		// However, there is a possibility of a temporary error condition,
 		// so we mark it as such.
-		return module.TLSNone, exterrors.WithTemporary(err, true)
+		return module.TLSNone, exterrors.WithFields(exterrors.WithTemporary(err, true), map[string]interface{}{
+			"tlsrpt_result": tlsrpt.ResultDNSSECInvalid,
+		})
 	}
 	recs := recsI.([]dns.TLSA)
 
@@ -509,13 +565,48 @@ func (c *daneDelivery) CheckConn(ctx context.Context, mxLevel module.MXLevel, tl
 	return module.TLSNone, nil
 }
 
+func (c *daneDelivery) tlsrptPolicy(ctx context.Context, domain, mx string) (*tlsrpt.Policy, tlsrpt.ResultType) {
+	if c.c.extResolver == nil || c.tlsaFut == nil {
+		return nil, ""
+	}
+
+	recsI, err := c.tlsaFut.GetContext(ctx)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, ""
+		}
+		// Records are unknown, but the failure is still reported.
+		return &tlsrpt.Policy{
+			Type:   tlsrpt.PolicyTLSA,
+			Domain: domain,
+			MXHost: []string{mx},
+		}, ""
+	}
+	recs := recsI.([]dns.TLSA)
+	if len(recs) == 0 {
+		return nil, ""
+	}
+
+	policyStr := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		policyStr = append(policyStr, fmt.Sprintf("%d %d %d %s", rec.Usage, rec.Selector, rec.MatchingType, rec.Certificate))
+	}
+	return &tlsrpt.Policy{
+		Type:   tlsrpt.PolicyTLSA,
+		String: policyStr,
+		Domain: domain,
+		MXHost: []string{mx},
+	}, ""
+}
+
 func (c *daneDelivery) Reset(*module.MsgMetadata) {}
 
 type (
 	localPolicy struct {
-		instName    string
-		minTLSLevel module.TLSLevel
-		minMXLevel  module.MXLevel
+		instName       string
+		minTLSLevel    module.TLSLevel
+		minMXLevel     module.MXLevel
+		trustTransport bool
 	}
 )
 
@@ -547,6 +638,7 @@ func (c *localPolicy) Init(cfg *config.Map) error {
 		[]string{"none", "encrypted", "authenticated"}, "encrypted", &minTLSLevel)
 	cfg.Enum("min_mx_level", false, false,
 		[]string{"none", "mtasts", "dnssec"}, "none", &minMXLevel)
+	cfg.Bool("trust_transport", false, true, &c.trustTransport)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -600,6 +692,22 @@ func (l localPolicy) CheckMX(ctx context.Context, mxLevel module.MXLevel, domain
 	return module.MXNone, nil
 }
 
+// checkRoute is used instead of CheckMX for servers configured using the
+// transport table.
+func (l localPolicy) checkRoute(host string) error {
+	if l.minMXLevel == module.MXNone || l.trustTransport {
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+		Message:      "Server from the transport table is not trusted by the local policy",
+		Misc: map[string]interface{}{
+			"remote_server": host,
+		},
+	}
+}
+
 func (l localPolicy) CheckConn(ctx context.Context, mxLevel module.MXLevel, tlsLevel module.TLSLevel, domain, mx string, tlsState tls.ConnectionState) (module.TLSLevel, error) {
 	if tlsLevel < l.minTLSLevel {
 		return module.TLSNone, &exterrors.SMTPError{
@@ -0,0 +1,278 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	sourceKeySenderDomain = "sender_domain"
+	sourceKeyAuthUser     = "auth_user"
+)
+
+// sourcePool is a set of local addresses that are used in round-robin
+// fashion.
+type sourcePool struct {
+	v4, v6       []net.IP
+	next4, next6 uint32
+}
+
+func parseSourcePool(addrs []string) (*sourcePool, error) {
+	p := &sourcePool{}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("malformed IP address: %s", addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			p.v4 = append(p.v4, ip4)
+		} else {
+			p.v6 = append(p.v6, ip)
+		}
+	}
+	if len(p.v4) == 0 && len(p.v6) == 0 {
+		return nil, errors.New("empty source IP pool")
+	}
+	return p, nil
+}
+
+// pick selects the next IPv4 and IPv6 address to use.
+func (p *sourcePool) pick() *sourceAddrs {
+	src := &sourceAddrs{}
+	if len(p.v4) != 0 {
+		src.v4 = p.v4[(atomic.AddUint32(&p.next4, 1)-1)%uint32(len(p.v4))]
+	}
+	if len(p.v6) != 0 {
+		src.v6 = p.v6[(atomic.AddUint32(&p.next6, 1)-1)%uint32(len(p.v6))]
+	}
+	return src
+}
+
+// sourceAddrs is the pair of local addresses used for a delivery. The address
+// of the same family as the remote server address is used.
+type sourceAddrs struct {
+	v4, v6 net.IP
+}
+
+// key is used as a part of the connection pool key so connections are never
+// reused for deliveries that should use a different source address.
+func (src *sourceAddrs) key() string {
+	return fmt.Sprintf("%v/%v", src.v4, src.v6)
+}
+
+func (src *sourceAddrs) forIP(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return src.v4
+	}
+	return src.v6
+}
+
+// sourceSelector implements the source_ip directive.
+type sourceSelector struct {
+	key   string
+	pools map[string]*sourcePool
+	table module.Table
+
+	// Parsed table values, kept to preserve the round-robin state between
+	// deliveries.
+	tablePools     map[string]*sourcePool
+	tablePoolsLock sync.Mutex
+}
+
+func sourceIPDirective(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	s := &sourceSelector{
+		pools:      map[string]*sourcePool{},
+		tablePools: map[string]*sourcePool{},
+	}
+	cfg := config.NewMap(m.Globals, node)
+	cfg.Enum("key", false, false, []string{sourceKeySenderDomain, sourceKeyAuthUser}, sourceKeySenderDomain, &s.key)
+	cfg.Custom("table", false, false, nil, modconfig.TableDirective, &s.table)
+	cfg.Callback("pool", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "key and at least one IP address are required")
+		}
+		key := node.Args[0]
+		if s.key == sourceKeySenderDomain {
+			var err error
+			key, err = dns.ForLookup(key)
+			if err != nil {
+				return config.NodeErr(node, "invalid domain: %v", err)
+			}
+		}
+		if _, ok := s.pools[key]; ok {
+			return config.NodeErr(node, "duplicate pool for %s", key)
+		}
+		p, err := parseSourcePool(node.Args[1:])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		s.pools[key] = p
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+	if len(s.pools) == 0 && s.table == nil {
+		return nil, config.NodeErr(node, "at least one pool or table is required")
+	}
+
+	return s, nil
+}
+
+func sourceErr(reason string, err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 5},
+		Message:      "Misconfigured source IP pool",
+		TargetName:   "remote",
+		Reason:       reason,
+		Err:          err,
+	}
+}
+
+// lookupKey returns the value used to select the pool for the message.
+func (s *sourceSelector) lookupKey(msgMeta *module.MsgMetadata, mailFrom string) (string, error) {
+	switch s.key {
+	case sourceKeyAuthUser:
+		return msgMeta.AuthUser, nil
+	default:
+		if mailFrom == "" {
+			return "", nil
+		}
+		_, domain, err := address.Split(mailFrom)
+		if err != nil {
+			return "", err
+		}
+		if domain == "" {
+			return "", nil
+		}
+		return dns.ForLookup(domain)
+	}
+}
+
+// sourceFor selects the local addresses to use for the message. It returns nil
+// if the message is not matched by any pool.
+func (s *sourceSelector) sourceFor(msgMeta *module.MsgMetadata, mailFrom string) (*sourceAddrs, error) {
+	key, err := s.lookupKey(msgMeta, mailFrom)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	if p, ok := s.pools[key]; ok {
+		return p.pick(), nil
+	}
+	if s.table == nil {
+		return nil, nil
+	}
+
+	value, ok, err := s.table.Lookup(key)
+	if err != nil {
+		return nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error during source IP lookup",
+			TargetName:   "remote",
+			Err:          err,
+		}
+	}
+	if !ok || value == "" {
+		return nil, nil
+	}
+
+	s.tablePoolsLock.Lock()
+	defer s.tablePoolsLock.Unlock()
+	p, ok := s.tablePools[value]
+	if !ok {
+		p, err = parseSourcePool(strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}))
+		if err != nil {
+			return nil, sourceErr("malformed table value", err)
+		}
+		s.tablePools[value] = p
+	}
+	return p.pick(), nil
+}
+
+// dialFrom returns the dial function that binds outbound connections to the
+// source addresses.
+//
+// It resolves the server name using the configured resolver and tries only
+// addresses for which there is a source address of the same family. Other
+// dialer settings (connect_timeout) are the same as for the default address.
+func (rt *Target) dialFrom(src *sourceAddrs) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			addrs, err := rt.resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range addrs {
+				ips = append(ips, a.IP)
+			}
+		}
+
+		lastErr := fmt.Errorf("remote: no addresses for %s match the source IP pool (%s)", host, src.key())
+		for _, ip := range ips {
+			local := src.forIP(ip)
+			if local == nil {
+				continue
+			}
+
+			d := rt.netDialer
+			d.LocalAddr = &net.TCPAddr{IP: local}
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return conn, nil
+		}
+		return nil, lastErr
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func sourceIPs(be *testutils.SMTPBackend) []string {
+	var ips []string
+	for endp := range be.SourceEndpoints {
+		host, _, _ := net.SplitHostPort(endp)
+		ips = append(ips, host)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func TestRemoteDelivery_SourceIP(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.connReuseLimit = 5
+	src, err := sourceIPDirective(config.NewMap(nil, config.Node{}), config.Node{
+		Children: []config.Node{
+			{Name: "pool", Args: []string{"example.org", "127.0.0.2", "127.0.0.3"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt.sourceIP = src.(*sourceSelector)
+	defer tgt.Close()
+
+	// Connections are not shared between source addresses but are reused for
+	// the same address.
+	for i := 0; i < 4; i++ {
+		testutils.DoTestDelivery(t, tgt, "test@example.org", []string{"test@example.invalid"})
+	}
+	if ips := sourceIPs(be); len(be.SourceEndpoints) != 2 || ips[0] != "127.0.0.2" || ips[1] != "127.0.0.3" {
+		t.Fatal("Wrong source endpoints:", be.SourceEndpoints)
+	}
+
+	// Not in the pool, default address is used.
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if ips := sourceIPs(be); len(ips) != 3 || ips[0] != "127.0.0.1" {
+		t.Fatal("Wrong source endpoints:", be.SourceEndpoints)
+	}
+}
+
+func TestRemoteDelivery_SourceIP_AuthUserTable(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.sourceIP = &sourceSelector{
+		key: sourceKeyAuthUser,
+		table: testutils.Table{M: map[string]string{
+			"user1": "127.0.0.2, ::1",
+			"user2": "not-an-ip",
+		}},
+		tablePools: map[string]*sourcePool{},
+	}
+	defer tgt.Close()
+
+	testutils.DoTestDeliveryMeta(t, tgt, "test@example.com", []string{"test@example.invalid"},
+		&module.MsgMetadata{ID: "test", AuthUser: "user1"})
+	if ips := sourceIPs(be); len(ips) != 1 || ips[0] != "127.0.0.2" {
+		t.Fatal("Wrong source endpoints:", be.SourceEndpoints)
+	}
+
+	_, err := testutils.DoTestDeliveryErrMeta(t, tgt, "test@example.com", []string{"test@example.invalid"},
+		&module.MsgMetadata{ID: "test", AuthUser: "user2"})
+	if err == nil {
+		t.Fatal("Expected an error for the malformed table value")
+	}
+}
+
+func TestRemoteDelivery_SourceIP_ConnectTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tgt := testTarget(t, nil, nil, nil)
+	src := &sourceAddrs{v4: net.IPv4(127, 0, 0, 2)}
+
+	conn, err := tgt.dialFrom(src)(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Unexpected dial error:", err)
+	}
+	conn.Close()
+
+	// The deadline is already expired by the time connect is attempted.
+	tgt.netDialer.Timeout = time.Nanosecond
+	_, err = tgt.dialFrom(src)(context.Background(), "tcp", l.Addr().String())
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("Expected a timeout error, got", err)
+	}
+}
+
+func TestSourcePool_Pick(t *testing.T) {
+	p, err := parseSourcePool([]string{"192.0.2.1", "2001:db8::1", "192.0.2.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		src := p.pick()
+		if src.v4.String() != expected {
+			t.Errorf("%d: wrong IPv4 address: %v", i, src.v4)
+		}
+		if src.v6.String() != "2001:db8::1" {
+			t.Errorf("%d: wrong IPv6 address: %v", i, src.v6)
+		}
+	}
+
+	if _, err := parseSourcePool([]string{"192.0.2.1", "example.org"}); err == nil {
+		t.Error("Expected an error for malformed address")
+	}
+}
+
+func TestRemoteDelivery_SourceIP_Proxy(t *testing.T) {
+	mod, err := New("target.remote", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt := mod.(*Target)
+	err = tgt.Init(config.NewMap(map[string]interface{}{"hostname": "mx.example.org"}, config.Node{
+		Children: []config.Node{
+			{
+				Name: "source_ip",
+				Children: []config.Node{
+					{Name: "pool", Args: []string{"example.org", "127.0.0.2"}},
+				},
+			},
+			{
+				Name: "proxy",
+				Args: []string{"socks5://127.0.0.1:1080", "example.com"},
+			},
+		},
+	}))
+	if err == nil {
+		tgt.Close()
+		t.Fatal("Expected an error for source_ip used together with proxy")
+	}
+}
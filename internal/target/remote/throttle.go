@@ -0,0 +1,267 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/limits/limiters"
+)
+
+// How long delivery can wait for the throttled destination before failing
+// with a temporary error.
+var throttleWaitTimeout = 30 * time.Second
+
+// throttler implements adaptive throttling of deliveries to destinations
+// that respond with "slow down" errors (see throttling directive).
+//
+// Limiters exist only for destinations that were throttled recently, they are
+// removed once the limits are back to their maximum values.
+type throttler struct {
+	modName string
+	perMX   bool
+	log     log.Logger
+
+	maxConcurrency int
+	maxRate        float64
+	minRate        float64
+	increaseAfter  int
+
+	destsLock sync.Mutex
+	dests     map[string]*limiters.Adaptive
+}
+
+func parseRateArgs(node config.Node) (float64, error) {
+	if len(node.Args) == 0 || len(node.Args) > 2 {
+		return 0, config.NodeErr(node, "expected a message count and an optional period")
+	}
+	count, err := strconv.Atoi(node.Args[0])
+	if err != nil {
+		return 0, config.NodeErr(node, "%v", err)
+	}
+	if count <= 0 {
+		return 0, config.NodeErr(node, "message count should be positive")
+	}
+	period := time.Second
+	if len(node.Args) == 2 {
+		period, err = time.ParseDuration(node.Args[1])
+		if err != nil {
+			return 0, config.NodeErr(node, "%v", err)
+		}
+		if period <= 0 {
+			return 0, config.NodeErr(node, "period should be positive")
+		}
+	}
+	return float64(count) / period.Seconds(), nil
+}
+
+func throttlingDirective(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	t := &throttler{
+		dests: map[string]*limiters.Adaptive{},
+	}
+	var key string
+	cfg := config.NewMap(m.Globals, node)
+	cfg.Enum("key", false, false, []string{"domain", "mx"}, "domain", &key)
+	cfg.Int("max_concurrency", false, false, 10, &t.maxConcurrency)
+	cfg.Custom("max_rate", false, false, func() (interface{}, error) {
+		return 10.0, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		return parseRateArgs(node)
+	}, &t.maxRate)
+	cfg.Custom("min_rate", false, false, func() (interface{}, error) {
+		return 1.0 / 60, nil
+	}, func(_ *config.Map, node config.Node) (interface{}, error) {
+		return parseRateArgs(node)
+	}, &t.minRate)
+	cfg.Int("increase_after", false, false, 10, &t.increaseAfter)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+	if t.maxConcurrency <= 0 {
+		return nil, config.NodeErr(node, "max_concurrency should be positive")
+	}
+	if t.increaseAfter <= 0 {
+		return nil, config.NodeErr(node, "increase_after should be positive")
+	}
+	if t.minRate > t.maxRate {
+		return nil, config.NodeErr(node, "min_rate should not be bigger than max_rate")
+	}
+	t.perMX = key == "mx"
+
+	return t, nil
+}
+
+// isThrottleErr checks whether the error indicates that the remote server
+// wants us to slow down.
+func isThrottleErr(err error) bool {
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return false
+	}
+	// 421 is used to close the connection when the server is overloaded or
+	// the client is sending too fast, X.7.28 is "Mail flood detected" (RFC
+	// 7372).
+	return smtpErr.Code == 421 ||
+		(smtpErr.Code/100 == 4 && smtpErr.EnhancedCode == exterrors.EnhancedCode{4, 7, 28})
+}
+
+// key returns the limiter key for the destination.
+func (t *throttler) key(domain, mx string) string {
+	if t == nil {
+		return ""
+	}
+	if t.perMX && mx != "" {
+		return mx
+	}
+	return domain
+}
+
+func (t *throttler) updateMetrics(key string, l *limiters.Adaptive) {
+	if l == nil {
+		throttleConcurrency.DeleteLabelValues(t.modName, key)
+		throttleRate.DeleteLabelValues(t.modName, key)
+		return
+	}
+	conc, rate := l.Limits()
+	throttleConcurrency.WithLabelValues(t.modName, key).Set(float64(conc))
+	throttleRate.WithLabelValues(t.modName, key).Set(rate)
+}
+
+// take waits until the delivery to the destination is allowed. Returned
+// limiter (can be nil) should be passed to release once the delivery is done.
+func (t *throttler) take(ctx context.Context, key string) (*limiters.Adaptive, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	t.destsLock.Lock()
+	l := t.dests[key]
+	t.destsLock.Unlock()
+	if l == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, throttleWaitTimeout)
+	defer cancel()
+	if err := l.TakeContext(ctx); err != nil {
+		return nil, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 5},
+			Message:      "Destination is throttled, try again later",
+			TargetName:   "remote",
+			Err:          err,
+			Misc: map[string]interface{}{
+				"throttle_key": key,
+			},
+		}
+	}
+	return l, nil
+}
+
+func (t *throttler) release(key string, l *limiters.Adaptive) {
+	if t == nil || l == nil {
+		return
+	}
+	l.Release()
+
+	t.destsLock.Lock()
+	defer t.destsLock.Unlock()
+
+	// Drop the limiter once the destination is fully recovered.
+	if t.dests[key] == l && l.Idle() {
+		t.log.Msg("destination is no longer throttled", "throttle_key", key)
+		delete(t.dests, key)
+		t.updateMetrics(key, nil)
+	}
+}
+
+// backoff reduces the limits for the destination.
+func (t *throttler) backoff(key string) {
+	if t == nil {
+		return
+	}
+
+	t.destsLock.Lock()
+	defer t.destsLock.Unlock()
+
+	l := t.dests[key]
+	if l == nil {
+		l = limiters.NewAdaptive(t.maxConcurrency, t.maxRate, t.minRate, t.increaseAfter)
+		t.dests[key] = l
+	}
+	l.Backoff()
+	t.updateMetrics(key, l)
+
+	conc, rate := l.Limits()
+	t.log.Msg("throttling destination", "throttle_key", key, "concurrency", conc, "rate", rate)
+}
+
+// success reports the successful delivery to the destination, eventually
+// raising the limits.
+func (t *throttler) success(key string) {
+	if t == nil {
+		return
+	}
+
+	t.destsLock.Lock()
+	defer t.destsLock.Unlock()
+
+	l := t.dests[key]
+	if l == nil {
+		return
+	}
+	l.Success()
+	t.updateMetrics(key, l)
+}
+
+// report updates the limits depending on the delivery result.
+func (t *throttler) report(key string, err error) {
+	if err == nil {
+		t.success(key)
+		return
+	}
+	if isThrottleErr(err) {
+		t.backoff(key)
+	}
+}
+
+func (t *throttler) close() {
+	if t == nil {
+		return
+	}
+
+	t.destsLock.Lock()
+	defer t.destsLock.Unlock()
+	for key, l := range t.dests {
+		l.Close()
+		t.updateMetrics(key, nil)
+	}
+	t.dests = map[string]*limiters.Adaptive{}
+}
@@ -0,0 +1,241 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testThrottler(t *testing.T, children ...config.Node) *throttler {
+	t.Helper()
+	thr, err := throttlingDirective(config.NewMap(nil, config.Node{}), config.Node{
+		Children: children,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := thr.(*throttler)
+	th.modName = "remote"
+	th.log = testutils.Logger(t, "remote")
+	return th
+}
+
+func checkThrottleLimits(t *testing.T, th *throttler, key string, expectConc int, expectRate float64) {
+	t.Helper()
+
+	th.destsLock.Lock()
+	defer th.destsLock.Unlock()
+	l := th.dests[key]
+	if expectConc == 0 {
+		if l != nil {
+			t.Fatalf("%s is throttled", key)
+		}
+		return
+	}
+	if l == nil {
+		t.Fatalf("%s is not throttled", key)
+	}
+	conc, rate := l.Limits()
+	if conc != expectConc || rate != expectRate {
+		t.Fatalf("wrong limits for %s: %d, %v (want %d, %v)", key, conc, rate, expectConc, expectRate)
+	}
+}
+
+func TestRemoteDelivery_Throttling(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.throttle = testThrottler(t,
+		config.Node{Name: "max_concurrency", Args: []string{"4"}},
+		config.Node{Name: "max_rate", Args: []string{"1000"}},
+		config.Node{Name: "min_rate", Args: []string{"100"}},
+		config.Node{Name: "increase_after", Args: []string{"1"}},
+	)
+	defer tgt.Close()
+
+	// Not throttled until the first "slow down" response.
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	checkThrottleLimits(t, tgt.throttle, "example.invalid", 0, 0)
+
+	be.RcptErr = map[string]error{
+		"test@example.invalid": &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Slow down",
+		},
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"}); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	checkThrottleLimits(t, tgt.throttle, "example.invalid", 2, 500)
+
+	// Other errors do not affect the limits.
+	be.RcptErr = map[string]error{
+		"test@example.invalid": &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Try again later",
+		},
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"}); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	checkThrottleLimits(t, tgt.throttle, "example.invalid", 2, 500)
+
+	// Limits are raised slowly after successful deliveries.
+	be.RcptErr = nil
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	checkThrottleLimits(t, tgt.throttle, "example.invalid", 3, 600)
+
+	for i := 0; i < 4; i++ {
+		testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	}
+	// Back to the maximum values, limiter is removed.
+	checkThrottleLimits(t, tgt.throttle, "example.invalid", 0, 0)
+}
+
+func TestRemoteDelivery_Throttling_MX(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.throttle = testThrottler(t,
+		config.Node{Name: "key", Args: []string{"mx"}},
+		config.Node{Name: "max_concurrency", Args: []string{"4"}},
+		config.Node{Name: "max_rate", Args: []string{"60", "1m"}},
+	)
+	defer tgt.Close()
+
+	be.MailErr = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 28},
+		Message:      "Mail flood detected",
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"}); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	checkThrottleLimits(t, tgt.throttle, "mx.example.invalid.", 2, 0.5)
+	checkThrottleLimits(t, tgt.throttle, "example.invalid", 0, 0)
+}
+
+func TestRemoteDelivery_Throttling_BeforeDial(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	oldTimeout := throttleWaitTimeout
+	throttleWaitTimeout = 50 * time.Millisecond
+	defer func() { throttleWaitTimeout = oldTimeout }()
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.throttle = testThrottler(t,
+		config.Node{Name: "max_concurrency", Args: []string{"2"}},
+		config.Node{Name: "max_rate", Args: []string{"1000"}},
+	)
+	dials := 0
+	dialer := tgt.dialer
+	tgt.dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		return dialer(ctx, network, addr)
+	}
+	defer tgt.Close()
+
+	// Concurrency is lowered to 1 and the only slot is in use.
+	tgt.throttle.backoff("example.invalid")
+	checkThrottleLimits(t, tgt.throttle, "example.invalid", 1, 500)
+	l, err := tgt.throttle.take(context.Background(), "example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"}); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if dials != 0 {
+		t.Fatal("Connection is opened to the throttled destination")
+	}
+
+	tgt.throttle.release("example.invalid", l)
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	if dials != 1 {
+		t.Fatal("Wrong amount of connections:", dials)
+	}
+}
+
+func TestThrottlingDirective(t *testing.T) {
+	for _, args := range [][]string{
+		{"0"},
+		{"1", "2", "3"},
+		{"1", "0s"},
+		{"foo"},
+	} {
+		_, err := throttlingDirective(config.NewMap(nil, config.Node{}), config.Node{
+			Children: []config.Node{{Name: "max_rate", Args: args}},
+		})
+		if err == nil {
+			t.Errorf("Expected an error for max_rate %v", args)
+		}
+	}
+
+	_, err := throttlingDirective(config.NewMap(nil, config.Node{}), config.Node{
+		Children: []config.Node{
+			{Name: "max_rate", Args: []string{"1", "1m"}},
+			{Name: "min_rate", Args: []string{"1", "1s"}},
+		},
+	})
+	if err == nil {
+		t.Error("Expected an error for min_rate > max_rate")
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/aggreport"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
+)
+
+// tlsReportingPolicy is implemented by delivery policies that can be included
+// in TLS reports (RFC 8460).
+type tlsReportingPolicy interface {
+	// tlsrptPolicy returns the policy applied to the MX or nil if there is
+	// none. Non-empty ResultType is returned if the connection would fail if
+	// the policy was enforced (e.g. MTA-STS in testing mode).
+	tlsrptPolicy(ctx context.Context, domain, mx string) (*tlsrpt.Policy, tlsrpt.ResultType)
+}
+
+// tlsReporter collects the results of TLS negotiation and periodically sends
+// aggregate reports to policy domains that request them.
+type tlsReporter struct {
+	rt *Target
+
+	orgName     string
+	contactInfo string
+	from        string
+	deliverTo   module.DeliveryTarget
+	stateFile   string
+
+	collector *aggreport.Collector
+	sender    *aggreport.Sender
+}
+
+func tlsReportingDirective(m *config.Map, node config.Node) (interface{}, error) {
+	r := &tlsReporter{}
+
+	cfg := config.NewMap(m.Globals, node)
+	cfg.String("organization", false, false, "", &r.orgName)
+	cfg.String("contact_info", false, false, "", &r.contactInfo)
+	cfg.String("from", false, true, "", &r.from)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &r.deliverTo)
+	cfg.String("state_file", false, false, "", &r.stateFile)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if r.contactInfo == "" {
+		r.contactInfo = r.from
+	}
+	return r, nil
+}
+
+func (r *tlsReporter) start(rt *Target) error {
+	r.rt = rt
+	if r.orgName == "" {
+		r.orgName = rt.hostname
+	}
+	if r.stateFile == "" {
+		r.stateFile = "tlsrpt_" + rt.name + ".json"
+	}
+	if !filepath.IsAbs(r.stateFile) {
+		r.stateFile = filepath.Join(config.StateDirectory, r.stateFile)
+	}
+	r.collector = aggreport.NewCollector(time.Now(), tlsrpt.NewResults)
+	r.sender = &aggreport.Sender{
+		Kind:      "TLS",
+		Log:       rt.Log,
+		From:      r.from,
+		DeliverTo: r.deliverTo,
+		StateFile: r.stateFile,
+		Collector: r.collector,
+		Prepare:   r.prepareReports,
+	}
+
+	if err := r.sender.Start(); err != nil {
+		return fmt.Errorf("remote: failed to load TLS reporting state: %w", err)
+	}
+	return nil
+}
+
+func (r *tlsReporter) close() error {
+	if err := r.sender.Close(); err != nil {
+		return fmt.Errorf("remote: failed to save TLS reporting state: %w", err)
+	}
+	return nil
+}
+
+// record updates the results collected for the current reporting period.
+func (r *tlsReporter) record(f func(res *tlsrpt.Results)) {
+	r.collector.Update(func(res aggreport.Results) {
+		f(res.(*tlsrpt.Results))
+	})
+}
+
+// prepareReports generates reports for the period ending at now.
+func (r *tlsReporter) prepareReports(ctx context.Context, now time.Time) []aggreport.Message {
+	start, collected := r.collector.Flush(now)
+	period := tlsrpt.DateRange{Start: start, End: now}
+	results := collected.(*tlsrpt.Results).ByDomain()
+
+	var msgs []aggreport.Message
+	for domain, policies := range results {
+		rec, err := tlsrpt.LookupRecord(ctx, r.rt.resolver, domain)
+		if err != nil {
+			if errors.Is(err, tlsrpt.ErrNoRecord) {
+				r.rt.Log.DebugMsg("no TLS reporting policy, discarding results", "domain", domain)
+			} else {
+				r.rt.Log.Error("failed to lookup TLS reporting policy", err, "domain", domain)
+			}
+			continue
+		}
+
+		report := tlsrpt.Report{
+			OrganizationName: r.orgName,
+			DateRange:        period,
+			ContactInfo:      r.contactInfo,
+			ReportID:         fmt.Sprintf("%d.%s@%s", period.Start.Unix(), domain, r.rt.hostname),
+			Policies:         policies,
+		}
+
+		for _, rua := range rec.RUA {
+			rcpt, err := aggreport.ParseMailtoURI(rua)
+			switch {
+			case err == nil:
+			case errors.Is(err, aggreport.ErrUnsupportedURI) && strings.HasPrefix(rua, "https:"):
+				// TODO: Implement HTTPS upload (RFC 8460 Section 5.4).
+				r.rt.Log.Msg("HTTPS TLS report submission is not supported, skipping", "domain", domain, "uri", rua)
+				continue
+			case errors.Is(err, aggreport.ErrUnsupportedURI):
+				r.rt.Log.Msg("unknown TLS report URI scheme, skipping", "domain", domain, "uri", rua)
+				continue
+			default:
+				r.rt.Log.Error("malformed TLS report URI", err, "domain", domain, "uri", rua)
+				continue
+			}
+
+			msg, err := r.reportMessage(rcpt, domain, report)
+			if err != nil {
+				r.rt.Log.Error("failed to generate TLS report", err, "domain", domain, "uri", rua)
+				continue
+			}
+			msg.URI = rua
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+func (r *tlsReporter) reportMessage(rcpt, domain string, report tlsrpt.Report) (aggreport.Message, error) {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return aggreport.Message{}, err
+	}
+
+	var body bytes.Buffer
+	header, err := tlsrpt.GenerateMessage(tlsrpt.Envelope{
+		MsgID:        "<" + msgID + "@" + r.rt.hostname + ">",
+		From:         r.from,
+		To:           rcpt,
+		Submitter:    r.rt.hostname,
+		PolicyDomain: domain,
+	}, report, &body)
+	if err != nil {
+		return aggreport.Message{}, err
+	}
+
+	return aggreport.Message{
+		ID:       msgID,
+		Rcpt:     rcpt,
+		Domain:   domain,
+		ReportID: report.ReportID,
+		Header:   header,
+		Body:     body.Bytes(),
+	}, nil
+}
+
+// tlsrptResult refines the failure reason reported by the policy using the
+// TLS handshake error. E.g. the policy sees only that TLS is not used, while
+// the actual reason is the invalid certificate.
+func tlsrptResult(result tlsrpt.ResultType, tlsErr error) tlsrpt.ResultType {
+	switch result {
+	case "", tlsrpt.ResultSTARTTLSNotSupported, tlsrpt.ResultCertificateNotTrusted:
+	default:
+		return result
+	}
+
+	var (
+		hostErr x509.HostnameError
+		certErr x509.CertificateInvalidError
+		authErr x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.As(tlsErr, &hostErr):
+		return tlsrpt.ResultCertificateHostMismatch
+	case errors.As(tlsErr, &certErr) && certErr.Reason == x509.Expired:
+		return tlsrpt.ResultCertificateExpired
+	case errors.As(tlsErr, &certErr), errors.As(tlsErr, &authErr):
+		return tlsrpt.ResultCertificateNotTrusted
+	case result == "":
+		return tlsrpt.ResultValidationFailure
+	}
+	return result
+}
+
+// reportTLS records the result of the connection attempt for TLS reporting.
+//
+// failedPolicy is the policy that rejected the connection (policyErr is the
+// returned error) or nil if the connection was accepted.
+func (rd *remoteDelivery) reportTLS(ctx context.Context, domain, mx string, failedPolicy module.DeliveryMXAuthPolicy, policyErr, tlsErr error) {
+	r := rd.rt.tlsReporter
+	if r == nil {
+		return
+	}
+	mx = strings.TrimSuffix(mx, ".")
+
+	details := tlsrpt.FailureDetails{
+		ReceivingMXHostname: mx,
+	}
+	if tlsErr != nil {
+		details.FailureReasonCode = tlsErr.Error()
+	}
+
+	if failedPolicy != nil {
+		rp, ok := failedPolicy.(tlsReportingPolicy)
+		if !ok {
+			return
+		}
+		policy, _ := rp.tlsrptPolicy(ctx, domain, mx)
+		if policy == nil {
+			return
+		}
+		result, _ := exterrors.Fields(policyErr)["tlsrpt_result"].(tlsrpt.ResultType)
+		details.ResultType = tlsrptResult(result, tlsErr)
+		r.record(func(res *tlsrpt.Results) {
+			res.Failure(*policy, details)
+		})
+		return
+	}
+
+	reported := false
+	for _, p := range rd.policies {
+		rp, ok := p.(tlsReportingPolicy)
+		if !ok {
+			continue
+		}
+		policy, testFailure := rp.tlsrptPolicy(ctx, domain, mx)
+		if policy == nil {
+			continue
+		}
+		reported = true
+
+		if testFailure != "" {
+			details.ResultType = tlsrptResult(testFailure, tlsErr)
+			r.record(func(res *tlsrpt.Results) {
+				res.Failure(*policy, details)
+			})
+			continue
+		}
+		r.record(func(res *tlsrpt.Results) {
+			res.Success(*policy)
+		})
+	}
+
+	if !reported {
+		r.record(func(res *tlsrpt.Results) {
+			res.Success(tlsrpt.Policy{
+				Type:   tlsrpt.PolicyNoPolicyFound,
+				Domain: domain,
+			})
+		})
+	}
+}
@@ -0,0 +1,241 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package remote
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/go-mtasts"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/foxcpp/maddy/internal/tlsrpt"
+)
+
+func TestRemoteDelivery_TLSReporting(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"example2.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"_smtp._tls.example.invalid.": {
+			TXT: []string{"v=TLSRPTv1; rua=mailto:tlsrpt@example.invalid"},
+		},
+	}
+
+	mtastsGet := func(ctx context.Context, domain string) (*mtasts.Policy, error) {
+		switch domain {
+		case "example.invalid":
+			return &mtasts.Policy{
+				Mode:   mtasts.ModeTesting,
+				MaxAge: 86400,
+				MX:     []string{"mx.example.invalid"},
+			}, nil
+		case "example2.invalid":
+			return &mtasts.Policy{
+				Mode:   mtasts.ModeTesting,
+				MaxAge: 86400,
+				MX:     []string{"mx4.example.invalid"}, // not mx.example.invalid!
+			}, nil
+		}
+		return nil, errors.New("Wrong domain in lookup")
+	}
+
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	reportTgt := testutils.Target{}
+	start := time.Now()
+	tgt := testTarget(t, zones, nil, []module.MXAuthPolicy{
+		testSTSPolicy(t, zones, mtastsGet),
+	})
+	tgt.tlsConfig = clientCfg
+	tgt.tlsReporter = &tlsReporter{
+		orgName:     "Test Org",
+		contactInfo: "postmaster@example.com",
+		from:        "tlsrpt@example.com",
+		deliverTo:   &reportTgt,
+		stateFile:   filepath.Join(dir, "state.json"),
+	}
+	if err := tgt.tlsReporter.start(tgt); err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example2.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.com", []string{"test@example2.invalid"})
+
+	end := start.Add(24 * time.Hour)
+	tgt.tlsReporter.sender.SendReports(end)
+
+	// No policy record for example2.invalid, so only one report is sent.
+	if len(reportTgt.Messages) != 1 {
+		t.Fatalf("wrong amount of reports sent: %d", len(reportTgt.Messages))
+	}
+	msg := reportTgt.Messages[0]
+	if msg.MailFrom != "tlsrpt@example.com" {
+		t.Errorf("wrong report sender: %v", msg.MailFrom)
+	}
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "tlsrpt@example.invalid" {
+		t.Errorf("wrong report recipients: %v", msg.RcptTo)
+	}
+	if msg.Header.Get("TLS-Report-Domain") != "example.invalid" {
+		t.Errorf("wrong TLS-Report-Domain: %v", msg.Header.Get("TLS-Report-Domain"))
+	}
+
+	report := readTLSReport(t, msg)
+	if report.OrganizationName != "Test Org" || report.ContactInfo != "postmaster@example.com" {
+		t.Errorf("wrong reporting organization: %v, %v", report.OrganizationName, report.ContactInfo)
+	}
+	if !report.DateRange.End.Equal(end) {
+		t.Errorf("wrong report period end: %v", report.DateRange.End)
+	}
+	if len(report.Policies) != 1 {
+		t.Fatalf("wrong amount of policies: %+v", report.Policies)
+	}
+	res := report.Policies[0]
+	wantPolicy := tlsrpt.Policy{
+		Type:   tlsrpt.PolicySTS,
+		String: []string{"version: STSv1", "mode: testing", "mx: mx.example.invalid", "max_age: 86400"},
+		Domain: "example.invalid",
+		MXHost: []string{"mx.example.invalid"},
+	}
+	if strings.Join(res.Policy.String, "\n") != strings.Join(wantPolicy.String, "\n") ||
+		res.Policy.Type != wantPolicy.Type || res.Policy.Domain != wantPolicy.Domain {
+		t.Errorf("wrong policy: %+v", res.Policy)
+	}
+	if res.Summary != (tlsrpt.Summary{TotalSuccessful: 1}) {
+		t.Errorf("wrong summary: %+v", res.Summary)
+	}
+}
+
+func TestRemoteDelivery_TLSReporting_Failure(t *testing.T) {
+	_, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	mtastsGet := func(ctx context.Context, domain string) (*mtasts.Policy, error) {
+		return &mtasts.Policy{
+			Mode: mtasts.ModeEnforce,
+			MX:   []string{"mx.example.invalid"},
+		}, nil
+	}
+
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	// Server certificate is not trusted by the client.
+	tgt := testTarget(t, zones, nil, []module.MXAuthPolicy{
+		testSTSPolicy(t, zones, mtastsGet),
+	})
+	tgt.tlsReporter = &tlsReporter{
+		from:      "tlsrpt@example.com",
+		deliverTo: &testutils.Target{},
+		stateFile: filepath.Join(dir, "state.json"),
+	}
+	if err := tgt.tlsReporter.start(tgt); err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Close()
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if be.MailFromCounter != 0 {
+		t.Fatal("MAIL FROM issued for server failing authentication")
+	}
+
+	_, collected := tgt.tlsReporter.collector.Flush(time.Now())
+	results := collected.(*tlsrpt.Results).ByDomain()
+	res := results["example.invalid"]
+	if len(res) != 1 {
+		t.Fatalf("wrong results: %+v", results)
+	}
+	if res[0].Summary != (tlsrpt.Summary{TotalFailure: 1}) {
+		t.Errorf("wrong summary: %+v", res[0].Summary)
+	}
+	if len(res[0].FailureDetails) != 1 {
+		t.Fatalf("wrong failure details: %+v", res[0].FailureDetails)
+	}
+	details := res[0].FailureDetails[0]
+	if details.ResultType != tlsrpt.ResultCertificateNotTrusted {
+		t.Errorf("wrong result type: %v", details.ResultType)
+	}
+	if details.ReceivingMXHostname != "mx.example.invalid" {
+		t.Errorf("wrong MX hostname: %v", details.ReceivingMXHostname)
+	}
+}
+
+func readTLSReport(t *testing.T, msg testutils.Msg) tlsrpt.Report {
+	t.Helper()
+
+	ct := msg.Header.Get("Content-Type")
+	boundary := ct[strings.Index(ct, "boundary=")+len("boundary="):]
+	mr := textproto.NewMultipartReader(strings.NewReader(string(msg.Body)), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal("no report attachment:", err)
+		}
+		if !strings.HasPrefix(part.Header.Get("Content-Type"), "application/tlsrpt+gzip") {
+			continue
+		}
+
+		gzr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var report tlsrpt.Report
+		if err := json.NewDecoder(gzr).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+}
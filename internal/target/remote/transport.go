@@ -0,0 +1,222 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// transportRoute describes how messages for the recipient domain are
+// delivered, as configured using the transport table. Zero value means the
+// usual delivery to MX servers.
+type transportRoute struct {
+	// Server to connect to instead of MX servers.
+	host string
+	port string
+
+	// Delivery target (usually target.smtp) to pass messages to.
+	targetName string
+	target     module.DeliveryTarget
+}
+
+func transportTargetsDirective(m *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one argument is required")
+	}
+
+	targets := make(map[string]module.DeliveryTarget, len(node.Args))
+	for _, arg := range node.Args {
+		if !strings.HasPrefix(arg, "&") {
+			return nil, config.NodeErr(node, "configuration block reference is expected, got %s", arg)
+		}
+		tgt, err := modconfig.DeliveryTarget(m.Globals, []string{arg}, node)
+		if err != nil {
+			return nil, err
+		}
+		targets[arg[1:]] = tgt
+	}
+	return targets, nil
+}
+
+// parseRoute parses the transport table value. It is either a reference to
+// the configuration block listed in transport_targets (&name) or the
+// server address (host or host:port).
+func (rt *Target) parseRoute(value string) (transportRoute, error) {
+	if strings.HasPrefix(value, "&") {
+		name := value[1:]
+		tgt, ok := rt.transportTargets[name]
+		if !ok {
+			return transportRoute{}, &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 5},
+				Message:      "Misconfigured transport for the destination domain",
+				TargetName:   "remote",
+				Reason:       "target is not listed in transport_targets",
+				Misc: map[string]interface{}{
+					"transport": value,
+				},
+			}
+		}
+		return transportRoute{targetName: name, target: tgt}, nil
+	}
+
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		// No port.
+		host = strings.Trim(value, "[]")
+		port = smtpPort
+	}
+	if host == "" || port == "" {
+		return transportRoute{}, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 5},
+			Message:      "Misconfigured transport for the destination domain",
+			TargetName:   "remote",
+			Reason:       "malformed server address",
+			Misc: map[string]interface{}{
+				"transport": value,
+			},
+		}
+	}
+	return transportRoute{host: host, port: port}, nil
+}
+
+// lookupTransport checks the transport table for the recipient domain.
+func (rt *Target) lookupTransport(domain string) (transportRoute, error) {
+	if rt.transport == nil {
+		return transportRoute{}, nil
+	}
+
+	key, err := dns.ForLookup(domain)
+	if err != nil {
+		return transportRoute{}, err
+	}
+	value, ok, err := rt.transport.Lookup(key)
+	if err != nil {
+		return transportRoute{}, &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal error during transport lookup",
+			TargetName:   "remote",
+			Err:          err,
+		}
+	}
+	if !ok || value == "" {
+		return transportRoute{}, nil
+	}
+
+	return rt.parseRoute(value)
+}
+
+// relayDelivery is the delivery to the target from transport_targets for
+// all recipients routed to it.
+type relayDelivery struct {
+	module.Delivery
+	rcpts []string
+
+	// The delivery is committed (or aborted) by body.
+	done bool
+}
+
+// relayStatus saves statuses set by the relay target until it is committed.
+type relayStatus struct {
+	lock sync.Mutex
+	errs map[string]error
+}
+
+func (s *relayStatus) SetStatus(rcptTo string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errs[rcptTo] = err
+}
+
+func (rd *remoteDelivery) addRelayRcpt(ctx context.Context, route transportRoute, to string) error {
+	rel, ok := rd.relays[route.targetName]
+	if !ok {
+		delivery, err := route.target.Start(ctx, rd.msgMeta, rd.mailFrom)
+		if err != nil {
+			return err
+		}
+		rel = &relayDelivery{Delivery: delivery}
+		rd.relays[route.targetName] = rel
+	}
+
+	if err := rel.AddRcpt(ctx, to); err != nil {
+		return err
+	}
+	rel.rcpts = append(rel.rcpts, to)
+	return nil
+}
+
+// body sends the message to the relay target and commits the delivery.
+//
+// The message is already sent to MX servers at this point, so the relay
+// delivery is committed here too instead of remoteDelivery.Commit. This way
+// the commit error is reported only for recipients routed to the target.
+func (rel *relayDelivery) body(ctx context.Context, l log.Logger, name string, c module.StatusCollector, header textproto.Header, b buffer.Buffer) {
+	if len(rel.rcpts) == 0 {
+		return
+	}
+
+	status := relayStatus{errs: make(map[string]error, len(rel.rcpts))}
+	if partDelivery, ok := rel.Delivery.(module.PartialDelivery); ok {
+		partDelivery.BodyNonAtomic(ctx, &status, header, b)
+	} else {
+		err := rel.Body(ctx, header, b)
+		for _, rcpt := range rel.rcpts {
+			status.SetStatus(rcpt, err)
+		}
+	}
+
+	accepted := false
+	for _, rcpt := range rel.rcpts {
+		if status.errs[rcpt] == nil {
+			accepted = true
+		}
+	}
+
+	rel.done = true
+	if !accepted {
+		if err := rel.Abort(ctx); err != nil {
+			l.Error("transport target abort failed", err, "transport_target", name)
+		}
+	} else if err := rel.Commit(ctx); err != nil {
+		for _, rcpt := range rel.rcpts {
+			if status.errs[rcpt] == nil {
+				status.errs[rcpt] = err
+			}
+		}
+	}
+
+	for _, rcpt := range rel.rcpts {
+		c.SetStatus(rcpt, status.errs[rcpt])
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestRemoteDelivery_TransportHost(t *testing.T) {
+	port, _ := strconv.Atoi(smtpPort)
+	relayPort := strconv.Itoa(port - 1)
+
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	relayBe, relaySrv := testutils.SMTPServer(t, "127.0.0.1:"+relayPort)
+	defer relaySrv.Close()
+	defer testutils.CheckSMTPConnLeak(t, relaySrv)
+
+	zones := map[string]mockdns.Zone{
+		"example.invalid.": {
+			// Should not be used.
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"relay.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"example.org.invalid.": {
+			MX: []net.MX{{Host: "mx.example.org.invalid.", Pref: 10}},
+		},
+		"mx.example.org.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.transport = testutils.Table{M: map[string]string{
+		"example.invalid": "relay.example.invalid:" + relayPort,
+	}}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	relayBe.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+
+	// Not in the table, MX is used.
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.org.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.org.invalid"})
+
+	if len(be.Messages) != 1 || len(relayBe.Messages) != 1 {
+		t.Fatal("wrong amount of messages:", len(be.Messages), len(relayBe.Messages))
+	}
+}
+
+func TestRemoteDelivery_TransportTarget(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.org.invalid.": {
+			MX: []net.MX{{Host: "mx.example.org.invalid.", Pref: 10}},
+		},
+		"mx.example.org.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	partner := testutils.Target{}
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.transport = testutils.Table{M: map[string]string{
+		"example.invalid":  "&partner",
+		"broken.invalid":   "&unknown",
+		"broken2.invalid":  "[::1]:",
+		"example2.invalid": "&partner",
+	}}
+	tgt.transportTargets = map[string]module.DeliveryTarget{
+		"partner": &partner,
+	}
+	defer tgt.Close()
+
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{
+		"test@example.invalid", "test@example2.invalid", "test@example.org.invalid",
+	})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.org.invalid"})
+	if len(partner.Messages) != 1 {
+		t.Fatal("wrong amount of messages passed to transport target:", len(partner.Messages))
+	}
+	testutils.CheckMsg(t, &partner.Messages[0], "test@example.com", []string{"test@example.invalid", "test@example2.invalid"})
+
+	for _, rcpt := range []string{"test@broken.invalid", "test@broken2.invalid"} {
+		delivery, err := tgt.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "test@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = delivery.AddRcpt(context.Background(), rcpt)
+		if err == nil {
+			t.Fatal("Expected an error, got none")
+		}
+		if !exterrors.IsTemporary(err) {
+			t.Error("Misconfigured transport error should be temporary:", err)
+		}
+		if err := delivery.Abort(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRemoteDelivery_TransportHost_Policies(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	srv.EnableREQUIRETLS = true
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"relay.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+	requireTLS := &module.MsgMetadata{
+		OriginalFrom: "test@example.com",
+		SMTPOpts: smtp.MailOptions{
+			RequireTLS: true,
+		},
+	}
+
+	// Configured server is accepted for REQUIRETLS messages if its
+	// certificate is valid, even though there is no MX record to
+	// authenticate.
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.tlsConfig = clientCfg
+	tgt.transport = testutils.Table{M: map[string]string{
+		"example.invalid": "relay.example.invalid:" + smtpPort,
+	}}
+	testutils.DoTestDeliveryMeta(t, tgt, "test@example.com", []string{"test@example.invalid"}, requireTLS)
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+	tgt.Close()
+
+	// local_policy decides whether it satisfies min_mx_level.
+	tgt = testTarget(t, zones, nil, []module.MXAuthPolicy{
+		&localPolicy{minMXLevel: module.MX_MTASTS},
+	})
+	tgt.tlsConfig = clientCfg
+	tgt.transport = testutils.Table{M: map[string]string{
+		"example.invalid": "relay.example.invalid:" + smtpPort,
+	}}
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	tgt.Close()
+
+	tgt = testTarget(t, zones, nil, []module.MXAuthPolicy{
+		&localPolicy{minMXLevel: module.MX_MTASTS, trustTransport: true},
+	})
+	tgt.tlsConfig = clientCfg
+	tgt.transport = testutils.Table{M: map[string]string{
+		"example.invalid": "relay.example.invalid:" + smtpPort,
+	}}
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.com", []string{"test@example.invalid"})
+	tgt.Close()
+}
+
+func TestRemoteDelivery_TransportHost_REQUIRETLS(t *testing.T) {
+	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+smtpPort)
+	srv.EnableREQUIRETLS = true
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		// The test certificate is not valid for this name.
+		"relay.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.tlsConfig = clientCfg
+	tgt.transport = testutils.Table{M: map[string]string{
+		"example.invalid": "relay.example.org:" + smtpPort,
+	}}
+	defer tgt.Close()
+
+	_, err := testutils.DoTestDeliveryErrMeta(t, tgt, "test@example.com", []string{"test@example.invalid"}, &module.MsgMetadata{
+		OriginalFrom: "test@example.com",
+		SMTPOpts: smtp.MailOptions{
+			RequireTLS: true,
+		},
+	})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 7, 30},
+		"TLS it not available or unauthenticated but required (REQUIRETLS)")
+	if be.MailFromCounter != 0 {
+		t.Fatal("MAIL FROM issued for server failing authentication")
+	}
+
+	// Messages without REQUIRETLS are still delivered.
+	testutils.DoTestDelivery(t, tgt, "test@example.com", []string{"test@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.invalid"})
+}
+
+func TestRemoteDelivery_TransportTarget_CommitErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+	zones := map[string]mockdns.Zone{
+		"example.org.invalid.": {
+			MX: []net.MX{{Host: "mx.example.org.invalid.", Pref: 10}},
+		},
+		"mx.example.org.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+
+	partner := testutils.Target{
+		CommitErr: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 0, 0},
+			Message:      "Commit failed",
+		},
+	}
+	tgt := testTarget(t, zones, nil, nil)
+	tgt.transport = testutils.Table{M: map[string]string{
+		"example.invalid": "&partner",
+	}}
+	tgt.transportTargets = map[string]module.DeliveryTarget{
+		"partner": &partner,
+	}
+	defer tgt.Close()
+
+	// Commit error is reported only for recipients routed to the target.
+	c := multipleErrs{
+		errs: map[string]error{},
+	}
+	testutils.DoTestDeliveryNonAtomic(t, &c, tgt, "test@example.com", []string{
+		"test@example.invalid", "test@example.org.invalid",
+	})
+	testutils.CheckSMTPErr(t, c.errs["test@example.invalid"], 451, exterrors.EnhancedCode{4, 0, 0}, "Commit failed")
+	if err := c.errs["test@example.org.invalid"]; err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	be.CheckMsg(t, 0, "test@example.com", []string{"test@example.org.invalid"})
+}
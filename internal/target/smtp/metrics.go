@@ -0,0 +1,67 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	upstreamUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "upstream_up",
+			Help:      "Whether the upstream server is in rotation",
+		},
+		[]string{"module", "upstream"},
+	)
+	upstreamConns = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "upstream_connections",
+			Help:      "Amount of connections to the upstream server used for deliveries",
+		},
+		[]string{"module", "upstream"},
+	)
+	upstreamFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "upstream_failures_total",
+			Help:      "Failed connection attempts to the upstream server",
+		},
+		[]string{"module", "upstream"},
+	)
+	upstreamDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "smtp_downstream",
+			Name:      "upstream_deliveries_total",
+			Help:      "Deliveries started using the upstream server",
+		},
+		[]string{"module", "upstream"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamUp)
+	prometheus.MustRegister(upstreamConns)
+	prometheus.MustRegister(upstreamFailures)
+	prometheus.MustRegister(upstreamDeliveries)
+}
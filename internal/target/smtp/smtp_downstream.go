@@ -33,6 +33,9 @@ import (
 	"fmt"
 	"net"
 	"runtime/trace"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -43,6 +46,7 @@ import (
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/net/idna"
 )
@@ -59,6 +63,23 @@ type Downstream struct {
 	endpoints       []config.Endpoint
 	saslFactory     saslClientFactory
 	tlsConfig       tls.Config
+	proxies         smtpconn.ProxyTable
+
+	// Credentials depend on the message, connections cannot be shared.
+	authPerMsg bool
+
+	// Load balancing and passive health checks, see upstream.go.
+	balance       string
+	weights       map[string]int
+	maxFails      int
+	failCooldown  time.Duration
+	upstreamsOnce sync.Once
+	upstreamsLock sync.Mutex
+	upstreams     []*upstream
+
+	// Idle connections cache, nil if connections are not reused.
+	pool           *pool.P
+	connReuseLimit int
 
 	log log.Logger
 }
@@ -92,15 +113,57 @@ func (u *Downstream) Init(cfg *config.Map) error {
 	cfg.StringList("targets", false, false, nil, &targetsArg)
 	cfg.Custom("auth", false, false, func() (interface{}, error) {
 		return nil, nil
-	}, saslAuthDirective, &u.saslFactory)
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		u.authPerMsg = len(node.Args) != 0 && node.Args[0] == "forward"
+		return saslAuthDirective(m, node)
+	}, &u.saslFactory)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return tls.Config{}, nil
 	}, tls2.TLSClientBlock, &u.tlsConfig)
+	cfg.Callback("proxy", u.proxies.ProxyDirective)
+	cfg.Enum("balance", false, false, []string{balanceFirst, balanceRoundRobin, balanceLeastConn}, balanceFirst, &u.balance)
+	cfg.Callback("weight", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected two arguments: target and weight")
+		}
+		endp, err := config.ParseEndpoint(node.Args[0])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		weight, err := strconv.Atoi(node.Args[1])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		if weight <= 0 {
+			return config.NodeErr(node, "weight should be positive")
+		}
+		if u.weights == nil {
+			u.weights = map[string]int{}
+		}
+		u.weights[endp.String()] = weight
+		return nil
+	})
+	cfg.Int("health_max_fails", false, false, 3, &u.maxFails)
+	cfg.Duration("health_cooldown", false, false, 30*time.Second, &u.failCooldown)
+
+	poolCfg := pool.Config{
+		MaxKeys:             5000,
+		MaxConnsPerKey:      10,
+		MaxConnLifetimeSec:  150,
+		StaleKeyLifetimeSec: 60 * 5,
+	}
+	cfg.Int("conn_reuse_limit", false, false, 0, &u.connReuseLimit)
+	cfg.Int("conn_max_idle_count", false, false, 10, &poolCfg.MaxConnsPerKey)
+	cfg.Int64("conn_max_idle_time", false, false, 150, &poolCfg.MaxConnLifetimeSec)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	if u.connReuseLimit > 0 && !u.authPerMsg {
+		u.pool = pool.New(poolCfg)
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	var err error
 	u.hostname, err = idna.ToASCII(u.hostname)
@@ -122,6 +185,27 @@ func (u *Downstream) Init(cfg *config.Map) error {
 		return fmt.Errorf("%s: at least one target endpoint is required", u.modName)
 	}
 
+	for endpStr := range u.weights {
+		found := false
+		for _, endp := range u.endpoints {
+			if endp.String() == endpStr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: weight is specified for unknown target: %s", u.modName, endpStr)
+		}
+	}
+	u.upstreamsOnce.Do(u.initUpstreams)
+
+	return nil
+}
+
+func (u *Downstream) Close() error {
+	if u.pool != nil {
+		u.pool.Close()
+	}
 	return nil
 }
 
@@ -141,7 +225,10 @@ type delivery struct {
 	mailFrom string
 	rcpts    []string
 
-	conn *smtpconn.C
+	conn *upstreamConn
+	// Whether the server supports the DSN extension, saved since conn can be
+	// reused by other deliveries after Commit.
+	dsn bool
 }
 
 // lmtpDelivery implements module.PartialDelivery
@@ -161,9 +248,11 @@ func (u *Downstream) Start(ctx context.Context, msgMeta *module.MsgMetadata, mai
 	if err := d.connect(ctx); err != nil {
 		return nil, err
 	}
+	d.dsn = d.conn.SupportsDSN()
 
 	if err := d.conn.Mail(ctx, mailFrom, msgMeta.SMTPOpts); err != nil {
-		d.conn.Close()
+		d.conn.errored = true
+		d.release()
 		return nil, err
 	}
 
@@ -175,40 +264,40 @@ func (u *Downstream) Start(ctx context.Context, msgMeta *module.MsgMetadata, mai
 }
 
 func (d *delivery) connect(ctx context.Context) error {
-	// TODO: Review possibility of connection pooling here.
 	var lastErr error
 
-	conn := smtpconn.New()
-	conn.Log = d.log
-	conn.Hostname = d.u.hostname
-	conn.AddrInSMTPMsg = false
-
-	for _, endp := range d.u.endpoints {
-		var (
-			didTLS bool
-			err    error
-		)
-		if d.u.lmtp {
-			didTLS, err = conn.ConnectLMTP(ctx, endp, d.u.attemptStartTLS, &d.u.tlsConfig)
-		} else {
-			didTLS, err = conn.Connect(ctx, endp, d.u.attemptStartTLS, &d.u.tlsConfig)
+	for _, up := range d.u.upstreamOrder() {
+		if d.u.pool != nil {
+			pooledConn, err := d.u.pool.Get(ctx, up.endp.String())
+			if err != nil {
+				return err
+			}
+			if pooledConn != nil {
+				d.log.DebugMsg("reusing cached connection", "downstream_server", up.endp.String())
+				d.conn = pooledConn.(*upstreamConn)
+				d.conn.Log = d.log
+				d.u.upstreamAcquired(up, false)
+				return nil
+			}
 		}
+
+		conn, err := d.connectUpstream(ctx, up)
 		if err != nil {
 			if len(d.u.endpoints) != 1 {
-				d.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(endp.Host, endp.Port))
+				d.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(up.endp.Host, up.endp.Port))
 			}
+			d.u.upstreamFailed(up, err)
 			lastErr = err
 			continue
 		}
 
 		d.log.DebugMsg("connected", "downstream_server", conn.ServerName())
-
-		if !didTLS && d.u.requireTLS {
-			conn.Close()
-			lastErr = errors.New("TLS is required, but unsupported by downstream")
-			continue
+		d.u.upstreamAcquired(up, true)
+		d.conn = &upstreamConn{
+			C:          conn,
+			up:         up,
+			reuseLimit: d.u.connReuseLimit,
 		}
-
 		lastErr = nil
 		break
 	}
@@ -219,23 +308,66 @@ func (d *delivery) connect(ctx context.Context) error {
 	if d.u.saslFactory != nil {
 		saslClient, err := d.u.saslFactory(d.msgMeta)
 		if err != nil {
-			conn.Close()
+			d.conn.errored = true
+			d.release()
 			return err
 		}
 
-		if err := conn.Client().Auth(saslClient); err != nil {
-			conn.Close()
+		if err := d.conn.Client().Auth(saslClient); err != nil {
+			d.conn.errored = true
+			d.release()
 			return err
 		}
 	}
 
-	d.conn = conn
+	return nil
+}
+
+func (d *delivery) connectUpstream(ctx context.Context, up *upstream) (*smtpconn.C, error) {
+	conn := smtpconn.New()
+	conn.Log = d.log
+	conn.Hostname = d.u.hostname
+	conn.AddrInSMTPMsg = false
+	conn.Proxy = d.u.proxies.For(up.endp.Host)
+
+	var (
+		didTLS bool
+		err    error
+	)
+	if d.u.lmtp {
+		didTLS, err = conn.ConnectLMTP(ctx, up.endp, d.u.attemptStartTLS, &d.u.tlsConfig)
+	} else {
+		didTLS, err = conn.Connect(ctx, up.endp, d.u.attemptStartTLS, &d.u.tlsConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !didTLS && d.u.requireTLS {
+		conn.Close()
+		return nil, errors.New("TLS is required, but unsupported by downstream")
+	}
+
+	return conn, nil
+}
+
+// release returns the connection to the pool or closes it if it cannot be
+// reused.
+func (d *delivery) release() error {
+	conn := d.conn
+	d.u.upstreamReleased(conn.up)
+	conn.transactions++
 
+	if d.u.pool == nil || conn.errored || conn.transactions > conn.reuseLimit || conn.Client() == nil {
+		return conn.Close()
+	}
+	d.log.DebugMsg("returning connection to pool", "downstream_server", conn.up.endp.String())
+	d.u.pool.Return(conn.up.endp.String(), conn)
 	return nil
 }
 
 func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
-	err := d.conn.Rcpt(ctx, rcptTo)
+	err := d.conn.Rcpt(ctx, rcptTo, d.msgMeta.RcptOptsFor(rcptTo))
 
 	if err != nil {
 		return d.u.moduleError(err)
@@ -252,7 +384,9 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	}
 
 	defer r.Close()
-	return d.u.moduleError(d.conn.Data(ctx, header, r))
+	err = d.conn.Data(ctx, header, r)
+	d.conn.errored = err != nil
+	return d.u.moduleError(err)
 }
 
 func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
@@ -281,6 +415,7 @@ func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollec
 		rcptIndx++
 	})
 	if err != nil {
+		d.conn.errored = true
 		modErr := d.u.moduleError(err)
 		for _, rcpt := range d.rcpts[rcptIndx:] {
 			sc.SetStatus(rcpt, modErr)
@@ -289,12 +424,26 @@ func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollec
 }
 
 func (d *delivery) Abort(ctx context.Context) error {
-	d.conn.Close()
+	d.release()
 	return nil
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
-	return d.conn.Close()
+	return d.release()
+}
+
+// DSNHandover implements module.DSNDelivery.
+//
+// LMTP servers are assumed to perform the final delivery.
+func (d *delivery) DSNHandover(rcptTo string) module.DSNHandover {
+	switch {
+	case d.dsn:
+		return module.DSNPassedOn
+	case d.u.lmtp:
+		return module.DSNDelivered
+	default:
+		return module.DSNRelayed
+	}
 }
 
 func init() {
@@ -174,6 +174,35 @@ func TestDownstreamDelivery_MAILErr(t *testing.T) {
 	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 2}, "Hey")
 }
 
+func TestDownstreamDelivery_RCPTErr(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.RcptErr = map[string]error{
+		"rcpt1@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		log: testutils.Logger(t, "target.smtp"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt1@example.invalid"})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 1}, "No such user")
+}
+
 func TestDownstreamDelivery_AttemptTLS(t *testing.T) {
 	clientCfg, be, srv := testutils.SMTPServerSTARTTLS(t, "127.0.0.1:"+testPort)
 	defer srv.Close()
@@ -0,0 +1,195 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+)
+
+// Load balancing policies, see 'balance' directive.
+const (
+	// Try targets in the configured order.
+	balanceFirst = "first"
+	// Smooth weighted round-robin.
+	balanceRoundRobin = "round_robin"
+	// Prefer the target with the least amount of connections in use
+	// (relative to its weight).
+	balanceLeastConn = "least_conn"
+)
+
+// upstream is a single server from the targets list together with its
+// load balancing and health state.
+//
+// Passive health checks are implemented as follows: after maxFails
+// consecutive connection failures the upstream is taken out of rotation for
+// failCooldown. After that, it is used again, but a single failure puts it
+// back out of rotation. The first successful connection resets the state.
+type upstream struct {
+	endp   config.Endpoint
+	weight int
+
+	// Fields below are protected by Downstream.upstreamsLock.
+
+	// Amount of connections currently used for deliveries.
+	active int
+	// Amount of consecutive connection failures.
+	fails     int
+	down      bool
+	downUntil time.Time
+	// Smooth weighted round-robin state.
+	currentWeight int
+}
+
+func (u *Downstream) initUpstreams() {
+	u.upstreams = make([]*upstream, 0, len(u.endpoints))
+	for _, endp := range u.endpoints {
+		weight := u.weights[endp.String()]
+		if weight == 0 {
+			weight = 1
+		}
+		u.upstreams = append(u.upstreams, &upstream{
+			endp:   endp,
+			weight: weight,
+		})
+		upstreamUp.WithLabelValues(u.instName, endp.String()).Set(1)
+	}
+}
+
+// upstreamOrder returns the upstreams in the order they should be tried for
+// the next delivery. Upstreams that are out of rotation are returned only if
+// there are no other upstreams available.
+func (u *Downstream) upstreamOrder() []*upstream {
+	u.upstreamsOnce.Do(u.initUpstreams)
+
+	u.upstreamsLock.Lock()
+	defer u.upstreamsLock.Unlock()
+
+	now := time.Now()
+	healthy := make([]*upstream, 0, len(u.upstreams))
+	for _, up := range u.upstreams {
+		if up.down && now.After(up.downUntil) {
+			u.log.Msg("upstream is back in rotation", "downstream_server", up.endp.String())
+			up.down = false
+			upstreamUp.WithLabelValues(u.instName, up.endp.String()).Set(1)
+		}
+		if !up.down {
+			healthy = append(healthy, up)
+		}
+	}
+	if len(healthy) == 0 {
+		return append(healthy, u.upstreams...)
+	}
+
+	switch u.balance {
+	case balanceRoundRobin:
+		// Smooth weighted round-robin as implemented by nginx. Remaining
+		// upstreams are tried in the configured order after the selected one.
+		var (
+			total int
+			best  int
+		)
+		for i, up := range healthy {
+			up.currentWeight += up.weight
+			total += up.weight
+			if up.currentWeight > healthy[best].currentWeight {
+				best = i
+			}
+		}
+		healthy[best].currentWeight -= total
+		order := make([]*upstream, 0, len(healthy))
+		order = append(order, healthy[best:]...)
+		healthy = append(order, healthy[:best]...)
+	case balanceLeastConn:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].active*healthy[j].weight < healthy[j].active*healthy[i].weight
+		})
+	}
+
+	return healthy
+}
+
+// upstreamFailed records the connection failure for the upstream.
+func (u *Downstream) upstreamFailed(up *upstream, err error) {
+	upstreamFailures.WithLabelValues(u.instName, up.endp.String()).Inc()
+
+	u.upstreamsLock.Lock()
+	defer u.upstreamsLock.Unlock()
+
+	up.fails++
+	if u.maxFails == 0 || up.fails < u.maxFails {
+		return
+	}
+
+	up.down = true
+	up.downUntil = time.Now().Add(u.failCooldown)
+	upstreamUp.WithLabelValues(u.instName, up.endp.String()).Set(0)
+	u.log.Error("upstream is taken out of rotation", err,
+		"downstream_server", up.endp.String(), "fails", up.fails, "cooldown", u.failCooldown)
+}
+
+// upstreamAcquired records the successful connection to the upstream that
+// is going to be used for the delivery.
+func (u *Downstream) upstreamAcquired(up *upstream, fresh bool) {
+	u.upstreamsLock.Lock()
+	defer u.upstreamsLock.Unlock()
+
+	if fresh {
+		up.fails = 0
+	}
+	up.active++
+	upstreamDeliveries.WithLabelValues(u.instName, up.endp.String()).Inc()
+	upstreamConns.WithLabelValues(u.instName, up.endp.String()).Set(float64(up.active))
+}
+
+func (u *Downstream) upstreamReleased(up *upstream) {
+	u.upstreamsLock.Lock()
+	defer u.upstreamsLock.Unlock()
+
+	up.active--
+	upstreamConns.WithLabelValues(u.instName, up.endp.String()).Set(float64(up.active))
+}
+
+// upstreamConn is the connection to the upstream that can be stored in the
+// connection pool.
+type upstreamConn struct {
+	*smtpconn.C
+
+	up *upstream
+
+	reuseLimit int
+	// Amount of times connection was used for an SMTP transaction.
+	transactions int
+	// Errors occurred previously on this connection.
+	errored bool
+}
+
+func (c *upstreamConn) Usable() bool {
+	if c.C == nil || c.transactions > c.reuseLimit || c.C.Client() == nil {
+		return false
+	}
+	return c.C.Client().Reset() == nil
+}
+
+func (c *upstreamConn) Close() error {
+	return c.C.Close()
+}
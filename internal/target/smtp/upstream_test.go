@@ -0,0 +1,192 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/smtpconn/pool"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testEndpoints(hosts ...string) []config.Endpoint {
+	endps := make([]config.Endpoint, 0, len(hosts))
+	for _, host := range hosts {
+		endps = append(endps, config.Endpoint{
+			Scheme: "tcp",
+			Host:   host,
+			Port:   testPort,
+		})
+	}
+	return endps
+}
+
+func TestDownstreamDelivery_RoundRobin(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+	be2, srv2 := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv2.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv2)
+
+	mod := &Downstream{
+		hostname:  "mx.example.invalid",
+		endpoints: testEndpoints("127.0.0.1", "127.0.0.2"),
+		balance:   balanceRoundRobin,
+		weights: map[string]int{
+			"tcp://127.0.0.1:" + testPort: 2,
+		},
+		log: testutils.Logger(t, "target.smtp"),
+	}
+
+	for i := 0; i < 6; i++ {
+		testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	}
+	if len(be1.Messages) != 4 || len(be2.Messages) != 2 {
+		t.Fatalf("Wrong distribution: %d, %d", len(be1.Messages), len(be2.Messages))
+	}
+}
+
+func TestDownstreamDelivery_LeastConn(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+	be2, srv2 := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv2.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv2)
+
+	mod := &Downstream{
+		hostname:  "mx.example.invalid",
+		endpoints: testEndpoints("127.0.0.1", "127.0.0.2"),
+		balance:   balanceLeastConn,
+		log:       testutils.Logger(t, "target.smtp"),
+	}
+
+	// Keep the connection to the first upstream busy.
+	delivery, err := mod.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "test@example.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if len(be1.Messages) != 0 || len(be2.Messages) != 1 {
+		t.Fatalf("Wrong distribution: %d, %d", len(be1.Messages), len(be2.Messages))
+	}
+
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if len(be1.Messages) != 1 || len(be2.Messages) != 1 {
+		t.Fatalf("Wrong distribution: %d, %d", len(be1.Messages), len(be2.Messages))
+	}
+}
+
+func TestDownstreamDelivery_HealthCheck(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	// Nothing is listening on 127.0.0.2.
+	mod := &Downstream{
+		hostname:     "mx.example.invalid",
+		endpoints:    testEndpoints("127.0.0.2", "127.0.0.1"),
+		maxFails:     2,
+		failCooldown: time.Hour,
+		log:          testutils.Logger(t, "target.smtp"),
+	}
+
+	isDown := func() bool {
+		mod.upstreamsLock.Lock()
+		defer mod.upstreamsLock.Unlock()
+		return mod.upstreams[0].down
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if isDown() {
+		t.Fatal("Upstream is taken out of rotation after the first failure")
+	}
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if !isDown() {
+		t.Fatal("Upstream is not taken out of rotation")
+	}
+	if order := mod.upstreamOrder(); len(order) != 1 || order[0].endp.Host != "127.0.0.1" {
+		t.Fatal("Wrong upstreams order:", order)
+	}
+
+	// Cooldown expired, the upstream is used again.
+	mod.upstreamsLock.Lock()
+	mod.upstreams[0].downUntil = time.Now().Add(-time.Second)
+	mod.upstreamsLock.Unlock()
+	if order := mod.upstreamOrder(); len(order) != 2 || order[0].endp.Host != "127.0.0.2" {
+		t.Fatal("Wrong upstreams order:", order)
+	}
+
+	// ... but a single failure is enough to take it out of rotation again.
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if !isDown() {
+		t.Fatal("Upstream is not taken out of rotation")
+	}
+
+	// If all upstreams are out of rotation, all of them are tried.
+	mod.upstreamsLock.Lock()
+	mod.upstreams[1].down = true
+	mod.upstreams[1].downUntil = time.Now().Add(time.Hour)
+	mod.upstreamsLock.Unlock()
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	if len(be.Messages) != 4 {
+		t.Fatal("Wrong amount of messages:", len(be.Messages))
+	}
+}
+
+func TestDownstreamDelivery_Pool(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname:       "mx.example.invalid",
+		endpoints:      testEndpoints("127.0.0.1"),
+		connReuseLimit: 2,
+		pool: pool.New(pool.Config{
+			MaxKeys:             5000,
+			MaxConnsPerKey:      5,
+			MaxConnLifetimeSec:  150,
+			StaleKeyLifetimeSec: 60 * 5,
+		}),
+		log: testutils.Logger(t, "target.smtp"),
+	}
+	defer mod.Close()
+
+	for i := 0; i < 4; i++ {
+		testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+		be.CheckMsg(t, i, "test@example.invalid", []string{"rcpt@example.invalid"})
+	}
+
+	// The connection is used for 3 transactions (initial one + 2 reuses).
+	if len(be.SourceEndpoints) != 2 {
+		t.Fatal("Wrong amount of connections:", len(be.SourceEndpoints))
+	}
+}
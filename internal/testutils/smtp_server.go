@@ -26,19 +26,22 @@ import (
 	"net"
 	"reflect"
 	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
 )
 
 type SMTPMessage struct {
 	From     string
 	Opts     smtp.MailOptions
 	To       []string
+	RcptOpts []smtp.RcptOptions
 	Data     []byte
-	State    *smtp.ConnectionState
+	State    *module.ConnectionState
 	AuthUser string
 	AuthPass string
 }
@@ -54,32 +57,14 @@ type SMTPBackend struct {
 	RcptErr     map[string]error
 	DataErr     error
 	LMTPDataErr []error
-}
 
-func (be *SMTPBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	if be.AuthErr != nil {
-		return nil, be.AuthErr
-	}
-	be.SessionCounter++
-	if be.SourceEndpoints == nil {
-		be.SourceEndpoints = make(map[string]struct{})
-	}
-	be.SourceEndpoints[state.RemoteAddr.String()] = struct{}{}
-	return &session{
-		backend:  be,
-		user:     username,
-		password: password,
-		state:    state,
-	}, nil
+	// Amount of sessions that are not closed yet. Accessed atomically.
+	activeSessions int32
 }
 
-func (be *SMTPBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	be.SessionCounter++
-	if be.SourceEndpoints == nil {
-		be.SourceEndpoints = make(map[string]struct{})
-	}
-	be.SourceEndpoints[state.RemoteAddr.String()] = struct{}{}
-	return &session{backend: be, state: state}, nil
+func (be *SMTPBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	atomic.AddInt32(&be.activeSessions, 1)
+	return &session{backend: be, conn: c}, nil
 }
 
 func (be *SMTPBackend) CheckMsg(t *testing.T, indx int, from string, rcptTo []string) {
@@ -108,21 +93,57 @@ func (be *SMTPBackend) CheckMsg(t *testing.T, indx int, from string, rcptTo []st
 
 type session struct {
 	backend  *SMTPBackend
+	conn     *smtp.Conn
+	loggedIn bool
 	user     string
 	password string
-	state    *smtp.ConnectionState
+	state    *module.ConnectionState
 	msg      *SMTPMessage
 }
 
+// login records the connection information once the client authenticates or
+// starts the first transaction.
+func (s *session) login() {
+	if s.loggedIn {
+		return
+	}
+	s.loggedIn = true
+
+	s.state = &module.ConnectionState{
+		Hostname:   s.conn.Hostname(),
+		LocalAddr:  s.conn.Conn().LocalAddr(),
+		RemoteAddr: s.conn.Conn().RemoteAddr(),
+	}
+	s.state.TLS, _ = s.conn.TLSConnectionState()
+
+	s.backend.SessionCounter++
+	if s.backend.SourceEndpoints == nil {
+		s.backend.SourceEndpoints = make(map[string]struct{})
+	}
+	s.backend.SourceEndpoints[s.state.RemoteAddr.String()] = struct{}{}
+}
+
 func (s *session) Reset() {
 	s.msg = &SMTPMessage{}
 }
 
 func (s *session) Logout() error {
+	atomic.AddInt32(&s.backend.activeSessions, -1)
+	return nil
+}
+
+func (s *session) AuthPlain(username, password string) error {
+	if s.backend.AuthErr != nil {
+		return s.backend.AuthErr
+	}
+	s.login()
+	s.user = username
+	s.password = password
 	return nil
 }
 
-func (s *session) Mail(from string, opts smtp.MailOptions) error {
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.login()
 	s.backend.MailFromCounter++
 
 	if s.backend.MailErr != nil {
@@ -131,16 +152,23 @@ func (s *session) Mail(from string, opts smtp.MailOptions) error {
 
 	s.Reset()
 	s.msg.From = from
-	s.msg.Opts = opts
+	if opts != nil {
+		s.msg.Opts = *opts
+	}
 	return nil
 }
 
-func (s *session) Rcpt(to string) error {
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	if err := s.backend.RcptErr[to]; err != nil {
 		return err
 	}
 
 	s.msg.To = append(s.msg.To, to)
+	rcptOpts := smtp.RcptOptions{}
+	if opts != nil {
+		rcptOpts = *opts
+	}
+	s.msg.RcptOpts = append(s.msg.RcptOpts, rcptOpts)
 	return nil
 }
 
@@ -191,7 +219,7 @@ var (
 	}
 )
 
-func SMTPServer(t *testing.T, addr string, fn ...SMTPServerConfigureFunc) (*SMTPBackend, *smtp.Server) {
+func SMTPServer(t testing.TB, addr string, fn ...SMTPServerConfigureFunc) (*SMTPBackend, *smtp.Server) {
 	t.Helper()
 
 	l, err := net.Listen("tcp", addr)
@@ -382,11 +410,8 @@ func CheckSMTPConnLeak(t *testing.T, srv *smtp.Server) {
 	// Connection closure is handled asynchronously, so before failing
 	// wait a bit for handleQuit in go-smtp to do its work.
 	for i := 0; i < 10; i++ {
-		found := false
-		srv.ForEachConn(func(c *smtp.Conn) {
-			found = true
-		})
-		if !found {
+		be, ok := srv.Backend.(*SMTPBackend)
+		if !ok || atomic.LoadInt32(&be.activeSessions) == 0 {
 			return
 		}
 		time.Sleep(100 * time.Millisecond)
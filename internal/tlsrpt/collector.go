@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/internal/aggreport"
+)
+
+// Results contains TLS session results collected by aggreport.Collector.
+type Results struct {
+	Results map[string]*PolicyResult
+}
+
+// NewResults creates the empty result set, it is passed to
+// aggreport.NewCollector.
+func NewResults() aggreport.Results {
+	return &Results{Results: make(map[string]*PolicyResult)}
+}
+
+func policyKey(p Policy) string {
+	return strings.Join([]string{
+		string(p.Type),
+		strings.ToLower(p.Domain),
+		strings.Join(p.String, "\n"),
+		strings.Join(p.MXHost, " "),
+	}, "\x00")
+}
+
+func (r *Results) result(p Policy) *PolicyResult {
+	key := policyKey(p)
+	res, ok := r.Results[key]
+	if !ok {
+		res = &PolicyResult{Policy: p}
+		r.Results[key] = res
+	}
+	return res
+}
+
+func (r *Results) Merge(saved aggreport.Results) {
+	for _, saved := range saved.(*Results).Results {
+		res := r.result(saved.Policy)
+		res.Summary.TotalSuccessful += saved.Summary.TotalSuccessful
+		res.Summary.TotalFailure += saved.Summary.TotalFailure
+		for _, details := range saved.FailureDetails {
+			addFailure(res, details, details.FailedSessionCount)
+		}
+	}
+}
+
+// Success records the successful session for the policy.
+func (r *Results) Success(p Policy) {
+	r.result(p).Summary.TotalSuccessful++
+}
+
+// Failure records the failed session for the policy. details.FailedSessionCount
+// is ignored, failures with the same details are counted together.
+func (r *Results) Failure(p Policy, details FailureDetails) {
+	res := r.result(p)
+	res.Summary.TotalFailure++
+	addFailure(res, details, 1)
+}
+
+func addFailure(res *PolicyResult, details FailureDetails, count int) {
+	details.FailedSessionCount = 0
+	for i, existing := range res.FailureDetails {
+		existing.FailedSessionCount = 0
+		if existing == details {
+			res.FailureDetails[i].FailedSessionCount += count
+			return
+		}
+	}
+	details.FailedSessionCount = count
+	res.FailureDetails = append(res.FailureDetails, details)
+}
+
+// ByDomain returns the collected results grouped by the policy domain.
+func (r *Results) ByDomain() map[string][]PolicyResult {
+	byDomain := make(map[string][]PolicyResult)
+	for _, res := range r.Results {
+		domain := strings.ToLower(res.Policy.Domain)
+		byDomain[domain] = append(byDomain[domain], *res)
+	}
+	for _, results := range byDomain {
+		sort.Slice(results, func(i, j int) bool {
+			return policyKey(results[i].Policy) < policyKey(results[j].Policy)
+		})
+	}
+	return byDomain
+}
@@ -0,0 +1,58 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/aggreport"
+)
+
+// Envelope contains the addressing information of the report message.
+// Submitter and PolicyDomain are also included in the TLS-Report-Submitter
+// and TLS-Report-Domain fields.
+type Envelope = aggreport.Envelope
+
+// GenerateMessage is aggreport.GenerateMessage for the report (RFC 8460
+// Section 5.3) with the TLS-Report-Domain and TLS-Report-Submitter fields added.
+func GenerateMessage(envelope Envelope, report Report, outWriter io.Writer) (textproto.Header, error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+
+	header, err := aggreport.GenerateMessage(envelope, aggreport.Report{
+		Kind:           "TLS",
+		ID:             report.ReportID,
+		Begin:          report.DateRange.Start,
+		End:            report.DateRange.End,
+		ContentType:    `multipart/report; report-type="tlsrpt"`,
+		AttachmentType: "application/tlsrpt+gzip",
+		Extension:      "json",
+		Data:           data,
+	}, outWriter)
+	if err != nil {
+		return textproto.Header{}, err
+	}
+	header.Add("TLS-Report-Domain", envelope.PolicyDomain)
+	header.Add("TLS-Report-Submitter", envelope.Submitter)
+	return header, nil
+}
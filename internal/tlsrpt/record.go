@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tlsrpt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+type Resolver interface {
+	LookupTXT(context.Context, string) ([]string, error)
+}
+
+// Record is the TLS reporting policy published by the domain, see RFC 8460
+// Section 3.
+type Record struct {
+	// Addresses to send reports to, either mailto: or https: URIs.
+	RUA []string
+}
+
+var ErrNoRecord = errors.New("tlsrpt: no policy record")
+
+// ParseRecord parses the TXT record value.
+func ParseRecord(txt string) (*Record, error) {
+	fields := strings.Split(txt, ";")
+	if strings.TrimSpace(fields[0]) != "v=TLSRPTv1" {
+		return nil, errors.New("tlsrpt: unknown record version")
+	}
+
+	rec := &Record{}
+	for _, field := range fields[1:] {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("tlsrpt: malformed field: %s", field)
+		}
+		if strings.TrimSpace(parts[0]) != "rua" {
+			// Extensions are ignored.
+			continue
+		}
+		for _, uri := range strings.Split(parts[1], ",") {
+			uri = strings.TrimSpace(uri)
+			if uri == "" {
+				continue
+			}
+			rec.RUA = append(rec.RUA, uri)
+		}
+	}
+	if len(rec.RUA) == 0 {
+		return nil, errors.New("tlsrpt: missing rua field")
+	}
+	return rec, nil
+}
+
+// LookupRecord finds the policy record for the domain. ErrNoRecord is
+// returned if the domain does not publish it.
+func LookupRecord(ctx context.Context, r Resolver, domain string) (*Record, error) {
+	txts, err := r.LookupTXT(ctx, "_smtp._tls."+dns.FQDN(domain))
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	// Records with unknown version are ignored, exactly one matching record
+	// is required, see RFC 8460 Section 3.
+	var matching []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=TLSRPTv1") {
+			matching = append(matching, txt)
+		}
+	}
+	switch len(matching) {
+	case 0:
+		return nil, ErrNoRecord
+	case 1:
+		return ParseRecord(matching[0])
+	default:
+		return nil, errors.New("tlsrpt: multiple policy records")
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package tlsrpt implements SMTP TLS Reporting (RFC 8460) data structures,
+// policy record discovery and report message generation.
+package tlsrpt
+
+import (
+	"time"
+)
+
+type PolicyType string
+
+const (
+	PolicyTLSA          PolicyType = "tlsa"
+	PolicySTS           PolicyType = "sts"
+	PolicyNoPolicyFound PolicyType = "no-policy-found"
+)
+
+// ResultType is the reason of the session failure, see RFC 8460 Section 4.3.
+type ResultType string
+
+const (
+	// Negotiation failures.
+	ResultSTARTTLSNotSupported    ResultType = "starttls-not-supported"
+	ResultCertificateHostMismatch ResultType = "certificate-host-mismatch"
+	ResultCertificateExpired      ResultType = "certificate-expired"
+	ResultCertificateNotTrusted   ResultType = "certificate-not-trusted"
+	ResultValidationFailure       ResultType = "validation-failure"
+
+	// Policy failures - DANE.
+	ResultTLSAInvalid   ResultType = "tlsa-invalid"
+	ResultDNSSECInvalid ResultType = "dnssec-invalid"
+	ResultDANERequired  ResultType = "dane-required"
+
+	// Policy failures - MTA-STS.
+	ResultSTSPolicyFetchError ResultType = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid    ResultType = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid    ResultType = "sts-webpki-invalid"
+)
+
+// Report is the aggregate report, serialized as JSON as described in
+// RFC 8460 Section 4.
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+type PolicyResult struct {
+	Policy         Policy           `json:"policy"`
+	Summary        Summary          `json:"summary"`
+	FailureDetails []FailureDetails `json:"failure-details,omitempty"`
+}
+
+type Policy struct {
+	Type   PolicyType `json:"policy-type"`
+	String []string   `json:"policy-string,omitempty"`
+	Domain string     `json:"policy-domain"`
+	MXHost []string   `json:"mx-host,omitempty"`
+}
+
+type Summary struct {
+	TotalSuccessful int `json:"total-successful-session-count"`
+	TotalFailure    int `json:"total-failure-session-count"`
+}
+
+type FailureDetails struct {
+	ResultType            ResultType `json:"result-type"`
+	SendingMTAIP          string     `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname   string     `json:"receiving-mx-hostname,omitempty"`
+	ReceivingMXHelo       string     `json:"receiving-mx-helo,omitempty"`
+	ReceivingIP           string     `json:"receiving-ip,omitempty"`
+	FailedSessionCount    int        `json:"failed-session-count"`
+	AdditionalInformation string     `json:"additional-information,omitempty"`
+	FailureReasonCode     string     `json:"failure-reason-code,omitempty"`
+}
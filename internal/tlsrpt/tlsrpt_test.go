@@ -0,0 +1,200 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/aggreport"
+)
+
+func TestParseRecord(t *testing.T) {
+	for _, c := range []struct {
+		txt  string
+		rua  []string
+		fail bool
+	}{
+		{txt: "v=TLSRPTv1; rua=mailto:tlsrpt@example.org", rua: []string{"mailto:tlsrpt@example.org"}},
+		{txt: "v=TLSRPTv1;rua=mailto:a@example.org,https://example.org/tlsrpt", rua: []string{"mailto:a@example.org", "https://example.org/tlsrpt"}},
+		{txt: "v=TLSRPTv1; rua=mailto:a@example.org; ext=1;", rua: []string{"mailto:a@example.org"}},
+		{txt: "v=TLSRPTv2; rua=mailto:a@example.org", fail: true},
+		{txt: "v=TLSRPTv1;", fail: true},
+		{txt: "v=TLSRPTv1; rua", fail: true},
+	} {
+		rec, err := ParseRecord(c.txt)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%s: expected failure, got %v", c.txt, rec.RUA)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.txt, err)
+			continue
+		}
+		if !reflect.DeepEqual(rec.RUA, c.rua) {
+			t.Errorf("%s: wrong rua: %v", c.txt, rec.RUA)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := aggreport.NewCollector(start, NewResults)
+	update := func(f func(r *Results)) {
+		c.Update(func(r aggreport.Results) {
+			f(r.(*Results))
+		})
+	}
+
+	sts := Policy{Type: PolicySTS, Domain: "example.org", String: []string{"version: STSv1", "mode: enforce"}, MXHost: []string{"mx.example.org"}}
+	tlsa := Policy{Type: PolicyTLSA, Domain: "example.org", String: []string{"3 1 1 AAAA"}}
+	mismatch := FailureDetails{ResultType: ResultCertificateHostMismatch, ReceivingMXHostname: "mx.example.org"}
+
+	update(func(r *Results) {
+		r.Success(sts)
+		r.Success(sts)
+		r.Failure(sts, mismatch)
+		r.Failure(sts, mismatch)
+		r.Failure(sts, FailureDetails{ResultType: ResultSTARTTLSNotSupported, ReceivingMXHostname: "mx.example.org"})
+		r.Success(tlsa)
+		r.Success(Policy{Type: PolicyNoPolicyFound, Domain: "example.com"})
+	})
+
+	// Save and restore the state to make sure nothing is lost.
+	var state bytes.Buffer
+	if err := c.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+	c = aggreport.NewCollector(start.Add(time.Hour), NewResults)
+	if err := c.Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	update(func(r *Results) {
+		r.Failure(sts, mismatch)
+	})
+
+	end := start.Add(24 * time.Hour)
+	begin, collected := c.Flush(end)
+	if !begin.Equal(start) {
+		t.Errorf("wrong period start: %v", begin)
+	}
+	results := collected.(*Results).ByDomain()
+	if len(results) != 2 {
+		t.Fatalf("wrong amount of domains: %v", results)
+	}
+	if len(results["example.com"]) != 1 || results["example.com"][0].Summary.TotalSuccessful != 1 {
+		t.Errorf("wrong results for example.com: %+v", results["example.com"])
+	}
+
+	org := results["example.org"]
+	if len(org) != 2 {
+		t.Fatalf("wrong amount of policies for example.org: %+v", org)
+	}
+	var stsRes PolicyResult
+	for _, res := range org {
+		if res.Policy.Type == PolicySTS {
+			stsRes = res
+		}
+	}
+	if stsRes.Summary != (Summary{TotalSuccessful: 2, TotalFailure: 4}) {
+		t.Errorf("wrong summary: %+v", stsRes.Summary)
+	}
+	mismatch.FailedSessionCount = 3
+	if len(stsRes.FailureDetails) != 2 || stsRes.FailureDetails[0] != mismatch {
+		t.Errorf("wrong failure details: %+v", stsRes.FailureDetails)
+	}
+
+	_, collected = c.Flush(end.Add(time.Hour))
+	results = collected.(*Results).ByDomain()
+	if len(results) != 0 {
+		t.Errorf("results are not reset after Flush: %v", results)
+	}
+}
+
+func TestGenerateMessage(t *testing.T) {
+	report := Report{
+		OrganizationName: "Example",
+		DateRange: DateRange{
+			Start: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			End:   time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		ContactInfo: "postmaster@mx.example.com",
+		ReportID:    "report1@mx.example.com",
+		Policies: []PolicyResult{
+			{
+				Policy:  Policy{Type: PolicyNoPolicyFound, Domain: "example.org"},
+				Summary: Summary{TotalSuccessful: 10},
+			},
+		},
+	}
+	envelope := Envelope{
+		MsgID:        "<report1@mx.example.com>",
+		From:         "tlsrpt@example.com",
+		To:           "tlsrpt@example.org",
+		Submitter:    "mx.example.com",
+		PolicyDomain: "example.org",
+	}
+
+	var body bytes.Buffer
+	hdr, err := GenerateMessage(envelope, report, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Get("TLS-Report-Domain") != "example.org" || hdr.Get("TLS-Report-Submitter") != "mx.example.com" {
+		t.Errorf("wrong report fields: %v, %v", hdr.Get("TLS-Report-Domain"), hdr.Get("TLS-Report-Submitter"))
+	}
+	if want := "Report Domain: example.org Submitter: mx.example.com Report-ID: <report1@mx.example.com>"; hdr.Get("Subject") != want {
+		t.Errorf("wrong subject: %v", hdr.Get("Subject"))
+	}
+
+	ct := hdr.Get("Content-Type")
+	boundary := ct[strings.Index(ct, "boundary=")+len("boundary="):]
+	mr := textproto.NewMultipartReader(&body, boundary)
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "attachment; filename=\"mx.example.com!example.org!1577836800!1577923200.json.gz\""; part.Header.Get("Content-Disposition") != want {
+		t.Errorf("wrong attachment disposition: %v", part.Header.Get("Content-Disposition"))
+	}
+
+	gzr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, part))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.NewDecoder(gzr).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, report) {
+		t.Errorf("report mismatch:\n%+v\n%+v", decoded, report)
+	}
+}
@@ -44,21 +44,28 @@ import (
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
 	_ "github.com/foxcpp/maddy/internal/auth/shadow"
+	_ "github.com/foxcpp/maddy/internal/check/arc"
+	_ "github.com/foxcpp/maddy/internal/check/clamav"
 	_ "github.com/foxcpp/maddy/internal/check/command"
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
+	_ "github.com/foxcpp/maddy/internal/check/greylist"
 	_ "github.com/foxcpp/maddy/internal/check/milter"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
+	_ "github.com/foxcpp/maddy/internal/check/spamassassin"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/dmarc/reporter"
 	_ "github.com/foxcpp/maddy/internal/endpoint/dovecot_sasld"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
+	_ "github.com/foxcpp/maddy/internal/endpoint/mtasts"
 	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
 	_ "github.com/foxcpp/maddy/internal/endpoint/smtp"
 	_ "github.com/foxcpp/maddy/internal/imap_filter"
 	_ "github.com/foxcpp/maddy/internal/imap_filter/command"
 	_ "github.com/foxcpp/maddy/internal/modify"
+	_ "github.com/foxcpp/maddy/internal/modify/arc"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
 	_ "github.com/foxcpp/maddy/internal/table"